@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -71,7 +72,7 @@ func startAgentStudio(initialSpec string) {
 
 // runAgentStudioTurn sends the current studio conversation to the LLM and processes tool calls.
 // It is safe by design: it only executes create_agent_definition; all other tools are rejected.
-func runAgentStudioTurn(cfg *Config) error {
+func runAgentStudioTurn(ctx context.Context, cfg *Config) error {
 	if studioAgent == nil {
 		return fmt.Errorf("studio is not initialized")
 	}
@@ -83,7 +84,7 @@ func runAgentStudioTurn(cfg *Config) error {
 
 	for {
 		// No agent definition for studio mode
-		resp, err := sendAPIRequest(studioAgent, &cfgCopy, false, nil)
+		resp, err := sendAPIRequest(ctx, studioAgent, &cfgCopy, false, nil)
 		if err != nil {
 			return err
 		}
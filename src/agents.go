@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"time"
@@ -26,6 +27,41 @@ type AgentDefinition struct {
 	// DeniedTools is an optional blacklist of tool function names this agent may NOT use.
 	// Only used when AllowedTools is empty.
 	DeniedTools []string `json:"denied_tools,omitempty"`
+	// Sandbox optionally overrides the global sandbox settings for commands run by this agent.
+	Sandbox *SandboxConfig `json:"sandbox,omitempty"`
+	// ToolsVersion records which builtInToolsAdded a saved built-in agent already got.
+	ToolsVersion int `json:"tools_version,omitempty"`
+}
+
+// builtInToolsVersion is the version of the built-in agents' tool lists. Saved built-in agents
+// with an older version get the tools added since, once; tools the user removes afterwards stay
+// removed. Bump it when adding tools to a built-in agent and list them in builtInToolsAdded.
+const builtInToolsVersion = 1
+
+// builtInToolsAdded lists by version the tools that were added to the built-in agents.
+var builtInToolsAdded = map[int][]string{
+	1: {"read_file", "write_file", "edit_file", "apply_patch", "search_files", "list_files"},
+}
+
+// migrateBuiltInTools adds the tools added to the built-in agent since def was saved, if the
+// built-in agent has them, to def's whitelist. It reports whether def changed.
+func migrateBuiltInTools(def *AgentDefinition) bool {
+	builtin, ok := getBuiltInAgentDefinition(def.Name)
+	if !ok || def.ToolsVersion >= builtInToolsVersion {
+		return false
+	}
+	// Without a whitelist, new tools are available anyway
+	if len(def.AllowedTools) > 0 {
+		for version := def.ToolsVersion + 1; version <= builtInToolsVersion; version++ {
+			for _, tool := range builtInToolsAdded[version] {
+				if slices.Contains(builtin.AllowedTools, tool) && !slices.Contains(def.AllowedTools, tool) {
+					def.AllowedTools = append(def.AllowedTools, tool)
+				}
+			}
+		}
+	}
+	def.ToolsVersion = builtInToolsVersion
+	return true
 }
 
 func isBuiltInAgentName(name string) bool {
@@ -50,8 +86,11 @@ func getBuiltInPlanAgent() *AgentDefinition {
 4. Generate a comprehensive TODO list using the create_todo tool
 5. Present the plan using the suggest_plan tool for approval
 
-IMPORTANT: You CANNOT execute shell commands in this mode. Focus purely on planning and strategy. When the user approves your plan, they will switch to Build mode for implementation.`,
+IMPORTANT: You CANNOT execute shell commands in this mode. Use read_file, search_files and list_files to inspect the codebase. Focus purely on planning and strategy. When the user approves your plan, they will switch to Build mode for implementation.`,
 		AllowedTools: []string{
+			"read_file",
+			"search_files",
+			"list_files",
 			"create_todo",
 			"update_todo",
 			"get_todo_list",
@@ -77,19 +116,29 @@ func getBuiltInBuildAgent() *AgentDefinition {
 
 Capabilities:
 - Execute shell commands via execute_command
+- Find code and files via search_files and list_files
+- Read, create and edit files via read_file, write_file and edit_file
+- Apply multi-file changes as a unified diff via apply_patch
 - Manage background processes
 - Create and restore checkpoints
 - Manage todo lists and notes
 - Use MCP tools for extended functionality
 
 Best Practices:
-- For multi-step tasks, chain commands with && (e.g., 'echo content > file.py && python3 file.py')
+- Use read_file before edit_file, and edit_file for changes to existing files
+- For multi-step tasks, chain commands with && (e.g., 'make build && ./run-tests.sh')
 - Use background execution for long-running processes
 - Create checkpoints before risky operations
 - Update todo lists to track progress
 - Be direct and technical in communication`,
 		AllowedTools: []string{
 			"execute_command",
+			"read_file",
+			"search_files",
+			"list_files",
+			"write_file",
+			"edit_file",
+			"apply_patch",
 			"kill_background_command",
 			"get_background_logs",
 			"list_background_commands",
@@ -135,6 +184,11 @@ Do NOT include:
 Be concise. The AGENTS.md should get SHORTER, not longer.`,
 		AllowedTools: []string{
 			"execute_command",
+			"read_file",
+			"search_files",
+			"list_files",
+			"write_file",
+			"edit_file",
 			"create_todo",
 			"update_todo",
 			"get_todo_list",
@@ -163,6 +217,11 @@ For 'deploy' (execution):
 Be direct and technical. Focus on actual deployment, not documentation.`,
 		AllowedTools: []string{
 			"execute_command",
+			"read_file",
+			"search_files",
+			"list_files",
+			"write_file",
+			"edit_file",
 			"create_todo",
 			"update_todo",
 			"get_todo_list",
@@ -193,6 +252,9 @@ Provide a clear, actionable summary of findings with severity levels:
 Be concise and focus on actual issues found, not theoretical possibilities.`,
 		AllowedTools: []string{
 			"execute_command",
+			"read_file",
+			"search_files",
+			"list_files",
 			"create_todo",
 			"update_todo",
 			"get_todo_list",
@@ -207,20 +269,23 @@ func getBuiltInAgentDefinition(name string) (*AgentDefinition, bool) {
 		return nil, false
 	}
 
+	var def *AgentDefinition
 	switch safe {
 	case "plan":
-		return getBuiltInPlanAgent(), true
+		def = getBuiltInPlanAgent()
 	case "build":
-		return getBuiltInBuildAgent(), true
+		def = getBuiltInBuildAgent()
 	case "init":
-		return getBuiltInInitAgent(), true
+		def = getBuiltInInitAgent()
 	case "deploy":
-		return getBuiltInDeployAgent(), true
+		def = getBuiltInDeployAgent()
 	case "security":
-		return getBuiltInSecurityAgent(), true
+		def = getBuiltInSecurityAgent()
 	default:
 		return nil, false
 	}
+	def.ToolsVersion = builtInToolsVersion
+	return def, true
 }
 
 // getAgentsDir returns the path to the agents directory.
@@ -324,17 +389,46 @@ func ensureDefaultAgentFiles() error {
 			agent := builtin.getFn()
 			agent.CreatedAt = time.Now()
 			agent.UpdatedAt = time.Now()
+			agent.ToolsVersion = builtInToolsVersion
 			data, _ := json.MarshalIndent(agent, "", "  ")
 			if err := os.WriteFile(path, data, 0644); err != nil {
 				return fmt.Errorf("failed to create %s.json in agents dir: %w", builtin.name, err)
 			}
 			fmt.Printf("Created %s.json in %s\n", builtin.name, agentsDir)
+			continue
+		}
+
+		// Give saved built-in agents the tools added since they were saved
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var agent AgentDefinition
+		if err := json.Unmarshal(data, &agent); err != nil || !migrateBuiltInTools(&agent) {
+			continue
+		}
+		agent.UpdatedAt = time.Now()
+		data, _ = json.MarshalIndent(&agent, "", "  ")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return fmt.Errorf("failed to update %s.json in agents dir: %w", builtin.name, err)
 		}
 	}
 
 	return nil
 }
 
+// agentDefinitionOf returns the definition an agent runs with, or nil if it has none.
+func agentDefinitionOf(a *Agent) *AgentDefinition {
+	if a == nil || a.AgentDefName == "" {
+		return nil
+	}
+	def, err := loadAgentDefinition(a.AgentDefName)
+	if err != nil {
+		return nil
+	}
+	return def
+}
+
 func loadAgentDefinition(name string) (*AgentDefinition, error) {
 	// Priority: User config → Built-in
 
@@ -359,6 +453,10 @@ func loadAgentDefinition(name string) (*AgentDefinition, error) {
 	if err := json.Unmarshal(data, &def); err != nil {
 		return nil, err
 	}
+	// A saved built-in agent that wasn't migrated yet (see ensureDefaultAgentFiles) still gets the new tools
+	if isBuiltInAgentName(name) {
+		migrateBuiltInTools(&def)
+	}
 
 	return &def, nil
 }
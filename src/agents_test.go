@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSavedBuiltInAgentGetsNewTools(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	if err := ensureAgentsDir(); err != nil {
+		t.Fatal(err)
+	}
+	// A plan.json saved before the file tools existed
+	old := `{"name": "plan", "system_prompt": "plan", "allowed_tools": ["create_todo", "suggest_plan"]}`
+	path := filepath.Join(getAgentsDir(), "plan.json")
+	if err := os.WriteFile(path, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	def, err := loadAgentDefinition("plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"create_todo", "suggest_plan", "read_file", "search_files", "list_files"}
+	if !slices.Equal(def.AllowedTools, want) {
+		t.Errorf("loaded tools = %q, want %q", def.AllowedTools, want)
+	}
+
+	if err := ensureDefaultAgentFiles(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved AgentDefinition
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(saved.AllowedTools, want) || saved.ToolsVersion != builtInToolsVersion {
+		t.Errorf("saved tools = %q (version %d), want %q", saved.AllowedTools, saved.ToolsVersion, want)
+	}
+
+	// Tools removed after the migration stay removed
+	saved.AllowedTools = []string{"create_todo"}
+	data, _ = json.Marshal(&saved)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	def, err = loadAgentDefinition("plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(def.AllowedTools, saved.AllowedTools) {
+		t.Errorf("tools after removal = %q, want %q", def.AllowedTools, saved.AllowedTools)
+	}
+}
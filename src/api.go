@@ -1,29 +1,37 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"strings"
 )
 
-func sendAPIRequest(agent *Agent, config *Config, includeSpawn bool, agentDef *AgentDefinition) (*APIResponse, error) {
-	apiURL := strings.TrimSuffix(config.APIURL, "/") + "/v1/chat/completions"
+func sendAPIRequest(ctx context.Context, agent *Agent, config *Config, includeSpawn bool, agentDef *AgentDefinition) (*APIResponse, error) {
+	return sendAPIRequestStreaming(ctx, agent, config, includeSpawn, agentDef, nil)
+}
 
+// sendAPIRequestStreaming sends a chat completion request. When onDelta is non-nil the request
+// is made with stream=true and onDelta receives content/reasoning tokens as they arrive; the
+// returned APIResponse is assembled from the stream and looks exactly like a blocking response.
+// Cancelling ctx aborts the request, including a stream that is already being read.
+func sendAPIRequestStreaming(ctx context.Context, agent *Agent, config *Config, includeSpawn bool, agentDef *AgentDefinition, onDelta StreamHandler) (*APIResponse, error) {
 	// Build base tools (now includes all tools)
 	baseTools := getAvailableTools(config, includeSpawn, config.OperationMode)
 
 	// Apply operation mode filtering and agent-specific policy
 	tools := filterToolsByPolicy(baseTools, agentDef, config.OperationMode)
 
+	// Sub-agents can always report back to their parent, whatever their agent definition allows
+	if agent.Depth > 0 {
+		tools = append(tools, getSubAgentTools()...)
+	}
+
 	// Create a copy of messages with time context injected
 	messagesWithTime := make([]Message, len(agent.Messages))
 	copy(messagesWithTime, agent.Messages)
 
-	// Inject current time as a system message at the end
-	timeContext := getCurrentTimeContext()
+	// Inject current time and directory as a system message at the end
+	timeContext := getCurrentTimeContext() + "\n" + getShellDirContext(agent.ID)
 	timeMsg := Message{
 		Role:    "system",
 		Content: &timeContext,
@@ -38,42 +46,13 @@ func sendAPIRequest(agent *Agent, config *Config, includeSpawn bool, agentDef *A
 		ToolChoice:  "auto",
 		Tools:       tools,
 	}
-
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+config.APIKey)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
-	}
-	defer func() {
-		err := resp.Body.Close()
-		if err != nil {
-			fmt.Printf("failed to close response body: %v\n", err)
-		}
-	}()
-
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
-	}
-
-	var apiResponse APIResponse
-	if err := json.NewDecoder(resp.Body).Decode(&apiResponse); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	if onDelta != nil {
+		requestBody.Stream = true
+		// Ask for usage in the final chunk so "Last Usage" token tracking keeps working
+		requestBody.StreamOptions = &StreamOptions{IncludeUsage: true}
 	}
 
-	return &apiResponse, nil
+	return postWithFallback(ctx, config, requestBody, onDelta)
 }
 
 // sendMiniLLMRequest sends a request to the configured mini model (or fallback to main model)
@@ -102,39 +81,9 @@ func sendMiniLLMRequest(config *Config, messages []Message) (string, error) {
 		MaxTokens:   CompressionMaxTokens, // Reuse default max tokens for utility tasks
 	}
 
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
-	}
-
-	apiURL := strings.TrimSuffix(config.APIURL, "/") + "/v1/chat/completions"
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonData))
+	apiResponse, err := postChatCompletion(context.Background(), config, requestBody, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+config.APIKey)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
-	}
-	defer func() {
-		err := resp.Body.Close()
-		if err != nil {
-			fmt.Printf("failed to close response body: %v\n", err)
-		}
-	}()
-
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
-	}
-
-	var apiResponse APIResponse
-	if err := json.NewDecoder(resp.Body).Decode(&apiResponse); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
+		return "", err
 	}
 
 	if len(apiResponse.Choices) == 0 {
@@ -209,39 +158,9 @@ func compressContext(agent *Agent, config *Config) (string, error) {
 		MaxTokens:   CompressionMaxTokens, // Limit the length of the compressed text
 	}
 
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal compression request: %w", err)
-	}
-
-	apiURL := strings.TrimSuffix(config.APIURL, "/") + "/v1/chat/completions"
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to create compression request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+config.APIKey)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	apiResponse, err := postChatCompletion(context.Background(), config, requestBody, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to send compression request: %w", err)
-	}
-	defer func() {
-		err := resp.Body.Close()
-		if err != nil {
-			fmt.Printf("failed to close response body: %v\n", err)
-		}
-	}()
-
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("compression API request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
-	}
-
-	var apiResponse APIResponse
-	if err := json.NewDecoder(resp.Body).Decode(&apiResponse); err != nil {
-		return "", fmt.Errorf("failed to decode compression response: %w", err)
+		return "", fmt.Errorf("compression request failed: %w", err)
 	}
 
 	if len(apiResponse.Choices) == 0 {
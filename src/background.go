@@ -0,0 +1,840 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Background process statuses
+const (
+	BackgroundRunning    = "running"
+	BackgroundRestarting = "restarting"
+	BackgroundExited     = "exited"
+	BackgroundKilled     = "killed"
+	BackgroundFailed     = "failed" // Gave up restarting, or could not be restarted
+	BackgroundLost       = "lost"   // Exited while agent-go was not running; the exit code is unknown
+)
+
+// BackgroundProcess is a command running in the background. Its output goes straight to a log
+// file under .agent-go/bg/, so it keeps running and logging when agent-go exits, and the next
+// agent-go started in the workspace reattaches to it. agent-go follows the log file into a
+// ring buffer that serves recent output and readiness checks.
+type BackgroundProcess struct {
+	ID        int               `json:"id"`                 // Shown to the model and the user as "PID"
+	OSPID     int               `json:"os_pid"`             // Process (group) ID of the current run
+	OSStart   string            `json:"os_start,omitempty"` // processStartID of OSPID, to tell it from a later process with the same PID
+	Command   string            `json:"command"`
+	Dir       string            `json:"dir"`
+	AgentID   string            `json:"agent_id"`
+	AgentName string            `json:"agent_name,omitempty"` // Agent definition whose sandbox restarts use
+	Options   BackgroundOptions `json:"options"`
+	StartTime time.Time         `json:"start_time"`
+	EndTime   time.Time         `json:"end_time"`
+	Status    string            `json:"status"`
+	ExitCode  *int              `json:"exit_code,omitempty"` // Unknown for processes that exited while reattached
+	Restarts  int               `json:"restarts,omitempty"`
+	Ready     bool              `json:"ready,omitempty"`
+	Note      string            `json:"note,omitempty"`
+	LogBase   int64             `json:"log_base"` // Log stream offset at which the current log file starts
+
+	config   *Config
+	agentDef *AgentDefinition
+	env      []string
+	readyRe  *regexp.Regexp
+	log      *ringLog
+	filePos  int64    // How much of the current log file has been read into log
+	reader   *os.File // Log file opened for following
+	cmd      *exec.Cmd
+	limited  *limitedCommand
+	exited   chan error // Receives the result of cmd.Wait; nil for reattached processes
+	killed   bool
+	readyAt  int64         // Log offset from which ReadyPattern is searched
+	ready    chan struct{} // Closed when the process first becomes ready
+	done     chan struct{} // Closed when the process has finished for good
+}
+
+var (
+	backgroundProcesses   = make(map[int]*BackgroundProcess)
+	bgMutex               sync.Mutex
+	processIDCounter      = 1
+	backgroundSaveMutex   sync.Mutex
+	backgroundRestoreOnce sync.Once
+)
+
+// backgroundDir is where background process logs and state are kept.
+func backgroundDir() string {
+	return filepath.Join(workspaceRoot(), ".agent-go", "bg")
+}
+
+func (p *BackgroundProcess) logPath() string {
+	return filepath.Join(backgroundDir(), fmt.Sprintf("%d.log", p.ID))
+}
+
+// ringLog keeps the last len(buf) bytes of a log stream. Offsets count bytes from the start of
+// the stream, so a reader can ask for everything after the last offset it has seen.
+type ringLog struct {
+	mu   sync.Mutex
+	buf  []byte
+	next int   // Index in buf the next byte is written to
+	size int   // Number of bytes in buf
+	end  int64 // Stream offset after the last byte written
+}
+
+func newRingLog(capacity int, offset int64) *ringLog {
+	return &ringLog{buf: make([]byte, capacity), end: offset}
+}
+
+func (r *ringLog) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := len(p)
+	if len(p) > len(r.buf) {
+		p = p[len(p)-len(r.buf):]
+	}
+	k := copy(r.buf[r.next:], p)
+	copy(r.buf, p[k:])
+	r.next = (r.next + len(p)) % len(r.buf)
+	r.size = min(r.size+len(p), len(r.buf))
+	r.end += int64(n)
+	return n, nil
+}
+
+// since returns the buffered output after offset together with the offset it starts at, which
+// is later than offset when that part of the stream is no longer buffered.
+func (r *ringLog) since(offset int64) ([]byte, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	offset = max(offset, r.end-int64(r.size))
+	if offset >= r.end {
+		return nil, r.end
+	}
+	n := int(r.end - offset)
+	out := make([]byte, n)
+	from := (r.next - n + len(r.buf)) % len(r.buf)
+	k := copy(out, r.buf[from:min(from+n, len(r.buf))])
+	copy(out[k:], r.buf[:n-k])
+	return out, offset
+}
+
+// executeBackgroundCommand starts command in the background. When opts names a readiness
+// condition, it waits until the command is ready, exits or DefaultBackgroundReadyTimeout
+// passes; ctx only bounds that wait, not the process.
+func executeBackgroundCommand(ctx context.Context, config *Config, agentDef *AgentDefinition, agentID, command string, opts BackgroundOptions) (string, error) {
+	var readyRe *regexp.Regexp
+	if opts.ReadyPattern != "" {
+		var err error
+		if readyRe, err = regexp.Compile(opts.ReadyPattern); err != nil {
+			return "", fmt.Errorf("invalid ready_pattern: %w", err)
+		}
+	}
+	switch opts.Restart {
+	case "", "no", "on-failure", "always":
+	default:
+		return "", fmt.Errorf("invalid restart policy %q: use \"no\", \"on-failure\" or \"always\"", opts.Restart)
+	}
+
+	// Pick up processes left by an earlier agent-go first, so their IDs and logs are not reused
+	restoreBackgroundProcesses(config)
+	if err := os.MkdirAll(backgroundDir(), 0755); err != nil {
+		return "", fmt.Errorf("failed to create background log directory: %w", err)
+	}
+
+	bgMutex.Lock()
+	p := &BackgroundProcess{
+		ID:        processIDCounter,
+		Command:   command,
+		Dir:       getShellDir(agentID),
+		AgentID:   agentID,
+		Options:   opts,
+		StartTime: time.Now(),
+		config:    config,
+		agentDef:  agentDef,
+		env:       getShellEnv(agentID),
+		readyRe:   readyRe,
+		log:       newRingLog(BackgroundLogBufferSize, 0),
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if agentDef != nil {
+		p.AgentName = agentDef.Name
+	}
+	// Logs of a process with the same ID that is no longer recorded are stale
+	_ = os.Remove(p.logPath())
+	_ = os.Remove(p.logPath() + ".1")
+	if err := p.start(); err != nil {
+		bgMutex.Unlock()
+		return "", err
+	}
+	processIDCounter++
+	backgroundProcesses[p.ID] = p
+	bgMutex.Unlock()
+
+	saveBackgroundProcesses()
+	go p.supervise()
+
+	started := fmt.Sprintf("Background command started with PID: %d", p.ID)
+	if opts.ReadyPort == 0 && opts.ReadyPattern == "" {
+		return started, nil
+	}
+
+	timer := time.NewTimer(DefaultBackgroundReadyTimeout)
+	defer timer.Stop()
+	select {
+	case <-p.ready:
+		return fmt.Sprintf("%s\nReady after %s (%s)", started, formatCommandDuration(time.Since(p.StartTime)), p.describeReadiness()), nil
+	case <-p.done:
+		logs, _ := getBackgroundLogs(p.ID, nil, 0)
+		return logs, fmt.Errorf("background command %d exited before it was ready", p.ID)
+	case <-timer.C:
+		logs, _ := getBackgroundLogs(p.ID, nil, 0)
+		return fmt.Sprintf("%s\nNot ready after %s (%s); it is still running. Recent output:\n%s",
+			started, formatCommandDuration(DefaultBackgroundReadyTimeout), p.describeReadiness(), logs), nil
+	case <-ctx.Done():
+		return started, ctx.Err()
+	}
+}
+
+// start runs p's command with its output appended to the log file. Called with bgMutex held.
+func (p *BackgroundProcess) start() error {
+	// Background processes outlive the turn that started them, so they are not tied to its context.
+	cmd := newShellCommand(context.Background(), p.Command)
+	cmd.Dir = p.Dir
+	cmd.Env = p.env
+	if err := sandboxCommand(cmd, resolveSandbox(p.config, p.agentDef), true); err != nil {
+		return err
+	}
+	limited, err := applyResourceLimits(cmd, p.config.ResourceLimits)
+	if err != nil {
+		return err
+	}
+
+	// The process writes to the file itself rather than through a pipe to agent-go, so it
+	// keeps logging after agent-go exits
+	logFile, err := os.OpenFile(p.logPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		limited.release()
+		return fmt.Errorf("failed to open background log: %w", err)
+	}
+	defer func() {
+		err := logFile.Close()
+		if err != nil {
+			fmt.Printf("failed to close background log: %v\n", err)
+		}
+	}()
+	readyAt := p.LogBase
+	if info, err := logFile.Stat(); err == nil {
+		readyAt += info.Size()
+	}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	if err := cmd.Start(); err != nil {
+		limited.release()
+		return fmt.Errorf("failed to start background command: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	p.cmd = cmd
+	p.limited = limited
+	p.exited = exited
+	p.OSPID = cmd.Process.Pid
+	p.OSStart = processStartID(p.OSPID)
+	p.Status = BackgroundRunning
+	p.Ready = false
+	p.Note = ""
+	p.readyAt = readyAt
+	return nil
+}
+
+// supervise follows p's output, records when it becomes ready and handles its exit, restarting
+// it as its restart policy asks. It returns once p has finished for good.
+func (p *BackgroundProcess) supervise() {
+	ticker := time.NewTicker(BackgroundPollInterval)
+	defer ticker.Stop()
+	defer close(p.done)
+
+	for {
+		bgMutex.Lock()
+		exited := p.exited
+		bgMutex.Unlock()
+
+		var waitErr error
+		gone := false
+		select {
+		case waitErr = <-exited: // Blocks forever for reattached processes, which are polled instead
+			gone = true
+		case <-ticker.C:
+			gone = exited == nil && !p.osProcessAlive()
+		}
+
+		bgMutex.Lock()
+		p.follow()
+		if !gone {
+			bgMutex.Unlock()
+			p.checkReady()
+			continue
+		}
+		restart, delay := p.handleExit(exited != nil, waitErr)
+		if restart {
+			bgMutex.Unlock()
+			saveBackgroundProcesses()
+			time.Sleep(delay)
+			bgMutex.Lock()
+			if p.killed {
+				p.Status = BackgroundKilled
+				restart = false
+			} else {
+				p.Restarts++
+				p.appendLogNote(fmt.Sprintf("restarting (%d/%d)", p.Restarts, p.maxRestarts()))
+				if err := p.start(); err != nil {
+					p.Status = BackgroundFailed
+					p.Note = fmt.Sprintf("restart failed: %s", err)
+					restart = false
+				}
+			}
+		}
+		if !restart {
+			p.closeReader()
+			pruneBackgroundProcesses()
+		}
+		bgMutex.Unlock()
+		saveBackgroundProcesses()
+		if !restart {
+			return
+		}
+	}
+}
+
+// handleExit records how p's current run ended and decides whether to restart it. Called with
+// bgMutex held.
+func (p *BackgroundProcess) handleExit(own bool, waitErr error) (restart bool, delay time.Duration) {
+	p.EndTime = time.Now()
+	p.Ready = false
+	p.ExitCode = nil
+	if own && p.cmd != nil && p.cmd.ProcessState != nil {
+		code := p.cmd.ProcessState.ExitCode()
+		p.ExitCode = &code
+	} else if own && waitErr != nil {
+		p.Note = waitErr.Error()
+	}
+	recent, _ := p.log.since(0)
+	if violation := p.limited.violation(string(recent)); violation != nil {
+		p.Note = violation.Error()
+		p.appendLogNote(violation.Error())
+	}
+	p.limited.release()
+	p.limited = nil
+	p.exited = nil
+
+	if p.Status == BackgroundLost {
+		return false, 0
+	}
+	if p.killed || p.Status == BackgroundKilled {
+		p.Status = BackgroundKilled
+		return false, 0
+	}
+	failed := p.ExitCode == nil || *p.ExitCode != 0
+	wantsRestart := p.Options.Restart == "always" || (p.Options.Restart == "on-failure" && failed)
+	if !wantsRestart {
+		p.Status = BackgroundExited
+		return false, 0
+	}
+	if p.Restarts >= p.maxRestarts() {
+		p.Status = BackgroundFailed
+		p.Note = fmt.Sprintf("gave up after %d restarts", p.Restarts)
+		p.appendLogNote(p.Note)
+		return false, 0
+	}
+	p.Status = BackgroundRestarting
+	return true, min(time.Duration(1<<p.Restarts)*time.Second, 30*time.Second)
+}
+
+func (p *BackgroundProcess) maxRestarts() int {
+	if p.Options.MaxRestarts > 0 {
+		return p.Options.MaxRestarts
+	}
+	return DefaultBackgroundMaxRestarts
+}
+
+// checkReady marks p ready once its port accepts connections and its output matches its
+// pattern, whichever of the two are configured.
+func (p *BackgroundProcess) checkReady() {
+	bgMutex.Lock()
+	if p.Ready || p.Status != BackgroundRunning || (p.Options.ReadyPort == 0 && p.readyRe == nil) {
+		bgMutex.Unlock()
+		return
+	}
+	port, re, from := p.Options.ReadyPort, p.readyRe, p.readyAt
+	bgMutex.Unlock()
+
+	if re != nil {
+		output, _ := p.log.since(from)
+		if !re.Match(output) {
+			return
+		}
+	}
+	if port > 0 {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)), BackgroundPollInterval)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}
+
+	bgMutex.Lock()
+	p.Ready = true
+	select {
+	case <-p.ready:
+	default:
+		close(p.ready)
+	}
+	bgMutex.Unlock()
+	saveBackgroundProcesses()
+}
+
+// describeReadiness names the readiness conditions of p, e.g. "port 8080 accepting connections".
+func (p *BackgroundProcess) describeReadiness() string {
+	var parts []string
+	if p.Options.ReadyPort > 0 {
+		parts = append(parts, fmt.Sprintf("port %d accepting connections", p.Options.ReadyPort))
+	}
+	if p.Options.ReadyPattern != "" {
+		parts = append(parts, fmt.Sprintf("output matching %q", p.Options.ReadyPattern))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// follow reads new output from the log file into the ring buffer, and rotates the file once it
+// grows past BackgroundLogFileSize. Called with bgMutex held.
+func (p *BackgroundProcess) follow() {
+	if p.reader == nil {
+		file, err := os.Open(p.logPath())
+		if err != nil {
+			return
+		}
+		p.reader = file
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := p.reader.ReadAt(buf, p.filePos)
+		if n > 0 {
+			_, _ = p.log.Write(buf[:n])
+			p.filePos += int64(n)
+		}
+		if err != nil || n == 0 {
+			break
+		}
+	}
+	if p.filePos >= BackgroundLogFileSize {
+		p.rotateLog()
+	}
+}
+
+// rotateLog moves the log file's contents to <id>.log.1 and truncates it, like logrotate's
+// copytruncate: the process keeps appending to the same file. Output written between the copy
+// and the truncation is lost. Called with bgMutex held.
+func (p *BackgroundProcess) rotateLog() {
+	path := p.logPath()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if int64(len(data)) > p.filePos {
+		_, _ = p.log.Write(data[p.filePos:])
+		p.filePos = int64(len(data))
+	}
+	if err := os.WriteFile(path+".1", data, 0644); err != nil {
+		return
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		return
+	}
+	p.LogBase += p.filePos
+	p.filePos = 0
+}
+
+func (p *BackgroundProcess) closeReader() {
+	if p.reader != nil {
+		if err := p.reader.Close(); err != nil {
+			fmt.Printf("failed to close background log: %v\n", err)
+		}
+		p.reader = nil
+	}
+}
+
+// appendLogNote adds a line from agent-go itself to p's log.
+func (p *BackgroundProcess) appendLogNote(note string) {
+	file, err := os.OpenFile(p.logPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			fmt.Printf("failed to close background log: %v\n", err)
+		}
+	}()
+	_, _ = fmt.Fprintf(file, "\n[agent-go: %s]\n", note)
+}
+
+// readLogFiles reads the log stream from offset up to end from the log files. The result starts
+// later than offset when that part was rotated away. Called with bgMutex held.
+func (p *BackgroundProcess) readLogFiles(offset, end int64) ([]byte, int64) {
+	path := p.logPath()
+	var previous int64
+	if info, err := os.Stat(path + ".1"); err == nil {
+		previous = info.Size()
+	}
+	offset = max(offset, p.LogBase-previous)
+
+	var out bytes.Buffer
+	read := func(path string, from, to int64) {
+		if from >= to {
+			return
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return
+		}
+		defer func() {
+			err := file.Close()
+			if err != nil {
+				fmt.Printf("failed to close background log: %v\n", err)
+			}
+		}()
+		_, _ = io.Copy(&out, io.NewSectionReader(file, from, to-from))
+	}
+	read(path+".1", offset-(p.LogBase-previous), min(end, p.LogBase)-(p.LogBase-previous))
+	read(path, max(offset, p.LogBase)-p.LogBase, end-p.LogBase)
+	return out.Bytes(), offset
+}
+
+// describeStatus summarizes p's state, e.g. "running, ready" or "exited with code 1".
+func (p *BackgroundProcess) describeStatus() string {
+	var status string
+	switch p.Status {
+	case BackgroundRunning:
+		status = "running"
+		if p.Ready {
+			status += ", ready"
+		} else if p.Options.ReadyPort > 0 || p.Options.ReadyPattern != "" {
+			status += ", not ready yet"
+		}
+	case BackgroundExited:
+		if p.ExitCode != nil {
+			status = fmt.Sprintf("exited with code %d", *p.ExitCode)
+		} else {
+			status = "exited"
+		}
+	default:
+		status = p.Status
+	}
+	if p.Note != "" {
+		status += fmt.Sprintf(" (%s)", p.Note)
+	}
+	return status
+}
+
+// osProcessAlive reports whether the process p started is still running. A live process with
+// p's PID that started at another time, e.g. after a reboot, is not p's.
+func (p *BackgroundProcess) osProcessAlive() bool {
+	return processAlive(p.OSPID) && processStartID(p.OSPID) == p.OSStart
+}
+
+func (p *BackgroundProcess) isRunning() bool {
+	return p.Status == BackgroundRunning || p.Status == BackgroundRestarting
+}
+
+func killBackgroundCommand(pid int) (string, error) {
+	bgMutex.Lock()
+	proc, exists := backgroundProcesses[pid]
+	if !exists {
+		bgMutex.Unlock()
+		return "", fmt.Errorf("background process with PID %d not found", pid)
+	}
+	if !proc.isRunning() {
+		bgMutex.Unlock()
+		return "Process already finished", nil
+	}
+
+	if proc.Status == BackgroundRunning && proc.exited == nil && !proc.osProcessAlive() {
+		// The PID may already belong to an unrelated process, which must not be killed
+		proc.Status = BackgroundLost
+		proc.Note = "exited before it could be killed"
+		bgMutex.Unlock()
+		return fmt.Sprintf("Process %d had already exited", pid), nil
+	}
+	proc.killed = true
+	var err error
+	if proc.Status == BackgroundRunning {
+		if proc.exited != nil {
+			err = killProcessGroup(proc.cmd)
+		} else {
+			err = killProcessGroupID(proc.OSPID)
+		}
+	}
+	bgMutex.Unlock()
+	if err != nil {
+		return "", fmt.Errorf("failed to kill process: %w", err)
+	}
+
+	// Give the supervisor a moment to record the exit, so a following listing is accurate
+	select {
+	case <-proc.done:
+	case <-time.After(ProcessWaitDelay):
+	}
+	return fmt.Sprintf("Process %d killed", pid), nil
+}
+
+// getBackgroundLogs returns output of a background process: with since, the output after that
+// log offset, otherwise the last tail lines (BackgroundLogTailLines when tail is 0). Either is
+// capped to max_command_output. The result ends with the status and the offset to pass as
+// since to read only newer output.
+func getBackgroundLogs(pid int, since *int64, tail int) (string, error) {
+	bgMutex.Lock()
+	defer bgMutex.Unlock()
+
+	proc, exists := backgroundProcesses[pid]
+	if !exists {
+		return "", fmt.Errorf("background process with PID %d not found", pid)
+	}
+	proc.follow()
+	end := proc.LogBase + proc.filePos
+	limit := proc.config.MaxCommandOutput
+	if limit <= 0 {
+		limit = DefaultMaxCommandOutput
+	}
+
+	var builder strings.Builder
+	next := end
+	if since != nil {
+		data, from := proc.log.since(*since)
+		if from > *since {
+			data, from = proc.readLogFiles(*since, end)
+		}
+		if from > *since {
+			builder.WriteString(fmt.Sprintf("[output before offset %d is no longer kept]\n", from))
+		}
+		if len(data) > limit {
+			data = data[:limit]
+		}
+		next = from + int64(len(data))
+		builder.Write(bytes.ToValidUTF8(data, nil))
+	} else {
+		if tail <= 0 {
+			tail = BackgroundLogTailLines
+		}
+		data, _ := proc.log.since(0)
+		data = bytes.TrimSuffix(data, []byte("\n"))
+		for i, lines := len(data)-1, 0; i >= 0; i-- {
+			if data[i] == '\n' {
+				if lines++; lines == tail {
+					data = data[i+1:]
+					break
+				}
+			}
+		}
+		if len(data) > limit {
+			data = data[len(data)-limit:]
+		}
+		builder.Write(bytes.ToValidUTF8(data, nil))
+	}
+
+	if builder.Len() > 0 && !strings.HasSuffix(builder.String(), "\n") {
+		builder.WriteString("\n")
+	}
+	trailer := fmt.Sprintf("[status: %s | offset: %d", proc.describeStatus(), next)
+	if next < end {
+		trailer += fmt.Sprintf(" | %d more bytes", end-next)
+	}
+	builder.WriteString(trailer + "]")
+	return builder.String(), nil
+}
+
+func listBackgroundCommands() string {
+	bgMutex.Lock()
+	defer bgMutex.Unlock()
+
+	if len(backgroundProcesses) == 0 {
+		return "No background commands running."
+	}
+
+	var builder strings.Builder
+	builder.WriteString("Background Commands:\n")
+	for _, proc := range sortedBackgroundProcesses() {
+		details := fmt.Sprintf("os pid %d", proc.OSPID)
+		if proc.isRunning() {
+			details += fmt.Sprintf(", started %s ago", formatCommandDuration(time.Since(proc.StartTime).Truncate(time.Second)))
+		}
+		if proc.Restarts > 0 {
+			details += fmt.Sprintf(", %d restarts", proc.Restarts)
+		}
+		builder.WriteString(fmt.Sprintf("- PID: %d | Command: %s | Status: %s | %s\n", proc.ID, proc.Command, proc.describeStatus(), details))
+	}
+	return builder.String()
+}
+
+func hasRunningBackgroundProcesses() bool {
+	bgMutex.Lock()
+	defer bgMutex.Unlock()
+
+	for _, proc := range backgroundProcesses {
+		if proc.isRunning() {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanBackgroundProcesses forgets all finished background processes and deletes their logs.
+func cleanBackgroundProcesses() int {
+	bgMutex.Lock()
+	removed := 0
+	for id, proc := range backgroundProcesses {
+		if !proc.isRunning() {
+			proc.removeLogs()
+			delete(backgroundProcesses, id)
+			removed++
+		}
+	}
+	bgMutex.Unlock()
+	saveBackgroundProcesses()
+	return removed
+}
+
+// pruneBackgroundProcesses forgets the oldest finished processes beyond
+// MaxFinishedBackgroundProcesses. Called with bgMutex held.
+func pruneBackgroundProcesses() {
+	var finished []*BackgroundProcess
+	for _, proc := range backgroundProcesses {
+		if !proc.isRunning() {
+			finished = append(finished, proc)
+		}
+	}
+	if len(finished) <= MaxFinishedBackgroundProcesses {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].EndTime.Before(finished[j].EndTime)
+	})
+	for _, proc := range finished[:len(finished)-MaxFinishedBackgroundProcesses] {
+		proc.removeLogs()
+		delete(backgroundProcesses, proc.ID)
+	}
+}
+
+func (p *BackgroundProcess) removeLogs() {
+	p.closeReader()
+	_ = os.Remove(p.logPath())
+	_ = os.Remove(p.logPath() + ".1")
+}
+
+// sortedBackgroundProcesses returns the background processes by ID. Called with bgMutex held.
+func sortedBackgroundProcesses() []*BackgroundProcess {
+	procs := make([]*BackgroundProcess, 0, len(backgroundProcesses))
+	for _, proc := range backgroundProcesses {
+		procs = append(procs, proc)
+	}
+	sort.Slice(procs, func(i, j int) bool {
+		return procs[i].ID < procs[j].ID
+	})
+	return procs
+}
+
+// saveBackgroundProcesses records the background processes in .agent-go/bg/processes.json, so
+// a later agent-go can reattach to them.
+func saveBackgroundProcesses() {
+	backgroundSaveMutex.Lock()
+	defer backgroundSaveMutex.Unlock()
+
+	bgMutex.Lock()
+	data, err := json.MarshalIndent(sortedBackgroundProcesses(), "", "  ")
+	bgMutex.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not save background processes: %s\n", err)
+		return
+	}
+	if err := os.MkdirAll(backgroundDir(), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not save background processes: %s\n", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(backgroundDir(), "processes.json"), data, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not save background processes: %s\n", err)
+	}
+}
+
+// restoreBackgroundProcesses loads the background processes recorded by an earlier agent-go in
+// this workspace and reattaches to those still running. Only the first call does anything; it
+// returns how many processes were reattached.
+func restoreBackgroundProcesses(config *Config) int {
+	reattached := 0
+	backgroundRestoreOnce.Do(func() {
+		data, err := os.ReadFile(filepath.Join(backgroundDir(), "processes.json"))
+		if err != nil {
+			return
+		}
+		var procs []*BackgroundProcess
+		if err := json.Unmarshal(data, &procs); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not read background processes: %s\n", err)
+			return
+		}
+
+		bgMutex.Lock()
+		for _, p := range procs {
+			if _, exists := backgroundProcesses[p.ID]; exists {
+				continue
+			}
+			p.config = config
+			p.log = newRingLog(BackgroundLogBufferSize, p.LogBase)
+			p.ready = make(chan struct{})
+			p.done = make(chan struct{})
+			if p.Ready {
+				close(p.ready)
+			}
+			processIDCounter = max(processIDCounter, p.ID+1)
+			backgroundProcesses[p.ID] = p
+
+			if !p.isRunning() {
+				close(p.done)
+				continue
+			}
+			if p.Status != BackgroundRunning || !p.osProcessAlive() {
+				p.Status = BackgroundLost
+				p.Note = "exited while agent-go was not running"
+				close(p.done)
+				continue
+			}
+			if p.AgentName != "" {
+				p.agentDef, _ = loadAgentDefinition(p.AgentName)
+			}
+			p.env = getShellEnv(p.AgentID)
+			p.readyRe, _ = regexp.Compile(p.Options.ReadyPattern)
+			if p.Options.ReadyPattern == "" {
+				p.readyRe = nil
+			}
+			reattached++
+			go p.supervise()
+		}
+		bgMutex.Unlock()
+		saveBackgroundProcesses()
+	})
+	return reattached
+}
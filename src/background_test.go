@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRingLog(t *testing.T) {
+	r := newRingLog(8, 0)
+	check := func(offset int64, want string, wantFrom int64) {
+		t.Helper()
+		got, from := r.since(offset)
+		if string(got) != want || from != wantFrom {
+			t.Errorf("since(%d) = %q from %d, want %q from %d", offset, got, from, want, wantFrom)
+		}
+	}
+
+	check(0, "", 0)
+	r.Write([]byte("abc"))
+	check(0, "abc", 0)
+	check(1, "bc", 1)
+	check(3, "", 3)
+
+	// Wrapping around keeps the last 8 bytes; older offsets start at the oldest buffered byte
+	r.Write([]byte("defghij"))
+	check(0, "cdefghij", 2)
+	check(5, "fghij", 5)
+	check(10, "", 10)
+	check(42, "", 10)
+
+	// A write larger than the buffer keeps only its end, but counts every byte
+	if n, err := r.Write([]byte("0123456789AB")); n != 12 || err != nil {
+		t.Errorf("Write = %d, %v, want 12, nil", n, err)
+	}
+	check(0, "456789AB", 14)
+	check(20, "AB", 20)
+
+	// Writes that end exactly at the end of the buffer
+	r = newRingLog(4, 0)
+	r.Write([]byte("ab"))
+	r.Write([]byte("cd"))
+	check(0, "abcd", 0)
+	r.Write([]byte("e"))
+	check(0, "bcde", 1)
+
+	// A log reattached after a restart continues at the offset it had reached
+	r = newRingLog(8, 100)
+	check(0, "", 100)
+	r.Write([]byte("xy"))
+	check(0, "xy", 100)
+	check(101, "y", 101)
+}
+
+// resetBackgroundState gives the test an empty process table and workspace, restoring both
+// when it ends.
+func resetBackgroundState(t *testing.T) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	bgMutex.Lock()
+	saved, savedCounter := backgroundProcesses, processIDCounter
+	backgroundProcesses = make(map[int]*BackgroundProcess)
+	processIDCounter = 1
+	backgroundRestoreOnce = sync.Once{}
+	bgMutex.Unlock()
+	t.Cleanup(func() {
+		bgMutex.Lock()
+		backgroundProcesses, processIDCounter = saved, savedCounter
+		backgroundRestoreOnce = sync.Once{}
+		bgMutex.Unlock()
+	})
+}
+
+// writeBackgroundState records procs as an earlier agent-go would have left them.
+func writeBackgroundState(t *testing.T, procs []*BackgroundProcess) {
+	t.Helper()
+	data, err := json.Marshal(procs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(backgroundDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(backgroundDir(), "processes.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// exitedPID returns the PID of a process that has already exited and been reaped.
+func exitedPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestRestoreBackgroundProcesses(t *testing.T) {
+	resetBackgroundState(t)
+	self := os.Getpid()
+	code := 3
+	started := time.Now().Add(-time.Hour)
+	writeBackgroundState(t, []*BackgroundProcess{
+		{ID: 2, OSPID: exitedPID(t), OSStart: "1", Command: "dead", Status: BackgroundRunning, StartTime: started},
+		{ID: 3, OSPID: self, OSStart: "stale-start", Command: "reused pid", Status: BackgroundRunning, StartTime: started},
+		{ID: 5, OSPID: self, OSStart: processStartID(self), Command: "restarting", Status: BackgroundRestarting, StartTime: started},
+		{ID: 7, OSPID: exitedPID(t), Command: "finished", Status: BackgroundExited, ExitCode: &code, StartTime: started, EndTime: started},
+	})
+
+	if n := restoreBackgroundProcesses(&Config{}); n != 0 {
+		t.Errorf("reattached %d processes, want 0", n)
+	}
+	// Only the first call restores anything
+	if n := restoreBackgroundProcesses(&Config{}); n != 0 {
+		t.Errorf("second restore reattached %d processes", n)
+	}
+
+	bgMutex.Lock()
+	defer bgMutex.Unlock()
+	want := map[int]string{2: BackgroundLost, 3: BackgroundLost, 5: BackgroundLost, 7: BackgroundExited}
+	if len(backgroundProcesses) != len(want) {
+		t.Fatalf("restored %d processes, want %d", len(backgroundProcesses), len(want))
+	}
+	for id, status := range want {
+		p := backgroundProcesses[id]
+		if p == nil || p.Status != status {
+			t.Errorf("process %d = %+v, want status %s", id, p, status)
+			continue
+		}
+		select {
+		case <-p.done:
+		default:
+			t.Errorf("process %d is not marked as finished", id)
+		}
+	}
+	if p := backgroundProcesses[7]; p.ExitCode == nil || *p.ExitCode != 3 || p.Note != "" {
+		t.Errorf("finished process changed on restore: %+v", p)
+	}
+	if processIDCounter != 8 {
+		t.Errorf("next ID = %d, want 8", processIDCounter)
+	}
+
+	// The lost processes are saved as such, so a later agent-go doesn't try them again
+	data, err := os.ReadFile(filepath.Join(backgroundDir(), "processes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []*BackgroundProcess
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range saved {
+		if p.Status != want[p.ID] {
+			t.Errorf("saved process %d with status %s, want %s", p.ID, p.Status, want[p.ID])
+		}
+	}
+}
+
+func TestRestoreBackgroundProcessesReattaches(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sleep")
+	}
+	resetBackgroundState(t)
+	cmd := exec.Command("sleep", "60")
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		_ = killProcessGroup(cmd)
+		<-exited
+	})
+
+	pid := cmd.Process.Pid
+	writeBackgroundState(t, []*BackgroundProcess{
+		{ID: 4, OSPID: pid, OSStart: processStartID(pid), Command: "sleep 60", Status: BackgroundRunning, StartTime: time.Now(), LogBase: 10},
+	})
+	// Output written while agent-go was not running is picked up from the log file
+	if err := os.WriteFile(filepath.Join(backgroundDir(), "4.log"), []byte("still here\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := restoreBackgroundProcesses(&Config{}); n != 1 {
+		t.Fatalf("reattached %d processes, want 1", n)
+	}
+	bgMutex.Lock()
+	p := backgroundProcesses[4]
+	bgMutex.Unlock()
+	if p == nil || p.Status != BackgroundRunning {
+		t.Fatalf("process 4 = %+v, want running", p)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		out, from := p.log.since(0)
+		if string(out) == "still here\n" && from == 10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("log = %q from %d, want the log file's output from offset 10", out, from)
+		}
+		time.Sleep(BackgroundPollInterval)
+	}
+
+	if msg, err := killBackgroundCommand(4); err != nil || !strings.Contains(msg, "killed") {
+		t.Fatalf("killBackgroundCommand = %q, %v", msg, err)
+	}
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not notice the kill")
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reattached process is still running")
+	}
+	bgMutex.Lock()
+	defer bgMutex.Unlock()
+	if p.Status != BackgroundKilled {
+		t.Errorf("status = %s, want %s", p.Status, BackgroundKilled)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LedgerEntry is one line of the spend ledger, recorded for every billed request.
+type LedgerEntry struct {
+	Time   time.Time `json:"time"`
+	Model  string    `json:"model"`
+	Tokens int       `json:"tokens"`
+	Cost   float64   `json:"cost"` // USD
+}
+
+// The ledger is append-only, so concurrent agent-go processes can share it. Each process
+// keeps a running total for today and only reads lines appended since its last check.
+var (
+	ledgerMu     sync.Mutex
+	ledgerDay    string
+	ledgerOffset int64
+	ledgerToday  float64
+)
+
+// Budget state for the current session: warnings already shown and extra allowance granted
+// by the user after a limit was reached, both keyed by limit name.
+var (
+	budgetMu     sync.Mutex
+	budgetWarned = make(map[string]bool)
+	budgetRaised = make(map[string]float64)
+)
+
+// getLedgerPath returns the path to the spend ledger shared by all agent-go processes.
+func getLedgerPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "agent-go", "spend_ledger.jsonl")
+}
+
+// appendLedger records a billed request in the spend ledger.
+func appendLedger(entry LedgerEntry) error {
+	path := getLedgerPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := f.Close()
+		if err != nil {
+			fmt.Printf("failed to close ledger file: %v\n", err)
+		}
+	}()
+	// A single small write to an O_APPEND file is not interleaved with other processes' writes
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// dailySpend returns today's spend (local time) across all processes from the ledger.
+func dailySpend() (float64, error) {
+	ledgerMu.Lock()
+	defer ledgerMu.Unlock()
+
+	today := time.Now().Format("2006-01-02")
+	if today != ledgerDay {
+		ledgerDay = today
+		ledgerOffset = 0
+		ledgerToday = 0
+	}
+
+	f, err := os.Open(getLedgerPath())
+	if os.IsNotExist(err) {
+		return ledgerToday, nil
+	}
+	if err != nil {
+		return ledgerToday, err
+	}
+	defer func() {
+		err := f.Close()
+		if err != nil {
+			fmt.Printf("failed to close ledger file: %v\n", err)
+		}
+	}()
+
+	if _, err := f.Seek(ledgerOffset, io.SeekStart); err != nil {
+		return ledgerToday, err
+	}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// A line without a newline is still being written; pick it up next time
+			break
+		}
+		ledgerOffset += int64(len(line))
+
+		var entry LedgerEntry
+		if json.Unmarshal(line, &entry) != nil {
+			continue
+		}
+		if entry.Time.Local().Format("2006-01-02") == today {
+			ledgerToday += entry.Cost
+		}
+	}
+	return ledgerToday, nil
+}
+
+// budgetLimit is one configured spending limit and the current usage against it.
+type budgetLimit struct {
+	name   string // e.g. "session cost"
+	used   float64
+	limit  float64 // Including any allowance granted by the user
+	step   float64 // The configured limit, by which it is raised when the user continues
+	format func(float64) string
+}
+
+func formatTokenAmount(v float64) string {
+	return formatNumber(int(v)) + " tokens"
+}
+
+// currentBudgetLimits returns the configured limits with their current usage.
+func currentBudgetLimits(config *Config) []budgetLimit {
+	usage, _ := snapshotModelUsage()
+	var tokens int
+	for _, u := range usage {
+		tokens += u.TotalTokens
+	}
+	cost, _ := sessionCost(usage)
+
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+
+	var limits []budgetLimit
+	if config.MaxSessionTokens > 0 {
+		step := float64(config.MaxSessionTokens)
+		limits = append(limits, budgetLimit{"session tokens", float64(tokens), step + budgetRaised["session tokens"], step, formatTokenAmount})
+	}
+	if config.MaxSessionCost > 0 {
+		limits = append(limits, budgetLimit{"session cost", cost, config.MaxSessionCost + budgetRaised["session cost"], config.MaxSessionCost, formatCost})
+	}
+	if config.MaxDailyCost > 0 {
+		daily, err := dailySpend()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to read spend ledger: %v\n", err)
+		}
+		limits = append(limits, budgetLimit{"daily cost", daily, config.MaxDailyCost + budgetRaised["daily cost"], config.MaxDailyCost, formatCost})
+	}
+	return limits
+}
+
+// checkBudget enforces the spending limits before each model request. It warns once when
+// usage crosses config.BudgetWarnPercent of a limit. When a limit is reached it asks the user
+// whether to continue, raising that limit by its configured amount; without a terminal to
+// ask it stops. It returns false if the agent must stop.
+func checkBudget(config *Config) bool {
+	for _, l := range currentBudgetLimits(config) {
+		if l.used >= l.limit {
+			if !confirmBudgetOverrun(config, l.name) {
+				return false
+			}
+			continue
+		}
+
+		if config.BudgetWarnPercent > 0 && l.used >= l.limit*float64(config.BudgetWarnPercent)/100 {
+			budgetMu.Lock()
+			warned := budgetWarned[l.name]
+			budgetWarned[l.name] = true
+			budgetMu.Unlock()
+			if !warned {
+				fmt.Fprintf(os.Stderr, "%sWarning: %s at %.0f%% of budget (%s of %s)%s\n",
+					ColorYellow, l.name, l.used/l.limit*100, l.format(l.used), l.format(l.limit), ColorReset)
+			}
+		}
+	}
+	return true
+}
+
+// confirmBudgetOverrun reports that the named limit was reached and asks whether to continue.
+func confirmBudgetOverrun(config *Config, name string) bool {
+	// Sub-agents may reach the limit at the same time; ask one at a time. Usage is checked
+	// again once the console is ours, so a limit another prompt just raised isn't raised twice.
+	lockConsole()
+	defer unlockConsole()
+	var l budgetLimit
+	for _, current := range currentBudgetLimits(config) {
+		if current.name == name {
+			l = current
+		}
+	}
+	if l.name == "" || l.used < l.limit {
+		return true
+	}
+
+	fmt.Fprintf(os.Stderr, "%sBudget reached: %s is %s (limit %s)%s\n", ColorRed, l.name, l.format(l.used), l.format(l.limit), ColorReset)
+	if pipelineMode || !isTTY() {
+		return false
+	}
+
+	fmt.Printf("%s?%s Continue anyway? The %s limit will be raised to %s [y/N]: ", ColorHighlight, ColorReset, l.name, l.format(l.limit+l.step))
+	var response string
+	fmt.Scanln(&response)
+	switch strings.ToLower(strings.TrimSpace(response)) {
+	case "y", "yes":
+		budgetMu.Lock()
+		budgetRaised[l.name] += l.step
+		// Warn again as the raised limit is approached
+		budgetWarned[l.name] = false
+		budgetMu.Unlock()
+		return true
+	default:
+		return false
+	}
+}
+
+// resetBudgetState forgets warnings and raised limits, e.g. when a new session starts.
+func resetBudgetState() {
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	budgetWarned = make(map[string]bool)
+	budgetRaised = make(map[string]float64)
+}
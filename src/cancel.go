@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Turn cancellation state. A "turn" is everything that happens after the user submits
+// input: API requests, tool calls and sub-agents. The first Ctrl+C cancels the turn's
+// context; a second one within InterruptExitWindow exits the program.
+var (
+	turnMu        sync.Mutex
+	turnCancel    context.CancelFunc
+	lastInterrupt time.Time
+)
+
+// beginTurn starts a new cancellable turn and returns its context.
+// Callers must call endTurn when the turn is over.
+func beginTurn() context.Context {
+	turnMu.Lock()
+	defer turnMu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	turnCancel = cancel
+	return ctx
+}
+
+// endTurn releases the current turn's context.
+func endTurn() {
+	turnMu.Lock()
+	defer turnMu.Unlock()
+
+	if turnCancel != nil {
+		turnCancel()
+		turnCancel = nil
+	}
+}
+
+// cancelCurrentTurn is called from the SIGINT handler. It returns false when there is no
+// turn to cancel or when the user pressed Ctrl+C twice in quick succession, in which case
+// the caller should exit.
+func cancelCurrentTurn() bool {
+	turnMu.Lock()
+	defer turnMu.Unlock()
+
+	if turnCancel == nil || time.Since(lastInterrupt) < InterruptExitWindow {
+		return false
+	}
+	lastInterrupt = time.Now()
+	turnCancel()
+	fmt.Printf("\n%sCancelling... (press Ctrl+C again to exit)%s\n", ColorYellow, ColorReset)
+	return true
+}
+
+// cancelledToolMessages returns synthetic tool results for tool calls that never produced
+// output, so every tool_call_id in the history still has a matching tool message.
+func cancelledToolMessages(toolCalls []ToolCall) []Message {
+	msgs := make([]Message, 0, len(toolCalls))
+	for _, toolCall := range toolCalls {
+		output := CancelledToolResult
+		msgs = append(msgs, Message{
+			Role:       "tool",
+			ToolCallID: toolCall.ID,
+			Content:    &output,
+		})
+	}
+	return msgs
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Interaction is one recorded HTTP request/response pair. A cassette file holds one
+// interaction per line (JSON Lines), in the order the requests were made.
+type Interaction struct {
+	Hash     string            `json:"hash"`
+	Method   string            `json:"method"`
+	URL      string            `json:"url"`
+	Request  json.RawMessage   `json:"request,omitempty"`
+	Status   int               `json:"status"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Response string            `json:"response"`
+}
+
+// Cassette records provider traffic to a file or replays it offline. Request headers
+// (which carry API keys) are never recorded.
+type Cassette struct {
+	mu        sync.Mutex
+	path      string
+	replaying bool
+	loose     bool // Fall back to other recordings of the same endpoint when the hash doesn't match
+	recorded  []Interaction
+	used      []bool
+}
+
+// activeCassette is set by --record or --replay and wraps every LLMClient transport.
+var activeCassette *Cassette
+
+// errCassetteMiss is returned in replay mode when no recorded response matches a request.
+var errCassetteMiss = errors.New("no recorded response for request")
+
+// recordedHeaders are the response headers kept in a cassette; the client only needs these.
+var recordedHeaders = []string{"Content-Type", "Retry-After", "Retry-After-Ms"}
+
+// volatilePattern matches timestamps injected into prompts (see getCurrentTimeContext and
+// getSystemInfo), which would otherwise change the request hash on every run.
+var volatilePattern = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})|[A-Z][a-z]{2}, \d{2} [A-Z][a-z]{2} \d{4} \d{2}:\d{2}:\d{2} [A-Za-z0-9+-]+`)
+
+// parseCassetteArgs removes --record <file> / --replay <file> (or --record=<file>) and
+// --replay-loose from args and activates the cassette. It returns the remaining arguments.
+func parseCassetteArgs(args []string) ([]string, error) {
+	var rest []string
+	loose := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		var mode, path string
+		switch {
+		case arg == "--replay-loose":
+			loose = true
+			continue
+		case arg == "--record" || arg == "--replay":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("%s requires a file argument", arg)
+			}
+			mode, path = arg, args[i+1]
+			i++
+		case strings.HasPrefix(arg, "--record=") || strings.HasPrefix(arg, "--replay="):
+			mode, path, _ = strings.Cut(arg, "=")
+		default:
+			rest = append(rest, arg)
+			continue
+		}
+
+		if activeCassette != nil {
+			return nil, fmt.Errorf("only one of --record and --replay may be given")
+		}
+		cassette, err := openCassette(path, mode == "--replay")
+		if err != nil {
+			return nil, err
+		}
+		activeCassette = cassette
+	}
+	if loose {
+		if activeCassette == nil || !activeCassette.replaying {
+			return nil, fmt.Errorf("--replay-loose requires --replay")
+		}
+		activeCassette.loose = true
+	}
+	return rest, nil
+}
+
+// openCassette prepares a cassette for recording (truncating the file) or loads one for replay.
+func openCassette(path string, replay bool) (*Cassette, error) {
+	c := &Cassette{path: path, replaying: replay}
+	if !replay {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			return nil, fmt.Errorf("failed to create cassette: %w", err)
+		}
+		return c, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cassette: %w", err)
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			fmt.Printf("failed to close cassette: %v\n", err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var interaction Interaction
+		if err := json.Unmarshal(scanner.Bytes(), &interaction); err != nil {
+			return nil, fmt.Errorf("invalid cassette line %d: %w", line, err)
+		}
+		c.recorded = append(c.recorded, interaction)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read cassette: %w", err)
+	}
+	c.used = make([]bool, len(c.recorded))
+	return c, nil
+}
+
+// isReplaying reports whether requests are being served from a cassette.
+func isReplaying() bool {
+	return activeCassette != nil && activeCassette.replaying
+}
+
+// wrapTransport routes a transport through the active cassette, if any.
+func wrapTransport(base http.RoundTripper) http.RoundTripper {
+	if activeCassette == nil {
+		return base
+	}
+	return &cassetteTransport{cassette: activeCassette, base: base}
+}
+
+// requestHash identifies a request by method, URL and body, ignoring volatile timestamps.
+func requestHash(method, url string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + url + "\n"))
+	h.Write(volatilePattern.ReplaceAll(body, []byte("<time>")))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+type cassetteTransport struct {
+	cassette *Cassette
+	base     http.RoundTripper
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	url := req.URL.String()
+	hash := requestHash(req.Method, url, body)
+
+	if t.cassette.replaying {
+		interaction, ok := t.cassette.next(hash, req.Method, url)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s %s with hash %s (cassette %s); the request differs from the recording, use --replay-loose to replay it in recorded order anyway", errCassetteMiss, req.Method, url, hash, t.cassette.path)
+		}
+		header := make(http.Header)
+		for k, v := range interaction.Headers {
+			header.Set(k, v)
+		}
+		return &http.Response{
+			StatusCode: interaction.Status,
+			Status:     fmt.Sprintf("%d %s", interaction.Status, http.StatusText(interaction.Status)),
+			Header:     header,
+			Body:       io.NopCloser(strings.NewReader(interaction.Response)),
+			Request:    req,
+		}, nil
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	interaction := Interaction{Hash: hash, Method: req.Method, URL: url, Status: resp.StatusCode, Headers: make(map[string]string)}
+	if json.Valid(body) {
+		interaction.Request = body
+	}
+	for _, k := range recordedHeaders {
+		if v := resp.Header.Get(k); v != "" {
+			interaction.Headers[k] = v
+		}
+	}
+	// Record once the caller has read the body, so streams are still rendered as they arrive
+	resp.Body = &recordingBody{ReadCloser: resp.Body, cassette: t.cassette, interaction: interaction}
+	return resp, nil
+}
+
+// next returns the first unused interaction with the given hash. In loose mode, a request that
+// changed (e.g. a different working directory in the system prompt) falls back to the next
+// unused interaction for the same method and URL, with a warning, so replays stay in recorded
+// order.
+func (c *Cassette) next(hash, method, url string) (Interaction, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, interaction := range c.recorded {
+		if !c.used[i] && interaction.Hash == hash {
+			c.used[i] = true
+			return interaction, true
+		}
+	}
+	if !c.loose {
+		return Interaction{}, false
+	}
+	for i, interaction := range c.recorded {
+		if !c.used[i] && interaction.Method == method && interaction.URL == url {
+			c.used[i] = true
+			fmt.Fprintf(os.Stderr, "%sWarning: request %s %s with hash %s is not in the cassette; replaying recording %s instead%s\n", ColorYellow, method, url, hash, interaction.Hash, ColorReset)
+			return interaction, true
+		}
+	}
+	return Interaction{}, false
+}
+
+// append writes an interaction to the cassette file.
+func (c *Cassette) append(interaction Interaction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := json.Marshal(interaction)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record interaction: %v\n", err)
+		return
+	}
+	f, err := os.OpenFile(c.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record interaction: %v\n", err)
+		return
+	}
+	defer func() {
+		err := f.Close()
+		if err != nil {
+			fmt.Printf("failed to close cassette: %v\n", err)
+		}
+	}()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record interaction: %v\n", err)
+	}
+}
+
+// recordingBody copies a response body as it is read and records the interaction on Close.
+type recordingBody struct {
+	io.ReadCloser
+	cassette    *Cassette
+	interaction Interaction
+	buf         bytes.Buffer
+	once        sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.interaction.Response = b.buf.String()
+		b.cassette.append(b.interaction)
+	})
+	return err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// toolRoundTripServer answers the first turn with a read_file call for note.txt and the turn
+// after the tool result with an answer that quotes it.
+func toolRoundTripServer(t *testing.T, hits *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		var req APIRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		msg := Message{Role: "assistant"}
+		last := req.Messages[len(req.Messages)-1]
+		if last.Role == "tool" {
+			answer := "The note says: " + *last.Content
+			msg.Content = &answer
+		} else {
+			msg.ToolCalls = []ToolCall{{ID: "call_1", Type: "function", Function: FunctionCall{Name: "read_file", Arguments: `{"path":"note.txt"}`}}}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(APIResponse{Choices: []Choice{{Message: msg}}}); err != nil {
+			t.Errorf("encode response: %v", err)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// runToolRoundTrip asks about note.txt in dir, runs the read_file call the model makes and
+// returns the final answer. The system prompt carries the current time like the real one.
+func runToolRoundTrip(config *Config, dir, question string, now time.Time) (string, error) {
+	ctx := context.Background()
+	system := "You are an agent. Current time: " + now.Format(time.RFC3339)
+	messages := []Message{
+		{Role: "system", Content: &system},
+		{Role: "user", Content: &question},
+	}
+	req := APIRequest{Model: "test-model", Messages: messages, Tools: []Tool{{Type: "function", Function: FunctionDefinition{Name: "read_file"}}}}
+
+	resp, err := getProvider(config).ChatCompletion(ctx, config, req, nil)
+	if err != nil {
+		return "", err
+	}
+	call := resp.Choices[0].Message
+	if len(call.ToolCalls) != 1 {
+		return "", fmt.Errorf("got %d tool calls, want 1", len(call.ToolCalls))
+	}
+	toolCall := call.ToolCalls[0]
+	output, _, err := executeFileTool(ctx, config, nil, dir, toolCall.Function.Name, toolCall.Function.Arguments)
+	if err != nil {
+		return "", err
+	}
+
+	req.Messages = append(req.Messages, call, Message{Role: "tool", ToolCallID: toolCall.ID, Content: &output})
+	resp, err = getProvider(config).ChatCompletion(ctx, config, req, nil)
+	if err != nil {
+		return "", err
+	}
+	if resp.Choices[0].Message.Content == nil {
+		return "", fmt.Errorf("final response has no content")
+	}
+	return *resp.Choices[0].Message.Content, nil
+}
+
+// useCassette activates the cassette at path for the rest of the test.
+func useCassette(t *testing.T, path string, replay bool) *Cassette {
+	t.Helper()
+	cassette, err := openCassette(path, replay)
+	if err != nil {
+		t.Fatalf("openCassette: %v", err)
+	}
+	activeCassette = cassette
+	t.Cleanup(func() { activeCassette = nil })
+	return cassette
+}
+
+func TestCassetteReplaysToolRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "note.txt"), []byte("ship on Friday"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "run.cassette")
+	var hits atomic.Int32
+	srv := toolRoundTripServer(t, &hits)
+	config := &Config{Provider: "openai", APIURL: srv.URL, APIKey: "test-key"}
+	recordedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	question := "What does note.txt say?"
+
+	useCassette(t, path, false)
+	recorded, err := runToolRoundTrip(config, dir, question, recordedAt)
+	if err != nil {
+		t.Fatalf("recording: %v", err)
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("server got %d requests while recording, want 2", hits.Load())
+	}
+	srv.Close()
+
+	// The replay runs offline, later, and must match both requests by hash
+	cassette := useCassette(t, path, true)
+	if len(cassette.recorded) != 2 {
+		t.Fatalf("cassette holds %d interactions, want 2", len(cassette.recorded))
+	}
+	replayed, err := runToolRoundTrip(config, dir, question, recordedAt.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if replayed != recorded || !strings.Contains(replayed, "ship on Friday") {
+		t.Errorf("replayed answer %q, recorded %q", replayed, recorded)
+	}
+	for i, used := range cassette.used {
+		if !used {
+			t.Errorf("interaction %d was not replayed", i)
+		}
+	}
+
+	// A request that differs from the recording fails unless --replay-loose is given
+	useCassette(t, path, true)
+	_, err = runToolRoundTrip(config, dir, "What is in note.txt?", recordedAt)
+	if !errors.Is(err, errCassetteMiss) {
+		t.Errorf("changed request: err = %v, want a cassette miss", err)
+	}
+
+	useCassette(t, path, true).loose = true
+	replayed, err = runToolRoundTrip(config, dir, "What is in note.txt?", recordedAt)
+	if err != nil {
+		t.Fatalf("loose replay: %v", err)
+	}
+	if replayed != recorded {
+		t.Errorf("loose replay answer %q, want %q", replayed, recorded)
+	}
+}
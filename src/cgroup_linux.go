@@ -0,0 +1,187 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// cgroupFS is where the cgroup v2 hierarchy is mounted
+const cgroupFS = "/sys/fs/cgroup"
+
+var (
+	cgroupOnce    sync.Once
+	cgroupParent  string // cgroup the per-command cgroups are created in; empty if unavailable
+	cgroupMutex   sync.Mutex
+	cgroupCounter int
+)
+
+// commandCgroup is the cgroup v2 one command runs in. A nil *commandCgroup means limits are
+// enforced by rlimits only.
+type commandCgroup struct {
+	path string
+	dir  *os.File
+}
+
+// setupCgroupParent prepares agent-go's own cgroup for per-command child cgroups. Controllers
+// can only be enabled for children of a cgroup without processes, so when they aren't enabled
+// yet and agent-go is the only process in its cgroup, agent-go moves itself into a leaf named
+// "agent-go" below it and stays there for the rest of its run; tools that look up the cgroup of
+// agent-go's PID will see the leaf. If the controllers still can't be enabled, agent-go moves
+// back. Any failure (cgroup v1, no delegation, other processes in the cgroup) leaves cgroup
+// limits disabled, so rlimits are used instead.
+func setupCgroupParent() string {
+	if _, err := os.Stat(filepath.Join(cgroupFS, "cgroup.controllers")); err != nil {
+		return ""
+	}
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+	var own string
+	for _, line := range strings.Split(string(data), "\n") {
+		if rel, ok := strings.CutPrefix(line, "0::"); ok {
+			own = filepath.Join(cgroupFS, rel)
+		}
+	}
+	if own == "" {
+		return ""
+	}
+
+	controllers, err := os.ReadFile(filepath.Join(own, "cgroup.controllers"))
+	if err != nil || !strings.Contains(string(controllers), "memory") || !strings.Contains(string(controllers), "pids") {
+		return ""
+	}
+	subtree, _ := os.ReadFile(filepath.Join(own, "cgroup.subtree_control"))
+	if strings.Contains(string(subtree), "memory") && strings.Contains(string(subtree), "pids") {
+		return own
+	}
+
+	// With other processes in the cgroup, moving agent-go alone would not help
+	procs, err := os.ReadFile(filepath.Join(own, "cgroup.procs"))
+	if err != nil || strings.TrimSpace(string(procs)) != strconv.Itoa(os.Getpid()) {
+		return ""
+	}
+	leaf := filepath.Join(own, "agent-go")
+	if err := os.MkdirAll(leaf, 0755); err != nil {
+		return ""
+	}
+	if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		_ = os.Remove(leaf)
+		return ""
+	}
+	if err := os.WriteFile(filepath.Join(own, "cgroup.subtree_control"), []byte("+memory +pids"), 0644); err != nil {
+		if err := os.WriteFile(filepath.Join(own, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644); err == nil {
+			_ = os.Remove(leaf)
+		}
+		return ""
+	}
+	return own
+}
+
+// newCommandCgroup creates a cgroup with the memory and process limits and makes cmd start in
+// it. It returns nil when cgroup v2 is not usable.
+func newCommandCgroup(cmd *exec.Cmd, limits ResourceLimits) *commandCgroup {
+	cgroupOnce.Do(func() {
+		cgroupParent = setupCgroupParent()
+	})
+	if cgroupParent == "" {
+		return nil
+	}
+
+	cgroupMutex.Lock()
+	cgroupCounter++
+	path := filepath.Join(cgroupParent, fmt.Sprintf("agent-go-cmd-%d-%d", os.Getpid(), cgroupCounter))
+	cgroupMutex.Unlock()
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil
+	}
+
+	cg := &commandCgroup{path: path}
+	write := func(file, value string) error {
+		return os.WriteFile(filepath.Join(path, file), []byte(value), 0644)
+	}
+	if limits.MemoryMB > 0 {
+		if err := write("memory.max", strconv.FormatInt(int64(limits.MemoryMB)<<20, 10)); err != nil {
+			cg.remove()
+			return nil
+		}
+		_ = write("memory.swap.max", "0") // Absent without swap accounting
+	}
+	if limits.MaxProcesses > 0 {
+		if err := write("pids.max", strconv.Itoa(limits.MaxProcesses)); err != nil {
+			cg.remove()
+			return nil
+		}
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		cg.remove()
+		return nil
+	}
+	cg.dir = dir
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	return cg
+}
+
+// events reports whether the OOM killer ran in the cgroup and whether a fork failed because
+// of the process limit.
+func (cg *commandCgroup) events() (oom bool, pids bool) {
+	if cg == nil {
+		return false, false
+	}
+	return cgroupEventCount(filepath.Join(cg.path, "memory.events"), "oom_kill") > 0,
+		cgroupEventCount(filepath.Join(cg.path, "pids.events"), "max") > 0
+}
+
+// cgroupEventCount reads one counter from a cgroup events file.
+func cgroupEventCount(path, key string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			fmt.Printf("failed to close cgroup events: %v\n", err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+	return 0
+}
+
+// remove deletes the cgroup. It stays behind while processes the command left running are
+// still in it.
+func (cg *commandCgroup) remove() {
+	if cg == nil {
+		return
+	}
+	if cg.dir != nil {
+		if err := cg.dir.Close(); err != nil {
+			fmt.Printf("failed to close cgroup: %v\n", err)
+		}
+		cg.dir = nil
+	}
+	_ = os.Remove(cg.path)
+}
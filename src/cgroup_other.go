@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+// commandCgroup is unavailable outside Linux; limits are enforced by rlimits only.
+type commandCgroup struct{}
+
+func newCommandCgroup(cmd *exec.Cmd, limits ResourceLimits) *commandCgroup {
+	return nil
+}
+
+func (cg *commandCgroup) events() (oom bool, pids bool) {
+	return false, false
+}
+
+func (cg *commandCgroup) remove() {}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// APIErrorKind classifies provider failures so callers can decide how to react.
+type APIErrorKind string
+
+const (
+	APIErrorRateLimited   APIErrorKind = "rate_limited"
+	APIErrorServer        APIErrorKind = "server_error"
+	APIErrorAuth          APIErrorKind = "auth"
+	APIErrorContextLength APIErrorKind = "context_length"
+	APIErrorBadRequest    APIErrorKind = "bad_request"
+	APIErrorNetwork       APIErrorKind = "network"
+	APIErrorTimeout       APIErrorKind = "timeout"
+)
+
+// APIError is the typed error returned by LLMClient for every failed provider call.
+type APIError struct {
+	Kind       APIErrorKind
+	StatusCode int           // 0 for network-level failures
+	Message    string        // Short human-readable message extracted from the response
+	Body       string        // Raw response body (may be long)
+	RetryAfter time.Duration // Server-requested delay, if any
+	Retryable  bool
+	Attempts   int // Number of attempts made before giving up
+	Err        error
+}
+
+func (e *APIError) Error() string {
+	var b strings.Builder
+	switch e.Kind {
+	case APIErrorRateLimited:
+		b.WriteString("rate limited by provider")
+	case APIErrorServer:
+		b.WriteString("provider server error")
+	case APIErrorAuth:
+		b.WriteString("authentication failed (check your API key)")
+	case APIErrorContextLength:
+		b.WriteString("request exceeds the model context length")
+	case APIErrorTimeout:
+		b.WriteString("request timed out")
+	case APIErrorNetwork:
+		b.WriteString("network error")
+	default:
+		b.WriteString("API request failed")
+	}
+	if e.StatusCode != 0 {
+		b.WriteString(fmt.Sprintf(" (status %d)", e.StatusCode))
+	}
+	if e.Message != "" {
+		b.WriteString(": " + e.Message)
+	} else if e.Err != nil {
+		b.WriteString(": " + e.Err.Error())
+	}
+	if e.Attempts > 1 {
+		b.WriteString(fmt.Sprintf(" after %d attempts", e.Attempts))
+	}
+	return b.String()
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// asAPIError returns the *APIError wrapped in err, if any.
+func asAPIError(err error) (*APIError, bool) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr, true
+	}
+	return nil, false
+}
+
+// RetryNotice describes an upcoming retry; it is passed to LLMClient.OnRetry.
+type RetryNotice struct {
+	Err         *APIError
+	Attempt     int // The attempt that just failed (1-based)
+	MaxAttempts int
+	Wait        time.Duration
+}
+
+// LLMClient is the single HTTP client used for every provider call (chat, mini model,
+// compression and model listing). It applies timeouts and retries transient failures
+// with exponential backoff, honoring Retry-After.
+type LLMClient struct {
+	httpClient        *http.Client
+	requestTimeout    time.Duration
+	streamIdleTimeout time.Duration
+	maxRetries        int
+	baseDelay         time.Duration
+	maxDelay          time.Duration
+
+	// OnRetry is called before sleeping between attempts. Defaults to printing a notice to stderr.
+	OnRetry func(notice RetryNotice)
+}
+
+var (
+	transportsMu sync.Mutex
+	transports   = make(map[time.Duration]*http.Transport)
+)
+
+// transportFor returns a shared transport for the given connect timeout so that
+// connections are reused across calls.
+func transportFor(connectTimeout time.Duration) *http.Transport {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if t, ok := transports[connectTimeout]; ok {
+		return t
+	}
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   connectTimeout,
+		MaxIdleConns:          20,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	transports[connectTimeout] = t
+	return t
+}
+
+// newLLMClient creates a client using the timeout and retry settings from config.
+func newLLMClient(config *Config) *LLMClient {
+	connectTimeout := time.Duration(config.ConnectTimeout) * time.Second
+	if connectTimeout <= 0 {
+		connectTimeout = DefaultConnectTimeout * time.Second
+	}
+	requestTimeout := time.Duration(config.RequestTimeout) * time.Second
+	if requestTimeout <= 0 {
+		requestTimeout = DefaultRequestTimeout * time.Second
+	}
+	streamIdleTimeout := time.Duration(config.StreamIdleTimeout) * time.Second
+	if streamIdleTimeout <= 0 {
+		streamIdleTimeout = DefaultStreamIdleTimeout * time.Second
+	}
+	maxRetries := config.MaxRetries
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+
+	return &LLMClient{
+		httpClient:        &http.Client{Transport: wrapTransport(transportFor(connectTimeout))},
+		requestTimeout:    requestTimeout,
+		streamIdleTimeout: streamIdleTimeout,
+		maxRetries:        maxRetries,
+		baseDelay:         RetryBaseDelay,
+		maxDelay:          RetryMaxDelay,
+		OnRetry:           printRetryNotice,
+	}
+}
+
+// newQuietLLMClient creates a client for best-effort calls such as model listing and
+// capability probing: at most one silent retry, so startup isn't held up.
+func newQuietLLMClient(config *Config) *LLMClient {
+	client := newLLMClient(config)
+	client.maxRetries = 1
+	client.OnRetry = nil
+	return client
+}
+
+// printRetryNotice is the default OnRetry handler.
+func printRetryNotice(n RetryNotice) {
+	reason := "Request failed"
+	switch n.Err.Kind {
+	case APIErrorRateLimited:
+		reason = "Rate limited"
+	case APIErrorServer:
+		reason = "Provider error"
+	case APIErrorTimeout:
+		reason = "Request timed out"
+	case APIErrorNetwork:
+		reason = "Network error"
+	}
+	fmt.Fprintf(os.Stderr, "%s%s, retrying in %s (attempt %d/%d)...%s\n",
+		ColorYellow, reason, formatRetryWait(n.Wait), n.Attempt+1, n.MaxAttempts, ColorReset)
+}
+
+func formatRetryWait(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return fmt.Sprintf("%ds", int(d.Round(time.Second).Seconds()))
+}
+
+// postJSON marshals payload and POSTs it to url with retries.
+// When stream is true the request timeout only covers the wait for response headers; after
+// that, the stream fails once no data arrived for the stream idle timeout.
+func (c *LLMClient) postJSON(ctx context.Context, url string, headers map[string]string, payload any, stream bool) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	return c.do(ctx, http.MethodPost, url, headers, body, stream)
+}
+
+// get performs a GET request with retries.
+func (c *LLMClient) get(ctx context.Context, url string, headers map[string]string) (*http.Response, error) {
+	return c.do(ctx, http.MethodGet, url, headers, nil, false)
+}
+
+// do runs a request, retrying transient failures. The returned response always has
+// status 200; every other outcome is reported as an *APIError.
+func (c *LLMClient) do(ctx context.Context, method, url string, headers map[string]string, body []byte, stream bool) (*http.Response, error) {
+	maxAttempts := c.maxRetries + 1
+
+	for attempt := 1; ; attempt++ {
+		resp, apiErr := c.attempt(ctx, method, url, headers, body, stream)
+		if apiErr == nil {
+			return resp, nil
+		}
+		apiErr.Attempts = attempt
+
+		// Never retry when the caller cancelled.
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !apiErr.Retryable || attempt >= maxAttempts {
+			return nil, apiErr
+		}
+
+		wait := c.backoff(attempt, apiErr.RetryAfter)
+		if isReplaying() {
+			// Recorded retries are replayed in order; there's nothing to wait for
+			wait = 0
+		}
+		if c.OnRetry != nil {
+			c.OnRetry(RetryNotice{Err: apiErr, Attempt: attempt, MaxAttempts: maxAttempts, Wait: wait})
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// attempt performs a single HTTP round trip.
+func (c *LLMClient) attempt(parent context.Context, method, url string, headers map[string]string, body []byte, stream bool) (*http.Response, *APIError) {
+	ctx, cancel := context.WithCancel(parent)
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(c.requestTimeout, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, &APIError{Kind: APIErrorBadRequest, Err: fmt.Errorf("failed to create request: %w", err)}
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		if timedOut.Load() {
+			return nil, &APIError{Kind: APIErrorTimeout, Retryable: true, Err: fmt.Errorf("no response within %s", c.requestTimeout)}
+		}
+		if errors.Is(err, errCassetteMiss) {
+			return nil, &APIError{Kind: APIErrorBadRequest, Err: err}
+		}
+		return nil, &APIError{Kind: APIErrorNetwork, Retryable: parent.Err() == nil, Err: err}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		timer.Stop()
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		cancel()
+		return nil, classifyHTTPError(resp, bodyBytes)
+	}
+
+	if stream {
+		// Streams may legitimately run for a long time once they've started, but not stall
+		timer.Reset(c.streamIdleTimeout)
+		resp.Body = &idleTimeoutBody{ReadCloser: resp.Body, timer: timer, idle: c.streamIdleTimeout, timedOut: &timedOut}
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: func() {
+		timer.Stop()
+		cancel()
+	}}
+	return resp, nil
+}
+
+// idleTimeoutBody restarts the idle timer of a stream whenever data arrives. A read that
+// fails because the timer ran out is reported as an APIErrorTimeout.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timer    *time.Timer
+	idle     time.Duration
+	timedOut *atomic.Bool
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.timedOut.Load() {
+		b.timer.Reset(b.idle)
+	}
+	if err != nil && err != io.EOF && b.timedOut.Load() {
+		err = &APIError{Kind: APIErrorTimeout, Err: fmt.Errorf("stream stalled: no data for %s", b.idle)}
+	}
+	return n, err
+}
+
+// cancelOnClose releases the per-attempt context once the caller is done with the body.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// backoff computes the delay before the next attempt: Retry-After when the server
+// provided one, otherwise exponential backoff with jitter.
+func (c *LLMClient) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		if retryAfter > RetryAfterMaxDelay {
+			return RetryAfterMaxDelay
+		}
+		return retryAfter
+	}
+	delay := c.baseDelay << uint(attempt-1)
+	if delay <= 0 || delay > c.maxDelay {
+		delay = c.maxDelay
+	}
+	// Jitter in [delay/2, delay) so concurrent sub-agents don't retry in lockstep.
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// classifyHTTPError turns a non-200 response into an *APIError.
+func classifyHTTPError(resp *http.Response, body []byte) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		Message:    extractErrorMessage(body),
+		RetryAfter: parseRetryAfter(resp.Header),
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		apiErr.Kind = APIErrorRateLimited
+		apiErr.Retryable = true
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		apiErr.Kind = APIErrorAuth
+	case resp.StatusCode == http.StatusRequestTimeout:
+		apiErr.Kind = APIErrorTimeout
+		apiErr.Retryable = true
+	case resp.StatusCode >= 500:
+		// 529 is used by some providers for "overloaded"
+		apiErr.Kind = APIErrorServer
+		apiErr.Retryable = resp.StatusCode != http.StatusNotImplemented
+	case isContextLengthMessage(string(body)):
+		apiErr.Kind = APIErrorContextLength
+	default:
+		apiErr.Kind = APIErrorBadRequest
+	}
+	return apiErr
+}
+
+// extractErrorMessage pulls a short message out of common provider error bodies.
+func extractErrorMessage(body []byte) string {
+	var parsed struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+	}
+	if err := json.Unmarshal(body, &parsed); err == nil {
+		if len(parsed.Error) > 0 {
+			var nested struct {
+				Message string `json:"message"`
+			}
+			if json.Unmarshal(parsed.Error, &nested) == nil && nested.Message != "" {
+				return nested.Message
+			}
+			var plain string
+			if json.Unmarshal(parsed.Error, &plain) == nil && plain != "" {
+				return plain
+			}
+		}
+		if parsed.Message != "" {
+			return parsed.Message
+		}
+	}
+
+	msg := strings.TrimSpace(string(body))
+	if len(msg) > 200 {
+		msg = truncateUTF8(msg, 197) + "..."
+	}
+	return msg
+}
+
+func isContextLengthMessage(body string) bool {
+	lower := strings.ToLower(body)
+	for _, marker := range []string{"context_length_exceeded", "context length", "maximum context", "too many tokens", "prompt is too long"} {
+		if strings.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRetryAfter reads Retry-After (seconds or HTTP date) and retry-after-ms headers.
+func parseRetryAfter(h http.Header) time.Duration {
+	if ms := h.Get("retry-after-ms"); ms != "" {
+		if v, err := strconv.ParseFloat(ms, 64); err == nil && v > 0 {
+			return time.Duration(v * float64(time.Millisecond))
+		}
+	}
+	ra := h.Get("Retry-After")
+	if ra == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseFloat(ra, 64); err == nil && secs > 0 {
+		return time.Duration(secs * float64(time.Second))
+	}
+	if t, err := http.ParseTime(ra); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
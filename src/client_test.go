@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassifyHTTPError(t *testing.T) {
+	tests := []struct {
+		status        int
+		body          string
+		wantKind      APIErrorKind
+		wantRetryable bool
+	}{
+		{http.StatusTooManyRequests, `{"error":{"message":"slow down"}}`, APIErrorRateLimited, true},
+		{http.StatusUnauthorized, `{"error":{"message":"bad key"}}`, APIErrorAuth, false},
+		{http.StatusForbidden, `{"error":"forbidden"}`, APIErrorAuth, false},
+		{http.StatusRequestTimeout, ``, APIErrorTimeout, true},
+		{http.StatusInternalServerError, `oops`, APIErrorServer, true},
+		{http.StatusBadGateway, ``, APIErrorServer, true},
+		{529, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, APIErrorServer, true},
+		{http.StatusNotImplemented, ``, APIErrorServer, false},
+		{http.StatusBadRequest, `{"error":{"code":"context_length_exceeded","message":"too long"}}`, APIErrorContextLength, false},
+		{http.StatusBadRequest, `{"error":{"message":"prompt is too long: 300000 tokens > 200000 maximum"}}`, APIErrorContextLength, false},
+		{http.StatusBadRequest, `{"error":{"message":"invalid tool schema"}}`, APIErrorBadRequest, false},
+		{http.StatusNotFound, `{"message":"model not found"}`, APIErrorBadRequest, false},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+		err := classifyHTTPError(resp, []byte(tt.body))
+		if err.Kind != tt.wantKind || err.Retryable != tt.wantRetryable {
+			t.Errorf("status %d %s: kind %s retryable %v, want %s %v", tt.status, tt.body, err.Kind, err.Retryable, tt.wantKind, tt.wantRetryable)
+		}
+	}
+
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"7"}}}
+	if err := classifyHTTPError(resp, []byte(`{"error":{"message":"slow down"}}`)); err.RetryAfter != 7*time.Second || err.Message != "slow down" {
+		t.Errorf("retry after %s, message %q", err.RetryAfter, err.Message)
+	}
+}
+
+func TestExtractErrorMessage(t *testing.T) {
+	tests := []struct {
+		body, want string
+	}{
+		{`{"error":{"message":"nested"}}`, "nested"},
+		{`{"error":"plain"}`, "plain"},
+		{`{"message":"top level"}`, "top level"},
+		{"  Bad Gateway \n", "Bad Gateway"},
+	}
+	for _, tt := range tests {
+		if got := extractErrorMessage([]byte(tt.body)); got != tt.want {
+			t.Errorf("extractErrorMessage(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+	// Long bodies are cut without splitting a character
+	long := extractErrorMessage([]byte(strings.Repeat("é", 150)))
+	if !strings.HasSuffix(long, "...") || len(long) > 200 || !strings.HasPrefix(long, "é") || strings.ContainsRune(long, '�') {
+		t.Errorf("long message = %q", long)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	date := time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		header   http.Header
+		min, max time.Duration
+	}{
+		{http.Header{}, 0, 0},
+		{http.Header{"Retry-After": {"12"}}, 12 * time.Second, 12 * time.Second},
+		{http.Header{"Retry-After": {"1.5"}}, 1500 * time.Millisecond, 1500 * time.Millisecond},
+		{http.Header{"Retry-After": {"0"}}, 0, 0},
+		{http.Header{"Retry-After": {"soon"}}, 0, 0},
+		// An HTTP date is relative to now; the header has second precision
+		{http.Header{"Retry-After": {date}}, 28 * time.Second, 30 * time.Second},
+		{http.Header{"Retry-After": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, 0, 0},
+		// retry-after-ms takes precedence
+		{http.Header{"Retry-After-Ms": {"250"}, "Retry-After": {"12"}}, 250 * time.Millisecond, 250 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.header); got < tt.min || got > tt.max {
+			t.Errorf("parseRetryAfter(%v) = %s, want %s to %s", tt.header, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c := &LLMClient{baseDelay: time.Second, maxDelay: 8 * time.Second}
+	// Retry-After wins, up to RetryAfterMaxDelay
+	if got := c.backoff(1, 20*time.Second); got != 20*time.Second {
+		t.Errorf("backoff with Retry-After = %s, want 20s", got)
+	}
+	if got := c.backoff(1, time.Hour); got != RetryAfterMaxDelay {
+		t.Errorf("backoff with a long Retry-After = %s, want %s", got, RetryAfterMaxDelay)
+	}
+	// Otherwise the delay doubles per attempt up to maxDelay, with jitter in [delay/2, delay]
+	for attempt, delay := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 8 * time.Second, 10: 8 * time.Second, 80: 8 * time.Second} {
+		for range 20 {
+			if got := c.backoff(attempt, 0); got < delay/2 || got > delay {
+				t.Errorf("backoff(%d) = %s, want %s to %s", attempt, got, delay/2, delay)
+			}
+		}
+	}
+}
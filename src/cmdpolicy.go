@@ -0,0 +1,565 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Command policy actions. A matching deny rule beats ask, which beats allow.
+const (
+	PolicyAllow = "allow"
+	PolicyAsk   = "ask"
+	PolicyDeny  = "deny"
+)
+
+// CommandRule is one rule of a command policy. A rule matches a simple command (one element of
+// a pipeline or && / || / ; chain) by glob on its words, by regex on its text, or both.
+type CommandRule struct {
+	Action  string `json:"action"`            // allow, ask or deny
+	Command string `json:"command,omitempty"` // Glob over the words, e.g. "go test *"; * also matches spaces
+	Regex   string `json:"regex,omitempty"`   // Regular expression over the words joined by spaces
+	// OutsideWorkspace restricts the rule to commands with a path argument outside the workspace
+	OutsideWorkspace bool   `json:"outside_workspace,omitempty"`
+	Reason           string `json:"reason,omitempty"` // Shown to the user and returned to the model
+
+	source  string
+	pattern *regexp.Regexp
+}
+
+// CommandPolicy is the content of a policy.json file.
+type CommandPolicy struct {
+	Rules []CommandRule `json:"rules"`
+}
+
+// PolicyDecision is the outcome of checking a command against the policy. An empty Action means
+// no rule matched every part of the command, so the execution mode decides.
+type PolicyDecision struct {
+	Action string
+	Rule   *CommandRule
+	Part   string // The simple command that decided the outcome
+}
+
+// Describe explains the decision for the user and the model.
+func (d PolicyDecision) Describe() string {
+	if d.Rule == nil {
+		return ""
+	}
+	text := fmt.Sprintf("'%s' matches %s rule \"%s\" in %s", d.Part, d.Action, d.Rule.describe(), d.Rule.source)
+	if d.Rule.Reason != "" {
+		text += ": " + d.Rule.Reason
+	}
+	return text
+}
+
+// describe returns the pattern of the rule.
+func (r *CommandRule) describe() string {
+	if r.Command != "" {
+		return r.Command
+	}
+	return r.Regex
+}
+
+// Policy files are re-read when they change, so edits apply without a restart.
+var (
+	policyMu    sync.Mutex
+	policyCache = make(map[string]cachedPolicy)
+)
+
+type cachedPolicy struct {
+	modTime time.Time
+	hash    string // SHA-256 of the file content
+	rules   []CommandRule
+}
+
+// getGlobalPolicyPath returns the path to the user-wide command policy.
+func getGlobalPolicyPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "agent-go", "policy.json")
+}
+
+// getTrustedPoliciesPath returns the path to the list of trusted project policy files.
+func getTrustedPoliciesPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "agent-go", "trusted_policies.json")
+}
+
+// getProjectPolicyPath returns the path to the project's command policy.
+func getProjectPolicyPath() string {
+	cwd, _ := os.Getwd()
+	return filepath.Join(cwd, ".agent-go", "policy.json")
+}
+
+// loadCommandRules returns the rules of the global and project policies. The project policy
+// comes with the repository, so its allow rules, which skip the Ask mode prompt, only apply once
+// the user trusted the file; its ask and deny rules always apply.
+func loadCommandRules() []CommandRule {
+	rules := loadPolicyFile(getGlobalPolicyPath()).rules
+	project := loadPolicyFile(getProjectPolicyPath())
+	var allows []string
+	for _, rule := range project.rules {
+		if rule.Action == PolicyAllow {
+			allows = append(allows, rule.describe())
+		}
+	}
+	trusted := len(allows) == 0 || projectPolicyTrusted(getProjectPolicyPath(), project.hash, allows)
+	for _, rule := range project.rules {
+		if rule.Action != PolicyAllow || trusted {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// projectPolicyTrusted reports whether the allow rules of the project policy apply (see
+// projectFileTrusted).
+func projectPolicyTrusted(path, hash string, allows []string) bool {
+	return projectFileTrusted(projectFileTrust{
+		Path:      path,
+		Hash:      hash,
+		TrustPath: getTrustedPoliciesPath(),
+		Kind:      "rules",
+		Summary:   fmt.Sprintf("The project command policy in %s runs these commands without asking:", path),
+		Lines:     allows,
+		Untrusted: fmt.Sprintf("ignoring allow rules in %s", path),
+		Declined:  "Project allow rules will not apply in this session.",
+	})
+}
+
+// loadPolicyFile loads and validates one policy file, using the cached rules while it is unchanged.
+// An invalid file is reported once and ignored.
+func loadPolicyFile(path string) cachedPolicy {
+	info, err := os.Stat(path)
+	if err != nil {
+		return cachedPolicy{}
+	}
+
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	if cached, ok := policyCache[path]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cachedPolicy{}
+	}
+	sum := sha256.Sum256(data)
+	cached := cachedPolicy{modTime: info.ModTime(), hash: hex.EncodeToString(sum[:])}
+	cached.rules, err = parsePolicyFile(path, data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring command policy %s: %s\n", path, err)
+	}
+	policyCache[path] = cached
+	return cached
+}
+
+func parsePolicyFile(path string, data []byte) ([]CommandRule, error) {
+	var policy CommandPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, err
+	}
+
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		rule.source = path
+		switch rule.Action {
+		case PolicyAllow, PolicyAsk, PolicyDeny:
+		default:
+			return nil, fmt.Errorf("rule %d: action must be allow, ask or deny", i+1)
+		}
+		if rule.Command == "" && rule.Regex == "" {
+			return nil, fmt.Errorf("rule %d: command or regex is required", i+1)
+		}
+		if rule.Regex != "" {
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid regex: %w", i+1, err)
+			}
+			rule.pattern = re
+		}
+	}
+	return policy.Rules, nil
+}
+
+// evaluateCommandPolicy checks every simple command in command against the policy. Any denied
+// part denies the whole command and any part that must be asked about makes it ask; the command
+// is only allowed without asking if every part matches an allow rule. dir is the directory the
+// command runs in, which relative path arguments are resolved against.
+func evaluateCommandPolicy(command, dir string) PolicyDecision {
+	rules := loadCommandRules()
+	if len(rules) == 0 {
+		return PolicyDecision{}
+	}
+
+	var decision PolicyDecision
+	allAllowed := true
+	for _, argv := range parseShellCommands(command) {
+		part := evaluateSimpleCommand(argv, rules, dir)
+		// A cd changes where the rest of the command resolves relative paths
+		if filepath.Base(argv[0]) == "cd" {
+			dir = resolveCdTarget(dir, argv[1:])
+		}
+		if part.Action == "" {
+			allAllowed = false
+			continue
+		}
+		if policyRank(part.Action) > policyRank(decision.Action) {
+			decision = part
+		}
+	}
+	if decision.Action == PolicyAllow && !allAllowed {
+		return PolicyDecision{}
+	}
+	return decision
+}
+
+// evaluateSimpleCommand returns the most restrictive rule matching one simple command run in dir.
+func evaluateSimpleCommand(argv []string, rules []CommandRule, dir string) PolicyDecision {
+	text := strings.Join(argv, " ")
+	// Also match "rm -rf x" when the command was invoked as "/bin/rm -rf x"
+	short := strings.Join(append([]string{filepath.Base(argv[0])}, argv[1:]...), " ")
+
+	var decision PolicyDecision
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.matches(text) && !rule.matches(short) {
+			continue
+		}
+		if rule.OutsideWorkspace && !hasPathOutsideWorkspace(argv[1:], dir) {
+			continue
+		}
+		if policyRank(rule.Action) > policyRank(decision.Action) {
+			decision = PolicyDecision{Action: rule.Action, Rule: rule, Part: text}
+		}
+	}
+	return decision
+}
+
+func (r *CommandRule) matches(text string) bool {
+	if r.Command != "" && !matchCommandGlob(r.Command, text) {
+		return false
+	}
+	if r.pattern != nil && !r.pattern.MatchString(text) {
+		return false
+	}
+	return true
+}
+
+func policyRank(action string) int {
+	switch action {
+	case PolicyAllow:
+		return 1
+	case PolicyAsk:
+		return 2
+	case PolicyDeny:
+		return 3
+	}
+	return 0
+}
+
+// matchCommandGlob matches a command glob, where * matches any text (including spaces and
+// slashes) and ? any single character. A trailing " *" also matches no arguments, so "ls *"
+// matches "ls".
+func matchCommandGlob(glob, text string) bool {
+	glob = strings.Join(strings.Fields(glob), " ")
+	var b strings.Builder
+	b.WriteString("^")
+	for i, part := range strings.Split(glob, "*") {
+		if i > 0 {
+			b.WriteString(".*")
+		}
+		b.WriteString(strings.ReplaceAll(regexp.QuoteMeta(part), `\?`, "."))
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return false
+	}
+	if re.MatchString(text) {
+		return true
+	}
+	return strings.HasSuffix(glob, " *") && text == strings.TrimSuffix(glob, " *")
+}
+
+// resolveCdTarget returns the directory a cd with args changes to from dir. It returns "" when
+// that is not known, e.g. for "cd $X" or "cd -", or when it leaves the workspace: subshells and
+// pipelines are not told apart from a chain, so a directory outside the workspace is never
+// trusted to be left again.
+func resolveCdTarget(dir string, args []string) string {
+	if dir == "" {
+		return ""
+	}
+	var target string
+	for _, arg := range args {
+		if arg != "-" && strings.HasPrefix(arg, "-") {
+			continue // -L, -P
+		}
+		target = arg
+		break
+	}
+	home, _ := os.UserHomeDir()
+	switch {
+	case target == "" || target == "~":
+		target = home
+	case target == "-" || strings.Contains(target, "$") || strings.Contains(target, "`"):
+		return ""
+	case strings.HasPrefix(target, "~/"):
+		target = filepath.Join(home, target[2:])
+	case !filepath.IsAbs(target):
+		target = filepath.Join(dir, target)
+	}
+	rel, err := filepath.Rel(workspaceRoot(), filepath.Clean(target))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return filepath.Clean(target)
+}
+
+// hasPathOutsideWorkspace reports whether any non-flag argument names a path outside the
+// workspace root. Relative paths are resolved against dir, the directory the command runs in;
+// if that is not known (dir is empty), every relative path counts as outside. Arguments with
+// unexpanded variables can't be checked and count as outside either.
+func hasPathOutsideWorkspace(args []string, dir string) bool {
+	root := workspaceRoot()
+	home, _ := os.UserHomeDir()
+	for _, arg := range args {
+		if arg == "" || strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if strings.Contains(arg, "$") || strings.Contains(arg, "`") {
+			return true
+		}
+		path := arg
+		if path == "~" || strings.HasPrefix(path, "~/") {
+			path = filepath.Join(home, strings.TrimPrefix(path, "~"))
+		}
+		if !filepath.IsAbs(path) {
+			if dir == "" {
+				return true
+			}
+			path = filepath.Join(dir, path)
+		}
+		rel, err := filepath.Rel(root, filepath.Clean(path))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// shellKeywords are dropped from the start of a simple command so "if grep ..." is checked as grep.
+var shellKeywords = map[string]bool{
+	"if": true, "then": true, "else": true, "elif": true, "fi": true, "do": true, "done": true,
+	"while": true, "until": true, "!": true, "{": true, "}": true,
+}
+
+// commandWrappers run their arguments as a command; the wrapped command is what gets checked.
+var commandWrappers = map[string]bool{
+	"sudo": true, "env": true, "nohup": true, "nice": true, "time": true, "command": true, "exec": true,
+}
+
+var envAssignmentPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// parseShellCommands splits a shell command line into the argv of each simple command. Pipelines,
+// && / || / ; / & chains and subshells are split apart, quotes and escapes are removed,
+// redirections are dropped, and $(...), backtick and sh -c bodies are parsed as commands of
+// their own. It is not a full shell parser, but it sees through the usual ways of hiding a
+// command inside another.
+func parseShellCommands(command string) [][]string {
+	var commands [][]string
+	var argv []string
+	var word strings.Builder
+	inWord := false
+	skipRedirectTarget := false
+
+	endWord := func() {
+		if !inWord {
+			return
+		}
+		if skipRedirectTarget {
+			skipRedirectTarget = false
+		} else {
+			argv = append(argv, word.String())
+		}
+		word.Reset()
+		inWord = false
+	}
+	endCommand := func() {
+		endWord()
+		if cmd := normalizeArgv(argv); len(cmd) > 0 {
+			commands = append(commands, cmd)
+			// sh -c "..." runs its argument as a command line
+			if len(cmd) >= 3 && isShell(cmd[0]) && cmd[1] == "-c" {
+				commands = append(commands, parseShellCommands(cmd[2])...)
+			}
+		}
+		argv = nil
+	}
+
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '\\' && i+1 < len(runes):
+			i++
+			if runes[i] != '\n' {
+				word.WriteRune(runes[i])
+				inWord = true
+			}
+		case c == '\'':
+			end := indexRune(runes, i+1, '\'')
+			word.WriteString(string(runes[i+1 : end]))
+			inWord = true
+			i = end
+		case c == '"':
+			// Double quotes still expand $(...) and backticks
+			j := i + 1
+			for ; j < len(runes) && runes[j] != '"'; j++ {
+				switch {
+				case runes[j] == '\\' && j+1 < len(runes):
+					j++
+					word.WriteRune(runes[j])
+				case runes[j] == '$' && j+1 < len(runes) && runes[j+1] == '(':
+					end := matchingParen(runes, j+1)
+					commands = append(commands, parseShellCommands(string(runes[j+2:end]))...)
+					word.WriteString(string(runes[j:min(end+1, len(runes))]))
+					j = end
+				case runes[j] == '`':
+					end := indexRune(runes, j+1, '`')
+					commands = append(commands, parseShellCommands(string(runes[j+1:end]))...)
+					word.WriteString(string(runes[j:min(end+1, len(runes))]))
+					j = end
+				default:
+					word.WriteRune(runes[j])
+				}
+			}
+			inWord = true
+			i = j
+		case c == '$' && i+1 < len(runes) && runes[i+1] == '(':
+			end := matchingParen(runes, i+1)
+			commands = append(commands, parseShellCommands(string(runes[i+2:end]))...)
+			word.WriteString(string(runes[i:min(end+1, len(runes))]))
+			inWord = true
+			i = end
+		case c == '`':
+			end := indexRune(runes, i+1, '`')
+			commands = append(commands, parseShellCommands(string(runes[i+1:end]))...)
+			word.WriteString(string(runes[i:min(end+1, len(runes))]))
+			inWord = true
+			i = end
+		case c == '>' || c == '<':
+			// Drop a file descriptor number before the operator ("2>") and the target after it
+			if inWord && isDigits(word.String()) {
+				word.Reset()
+				inWord = false
+			}
+			endWord()
+			for i+1 < len(runes) && (runes[i+1] == '>' || runes[i+1] == '&' || runes[i+1] == '|') {
+				i++
+			}
+			// "2>&1" has its target attached
+			if i+1 < len(runes) && runes[i] == '&' && isDigitRune(runes[i+1]) {
+				for i+1 < len(runes) && isDigitRune(runes[i+1]) {
+					i++
+				}
+				continue
+			}
+			skipRedirectTarget = true
+		case c == '|' || c == '&' || c == ';' || c == '\n' || c == '(' || c == ')':
+			endCommand()
+		case c == ' ' || c == '\t':
+			endWord()
+		case c == '#' && !inWord:
+			// Comment until the end of the line
+			for i+1 < len(runes) && runes[i+1] != '\n' {
+				i++
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	endCommand()
+	return commands
+}
+
+// normalizeArgv strips leading keywords, variable assignments and wrapper commands.
+func normalizeArgv(argv []string) []string {
+	for len(argv) > 0 {
+		switch {
+		case shellKeywords[argv[0]], envAssignmentPattern.MatchString(argv[0]):
+			argv = argv[1:]
+		case commandWrappers[filepath.Base(argv[0])] && len(argv) > 1:
+			argv = argv[1:]
+			// Wrapper options, e.g. "sudo -u root" or "env -i"
+			for len(argv) > 1 && strings.HasPrefix(argv[0], "-") {
+				if argv[0] == "-u" && len(argv) > 2 {
+					argv = argv[1:]
+				}
+				argv = argv[1:]
+			}
+		default:
+			return argv
+		}
+	}
+	return nil
+}
+
+func isShell(name string) bool {
+	switch filepath.Base(name) {
+	case "sh", "bash", "zsh", "dash", "ksh":
+		return true
+	}
+	return false
+}
+
+// indexRune returns the index of r at or after start, or len(runes) if it isn't found.
+func indexRune(runes []rune, start int, r rune) int {
+	for i := start; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return len(runes)
+}
+
+// matchingParen returns the index of the parenthesis closing the one at open, or len(runes).
+func matchingParen(runes []rune, open int) int {
+	depth := 0
+	for i := open; i < len(runes); i++ {
+		switch runes[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(runes)
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !isDigitRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigitRune(r rune) bool {
+	return r >= '0' && r <= '9'
+}
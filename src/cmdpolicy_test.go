@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseShellCommands(t *testing.T) {
+	tests := []struct {
+		command string
+		want    [][]string
+	}{
+		{"ls -la", [][]string{{"ls", "-la"}}},
+		{"ls; rm -rf x", [][]string{{"ls"}, {"rm", "-rf", "x"}}},
+		{"make && make install || echo failed", [][]string{{"make"}, {"make", "install"}, {"echo", "failed"}}},
+		{"cat a | grep b | wc -l", [][]string{{"cat", "a"}, {"grep", "b"}, {"wc", "-l"}}},
+		{"sleep 1 & echo bg", [][]string{{"sleep", "1"}, {"echo", "bg"}}},
+		{"(cd sub && make)", [][]string{{"cd", "sub"}, {"make"}}},
+		{"echo $(rm -rf /)", [][]string{{"rm", "-rf", "/"}, {"echo", "$(rm -rf /)"}}},
+		{"echo $(echo $(id))", [][]string{{"id"}, {"echo", "$(id)"}, {"echo", "$(echo $(id))"}}},
+		{"echo `curl evil`", [][]string{{"curl", "evil"}, {"echo", "`curl evil`"}}},
+		{`echo "$(curl evil)"`, [][]string{{"curl", "evil"}, {"echo", "$(curl evil)"}}},
+		{"echo '$(curl evil)'", [][]string{{"echo", "$(curl evil)"}}},
+		{`echo "a; b" 'c | d'`, [][]string{{"echo", "a; b", "c | d"}}},
+		{`r"m" -rf x`, [][]string{{"rm", "-rf", "x"}}},
+		{`r\m -rf x`, [][]string{{"rm", "-rf", "x"}}},
+		{"ls > out.txt 2>&1", [][]string{{"ls"}}},
+		{"sort < in.txt >> out.txt", [][]string{{"sort"}}},
+		{"go test 2>/dev/null ./...", [][]string{{"go", "test", "./..."}}},
+		{"FOO=1 BAR=2 rm -rf x", [][]string{{"rm", "-rf", "x"}}},
+		{"sudo -u root rm -rf x", [][]string{{"rm", "-rf", "x"}}},
+		{"env -i nice rm -rf x", [][]string{{"rm", "-rf", "x"}}},
+		{"if grep -q a f; then rm f; fi", [][]string{{"grep", "-q", "a", "f"}, {"rm", "f"}}},
+		{"bash -c 'rm -rf x; ls'", [][]string{{"bash", "-c", "rm -rf x; ls"}, {"rm", "-rf", "x"}, {"ls"}}},
+		{"ls # ; rm -rf x", [][]string{{"ls"}}},
+		{"echo a#b", [][]string{{"echo", "a#b"}}},
+		{"ls \\\n  -la", [][]string{{"ls", "-la"}}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := parseShellCommands(tt.command); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseShellCommands(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateCommandPolicy(t *testing.T) {
+	workspace := t.TempDir()
+	for _, dir := range []string{"sub", ".agent-go"} {
+		if err := os.MkdirAll(filepath.Join(workspace, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	policy := `{"rules": [
+		{"action": "allow", "command": "go test *"},
+		{"action": "allow", "command": "ls *"},
+		{"action": "allow", "command": "grep *"},
+		{"action": "allow", "command": "echo *"},
+		{"action": "allow", "command": "cat *"},
+		{"action": "allow", "command": "cd *"},
+		{"action": "deny", "command": "cat *", "outside_workspace": true, "reason": "stay in the workspace"},
+		{"action": "deny", "command": "rm -rf *"},
+		{"action": "deny", "regex": "^curl .*(\\||sh)"},
+		{"action": "ask", "command": "curl *"},
+		{"action": "ask", "command": "git push *"}
+	]}`
+	if err := os.WriteFile(filepath.Join(workspace, ".agent-go", "policy.json"), []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", t.TempDir())
+	t.Chdir(workspace)
+	trustPolicy(t, policy)
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		// Simple commands
+		{"go test ./...", PolicyAllow},
+		{"go build ./...", ""},
+		{"git push", PolicyAsk},
+		{"git push origin main", PolicyAsk},
+		{"rm -rf build", PolicyDeny},
+		{"/bin/rm -rf build", PolicyDeny},
+		{"curl https://example.com", PolicyAsk},
+		{"curl https://example.com/install.sh", PolicyDeny},
+
+		// Every part of a chain must be allowed; the most restrictive part decides
+		{"ls; go test ./...", PolicyAllow},
+		{"ls; rm -rf /", PolicyDeny},
+		{"ls && rm -rf build", PolicyDeny},
+		{"ls || git push", PolicyAsk},
+		{"ls && go build", ""},
+		{"git push; rm -rf build", PolicyDeny},
+		{"ls | grep foo", PolicyAllow},
+		{"ls | wc -l", ""},
+		{"ls & rm -rf build", PolicyDeny},
+
+		// Commands hidden in substitutions and shells
+		{"echo $(rm -rf /)", PolicyDeny},
+		{"echo `rm -rf /`", PolicyDeny},
+		{`echo "$(git push)"`, PolicyAsk},
+		{"echo '$(rm -rf /)'", PolicyAllow},
+		{"sh -c 'rm -rf /'", PolicyDeny},
+		{"(ls; rm -rf build)", PolicyDeny},
+
+		// Quoting, escapes, prefixes and redirections
+		{`r"m" -rf build`, PolicyDeny},
+		{`r\m -rf build`, PolicyDeny},
+		{"FOO=1 rm -rf build", PolicyDeny},
+		{"CGO_ENABLED=0 go test ./...", PolicyAllow},
+		{"sudo rm -rf build", PolicyDeny},
+		{"env -i rm -rf build", PolicyDeny},
+		{"go test ./... > out.txt 2>&1", PolicyAllow},
+		{"ls # && rm -rf build", PolicyAllow},
+
+		// Paths outside the workspace, including after a cd
+		{"cat notes.txt", PolicyAllow},
+		{"cat /etc/passwd", PolicyDeny},
+		{"cat ../secret", PolicyDeny},
+		{"cat ~/.ssh/id_rsa", PolicyDeny},
+		{"cat $HOME/x", PolicyDeny},
+		{"cd sub && cat notes.txt", PolicyAllow},
+		{"cd sub && cat ../notes.txt", PolicyAllow},
+		{"cd .. && cat notes.txt", PolicyDeny},
+		{"cd /etc; cat passwd", PolicyDeny},
+		{"cd $DIR && cat notes.txt", PolicyDeny},
+	}
+	for _, tt := range tests {
+		decision := evaluateCommandPolicy(tt.command, workspace)
+		if decision.Action != tt.want {
+			t.Errorf("evaluateCommandPolicy(%q) = %q (%s), want %q", tt.command, decision.Action, decision.Describe(), tt.want)
+		}
+	}
+
+	// A command run from outside the workspace resolves relative paths there
+	if decision := evaluateCommandPolicy("cat notes.txt", filepath.Dir(workspace)); decision.Action != PolicyDeny {
+		t.Errorf("cat from outside the workspace = %q, want deny", decision.Action)
+	}
+	if decision := evaluateCommandPolicy("cat /etc/passwd", workspace); decision.Describe() == "" || decision.Part != "cat /etc/passwd" {
+		t.Errorf("deny decision = %+v, want the rule and part", decision)
+	}
+}
+
+func TestProjectPolicyAllowNeedsTrust(t *testing.T) {
+	workspace := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(workspace, ".agent-go"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	policy := `{"rules": [
+		{"action": "allow", "command": "*"},
+		{"action": "deny", "command": "rm *"}
+	]}`
+	if err := os.WriteFile(filepath.Join(workspace, ".agent-go", "policy.json"), []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", t.TempDir())
+	t.Chdir(workspace)
+	// Without a terminal, an untrusted file isn't asked about
+	defer func(mode bool) { pipelineMode = mode }(pipelineMode)
+	pipelineMode = true
+
+	if decision := evaluateCommandPolicy("curl https://example.com", workspace); decision.Action != "" {
+		t.Errorf("untrusted allow rule = %q, want no decision", decision.Action)
+	}
+	if decision := evaluateCommandPolicy("rm -rf x", workspace); decision.Action != PolicyDeny {
+		t.Errorf("untrusted deny rule = %q, want deny", decision.Action)
+	}
+
+	trustPolicy(t, policy)
+	if decision := evaluateCommandPolicy("curl https://example.com", workspace); decision.Action != PolicyAllow {
+		t.Errorf("trusted allow rule = %q, want allow", decision.Action)
+	}
+}
+
+// trustPolicy marks the project policy content as trusted in the current HOME.
+func trustPolicy(t *testing.T, policy string) {
+	t.Helper()
+	sum := sha256.Sum256([]byte(policy))
+	data, _ := json.Marshal(map[string]string{hex.EncodeToString(sum[:]): getProjectPolicyPath()})
+	if err := os.MkdirAll(filepath.Dir(getTrustedPoliciesPath()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(getTrustedPoliciesPath(), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	projectTrustMu.Lock()
+	projectTrust = make(map[string]bool)
+	projectTrustMu.Unlock()
+}
+
+func TestMatchCommandGlob(t *testing.T) {
+	tests := []struct {
+		glob, text string
+		want       bool
+	}{
+		{"ls *", "ls", true},
+		{"ls *", "ls -la /tmp", true},
+		{"ls *", "lsof", false},
+		{"go test *", "go  test", false},
+		{"go   test *", "go test ./...", true},
+		{"git ?ush *", "git push origin", true},
+		{"rm -rf *", "rm -r x", false},
+		// Globs see one simple command; evaluateCommandPolicy splits chains before matching
+		{"npm run *", "npm run build && rm -rf /", true},
+		{"a.b", "axb", false},
+	}
+	for _, tt := range tests {
+		if got := matchCommandGlob(tt.glob, tt.text); got != tt.want {
+			t.Errorf("matchCommandGlob(%q, %q) = %v, want %v", tt.glob, tt.text, got, tt.want)
+		}
+	}
+}
@@ -1,10 +1,8 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -22,49 +20,11 @@ type ModelListResponse struct {
 
 // fetchAvailableModels retrieves the list of available models from the provider's API.
 func fetchAvailableModels(config *Config) ([]string, error) {
-	if config.APIURL == "" || config.APIKey == "" {
+	if config.APIURL == "" || missingAPIKey(config) {
 		return nil, fmt.Errorf("API URL or API Key not configured")
 	}
 
-	// Construct the request for an OpenAI-compatible models endpoint.
-	url := strings.TrimSuffix(config.APIURL, "/") + "/v1/models"
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("could not create request: %w", err)
-	}
-	req.Header.Set("Authorization", "Bearer "+config.APIKey)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("could not send request to %s: %w", url, err)
-	}
-	defer func() {
-		err := resp.Body.Close()
-		if err != nil {
-			fmt.Printf("failed to close response body: %v\n", err)
-		}
-	}()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to fetch models, status: %s", resp.Status)
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("could not read response body: %w", err)
-	}
-
-	var modelList ModelListResponse
-	if err := json.Unmarshal(body, &modelList); err != nil {
-		return nil, fmt.Errorf("could not unmarshal models response: %w", err)
-	}
-
-	var models []string
-	for _, model := range modelList.Data {
-		models = append(models, model.ID)
-	}
-	return models, nil
+	return getProvider(config).ListModels(context.Background(), config)
 }
 
 // AgentCompleter handles both slash commands and @filename completion
@@ -203,6 +163,12 @@ func buildCompleter(config *Config) readline.AutoCompleter {
 		}
 	}
 
+	// Prepare profile name completions for /profile use|rm
+	profileNameCompleters := make([]readline.PrefixCompleterInterface, 0)
+	for _, name := range listProfileNames(config) {
+		profileNameCompleters = append(profileNameCompleters, readline.PcItem(name))
+	}
+
 	var slashCompleter = readline.NewPrefixCompleter(
 		readline.PcItem("/help"),
 		readline.PcItem("/?"),
@@ -211,12 +177,24 @@ func buildCompleter(config *Config) readline.AutoCompleter {
 		readline.PcItem("/edit"),
 		readline.PcItem("/model",
 			append(modelCompleters,
-				readline.PcItem("mini", modelCompleters...))...,
+				readline.PcItem("mini", modelCompleters...),
+				readline.PcItem("pull"))...,
 		),
 		readline.PcItem("/provider",
+			readline.PcItem("openai"),
+			readline.PcItem("anthropic"),
+			readline.PcItem("ollama"),
+			readline.PcItem("llamacpp"),
 			readline.PcItem("https://"),
 			readline.PcItem("http://"),
 		),
+		readline.PcItem("/profile",
+			readline.PcItem("list"),
+			readline.PcItem("use", profileNameCompleters...),
+			readline.PcItem("add"),
+			readline.PcItem("clear"),
+			readline.PcItem("rm", profileNameCompleters...),
+		),
 		readline.PcItem("/config"),
 		readline.PcItem("/rag",
 			readline.PcItem("on"),
@@ -265,10 +243,23 @@ func buildCompleter(config *Config) readline.AutoCompleter {
 				readline.PcItem("1"),
 				readline.PcItem("2"),
 			),
+			readline.PcItem("depth",
+				readline.PcItem("1"),
+				readline.PcItem("2"),
+				readline.PcItem("3"),
+			),
+			readline.PcItem("tree"),
 		),
 		readline.PcItem("/shell"),
+		readline.PcItem("/cwd",
+			readline.PcItem("reset"),
+		),
 		readline.PcItem("/security"),
 		readline.PcItem("/cost"),
+		readline.PcItem("/stream",
+			readline.PcItem("on"),
+			readline.PcItem("off"),
+		),
 		readline.PcItem("/usage",
 			readline.PcItem("1"),
 			readline.PcItem("2"),
@@ -10,6 +10,7 @@ import (
 
 func loadConfig() *Config {
 	config := &Config{
+		Provider:              DefaultProvider,
 		Temp:                  DefaultTemp,
 		MaxTokens:             DefaultMaxTokens,
 		APIURL:                DefaultAPIURL,
@@ -21,9 +22,21 @@ func loadConfig() *Config {
 		AutoCompressThreshold: DefaultAutoCompressThreshold,
 		ModelContextLength:    DefaultModelContextLength,
 		SubagentsEnabled:      true,
+		MaxParallelSubAgents:  DefaultMaxParallelSubAgents,
+		MaxSubAgentDepth:      DefaultMaxSubAgentDepth,
+		MaxSubAgentIterations: MaxSubAgentIterations,
 		ExecutionMode:         Ask,
 		OperationMode:         Build,
 		UsageVerboseMode:      UsageSilent,
+		Stream:                true,
+		ConnectTimeout:        DefaultConnectTimeout,
+		RequestTimeout:        DefaultRequestTimeout,
+		StreamIdleTimeout:     DefaultStreamIdleTimeout,
+		MaxRetries:            DefaultMaxRetries,
+		BudgetWarnPercent:     DefaultBudgetWarnPercent,
+		CommandTimeout:        DefaultCommandTimeout,
+		MaxCommandTimeout:     DefaultMaxCommandTimeout,
+		MaxCommandOutput:      DefaultMaxCommandOutput,
 	}
 	config.MCPs = make(map[string]MCPServer)
 
@@ -70,8 +83,26 @@ func loadConfig() *Config {
 		config.Skills = skills
 	}
 
+	// Overlay the active profile before env vars, so env vars still override everything
+	if name := os.Getenv("AGENT_GO_PROFILE"); name != "" && name != config.ActiveProfile {
+		savedActiveProfile = config.ActiveProfile
+		envProfile = true
+		config.ActiveProfile = name
+	}
+	if config.ActiveProfile != "" {
+		if err := activateProfile(config, config.ActiveProfile); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to activate profile: %v\n", err)
+			config.ActiveProfile = ""
+		}
+	}
+
+	if provider := os.Getenv("PROVIDER"); provider != "" {
+		config.Provider = provider
+	}
 	if key := os.Getenv("OPENAI_KEY"); key != "" {
 		config.APIKey = key
+	} else if key := os.Getenv("ANTHROPIC_API_KEY"); key != "" && config.Provider == "anthropic" {
+		config.APIKey = key
 	}
 	if url := os.Getenv("OPENAI_BASE"); url != "" {
 		config.APIURL = url
@@ -109,6 +140,44 @@ func loadConfig() *Config {
 	if subagents := os.Getenv("SUBAGENTS_ENABLED"); subagents == "0" || subagents == "false" {
 		config.SubagentsEnabled = false
 	}
+	if maxParallel := os.Getenv("MAX_PARALLEL_SUBAGENTS"); maxParallel != "" {
+		if val, err := strconv.Atoi(maxParallel); err == nil && val > 0 {
+			config.MaxParallelSubAgents = val
+		}
+	}
+	if maxDepth := os.Getenv("MAX_SUBAGENT_DEPTH"); maxDepth != "" {
+		if val, err := strconv.Atoi(maxDepth); err == nil && val > 0 {
+			config.MaxSubAgentDepth = val
+		}
+	}
+	if maxIterations := os.Getenv("MAX_SUBAGENT_ITERATIONS"); maxIterations != "" {
+		if val, err := strconv.Atoi(maxIterations); err == nil && val > 0 {
+			config.MaxSubAgentIterations = val
+		}
+	}
+	if stream := os.Getenv("STREAM"); stream == "0" || stream == "false" {
+		config.Stream = false
+	}
+	if requestTimeout := os.Getenv("REQUEST_TIMEOUT"); requestTimeout != "" {
+		if val, err := strconv.Atoi(requestTimeout); err == nil && val > 0 {
+			config.RequestTimeout = val
+		}
+	}
+	if idleTimeout := os.Getenv("STREAM_IDLE_TIMEOUT"); idleTimeout != "" {
+		if val, err := strconv.Atoi(idleTimeout); err == nil && val > 0 {
+			config.StreamIdleTimeout = val
+		}
+	}
+	if commandTimeout := os.Getenv("COMMAND_TIMEOUT"); commandTimeout != "" {
+		if val, err := strconv.Atoi(commandTimeout); err == nil && val > 0 {
+			config.CommandTimeout = val
+		}
+	}
+	if maxRetries := os.Getenv("MAX_RETRIES"); maxRetries != "" {
+		if val, err := strconv.Atoi(maxRetries); err == nil && val >= 0 {
+			config.MaxRetries = val
+		}
+	}
 	if executionMode := os.Getenv("EXECUTION_MODE"); executionMode != "" {
 		if executionMode == "yolo" {
 			config.ExecutionMode = YOLO
@@ -123,6 +192,12 @@ func loadConfig() *Config {
 			config.OperationMode = Build
 		}
 	}
+	if sandbox := os.Getenv("AGENT_GO_SANDBOX"); sandbox != "" {
+		config.Sandbox.Mode = sandbox
+	}
+	if err := validateSandboxMode(config.Sandbox.Mode); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s; commands will not run until it is fixed\n", err)
+	}
 
 	return config
 }
@@ -137,6 +212,15 @@ func saveConfig(config *Config) error {
 		return err
 	}
 	configPath := filepath.Join(configDir, "config.json")
+
+	// Don't persist a context length that was filled in from model metadata
+	if autoContextLength != 0 && config.ModelContextLength == autoContextLength {
+		saved := *config
+		saved.ModelContextLength = configuredContextLength
+		config = &saved
+	}
+	config = configForSave(config)
+
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return err
@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 // ANSI color codes for terminal output - these are now variables that can be disabled
 var (
 	ColorRed           = "\033[31m"
@@ -34,7 +36,41 @@ const (
 
 // Sub-agent limits
 const (
+	// MaxSubAgentIterations is how many steps a sub-agent may take when max_subagent_iterations is unset
 	MaxSubAgentIterations = 50
+
+	// MaxSubAgentSchemaRetries is how often a sub-agent may retry a final message that does not match its output_schema
+	MaxSubAgentSchemaRetries = 2
+
+	// DefaultMaxParallelSubAgents is how many sub-agents may run at once when max_parallel_subagents is unset
+	DefaultMaxParallelSubAgents = 4
+
+	// DefaultMaxSubAgentDepth is how deep sub-agents may be nested when max_subagent_depth is unset
+	DefaultMaxSubAgentDepth = 2
+
+	// MaxSubAgentTreeRoots is how many finished sub-agent trees /subagents tree keeps
+	MaxSubAgentTreeRoots = 20
+
+	// SubAgentProgressInterval is how often the status view of parallel sub-agents is redrawn
+	SubAgentProgressInterval = 200 * time.Millisecond
+)
+
+// read_file limits
+const (
+	MaxReadFileLines      = 2000       // Lines returned when no line range is given
+	MaxReadFileLineLength = 2000       // Bytes; longer lines are cut
+	MaxReadFileBytes      = 128 * 1024 // Bytes returned at most, even for an explicit line range
+	MaxReadFileSize       = 16 << 20   // Bytes; larger files are refused
+)
+
+// Search tool limits
+const (
+	DefaultSearchMaxResults = 100
+	MaxSearchResults        = 1000
+	MaxSearchContextLines   = 10
+	MaxSearchFileSize       = 2 * 1024 * 1024 // Larger files are skipped
+	MaxSearchLineLength     = 300             // Longer matching lines are truncated
+	MaxListFiles            = 1000
 )
 
 // Tool loop detection
@@ -47,16 +83,96 @@ const (
 	ToolLoopStopMessage = "STOP: You appear to be stuck in a loop, repeatedly calling the same tool. Please step back, analyze what you've tried so far, and try a completely different approach to solve this task. If you cannot complete the task, explain what's blocking you."
 )
 
+// Interrupt handling
+const (
+	// InterruptExitWindow is how soon a second Ctrl+C must follow the first to exit agent-go
+	InterruptExitWindow = 2 * time.Second
+
+	// ProcessWaitDelay bounds how long a cancelled command may keep its output pipes open
+	ProcessWaitDelay = 2 * time.Second
+
+	// CancelledToolResult is the tool result recorded for tool calls interrupted by the user
+	CancelledToolResult = "Tool call cancelled by user."
+)
+
+// DefaultFallbackOn lists the error kinds that trigger a model fallback when fallback_on is unset.
+// Auth and bad request errors are excluded because another model would most likely fail the same way.
+var DefaultFallbackOn = []string{
+	string(APIErrorServer),
+	string(APIErrorRateLimited),
+	string(APIErrorTimeout),
+	string(APIErrorNetwork),
+	string(APIErrorContextLength),
+}
+
+// ProfileKeyCommandTimeout bounds how long a profile's api_key_command may run
+const ProfileKeyCommandTimeout = 60 * time.Second
+
 // Default configuration values
 const (
 	DefaultTemp                  = 0.1
 	DefaultMaxTokens             = 32768
+	DefaultProvider              = "openai"
 	DefaultAPIURL                = "https://api.openai.com"
+	DefaultAnthropicAPIURL       = "https://api.anthropic.com"
+	DefaultAnthropicMaxTokens    = 8192
+	AnthropicAPIVersion          = "2023-06-01"
+	DefaultOllamaURL             = "http://localhost:11434"
+	DefaultLlamaCppURL           = "http://localhost:8080"
 	DefaultModel                 = "gpt-3.5-turbo"
 	DefaultMiniModel             = "gpt-4o-mini"
 	DefaultRAGSnippets           = 5
 	DefaultAutoCompressThreshold = 20
 	DefaultModelContextLength    = 262144
+	DefaultConnectTimeout        = 30  // seconds
+	DefaultRequestTimeout        = 300 // seconds
+	DefaultStreamIdleTimeout     = 120 // seconds
+	DefaultMaxRetries            = 4
+	DefaultBudgetWarnPercent     = 80
+	DefaultCommandTimeout        = 120   // seconds
+	DefaultMaxCommandTimeout     = 600   // seconds
+	DefaultMaxCommandOutput      = 32768 // bytes
+)
+
+// Background processes
+const (
+	// BackgroundLogBufferSize is how much recent output of a background process is kept in memory
+	BackgroundLogBufferSize = 64 * 1024
+
+	// BackgroundLogFileSize is the size at which a background log file is rotated. The current
+	// and one previous file are kept, so at most twice this much output is on disk per process.
+	BackgroundLogFileSize = 8 * 1024 * 1024
+
+	// BackgroundLogTailLines is how many lines get_background_logs returns by default
+	BackgroundLogTailLines = 100
+
+	// BackgroundPollInterval is how often background processes are checked for output, readiness and exit
+	BackgroundPollInterval = 250 * time.Millisecond
+
+	// DefaultBackgroundReadyTimeout is how long starting a background command waits for it to become ready
+	DefaultBackgroundReadyTimeout = 60 * time.Second
+
+	// DefaultBackgroundMaxRestarts is how often a background process is restarted when max_restarts is unset
+	DefaultBackgroundMaxRestarts = 3
+
+	// MaxFinishedBackgroundProcesses is how many finished background processes are kept for their logs
+	MaxFinishedBackgroundProcesses = 20
+)
+
+// Hooks
+const (
+	// DefaultHookTimeout is how long a hook may run when its timeout is unset
+	DefaultHookTimeout = 60 * time.Second
+
+	// MaxStopHookContinuations is how often Stop hooks may send the agent back to work in one turn
+	MaxStopHookContinuations = 3
+)
+
+// Provider retry settings
+const (
+	RetryBaseDelay     = 1 * time.Second
+	RetryMaxDelay      = 60 * time.Second
+	RetryAfterMaxDelay = 5 * time.Minute // Upper bound for server-requested Retry-After delays
 )
 
 // Valid todo statuses
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// DiffContextLines is the number of unchanged lines shown around each change
+const DiffContextLines = 3
+
+// maxDiffCells bounds the size of the LCS table; larger changes are shown as one replaced block
+const maxDiffCells = 4_000_000
+
+// diffOp is one line of a line-based diff: ' ' unchanged, '-' removed or '+' added.
+type diffOp struct {
+	kind byte
+	text string
+	oldN int // 1-based line number in the old text (unchanged and removed lines)
+	newN int // 1-based line number in the new text (unchanged and added lines)
+}
+
+// splitLines splits text into lines without their terminators. A trailing newline does not
+// produce an empty last line.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+// diffLines computes a line diff of a and b using the longest common subsequence of the part
+// between their common prefix and suffix.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	oldN, newN := 1, 1
+	keep := func(text string) {
+		ops = append(ops, diffOp{' ', text, oldN, newN})
+		oldN++
+		newN++
+	}
+	remove := func(text string) {
+		ops = append(ops, diffOp{'-', text, oldN, 0})
+		oldN++
+	}
+	add := func(text string) {
+		ops = append(ops, diffOp{'+', text, 0, newN})
+		newN++
+	}
+
+	for _, line := range a[:prefix] {
+		keep(line)
+	}
+
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(midA)*len(midB) > maxDiffCells {
+		for _, line := range midA {
+			remove(line)
+		}
+		for _, line := range midB {
+			add(line)
+		}
+	} else {
+		// lcs[i][j] is the LCS length of midA[i:] and midB[j:]
+		lcs := make([][]int, len(midA)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(midB)+1)
+		}
+		for i := len(midA) - 1; i >= 0; i-- {
+			for j := len(midB) - 1; j >= 0; j-- {
+				if midA[i] == midB[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(midA) || j < len(midB) {
+			switch {
+			case i < len(midA) && j < len(midB) && midA[i] == midB[j]:
+				keep(midA[i])
+				i++
+				j++
+			case i < len(midA) && (j == len(midB) || lcs[i+1][j] >= lcs[i][j+1]):
+				remove(midA[i])
+				i++
+			default:
+				add(midB[j])
+				j++
+			}
+		}
+	}
+
+	for _, line := range a[len(a)-suffix:] {
+		keep(line)
+	}
+	return ops
+}
+
+// unifiedDiff renders the changes from oldText to newText as a unified diff of path. With
+// isNew the old side is shown as /dev/null. It returns "" if the texts have the same lines.
+func unifiedDiff(path, oldText, newText string, isNew bool) string {
+	ops := diffLines(splitLines(oldText), splitLines(newText))
+	label := strings.TrimPrefix(filepath.ToSlash(path), "/")
+
+	var b strings.Builder
+	for start := 0; start < len(ops); {
+		// Find the next change
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+
+		// Extend the hunk while changes are separated by at most 2*DiffContextLines unchanged lines
+		from := max(start-DiffContextLines, 0)
+		end := start
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*DiffContextLines {
+				break
+			}
+			end = run
+		}
+		to := min(end+DiffContextLines, len(ops))
+
+		if b.Len() == 0 {
+			if isNew {
+				b.WriteString("--- /dev/null\n")
+			} else {
+				b.WriteString(fmt.Sprintf("--- a/%s\n", label))
+			}
+			b.WriteString(fmt.Sprintf("+++ b/%s\n", label))
+		}
+		b.WriteString(formatHunkHeader(ops[from:to]))
+		for _, op := range ops[from:to] {
+			b.WriteString(string(op.kind) + op.text + "\n")
+		}
+		start = to
+	}
+	return b.String()
+}
+
+// formatHunkHeader returns the "@@ -l,n +l,n @@" line for a hunk.
+func formatHunkHeader(ops []diffOp) string {
+	oldStart, newStart, oldCount, newCount := 0, 0, 0, 0
+	for _, op := range ops {
+		if op.kind != '+' {
+			if oldStart == 0 {
+				oldStart = op.oldN
+			}
+			oldCount++
+		}
+		if op.kind != '-' {
+			if newStart == 0 {
+				newStart = op.newN
+			}
+			newCount++
+		}
+	}
+	// A side is only empty when that whole file is empty; diff -u numbers it from 0
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+}
+
+// colorizeDiff colors removed lines red, added lines green and hunk headers as metadata.
+func colorizeDiff(diff string) string {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+			b.WriteString(StyleBold + strings.TrimSuffix(line, "\n") + ColorReset + "\n")
+		case strings.HasPrefix(line, "@@"):
+			b.WriteString(ColorCyan + strings.TrimSuffix(line, "\n") + ColorReset + "\n")
+		case strings.HasPrefix(line, "+"):
+			b.WriteString(ColorGreen + strings.TrimSuffix(line, "\n") + ColorReset + "\n")
+		case strings.HasPrefix(line, "-"):
+			b.WriteString(ColorRed + strings.TrimSuffix(line, "\n") + ColorReset + "\n")
+		default:
+			b.WriteString(line)
+		}
+	}
+	return b.String()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -13,255 +14,306 @@ import (
 
 var executionMutex sync.Mutex
 
-type BackgroundProcess struct {
-	PID       int
-	Command   string
-	StartTime time.Time
-	Cmd       *exec.Cmd
-	Output    *bytes.Buffer
-}
-
-var (
-	backgroundProcesses = make(map[int]*BackgroundProcess)
-	bgMutex             sync.Mutex
-	processIDCounter    = 1
-)
-
 // confirmAndExecute checks the execution mode and prompts for confirmation if necessary.
 //
 // Background execution is not agent-controlled. In Ask mode, the user can choose to run the
-// command in the foreground or start it as a background process.
-func confirmAndExecute(config *Config, command string) (string, error) {
+// command in the foreground or start it as a background process. The command policy (see
+// evaluateCommandPolicy) is applied first: denied commands never run, "ask" rules prompt even
+// in YOLO mode, and commands allowed by policy run without asking. timeoutSeconds overrides
+// the configured command timeout for foreground runs (0 uses the default), and bg how a
+// background run is supervised. Commands run in the shell session of agentID (see ShellSession)
+// and in the sandbox of agentDef, if any.
+func confirmAndExecute(ctx context.Context, config *Config, agentDef *AgentDefinition, agentID, command string, timeoutSeconds int, bg BackgroundOptions) (string, error) {
 	// Check operation mode first
 	if config.OperationMode == Plan {
 		return "", fmt.Errorf("command execution is blocked in Plan mode. Switch to Build mode to execute commands")
 	}
 
+	// The command policy can deny a command outright, or decide whether to ask regardless of the execution mode
+	decision := evaluateCommandPolicy(command, getShellDir(agentID))
+	if decision.Action == PolicyDeny {
+		return "", fmt.Errorf("command denied by policy: %s", decision.Describe())
+	}
+
 	// In pipeline mode, skip all prompts and execute directly
 	if pipelineMode {
-		return executeCommandSilent(command)
+		if decision.Action == PolicyAsk {
+			return "", fmt.Errorf("command requires approval by policy, which is not possible in pipeline mode: %s", decision.Describe())
+		}
+		return executeCommandSilent(ctx, config, agentDef, agentID, command, timeoutSeconds)
 	}
 
-	// We need to lock here because multiple sub-agents might try to execute commands
-	// or ask for confirmation simultaneously, which would mess up the console I/O.
-	executionMutex.Lock()
-	defer executionMutex.Unlock()
-
-	if config.ExecutionMode == Ask {
+	// A PreToolUse hook's approval counts like an allow rule, but not against an ask rule
+	if decision.Action == PolicyAsk || (config.ExecutionMode == Ask && decision.Action != PolicyAllow && !hookApproved(ctx)) {
+		// Sub-agents running in parallel may ask at the same time, so only one prompt holds
+		// the console at once. The command itself runs after the console is released.
+		lockConsole()
+		if decision.Action == PolicyAsk {
+			fmt.Printf("%sPolicy requires approval: %s%s\n", ColorYellow, decision.Describe(), ColorReset)
+		}
 		// The command is already printed as part of the tool call, so we just ask for confirmation.
 		fmt.Printf("%s$ %s%s\n%s?%s Execute? [y=foreground/b=background/a=all/N]: ", ColorCyan, command, ColorReset, ColorHighlight, ColorReset)
 
 		var response string
 		fmt.Scanln(&response) // This is safer than bufio.NewReader with the readline library.
+		response = strings.ToLower(strings.TrimSpace(response))
+		if response == "a" || response == "all" || response == "always" || response == "yolo" {
+			config.ExecutionMode = YOLO
+			fmt.Println("Switched to YOLO mode. Future commands will be executed without confirmation.")
+		}
+		unlockConsole()
+
+		// The user may have pressed Ctrl+C while the prompt was waiting
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
 
-		switch strings.ToLower(strings.TrimSpace(response)) {
+		switch response {
 		case "y", "yes":
-			return executeCommand(command)
+			return executeCommand(ctx, config, agentDef, agentID, command, timeoutSeconds)
 		case "b", "bg", "background":
-			return executeBackgroundCommand(command)
+			return executeBackgroundCommand(ctx, config, agentDef, agentID, command, bg)
 		case "a", "all", "always", "yolo":
-			config.ExecutionMode = YOLO
-			fmt.Println("Switched to YOLO mode. Future commands will be executed without confirmation.")
-			return executeCommand(command)
+			return executeCommand(ctx, config, agentDef, agentID, command, timeoutSeconds)
 		default:
 			return "Command not executed by user.", nil
 		}
 	}
 
 	// In YOLO mode, commands always execute in the foreground.
-	return executeCommand(command)
+	return executeCommand(ctx, config, agentDef, agentID, command, timeoutSeconds)
 }
 
-// executeCommand executes a shell command and returns its output
-func executeCommand(command string) (string, error) {
+// newShellCommand builds a shell invocation of command. The child runs in its own process
+// group: Ctrl+C only reaches agent-go, and cancelling ctx kills the command with all its children.
+func newShellCommand(ctx context.Context, command string) *exec.Cmd {
 	var cmd *exec.Cmd
 	if runtime.GOOS == "windows" {
-		cmd = exec.Command("cmd", "/C", command)
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
 	} else {
-		cmd = exec.Command("sh", "-c", command)
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
 	}
-
-	output, err := cmd.CombinedOutput()
-	outputStr := string(output)
-
-	if err != nil {
-		// Return output even on error - useful for diagnostics
-		return outputStr, fmt.Errorf("command execution failed: %w", err)
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd)
 	}
-
-	return outputStr, nil
+	cmd.WaitDelay = ProcessWaitDelay
+	return cmd
 }
 
-// executeCommandSilent executes a shell command silently without any prompts or output messages.
-// Used exclusively in pipeline mode.
-func executeCommandSilent(command string) (string, error) {
-	var cmd *exec.Cmd
-	if runtime.GOOS == "windows" {
-		cmd = exec.Command("cmd", "/C", command)
-	} else {
-		cmd = exec.Command("sh", "-c", command)
+// executeCommand executes a shell command and returns its output. The command runs until it
+// exits or its timeout expires, in which case the whole process group is killed. Output is
+// capped to config.MaxCommandOutput bytes, and the result ends with a line like
+// "[exit_code: 0 | duration: 1.2s]" so the model can tell success, failure and timeouts apart.
+// The command starts in the agent's shell directory and environment, and the directory and
+// variables it leaves behind carry over to the agent's next command.
+func executeCommand(ctx context.Context, config *Config, agentDef *AgentDefinition, agentID, command string, timeoutSeconds int) (string, error) {
+	timeout := commandTimeout(config, timeoutSeconds)
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// The shell reports its final directory and environment through file descriptor 3, which
+	// also works inside a sandbox with a private /tmp
+	var stateFile *os.File
+	if shellStateSupported() {
+		if f, err := os.CreateTemp("", "agent-go-shell-*"); err == nil {
+			stateFile = f
+			defer func() {
+				if err := f.Close(); err != nil {
+					fmt.Printf("failed to close shell state file: %v\n", err)
+				}
+				os.Remove(f.Name())
+			}()
+			command = wrapShellCommand(command)
+		}
 	}
 
-	output, err := cmd.CombinedOutput()
-	outputStr := string(output)
-
+	cmd := newShellCommand(runCtx, command)
+	cmd.Dir = getShellDir(agentID)
+	cmd.Env = getShellEnv(agentID)
+	if stateFile != nil {
+		cmd.ExtraFiles = []*os.File{stateFile}
+	}
+	if err := sandboxCommand(cmd, resolveSandbox(config, agentDef), false); err != nil {
+		return "", err
+	}
+	limited, err := applyResourceLimits(cmd, config.ResourceLimits)
 	if err != nil {
-		// Return output even on error - useful for diagnostics
-		return outputStr, fmt.Errorf("command execution failed: %w", err)
+		return "", err
+	}
+	defer limited.release()
+	limit := config.MaxCommandOutput
+	if limit <= 0 {
+		limit = DefaultMaxCommandOutput
 	}
+	output := newCappedBuffer(limit)
+	cmd.Stdout = output
+	cmd.Stderr = output
 
-	return outputStr, nil
-}
+	start := time.Now()
+	err = cmd.Run()
+	duration := time.Since(start)
 
-func executeBackgroundCommand(command string) (string, error) {
-	var cmd *exec.Cmd
-	if runtime.GOOS == "windows" {
-		cmd = exec.Command("cmd", "/C", command)
-	} else {
-		cmd = exec.Command("sh", "-c", command)
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	if stateFile != nil {
+		if state, err := os.ReadFile(stateFile.Name()); err == nil {
+			updateShellSession(agentID, state)
+		}
 	}
 
-	var outBuf bytes.Buffer
-	cmd.Stdout = &outBuf
-	cmd.Stderr = &outBuf
-
-	if err := cmd.Start(); err != nil {
-		return "", fmt.Errorf("failed to start background command: %w", err)
+	result := output.String()
+	if result != "" && !strings.HasSuffix(result, "\n") {
+		result += "\n"
+	}
+	status := fmt.Sprintf("exit_code: %d | duration: %s", exitCode, formatCommandDuration(duration))
+	if dir := displayShellDir(agentID); dir != "" {
+		status += " | cwd: " + dir
 	}
 
-	bgMutex.Lock()
-	pid := processIDCounter
-	processIDCounter++
-	backgroundProcesses[pid] = &BackgroundProcess{
-		PID:       pid,
-		Command:   command,
-		StartTime: time.Now(),
-		Cmd:       cmd,
-		Output:    &outBuf,
+	// Return output even on error - useful for diagnostics
+	switch {
+	case ctx.Err() != nil:
+		return result, fmt.Errorf("command cancelled: %w", ctx.Err())
+	case runCtx.Err() != nil:
+		result += fmt.Sprintf("[%s | timed out after %s; the process group was killed. Pass a larger timeout_seconds (up to %d) for slow commands]",
+			status, timeout, maxCommandTimeout(config))
+		return result, fmt.Errorf("command timed out after %s", timeout)
+	case err != nil:
+		if violation := limited.violation(result); violation != nil {
+			result += fmt.Sprintf("[%s | %s]", status, violation)
+			return result, violation
+		}
+		result += "[" + status + "]"
+		return result, fmt.Errorf("command execution failed: %w", err)
 	}
-	bgMutex.Unlock()
-
-	// Monitor process in a goroutine to clean up when done
-	go func(pid int, p *exec.Cmd) {
-		p.Wait()
-		bgMutex.Lock()
-		// We keep the process in the map so we can retrieve logs, but we could mark it as done?
-		// For now, let's just keep it. Or maybe we want to remove it?
-		// If we remove it, we lose the logs.
-		// Let's keep it but maybe mark as finished?
-		// The user requirement says "Agent can't stop when it have running backgound commands",
-		// so we need to know if it's running.
-		// cmd.ProcessState contains information after Wait() returns.
-		bgMutex.Unlock()
-	}(pid, cmd)
-
-	return fmt.Sprintf("Background command started with PID: %d", pid), nil
+	result += "[" + status + "]"
+	return result, nil
 }
 
-func killBackgroundCommand(pid int) (string, error) {
-	bgMutex.Lock()
-	proc, exists := backgroundProcesses[pid]
-	bgMutex.Unlock()
-
-	if !exists {
-		return "", fmt.Errorf("background process with PID %d not found", pid)
+// commandTimeout resolves the timeout for a foreground command: the requested number of
+// seconds, or the configured default, capped by the configured maximum.
+func commandTimeout(config *Config, requested int) time.Duration {
+	seconds := config.CommandTimeout
+	if seconds <= 0 {
+		seconds = DefaultCommandTimeout
 	}
-
-	if proc.Cmd.ProcessState != nil && proc.Cmd.ProcessState.Exited() {
-		return "Process already finished", nil
+	if requested > 0 {
+		seconds = requested
 	}
+	return time.Duration(min(seconds, maxCommandTimeout(config))) * time.Second
+}
 
-	if err := proc.Cmd.Process.Kill(); err != nil {
-		return "", fmt.Errorf("failed to kill process: %w", err)
+// maxCommandTimeout returns the largest timeout in seconds a command may ask for.
+func maxCommandTimeout(config *Config) int {
+	if config.MaxCommandTimeout <= 0 {
+		return DefaultMaxCommandTimeout
 	}
-
-	return fmt.Sprintf("Process %d killed", pid), nil
+	return config.MaxCommandTimeout
 }
 
-func getBackgroundLogs(pid int) (string, error) {
-	bgMutex.Lock()
-	defer bgMutex.Unlock()
-
-	proc, exists := backgroundProcesses[pid]
-	if !exists {
-		return "", fmt.Errorf("background process with PID %d not found", pid)
+// formatCommandDuration rounds d for display, e.g. "1.24s" or "35ms".
+func formatCommandDuration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
 	}
+	return d.Round(10 * time.Millisecond).String()
+}
 
-	return proc.Output.String(), nil
+// executeCommandSilent executes a shell command silently without any prompts or output messages.
+// Used exclusively in pipeline mode.
+func executeCommandSilent(ctx context.Context, config *Config, agentDef *AgentDefinition, agentID, command string, timeoutSeconds int) (string, error) {
+	return executeCommand(ctx, config, agentDef, agentID, command, timeoutSeconds)
 }
 
-func listBackgroundCommands() string {
-	bgMutex.Lock()
-	defer bgMutex.Unlock()
+// cappedBuffer keeps the first and last limit/2 bytes written to it and counts the bytes
+// dropped in between, so a huge build log still shows how it started and how it ended.
+type cappedBuffer struct {
+	head    []byte
+	tail    []byte
+	half    int
+	dropped int64
+}
 
-	if len(backgroundProcesses) == 0 {
-		return "No background commands running."
-	}
+func newCappedBuffer(limit int) *cappedBuffer {
+	return &cappedBuffer{half: max(limit/2, 1)}
+}
 
-	var builder strings.Builder
-	builder.WriteString("Background Commands:\n")
-	for _, proc := range backgroundProcesses {
-		status := "Running"
-		if proc.Cmd.ProcessState != nil && proc.Cmd.ProcessState.Exited() {
-			status = fmt.Sprintf("Finished (Exit Code: %d)", proc.Cmd.ProcessState.ExitCode())
-		}
-		builder.WriteString(fmt.Sprintf("- PID: %d | Command: %s | Status: %s\n", proc.PID, proc.Command, status))
+// Write implements io.Writer. exec.Cmd never calls it concurrently when Stdout and Stderr
+// are the same writer.
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.half - len(b.head); room > 0 {
+		take := min(room, len(p))
+		b.head = append(b.head, p[:take]...)
+		p = p[take:]
 	}
-	return builder.String()
+	b.tail = append(b.tail, p...)
+	if over := len(b.tail) - b.half; over > 0 {
+		b.dropped += int64(over)
+		b.tail = append(b.tail[:0], b.tail[over:]...)
+	}
+	return n, nil
 }
 
-func hasRunningBackgroundProcesses() bool {
-	bgMutex.Lock()
-	defer bgMutex.Unlock()
-
-	for _, proc := range backgroundProcesses {
-		if proc.Cmd.ProcessState == nil || !proc.Cmd.ProcessState.Exited() {
-			return true
-		}
+// String returns the kept output with a note in place of the dropped bytes.
+func (b *cappedBuffer) String() string {
+	if b.dropped == 0 {
+		return string(b.head) + string(b.tail)
 	}
-	return false
+	return fmt.Sprintf("%s\n... [%d bytes of output truncated] ...\n%s",
+		strings.ToValidUTF8(string(b.head), ""), b.dropped, strings.ToValidUTF8(string(b.tail), ""))
 }
 
-// executeSkill executes a skill command.
+// executeSkill executes a skill command in the agent's sandbox, if it has one.
 // If it's a .sh file, it executes it directly with sh to avoid shell escaping issues.
-func executeSkill(command string, argsJSON []byte) (string, error) {
+func executeSkill(ctx context.Context, config *Config, sandbox SandboxConfig, command string, argsJSON []byte) (string, error) {
 	// Security: Re-validate command before execution (defense in depth)
 	if err := validateSkillCommand(command); err != nil {
 		return "", fmt.Errorf("refusing to execute unsafe command: %w", err)
 	}
 
 	if strings.HasSuffix(command, ".sh") {
-		cmd := exec.Command("sh", command)
-		cmd.Env = append(os.Environ(), fmt.Sprintf("SKILL_ARGS=%s", string(argsJSON)))
-
-		var outBuf bytes.Buffer
-		cmd.Stdout = &outBuf
-		cmd.Stderr = &outBuf
-
-		err := cmd.Run()
-		output := outBuf.String()
-		if err != nil {
-			return output, fmt.Errorf("skill execution failed: %w", err)
+		cmd := exec.CommandContext(ctx, "sh", command)
+		setProcessGroup(cmd)
+		cmd.Cancel = func() error {
+			return killProcessGroup(cmd)
 		}
-		return output, nil
+		cmd.WaitDelay = ProcessWaitDelay
+		cmd.Env = append(os.Environ(), fmt.Sprintf("SKILL_ARGS=%s", string(argsJSON)))
+		return runSkillCommand(cmd, config, sandbox)
 	}
 
 	// Fallback to shell execution while safely passing SKILL_ARGS via the environment.
-	var cmd *exec.Cmd
-	if runtime.GOOS == "windows" {
-		cmd = exec.Command("cmd", "/C", command)
-	} else {
-		cmd = exec.Command("sh", "-c", command)
-	}
+	cmd := newShellCommand(ctx, command)
 	cmd.Env = append(os.Environ(), fmt.Sprintf("SKILL_ARGS=%s", string(argsJSON)))
+	return runSkillCommand(cmd, config, sandbox)
+}
+
+// runSkillCommand runs a prepared skill command in the sandbox and under the configured
+// resource limits.
+func runSkillCommand(cmd *exec.Cmd, config *Config, sandbox SandboxConfig) (string, error) {
+	if err := sandboxCommand(cmd, sandbox, false); err != nil {
+		return "", err
+	}
+	limited, err := applyResourceLimits(cmd, config.ResourceLimits)
+	if err != nil {
+		return "", err
+	}
+	defer limited.release()
 
 	var outBuf bytes.Buffer
 	cmd.Stdout = &outBuf
 	cmd.Stderr = &outBuf
 
-	err := cmd.Run()
+	err = cmd.Run()
 	output := outBuf.String()
 	if err != nil {
+		if violation := limited.violation(output); violation != nil {
+			return output, violation
+		}
 		return output, fmt.Errorf("skill execution failed: %w", err)
 	}
 	return output, nil
@@ -115,6 +115,15 @@ func formatSessionMarkdown(session *Session, includeMetadata bool) string {
 		sb.WriteString(fmt.Sprintf("- **Completion Tokens**: %d\n", session.CompletionTokens))
 		sb.WriteString(fmt.Sprintf("- **Total Tokens**: %d\n", session.TotalTokens))
 		sb.WriteString(fmt.Sprintf("- **Current Context**: %d tokens\n", session.CurrentContextTokens))
+		if len(session.ModelUsage) > 0 {
+			sb.WriteString(fmt.Sprintf("- **Cost**: %s\n\n", formatSessionCost(session.ModelUsage)))
+			sb.WriteString("| Model | Requests | Prompt | Cached | Completion | Cost |\n")
+			sb.WriteString("|-------|----------|--------|--------|------------|------|\n")
+			for _, model := range sortedModelNames(session.ModelUsage) {
+				u := session.ModelUsage[model]
+				sb.WriteString(fmt.Sprintf("| %s | %d | %d | %d | %d | %s |\n", model, u.Requests, u.PromptTokens, u.CachedTokens, u.CompletionTokens, formatModelCost(u)))
+			}
+		}
 	}
 
 	return sb.String()
@@ -178,6 +187,13 @@ func formatSessionText(session *Session, includeMetadata bool) string {
 		sb.WriteString(fmt.Sprintf("Completion Tokens: %d\n", session.CompletionTokens))
 		sb.WriteString(fmt.Sprintf("Total Tokens: %d\n", session.TotalTokens))
 		sb.WriteString(fmt.Sprintf("Current Context: %d tokens\n", session.CurrentContextTokens))
+		if len(session.ModelUsage) > 0 {
+			sb.WriteString(fmt.Sprintf("Cost: %s\n", formatSessionCost(session.ModelUsage)))
+			for _, model := range sortedModelNames(session.ModelUsage) {
+				u := session.ModelUsage[model]
+				sb.WriteString(fmt.Sprintf("  %s: %s, %d requests, %d prompt (%d cached) + %d completion tokens\n", model, formatModelCost(u), u.Requests, u.PromptTokens, u.CachedTokens, u.CompletionTokens))
+			}
+		}
 	}
 
 	return sb.String()
@@ -191,13 +207,16 @@ func formatSessionJSON(session *Session, includeMetadata bool) (string, error) {
 		ExportedAt   time.Time `json:"exported_at"`
 		ExportFormat string    `json:"export_format"`
 		MessageCount int       `json:"message_count"`
+		TotalCost    float64   `json:"total_cost"` // USD, summed from model_usage
 	}
 
+	totalCost, _ := sessionCost(session.ModelUsage)
 	export := ExportSession{
 		Session:      *session,
 		ExportedAt:   time.Now(),
 		ExportFormat: "json",
 		MessageCount: len(session.Messages),
+		TotalCost:    totalCost,
 	}
 
 	// If not including metadata, clear the metadata fields
@@ -209,6 +228,9 @@ func formatSessionJSON(session *Session, includeMetadata bool) (string, error) {
 		export.PromptTokens = 0
 		export.CompletionTokens = 0
 		export.ToolCalls = 0
+		export.ModelUsage = nil
+		export.Fallbacks = nil
+		export.TotalCost = 0
 	}
 
 	data, err := json.MarshalIndent(export, "", "  ")
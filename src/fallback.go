@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ModelUsage accumulates the tokens served by one model during a session.
+type ModelUsage struct {
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CachedTokens     int     `json:"cached_tokens,omitempty"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	Cost             float64 `json:"cost"`               // USD
+	Unpriced         bool    `json:"unpriced,omitempty"` // Some requests had no known price and aren't in Cost
+}
+
+// FallbackEvent records a switch from a failing model to a fallback.
+type FallbackEvent struct {
+	Time   time.Time `json:"time"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+}
+
+// Per-model usage and fallback history of the current session. Sub-agents may fall back
+// concurrently with the main loop, so access goes through usageMu.
+var (
+	usageMu           sync.Mutex
+	sessionModelUsage = make(map[string]*ModelUsage)
+	sessionFallbacks  []FallbackEvent
+)
+
+// postWithFallback sends req to the configured model and, if it fails with one of the
+// error kinds in config.FallbackOn, retries it on each entry of config.Fallbacks in order.
+// The returned response's Model names the model that actually served the request. A stream
+// that fails after some of it was shown is not retried, so a second answer never follows the
+// first one's beginning.
+func postWithFallback(ctx context.Context, config *Config, req APIRequest, onDelta StreamHandler) (*APIResponse, error) {
+	streamed := false
+	if onDelta != nil {
+		show := onDelta
+		onDelta = func(delta StreamDelta) {
+			streamed = true
+			show(delta)
+		}
+	}
+	resp, err := postChatCompletion(ctx, config, req, onDelta)
+	if err == nil {
+		resp.Model = req.Model
+		return resp, nil
+	}
+
+	from := req.Model
+	for _, name := range config.Fallbacks {
+		if ctx.Err() != nil || streamed || !shouldFallback(config, err) {
+			return nil, err
+		}
+
+		target, resolveErr := resolveFallback(config, name)
+		if resolveErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping fallback '%s': %s\n", name, resolveErr)
+			continue
+		}
+		if target.Model == from && target.APIURL == config.APIURL && target.Provider == config.Provider {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "%s%s failed (%s), falling back to %s%s\n", ColorYellow, from, err, describeFallback(name, target), ColorReset)
+		recordFallback(from, target.Model, err)
+
+		req.Model = target.Model
+		resp, err = postChatCompletion(ctx, target, req, onDelta)
+		if err == nil {
+			resp.Model = target.Model
+			return resp, nil
+		}
+		from = target.Model
+	}
+	return nil, err
+}
+
+// shouldFallback reports whether err is of a kind that config allows falling back on.
+func shouldFallback(config *Config, err error) bool {
+	apiErr, ok := asAPIError(err)
+	if !ok {
+		return false
+	}
+	kinds := config.FallbackOn
+	if len(kinds) == 0 {
+		kinds = DefaultFallbackOn
+	}
+	for _, kind := range kinds {
+		if APIErrorKind(kind) == apiErr.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveFallback builds the config for a fallback entry: "mini" selects the mini model,
+// a profile name selects that profile's connection settings, and anything else is taken
+// as a model name on the current provider. Like activateProfile, a profile is applied to the
+// top-level settings rather than the active profile, so e.g. the active API key is never sent
+// to the fallback's URL.
+func resolveFallback(config *Config, name string) (*Config, error) {
+	target := *config
+	if name == "mini" {
+		if config.MiniModel == "" {
+			return nil, fmt.Errorf("no mini model configured")
+		}
+		target.Model = config.MiniModel
+		return &target, nil
+	}
+	if profile, ok := config.Profiles[name]; ok {
+		if baseProfile != nil {
+			restoreProfile(&target, *baseProfile)
+		}
+		if err := applyProfile(&target, profile); err != nil {
+			return nil, err
+		}
+		return &target, nil
+	}
+	target.Model = name
+	return &target, nil
+}
+
+func describeFallback(name string, target *Config) string {
+	if name == target.Model {
+		return target.Model
+	}
+	return fmt.Sprintf("%s (%s)", target.Model, name)
+}
+
+func recordFallback(from, to string, err error) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	sessionFallbacks = append(sessionFallbacks, FallbackEvent{
+		Time:   time.Now(),
+		From:   from,
+		To:     to,
+		Reason: err.Error(),
+	})
+}
+
+// recordModelUsage attributes the usage and cost of one request to the model that served it.
+func recordModelUsage(config *Config, model string, u Usage) {
+	price, priced := lookupPrice(config, model)
+
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	usage, ok := sessionModelUsage[model]
+	if !ok {
+		usage = &ModelUsage{}
+		sessionModelUsage[model] = usage
+	}
+	usage.Requests++
+	usage.PromptTokens += u.PromptTokens
+	usage.CachedTokens += u.cachedTokens()
+	usage.CompletionTokens += u.CompletionTokens
+	usage.TotalTokens += u.TotalTokens
+	var cost float64
+	if priced {
+		cost = requestCost(price, u)
+		usage.Cost += cost
+	} else {
+		usage.Unpriced = true
+	}
+
+	// Replayed responses cost nothing
+	if isReplaying() {
+		return
+	}
+	entry := LedgerEntry{Time: time.Now(), Model: model, Tokens: u.TotalTokens, Cost: cost}
+	if err := appendLedger(entry); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to update spend ledger: %v\n", err)
+	}
+}
+
+// resetModelUsage clears per-model usage and fallback history, e.g. when a new session starts.
+func resetModelUsage() {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	sessionModelUsage = make(map[string]*ModelUsage)
+	sessionFallbacks = nil
+	resetBudgetState()
+}
+
+// snapshotModelUsage returns copies of the per-model usage and fallback history for saving.
+func snapshotModelUsage() (map[string]ModelUsage, []FallbackEvent) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if len(sessionModelUsage) == 0 && len(sessionFallbacks) == 0 {
+		return nil, nil
+	}
+	usage := make(map[string]ModelUsage, len(sessionModelUsage))
+	for model, u := range sessionModelUsage {
+		usage[model] = *u
+	}
+	return usage, append([]FallbackEvent(nil), sessionFallbacks...)
+}
+
+// restoreModelUsage loads per-model usage and fallback history from a saved session.
+func restoreModelUsage(session *Session) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	sessionModelUsage = make(map[string]*ModelUsage, len(session.ModelUsage))
+	for model, u := range session.ModelUsage {
+		sessionModelUsage[model] = &u
+	}
+	sessionFallbacks = append([]FallbackEvent(nil), session.Fallbacks...)
+	resetBudgetState()
+}
+
+// formatModelUsage renders the per-model breakdown shown by /cost. It includes every request,
+// so mini-model calls, compression and sub-agents are counted too.
+func formatModelUsage() string {
+	usage, fallbacks := snapshotModelUsage()
+	if len(usage) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("%sBy Model%s:\n", StyleBold, ColorReset))
+	for _, model := range sortedModelNames(usage) {
+		u := usage[model]
+		b.WriteString(fmt.Sprintf("%s•%s %s: %s, %s tokens (%s prompt, %s cached, %s completion), %d requests\n",
+			ColorHighlight, ColorReset, model, formatModelCost(u), formatNumber(u.TotalTokens), formatNumber(u.PromptTokens), formatNumber(u.CachedTokens), formatNumber(u.CompletionTokens), u.Requests))
+	}
+	b.WriteString(fmt.Sprintf("%s•%s Total Cost: %s\n", ColorHighlight, ColorReset, formatSessionCost(usage)))
+	if len(fallbacks) > 0 {
+		last := fallbacks[len(fallbacks)-1]
+		b.WriteString(fmt.Sprintf("%s  %d fallback(s), last: %s → %s (%s)%s\n", ColorMeta, len(fallbacks), last.From, last.To, last.Reason, ColorReset))
+	}
+	return b.String()
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// ReadFileArgs represents arguments for reading a file
+type ReadFileArgs struct {
+	Path      string `json:"path"`
+	StartLine int    `json:"start_line,omitempty"`
+	EndLine   int    `json:"end_line,omitempty"`
+}
+
+// WriteFileArgs represents arguments for writing a file
+type WriteFileArgs struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+// EditFileArgs represents arguments for replacing a unique string in a file
+type EditFileArgs struct {
+	Path      string `json:"path"`
+	OldString string `json:"old_string"`
+	NewString string `json:"new_string"`
+}
+
+// fileChangeDeclined is the tool result when the user rejects a file change
+const fileChangeDeclined = "File change not applied by user."
+
+// fileReadDeclined is the tool result when the user rejects a read outside the workspace
+const fileReadDeclined = "File not read: the user did not allow reading outside the workspace."
+
+// readFile returns the lines of a file prefixed with their line numbers. Without a range at
+// most MaxReadFileLines lines are returned. Lines longer than MaxReadFileLineLength bytes are
+// cut, and the result stops before MaxReadFileBytes, so minified files don't flood the context.
+func readFile(dir, argsJSON string) (string, error) {
+	var args ReadFileArgs
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	if strings.TrimSpace(args.Path) == "" {
+		return "", fmt.Errorf("path cannot be empty")
+	}
+	args.Path = resolveAgentPath(dir, args.Path)
+
+	data, err := readRegularFile(args.Path, MaxReadFileSize)
+	if err != nil {
+		return "", err
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return "", fmt.Errorf("%s appears to be a binary file", args.Path)
+	}
+
+	lines := splitLines(string(data))
+	if len(lines) == 0 {
+		return fmt.Sprintf("%s is empty.", args.Path), nil
+	}
+
+	start := max(args.StartLine, 1)
+	if start > len(lines) {
+		return "", fmt.Errorf("start_line %d is past the end of the file (%d lines)", start, len(lines))
+	}
+	end := args.EndLine
+	if end <= 0 || end > len(lines) {
+		end = len(lines)
+	}
+	if end < start {
+		return "", fmt.Errorf("end_line %d is before start_line %d", end, start)
+	}
+	truncated := false
+	if args.EndLine <= 0 && end-start+1 > MaxReadFileLines {
+		end = start + MaxReadFileLines - 1
+		truncated = true
+	}
+
+	var sb strings.Builder
+	for i := start; i <= end; i++ {
+		line := lines[i-1]
+		if len(line) > MaxReadFileLineLength {
+			cut := truncateUTF8(line, MaxReadFileLineLength)
+			line = fmt.Sprintf("%s... [%d more bytes]", cut, len(line)-len(cut))
+		}
+		entry := fmt.Sprintf("%6d\t%s\n", i, line)
+		if i > start && sb.Len()+len(entry) > MaxReadFileBytes {
+			end = i - 1
+			truncated = true
+			break
+		}
+		sb.WriteString(entry)
+	}
+	if truncated {
+		sb.WriteString(fmt.Sprintf("(showing lines %d-%d of %d; use start_line/end_line to read more)\n", start, end, len(lines)))
+	}
+	return sb.String(), nil
+}
+
+// readRegularFile reads a regular file of at most limit bytes. Devices, FIFOs and the like are
+// refused, since reading them may never end, and so are larger files, which would all be loaded
+// into memory.
+func readRegularFile(path string, limit int64) ([]byte, error) {
+	// Stat before opening: opening a FIFO blocks until it has a writer
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory; use list_files to see its contents", path)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	if info.Size() > limit {
+		return nil, fmt.Errorf("%s is too large to read (%d MB, at most %d MB); use search_files or execute_command to look at parts of it", path, info.Size()>>20, limit>>20)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// The file may grow or be replaced after the Stat
+	data, err := io.ReadAll(io.LimitReader(f, limit))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// truncateUTF8 returns the longest prefix of s of at most n bytes that doesn't split a
+// multi-byte character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// writeFile creates or overwrites a file after showing the change for approval. With a sandbox,
+// only its writable paths can be written.
+func writeFile(ctx context.Context, config *Config, sandbox SandboxConfig, dir, argsJSON string) (string, []FileChange, error) {
+	var args WriteFileArgs
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return "", nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+	if strings.TrimSpace(args.Path) == "" {
+		return "", nil, fmt.Errorf("path cannot be empty")
+	}
+	args.Path = resolveAgentPath(dir, args.Path)
+	if err := checkSandboxWritable(sandbox, args.Path); err != nil {
+		return "", nil, err
+	}
+	if config.OperationMode == Plan {
+		return "", nil, fmt.Errorf("writing files is blocked in Plan mode. Switch to Build mode to modify files")
+	}
+
+	old, err := os.ReadFile(args.Path)
+	isNew := os.IsNotExist(err)
+	if err != nil && !isNew {
+		return "", nil, err
+	}
+
+	diff := unifiedDiff(args.Path, string(old), args.Content, isNew)
+	if !isNew && string(old) == args.Content {
+		return fmt.Sprintf("%s already has this content; nothing changed.", args.Path), nil, nil
+	}
+	approved, err := confirmFileChange(ctx, config, "Write", args.Path, diff)
+	if err != nil || !approved {
+		return fileChangeDeclined, nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(args.Path), 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := writeFilePreservingMode(args.Path, []byte(args.Content)); err != nil {
+		return "", nil, err
+	}
+
+	lines := len(splitLines(args.Content))
+	if isNew {
+		return fmt.Sprintf("Created %s (%d lines).", args.Path, lines), []FileChange{{Path: args.Path, Status: "added"}}, nil
+	}
+	return fmt.Sprintf("Wrote %s (%d lines).", args.Path, lines), []FileChange{{Path: args.Path, Status: "modified"}}, nil
+}
+
+// editFile replaces old_string with new_string in a file. old_string must occur exactly once,
+// so the model has to include enough surrounding context to identify the location.
+func editFile(ctx context.Context, config *Config, sandbox SandboxConfig, dir, argsJSON string) (string, []FileChange, error) {
+	var args EditFileArgs
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return "", nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+	if strings.TrimSpace(args.Path) == "" {
+		return "", nil, fmt.Errorf("path cannot be empty")
+	}
+	args.Path = resolveAgentPath(dir, args.Path)
+	if args.OldString == "" {
+		return "", nil, fmt.Errorf("old_string cannot be empty; use write_file to create a file")
+	}
+	if args.OldString == args.NewString {
+		return "", nil, fmt.Errorf("old_string and new_string are identical")
+	}
+	if err := checkSandboxWritable(sandbox, args.Path); err != nil {
+		return "", nil, err
+	}
+	if config.OperationMode == Plan {
+		return "", nil, fmt.Errorf("editing files is blocked in Plan mode. Switch to Build mode to modify files")
+	}
+
+	data, err := os.ReadFile(args.Path)
+	if err != nil {
+		return "", nil, err
+	}
+	content := string(data)
+
+	oldString, newString := args.OldString, args.NewString
+	count := strings.Count(content, oldString)
+	if count == 0 && strings.Contains(content, "\r\n") && !strings.Contains(oldString, "\r\n") {
+		// Models write "\n"; match files with Windows line endings too
+		oldString = strings.ReplaceAll(oldString, "\n", "\r\n")
+		newString = strings.ReplaceAll(newString, "\n", "\r\n")
+		count = strings.Count(content, oldString)
+	}
+	switch {
+	case count == 0:
+		return "", nil, fmt.Errorf("old_string not found in %s; read the file and copy the text exactly, including whitespace", args.Path)
+	case count > 1:
+		return "", nil, fmt.Errorf("old_string occurs %d times in %s; include more surrounding lines so it matches exactly once", count, args.Path)
+	}
+
+	updated := strings.Replace(content, oldString, newString, 1)
+	diff := unifiedDiff(args.Path, content, updated, false)
+	approved, err := confirmFileChange(ctx, config, "Edit", args.Path, diff)
+	if err != nil || !approved {
+		return fileChangeDeclined, nil, err
+	}
+
+	if err := writeFilePreservingMode(args.Path, []byte(updated)); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("Edited %s:\n%s", args.Path, diff), []FileChange{{Path: args.Path, Status: "modified"}}, nil
+}
+
+// writeFilePreservingMode writes data to path, keeping the permissions of an existing file.
+func writeFilePreservingMode(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	return os.WriteFile(path, data, mode)
+}
+
+// readPolicyCommands are the commands the command policy checks a read of each file tool as.
+var readPolicyCommands = map[string]string{
+	"read_file":    "cat",
+	"search_files": "grep",
+	"list_files":   "ls",
+}
+
+// confirmOutsideRead checks a read by a file tool of a path outside the workspace, such as
+// ~/.ssh or agent-go's own config, which a model shouldn't see without the user knowing. The
+// command policy applies as if the path were read with cat (grep, ls), so deny and
+// outside_workspace rules cover it too. Such reads are refused in Plan mode and, like commands,
+// need approval in Ask mode unless a policy allow rule or a PreToolUse hook approved them.
+// Paths inside the workspace are always allowed.
+func confirmOutsideRead(ctx context.Context, config *Config, dir, tool, path string) (bool, error) {
+	if !isOutsideWorkspace(path) {
+		return true, nil
+	}
+	if config.OperationMode == Plan {
+		return false, fmt.Errorf("reading %s outside the workspace is blocked in Plan mode", path)
+	}
+
+	decision := evaluateSimpleCommand([]string{readPolicyCommands[tool], path}, loadCommandRules(), dir)
+	if decision.Action == PolicyDeny {
+		return false, fmt.Errorf("reading %s denied by policy: %s", path, decision.Describe())
+	}
+	if pipelineMode {
+		if decision.Action == PolicyAsk {
+			return false, fmt.Errorf("reading %s requires approval by policy, which is not possible in pipeline mode: %s", path, decision.Describe())
+		}
+		return true, nil
+	}
+	if decision.Action != PolicyAsk && (config.ExecutionMode != Ask || decision.Action == PolicyAllow || hookApproved(ctx)) {
+		return true, nil
+	}
+
+	lockConsole()
+	defer unlockConsole()
+
+	if decision.Action == PolicyAsk {
+		fmt.Printf("%sPolicy requires approval: %s%s\n", ColorYellow, decision.Describe(), ColorReset)
+	}
+	fmt.Printf("%s%s wants to read %s, which is outside the workspace%s\n", ColorCyan, tool, path, ColorReset)
+	fmt.Printf("%s?%s Allow? [y/N]: ", ColorHighlight, ColorReset)
+
+	var response string
+	fmt.Scanln(&response)
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	answer := strings.ToLower(strings.TrimSpace(response))
+	return answer == "y" || answer == "yes", nil
+}
+
+// isOutsideWorkspace reports whether path, as returned by resolveAgentPath, is outside the
+// workspace root.
+func isOutsideWorkspace(path string) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+	rel, err := filepath.Rel(workspaceRoot(), filepath.Clean(path))
+	return err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// confirmFileChange shows the diff of a file change and, in Ask mode, asks whether to apply it.
+// Like confirmAndExecute, answering "a" switches to YOLO mode.
+func confirmFileChange(ctx context.Context, config *Config, action, path, diff string) (bool, error) {
+	if pipelineMode {
+		return true, nil
+	}
+
+	if config.ExecutionMode != Ask || hookApproved(ctx) {
+		return true, nil
+	}
+
+	lockConsole()
+	defer unlockConsole()
+
+	fmt.Printf("%s%s %s%s\n", ColorCyan, action, path, ColorReset)
+	fmt.Print(colorizeDiff(diff))
+	fmt.Printf("%s?%s Apply? [y/a=all/N]: ", ColorHighlight, ColorReset)
+
+	var response string
+	fmt.Scanln(&response)
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+
+	switch strings.ToLower(strings.TrimSpace(response)) {
+	case "y", "yes":
+		return true, nil
+	case "a", "all", "always", "yolo":
+		config.ExecutionMode = YOLO
+		fmt.Println("Switched to YOLO mode. Future commands and file changes will be applied without confirmation.")
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// formatFileToolCompact returns a compact display string for a file tool call, e.g. "Edit (main.go)".
+func formatFileToolCompact(name, argsJSON string) (string, bool) {
+	if name == "apply_patch" {
+		var args ApplyPatchArgs
+		if json.Unmarshal([]byte(argsJSON), &args) != nil {
+			return "", false
+		}
+		if patches, err := parsePatch(args.Patch); err == nil {
+			return fmt.Sprintf("Patch (%d file(s))", len(patches)), true
+		}
+		return "Patch (...)", true
+	}
+
+	var args struct {
+		Path    string `json:"path"`
+		Pattern string `json:"pattern"`
+	}
+	if json.Unmarshal([]byte(argsJSON), &args) != nil {
+		return "", false
+	}
+	switch name {
+	case "search_files":
+		return fmt.Sprintf("Search (%s)", args.Pattern), true
+	case "list_files":
+		if args.Path == "" {
+			args.Path = "."
+		}
+		return fmt.Sprintf("List (%s)", args.Path), true
+	}
+	if args.Path == "" {
+		return "", false
+	}
+	switch name {
+	case "read_file":
+		return fmt.Sprintf("Read (%s)", args.Path), true
+	case "write_file":
+		return fmt.Sprintf("Write (%s)", args.Path), true
+	case "edit_file":
+		return fmt.Sprintf("Edit (%s)", args.Path), true
+	}
+	return "", false
+}
+
+// executeFileTool runs a native file or search tool after checking that the operation
+// mode and agent policy allow it. Relative paths are resolved against dir, the calling
+// agent's shell directory. Besides the output, it returns the files the tool changed.
+func executeFileTool(ctx context.Context, config *Config, agentDef *AgentDefinition, dir, name, argsJSON string) (string, []FileChange, error) {
+	if err := checkToolAllowed(name, agentDef, config.OperationMode); err != nil {
+		return "", nil, err
+	}
+	var output string
+	var err error
+	switch name {
+	case "read_file", "search_files", "list_files":
+		var args struct {
+			Path string `json:"path"`
+		}
+		if json.Unmarshal([]byte(argsJSON), &args) == nil {
+			allowed, err := confirmOutsideRead(ctx, config, dir, name, resolveAgentPath(dir, args.Path))
+			if err != nil {
+				return "", nil, err
+			}
+			if !allowed {
+				return fileReadDeclined, nil, nil
+			}
+		}
+	}
+	switch name {
+	case "read_file":
+		output, err = readFile(dir, argsJSON)
+	case "search_files":
+		output, err = searchFiles(ctx, dir, argsJSON)
+	case "list_files":
+		output, err = listFiles(ctx, dir, argsJSON)
+	case "write_file":
+		return writeFile(ctx, config, resolveSandbox(config, agentDef), dir, argsJSON)
+	case "edit_file":
+		return editFile(ctx, config, resolveSandbox(config, agentDef), dir, argsJSON)
+	case "apply_patch":
+		return applyPatch(ctx, config, resolveSandbox(config, agentDef), dir, argsJSON)
+	default:
+		return "", nil, fmt.Errorf("unknown file tool: %s", name)
+	}
+	return output, nil, err
+}
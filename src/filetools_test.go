@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestReadFileCapsBytes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "min.js")
+	// One huge line of multi-byte characters, then enough short lines to pass the byte cap
+	content := strings.Repeat("é", MaxReadFileLineLength) + "\n" + strings.Repeat(strings.Repeat("x", 100)+"\n", MaxReadFileBytes/100)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	args, _ := json.Marshal(ReadFileArgs{Path: path, EndLine: 1 << 20})
+	out, err := readFile(dir, string(args))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) > MaxReadFileBytes+200 {
+		t.Errorf("read %d bytes, want at most about %d", len(out), MaxReadFileBytes)
+	}
+	if !utf8.ValidString(out) {
+		t.Error("output splits a multi-byte character")
+	}
+	first, _, _ := strings.Cut(out, "\n")
+	if !strings.HasSuffix(first, "... [2000 more bytes]") {
+		t.Errorf("first line ends with %q, want it cut", first[max(len(first)-30, 0):])
+	}
+	if !strings.Contains(out, "use start_line/end_line to read more") {
+		t.Error("capped output doesn't say how to read more")
+	}
+}
+
+func TestConfirmOutsideRead(t *testing.T) {
+	workspace := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(workspace, ".agent-go"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	policy := `{"rules": [{"action": "deny", "command": "cat *", "outside_workspace": true}]}`
+	if err := os.WriteFile(filepath.Join(workspace, ".agent-go", "policy.json"), []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", t.TempDir())
+	t.Chdir(workspace)
+	defer func(mode bool) { pipelineMode = mode }(pipelineMode)
+	pipelineMode = true
+
+	outside := filepath.Join(filepath.Dir(workspace), "secret")
+	tests := []struct {
+		mode    OperationMode
+		tool    string
+		path    string
+		wantErr bool
+	}{
+		{Build, "read_file", "notes.txt", false},
+		{Plan, "read_file", "notes.txt", false},
+		{Build, "read_file", outside, true},   // Denied by policy
+		{Build, "list_files", outside, false}, // No rule for ls
+		{Plan, "list_files", outside, true},
+	}
+	for _, tt := range tests {
+		allowed, err := confirmOutsideRead(context.Background(), &Config{OperationMode: tt.mode}, workspace, tt.tool, resolveAgentPath(workspace, tt.path))
+		if (err != nil) != tt.wantErr || allowed == tt.wantErr {
+			t.Errorf("confirmOutsideRead(%s, %s, %s) = %v, %v, want error %v", tt.mode, tt.tool, tt.path, allowed, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReadFileRefusesSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, path := range []string{os.DevNull, dir} {
+		args, _ := json.Marshal(ReadFileArgs{Path: path})
+		if _, err := readFile(dir, string(args)); err == nil {
+			t.Errorf("readFile(%s) succeeded, want an error", path)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hook events
+const (
+	HookPreToolUse       = "PreToolUse"       // Before a tool runs; can approve or deny it
+	HookPostToolUse      = "PostToolUse"      // After a tool ran; can replace or extend its result
+	HookUserPromptSubmit = "UserPromptSubmit" // Before a prompt is sent; can block it or add context
+	HookSessionStart     = "SessionStart"     // When agent-go starts a session; can add context
+	HookStop             = "Stop"             // When the agent finishes a turn; can send it back to work
+)
+
+// Hook decisions
+const (
+	HookApprove = "approve"
+	HookDeny    = "deny"
+)
+
+// HookDenyExitCode is the exit code with which a hook denies, like printing {"decision": "deny"}.
+const HookDenyExitCode = 2
+
+// Hook is a command run on an agent event. It gets a HookInput as JSON on stdin and may print a
+// HookOutput as JSON. Exiting with HookDenyExitCode denies, with the reason taken from stderr.
+// Any other failure only denies a PreToolUse call; for other events it is reported as a warning.
+type Hook struct {
+	Matcher string `json:"matcher,omitempty"` // Regular expression over the tool name (tool events); empty matches every tool
+	Command string `json:"command"`
+	Timeout int    `json:"timeout,omitempty"` // Seconds; defaults to DefaultHookTimeout
+
+	pattern *regexp.Regexp
+}
+
+// HooksConfig is the content of a hooks.json file: hooks by event name.
+type HooksConfig struct {
+	Hooks map[string][]Hook `json:"hooks"`
+}
+
+// HookInput is what a hook receives on stdin.
+type HookInput struct {
+	Event          string          `json:"event"`
+	SessionID      string          `json:"session_id"`
+	Agent          string          `json:"agent,omitempty"`
+	Cwd            string          `json:"cwd"`
+	ToolName       string          `json:"tool_name,omitempty"`
+	ToolInput      json.RawMessage `json:"tool_input,omitempty"`
+	ToolOutput     *string         `json:"tool_output,omitempty"`
+	ToolError      bool            `json:"tool_error,omitempty"`
+	Prompt         string          `json:"prompt,omitempty"`
+	LastMessage    string          `json:"last_message,omitempty"`     // Stop: the agent's final message
+	StopHookActive bool            `json:"stop_hook_active,omitempty"` // Stop: a Stop hook already continued this turn
+}
+
+// HookOutput is what a hook may print on stdout. Plain text instead of JSON is treated as
+// additional context.
+type HookOutput struct {
+	Decision          string  `json:"decision,omitempty"`           // approve or deny
+	Reason            string  `json:"reason,omitempty"`             // Told to the model (and user) on deny
+	Output            *string `json:"output,omitempty"`             // PostToolUse: replaces the tool result
+	AdditionalContext string  `json:"additional_context,omitempty"` // Added for the model
+}
+
+// HookResult combines the outputs of the hooks run for one event.
+type HookResult struct {
+	Decision string
+	Reason   string
+	Output   *string
+	Context  []string
+}
+
+// Hook files are re-read when they change, like policy files.
+var (
+	hooksMu    sync.Mutex
+	hooksCache = make(map[string]cachedHooks)
+)
+
+type cachedHooks struct {
+	modTime time.Time
+	hash    string // SHA-256 of the file content
+	hooks   map[string][]Hook
+}
+
+// getGlobalHooksPath returns the path to the user-wide hooks.
+func getGlobalHooksPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "agent-go", "hooks.json")
+}
+
+// getProjectHooksPath returns the path to the project's hooks.
+func getProjectHooksPath() string {
+	cwd, _ := os.Getwd()
+	return filepath.Join(cwd, ".agent-go", "hooks.json")
+}
+
+// getTrustedHooksPath returns the path to the list of trusted project hooks files.
+func getTrustedHooksPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "agent-go", "trusted_hooks.json")
+}
+
+// loadHooks returns the hooks for event from the global and project files, global ones first.
+// Project hooks are left out unless the user trusts the file.
+func loadHooks(event string) []Hook {
+	hooks := loadHooksFile(getGlobalHooksPath()).hooks[event]
+	project := loadHooksFile(getProjectHooksPath())
+	if len(project.hooks[event]) > 0 && projectHooksTrusted(getProjectHooksPath(), project) {
+		hooks = append(hooks, project.hooks[event]...)
+	}
+	return hooks
+}
+
+// loadHooksFile loads and validates one hooks file, using the cached hooks while it is unchanged.
+// An invalid file is reported once and ignored.
+func loadHooksFile(path string) cachedHooks {
+	info, err := os.Stat(path)
+	if err != nil {
+		return cachedHooks{}
+	}
+
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	if cached, ok := hooksCache[path]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cachedHooks{}
+	}
+	sum := sha256.Sum256(data)
+	cached := cachedHooks{modTime: info.ModTime(), hash: hex.EncodeToString(sum[:])}
+	cached.hooks, err = parseHooksFile(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring hooks %s: %s\n", path, err)
+	}
+	hooksCache[path] = cached
+	return cached
+}
+
+// projectHooksTrusted reports whether the project hooks file may run (see projectFileTrusted).
+func projectHooksTrusted(path string, file cachedHooks) bool {
+	events := make([]string, 0, len(file.hooks))
+	for event := range file.hooks {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	var lines []string
+	for _, event := range events {
+		for _, hook := range file.hooks[event] {
+			lines = append(lines, fmt.Sprintf("%s: %s", event, hook.Command))
+		}
+	}
+	return projectFileTrusted(projectFileTrust{
+		Path:      path,
+		Hash:      file.hash,
+		TrustPath: getTrustedHooksPath(),
+		Kind:      "hooks",
+		Summary:   fmt.Sprintf("The project hooks in %s run these commands:", path),
+		Lines:     lines,
+		Untrusted: fmt.Sprintf("not running hooks from %s", path),
+		Declined:  "Project hooks will not run in this session.",
+	})
+}
+
+func parseHooksFile(data []byte) (map[string][]Hook, error) {
+	var config HooksConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	for event, hooks := range config.Hooks {
+		switch event {
+		case HookPreToolUse, HookPostToolUse, HookUserPromptSubmit, HookSessionStart, HookStop:
+		default:
+			return nil, fmt.Errorf("unknown event %q", event)
+		}
+		for i := range hooks {
+			hook := &hooks[i]
+			if strings.TrimSpace(hook.Command) == "" {
+				return nil, fmt.Errorf("%s hook %d: command is required", event, i+1)
+			}
+			if hook.Matcher != "" {
+				re, err := regexp.Compile("^(?:" + hook.Matcher + ")$")
+				if err != nil {
+					return nil, fmt.Errorf("%s hook %d: invalid matcher: %w", event, i+1, err)
+				}
+				hook.pattern = re
+			}
+		}
+	}
+	return config.Hooks, nil
+}
+
+// runHooks runs the hooks for input.Event that match its tool, in order, and combines their
+// results. Running stops at the first denial. Each PostToolUse hook sees the result as amended
+// by the hooks before it. A hook that fails without denying (see Hook) is skipped with a
+// warning, except for PreToolUse, where it denies so a broken guard doesn't let calls through.
+func runHooks(ctx context.Context, input HookInput) HookResult {
+	var result HookResult
+	for _, hook := range loadHooks(input.Event) {
+		if hook.pattern != nil && !hook.pattern.MatchString(input.ToolName) {
+			continue
+		}
+		out, err := runHook(ctx, hook, input)
+		if ctx.Err() != nil {
+			return result
+		}
+		var denial hookDenial
+		if errors.As(err, &denial) {
+			result.Decision = HookDeny
+			result.Reason = denial.reason
+			return result
+		}
+		if err != nil && input.Event == HookPreToolUse {
+			result.Decision = HookDeny
+			result.Reason = fmt.Sprintf("hook '%s' failed: %s", hook.Command, err)
+			return result
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s hook '%s' failed: %s\n", input.Event, hook.Command, err)
+			continue
+		}
+		if out.AdditionalContext != "" {
+			result.Context = append(result.Context, out.AdditionalContext)
+		}
+		if out.Output != nil {
+			result.Output = out.Output
+			input.ToolOutput = out.Output
+		}
+		switch out.Decision {
+		case HookDeny:
+			result.Decision = HookDeny
+			result.Reason = out.Reason
+			if result.Reason == "" {
+				result.Reason = fmt.Sprintf("denied by hook '%s'", hook.Command)
+			}
+			return result
+		case HookApprove:
+			result.Decision = HookApprove
+		}
+	}
+	return result
+}
+
+// hookDenial is the error of a hook that exited with HookDenyExitCode. It carries the reason.
+type hookDenial struct {
+	reason string
+}
+
+func (d hookDenial) Error() string {
+	return d.reason
+}
+
+// runHook runs one hook. A non-zero exit is returned as an error carrying the hook's stderr,
+// which is a hookDenial for HookDenyExitCode.
+func runHook(ctx context.Context, hook Hook, input HookInput) (HookOutput, error) {
+	timeout := DefaultHookTimeout
+	if hook.Timeout > 0 {
+		timeout = time.Duration(hook.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stdin, err := json.Marshal(input)
+	if err != nil {
+		return HookOutput{}, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := newShellCommand(ctx, hook.Command)
+	cmd.Dir = workspaceRoot()
+	cmd.Env = append(os.Environ(), "AGENT_GO_HOOK_EVENT="+input.Event, "AGENT_GO_TOOL_NAME="+input.ToolName, "AGENT_GO_SESSION_ID="+input.SessionID)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return HookOutput{}, fmt.Errorf("timed out after %s", formatCommandDuration(timeout))
+		}
+		reason := strings.TrimSpace(stderr.String())
+		if reason == "" {
+			reason = strings.TrimSpace(stdout.String())
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == HookDenyExitCode {
+			if reason == "" {
+				reason = fmt.Sprintf("denied by hook '%s'", hook.Command)
+			}
+			return HookOutput{}, hookDenial{reason: reason}
+		}
+		if reason == "" {
+			return HookOutput{}, err
+		}
+		return HookOutput{}, fmt.Errorf("%s", reason)
+	}
+
+	var out HookOutput
+	text := strings.TrimSpace(stdout.String())
+	if strings.HasPrefix(text, "{") {
+		if err := json.Unmarshal([]byte(text), &out); err != nil {
+			return HookOutput{}, fmt.Errorf("printed invalid JSON: %w", err)
+		}
+	} else {
+		out.AdditionalContext = text
+	}
+	return out, nil
+}
+
+// newHookInput fills in the fields every hook input has.
+func newHookInput(event string, a *Agent) HookInput {
+	input := HookInput{Event: event, Cwd: workspaceRoot()}
+	if a != nil {
+		input.SessionID = a.ID
+		input.Agent = a.AgentDefName
+	}
+	return input
+}
+
+// toolHookInput describes a tool call for PreToolUse and PostToolUse hooks.
+func toolHookInput(event string, a *Agent, toolCall ToolCall) HookInput {
+	input := newHookInput(event, a)
+	input.ToolName = toolCall.Function.Name
+	input.ToolInput = json.RawMessage(toolCall.Function.Arguments)
+	if !json.Valid(input.ToolInput) {
+		// Pass malformed arguments as a JSON string so the input stays valid JSON
+		input.ToolInput, _ = json.Marshal(toolCall.Function.Arguments)
+	}
+	return input
+}
+
+// hookApprovalKey marks a context whose tool call was approved by a PreToolUse hook.
+type hookApprovalKey struct{}
+
+// hookApproved reports whether a PreToolUse hook approved the tool call running under ctx, in
+// which case it runs without asking in Ask mode. Command policy still applies.
+func hookApproved(ctx context.Context) bool {
+	approved, _ := ctx.Value(hookApprovalKey{}).(bool)
+	return approved
+}
+
+// runPreToolUseHooks runs the PreToolUse hooks for a tool call. When a hook denies it, the
+// returned result is given to the model instead of running the tool. The returned context
+// carries a hook approval, if any.
+func runPreToolUseHooks(ctx context.Context, a *Agent, toolCall ToolCall) (context.Context, string, bool) {
+	result := runHooks(ctx, toolHookInput(HookPreToolUse, a, toolCall))
+	switch result.Decision {
+	case HookDeny:
+		if !pipelineMode {
+			fmt.Printf("%sHook blocked %s: %s%s\n", ColorYellow, formatToolCallCompact(toolCall), result.Reason, ColorReset)
+		}
+		return ctx, fmt.Sprintf("Tool call denied by hook: %s", result.Reason), false
+	case HookApprove:
+		return context.WithValue(ctx, hookApprovalKey{}, true), "", true
+	}
+	return ctx, "", true
+}
+
+// runPostToolUseHooks runs the PostToolUse hooks for a finished tool call and returns the result
+// to give the model, which hooks may have replaced, extended with context, or, when a hook
+// denies, extended with its reason.
+func runPostToolUseHooks(ctx context.Context, a *Agent, toolCall ToolCall, output string, toolErr error) string {
+	if ctx.Err() != nil {
+		return output
+	}
+	input := toolHookInput(HookPostToolUse, a, toolCall)
+	input.ToolOutput = &output
+	input.ToolError = toolErr != nil
+	result := runHooks(ctx, input)
+
+	if result.Output != nil {
+		output = *result.Output
+	}
+	for _, text := range result.Context {
+		output += "\n\n" + text
+	}
+	if result.Decision == HookDeny {
+		output += fmt.Sprintf("\n\n[hook feedback: %s]", result.Reason)
+	}
+	return output
+}
+
+// runUserPromptSubmitHooks runs the UserPromptSubmit hooks for a prompt. It returns false when
+// a hook blocked the prompt, after telling the user why, and otherwise any context the hooks
+// add for the model.
+func runUserPromptSubmitHooks(ctx context.Context, a *Agent, prompt string) (string, bool) {
+	input := newHookInput(HookUserPromptSubmit, a)
+	input.Prompt = prompt
+	result := runHooks(ctx, input)
+	if result.Decision == HookDeny {
+		fmt.Fprintf(os.Stderr, "Prompt blocked by hook: %s\n", result.Reason)
+		return "", false
+	}
+	return strings.Join(result.Context, "\n\n"), true
+}
+
+// runSessionStartHooks runs the SessionStart hooks and adds the context they print to the
+// agent's messages.
+func runSessionStartHooks(ctx context.Context, a *Agent) {
+	result := runHooks(ctx, newHookInput(HookSessionStart, a))
+	appendHookContext(a, strings.Join(result.Context, "\n\n"))
+}
+
+// runStopHooks runs the Stop hooks once the agent has finished a turn. If a hook denies
+// stopping, its reason is added for the model and runStopHooks returns true so the turn goes
+// on, at most MaxStopHookContinuations times per turn.
+func runStopHooks(ctx context.Context, a *Agent, continuations int) bool {
+	if continuations >= MaxStopHookContinuations {
+		return false
+	}
+	input := newHookInput(HookStop, a)
+	input.StopHookActive = continuations > 0
+	if n := len(a.Messages); n > 0 && a.Messages[n-1].Content != nil {
+		input.LastMessage = *a.Messages[n-1].Content
+	}
+	result := runHooks(ctx, input)
+	if result.Decision != HookDeny || ctx.Err() != nil {
+		return false
+	}
+
+	if !pipelineMode {
+		fmt.Printf("%sStop hook: %s%s\n", ColorYellow, result.Reason, ColorReset)
+	}
+	feedback := fmt.Sprintf("A Stop hook asked you to continue: %s", result.Reason)
+	a.Messages = append(a.Messages, Message{Role: "user", Content: &feedback})
+	return true
+}
+
+// appendHookContext adds context printed by hooks to the agent's messages.
+func appendHookContext(a *Agent, text string) {
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	a.Messages = append(a.Messages, Message{Role: "system", Content: &text})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestRunHooksFailures(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks in this test are sh commands")
+	}
+	t.Setenv("HOME", t.TempDir())
+	t.Chdir(t.TempDir())
+	hooks := `{"hooks": {
+		"PreToolUse": [{"matcher": "broken", "command": "exit 1"}, {"matcher": "denied", "command": "echo no >&2; exit 2"}],
+		"Stop": [{"command": "exit 1"}, {"command": "echo more context"}],
+		"UserPromptSubmit": [{"command": "echo '{\"decision\": \"deny\", \"reason\": \"blocked\"}'"}]
+	}}`
+	if err := os.MkdirAll(filepath.Dir(getGlobalHooksPath()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(getGlobalHooksPath(), []byte(hooks), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input        HookInput
+		wantDecision string
+		wantReason   string
+	}{
+		// A failing guard denies the tool call
+		{HookInput{Event: HookPreToolUse, ToolName: "broken"}, HookDeny, ""},
+		{HookInput{Event: HookPreToolUse, ToolName: "denied"}, HookDeny, "no"},
+		{HookInput{Event: HookPreToolUse, ToolName: "other"}, "", ""},
+		// Other events only deny on purpose; a failing hook is skipped
+		{HookInput{Event: HookStop}, "", ""},
+		{HookInput{Event: HookUserPromptSubmit}, HookDeny, "blocked"},
+	}
+	for _, tt := range tests {
+		result := runHooks(context.Background(), tt.input)
+		if result.Decision != tt.wantDecision || (tt.wantReason != "" && result.Reason != tt.wantReason) {
+			t.Errorf("runHooks(%s %s) = %q (%q), want %q (%q)", tt.input.Event, tt.input.ToolName, result.Decision, result.Reason, tt.wantDecision, tt.wantReason)
+		}
+	}
+
+	// The hooks after a failed one still run
+	if result := runHooks(context.Background(), HookInput{Event: HookStop}); len(result.Context) != 1 || result.Context[0] != "more context" {
+		t.Errorf("Stop context = %q, want the second hook's output", result.Context)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreRule is one pattern from a .gitignore-style file.
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreMatcher decides which workspace paths the search tools skip. It applies the
+// .gitignore of every directory on the way down (nested files override their parents) plus
+// the workspace's .agent-go/ignore. The .git directory is always skipped.
+type ignoreMatcher struct {
+	root  string
+	rules map[string][]ignoreRule // keyed by the directory the rules are relative to
+}
+
+// newIgnoreMatcher creates a matcher for paths under root.
+func newIgnoreMatcher(root string) *ignoreMatcher {
+	m := &ignoreMatcher{root: root, rules: make(map[string][]ignoreRule)}
+	extra := loadIgnoreFile(filepath.Join(root, ".agent-go", "ignore"))
+	m.rules[root] = append(loadIgnoreFile(filepath.Join(root, ".gitignore")), extra...)
+	return m
+}
+
+// loadIgnoreFile parses a .gitignore-style file. A missing file has no rules.
+func loadIgnoreFile(path string) []ignoreRule {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			fmt.Printf("failed to close ignore file: %v\n", err)
+		}
+	}()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// parseIgnoreRule converts one .gitignore line into a rule.
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+
+	// A pattern with a slash is relative to the ignore file's directory; otherwise it
+	// matches a name at any depth
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		line = "**/" + line
+	}
+
+	re, err := regexp.Compile("^" + globToRegexp(line) + "$")
+	if err != nil {
+		return ignoreRule{}, false
+	}
+	rule.pattern = re
+	return rule, true
+}
+
+// globToRegexp converts a glob with *, ?, [...] and ** into a regular expression over
+// slash-separated paths.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// compileGlob compiles glob into a regular expression over paths relative to the search root
+// (slash-separated). A glob without a slash matches the file name at any depth, e.g. "*.go".
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	if !strings.Contains(glob, "/") {
+		glob = "**/" + glob
+	}
+	re, err := regexp.Compile("^" + globToRegexp(strings.TrimPrefix(glob, "./")) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob: %w", err)
+	}
+	return re, nil
+}
+
+// rulesFor returns the rules defined in dir, loading its .gitignore on first use.
+func (m *ignoreMatcher) rulesFor(dir string) []ignoreRule {
+	if rules, ok := m.rules[dir]; ok {
+		return rules
+	}
+	rules := loadIgnoreFile(filepath.Join(dir, ".gitignore"))
+	m.rules[dir] = rules
+	return rules
+}
+
+// ignored reports whether path should be skipped. Paths outside the root are only checked
+// against the .git rule.
+func (m *ignoreMatcher) ignored(path string, isDir bool) bool {
+	if filepath.Base(path) == ".git" {
+		return true
+	}
+	rel, err := filepath.Rel(m.root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+
+	// Apply rules from the root down to the parent directory; the last match wins
+	ignored := false
+	dir := m.root
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := range parts {
+		sub := strings.Join(parts[i:], "/")
+		for _, rule := range m.rulesFor(dir) {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if rule.pattern.MatchString(sub) {
+				ignored = !rule.negate
+			}
+		}
+		dir = filepath.Join(dir, parts[i])
+	}
+	return ignored
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".gitignore":       "# comment\n*.log\n!keep.log\nbuild/\n/dist\ndocs/**/*.tmp\n\\#hash\n*.env\n",
+		".agent-go/ignore": "secret.txt\n",
+		"sub/.gitignore":   "local.txt\n!debug.log\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := newIgnoreMatcher(root)
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		// Unanchored patterns match at any depth; negation re-includes
+		{"a.log", false, true},
+		{"sub/deep/a.log", false, true},
+		{"keep.log", false, false},
+		{"a.txt", false, false},
+		// Dir-only rules don't match files
+		{"build", true, true},
+		{"build", false, false},
+		{"src/build", true, true},
+		// A leading slash anchors to the ignore file's directory
+		{"dist", true, true},
+		{"src/dist", true, false},
+		// ** matches any number of directories, including none
+		{"docs/a.tmp", false, true},
+		{"docs/a/b/c.tmp", false, true},
+		{"other/c.tmp", false, false},
+		// An escaped # is a pattern, not a comment
+		{"#hash", false, true},
+		// .agent-go/ignore adds to the root rules
+		{"secret.txt", false, true},
+		// Nested files apply below their directory and override their parents
+		{"sub/local.txt", false, true},
+		{"local.txt", false, false},
+		{"sub/debug.log", false, false},
+		{"sub/other.log", false, true},
+		// .git is always skipped
+		{".git", true, true},
+		{"sub/.git", true, true},
+		// Names starting with .. are inside the workspace
+		{"..env", false, true},
+		{"..cache/a.log", false, true},
+		// Paths outside the root only get the .git rule
+		{"../a.log", false, false},
+	}
+	for _, tt := range tests {
+		if got := m.ignored(filepath.Join(root, filepath.FromSlash(tt.path)), tt.isDir); got != tt.want {
+			t.Errorf("ignored(%q, dir=%v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestParseIgnoreRule(t *testing.T) {
+	for _, line := range []string{"", "   ", "# comment", "!", "/"} {
+		if _, ok := parseIgnoreRule(line); ok {
+			t.Errorf("parseIgnoreRule(%q) gave a rule, want none", line)
+		}
+	}
+	rule, ok := parseIgnoreRule("!out/ \r")
+	if !ok || !rule.negate || !rule.dirOnly || !rule.pattern.MatchString("a/out") {
+		t.Errorf("parseIgnoreRule(\"!out/\") = %+v, want a negated dir-only rule at any depth", rule)
+	}
+}
+
+func TestCompileGlob(t *testing.T) {
+	tests := []struct {
+		glob, rel string
+		want      bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "src/main.go", true},
+		{"*.go", "main.go.bak", false},
+		{"src/*.go", "src/main.go", true},
+		{"src/*.go", "src/x/main.go", false},
+		{"src/**/*.go", "src/main.go", true},
+		{"src/**/*.go", "src/x/y/main.go", true},
+		{"./main.go", "main.go", true},
+		{"file?.txt", "file1.txt", true},
+		{"file?.txt", "file/.txt", false},
+		{"file[0-9].txt", "file7.txt", true},
+		{"file[!0-9].txt", "file7.txt", false},
+		{"a.b", "axb", false},
+	}
+	for _, tt := range tests {
+		re, err := compileGlob(tt.glob)
+		if err != nil {
+			t.Fatalf("compileGlob(%q): %v", tt.glob, err)
+		}
+		if got := re.MatchString(tt.rel); got != tt.want {
+			t.Errorf("glob %q on %q = %v, want %v", tt.glob, tt.rel, got, tt.want)
+		}
+	}
+}
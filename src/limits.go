@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ResourceLimits caps what a process started for the agent may use. Zero means unlimited.
+// Memory and process count are limited for the command as a whole through a cgroup v2 when
+// one is available, and per process or user with rlimits otherwise. The other limits are
+// always rlimits.
+type ResourceLimits struct {
+	CPUSeconds    int `json:"cpu_seconds,omitempty"`      // CPU time per process
+	MemoryMB      int `json:"memory_mb,omitempty"`        // Memory of the command (cgroup) or its data segment per process (rlimit)
+	MaxProcesses  int `json:"max_processes,omitempty"`    // Processes of the command (cgroup) or of the user (rlimit)
+	MaxFileSizeMB int `json:"max_file_size_mb,omitempty"` // Largest file a process may write
+}
+
+// enabled reports whether any limit is set.
+func (l ResourceLimits) enabled() bool {
+	return l.CPUSeconds > 0 || l.MemoryMB > 0 || l.MaxProcesses > 0 || l.MaxFileSizeMB > 0
+}
+
+// String describes the limits for display, e.g. "cpu 60s, memory 2048 MB".
+func (l ResourceLimits) String() string {
+	var parts []string
+	if l.CPUSeconds > 0 {
+		parts = append(parts, fmt.Sprintf("cpu %ds", l.CPUSeconds))
+	}
+	if l.MemoryMB > 0 {
+		parts = append(parts, fmt.Sprintf("memory %d MB", l.MemoryMB))
+	}
+	if l.MaxProcesses > 0 {
+		parts = append(parts, fmt.Sprintf("processes %d", l.MaxProcesses))
+	}
+	if l.MaxFileSizeMB > 0 {
+		parts = append(parts, fmt.Sprintf("file size %d MB", l.MaxFileSizeMB))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ResourceLimitError reports that a process was stopped by one of the configured limits, so
+// the model can tell it apart from an ordinary failure.
+type ResourceLimitError struct {
+	Limit  string // "cpu", "memory", "processes" or "file size"
+	Detail string
+}
+
+func (e *ResourceLimitError) Error() string {
+	return fmt.Sprintf("resource limit exceeded: %s (%s)", e.Limit, e.Detail)
+}
+
+// limitedCommand tracks the limits applied to one command, so a violation can be detected
+// once it exits.
+type limitedCommand struct {
+	limits ResourceLimits
+	cmd    *exec.Cmd
+	cgroup *commandCgroup
+}
+
+// applyResourceLimits rewrites cmd to run under limits. It must be called after any sandbox
+// wrapping, right before the command is started. The result is nil when no limits are set;
+// its methods handle that.
+func applyResourceLimits(cmd *exec.Cmd, limits ResourceLimits) (*limitedCommand, error) {
+	if !limits.enabled() {
+		return nil, nil
+	}
+	lc := &limitedCommand{limits: limits, cmd: cmd}
+	if limits.MemoryMB > 0 || limits.MaxProcesses > 0 {
+		lc.cgroup = newCommandCgroup(cmd, limits)
+	}
+	// RLIMIT_DATA and RLIMIT_NPROC are only stand-ins for the cgroup; RLIMIT_NPROC in
+	// particular counts every process of the user, not just the command's
+	rlimits := limits
+	if lc.cgroup != nil {
+		rlimits.MemoryMB = 0
+		rlimits.MaxProcesses = 0
+	}
+	if rlimits.enabled() {
+		if err := wrapRlimits(cmd, rlimits); err != nil {
+			lc.release()
+			return nil, err
+		}
+	}
+	return lc, nil
+}
+
+// violation returns the limit a failed command ran into, or nil. Limits enforced by
+// rlimits alone are recognized from the fatal signal or, for memory and processes, from the
+// error messages programs print when allocations or forks fail.
+func (lc *limitedCommand) violation(output string) *ResourceLimitError {
+	if lc == nil {
+		return nil
+	}
+	state := lc.cmd.ProcessState
+	if state == nil || state.Success() {
+		return nil
+	}
+
+	if oom, pids := lc.cgroup.events(); oom {
+		return &ResourceLimitError{Limit: "memory", Detail: fmt.Sprintf("killed at %d MB", lc.limits.MemoryMB)}
+	} else if pids {
+		return &ResourceLimitError{Limit: "processes", Detail: fmt.Sprintf("at most %d processes", lc.limits.MaxProcesses)}
+	}
+	switch sig := limitSignal(state); {
+	case sig == "cpu" && lc.limits.CPUSeconds > 0:
+		return &ResourceLimitError{Limit: "cpu", Detail: fmt.Sprintf("more than %d seconds of CPU time", lc.limits.CPUSeconds)}
+	case sig == "file size" && lc.limits.MaxFileSizeMB > 0:
+		return &ResourceLimitError{Limit: "file size", Detail: fmt.Sprintf("a file grew past %d MB", lc.limits.MaxFileSizeMB)}
+	}
+
+	lower := strings.ToLower(output)
+	if lc.limits.MemoryMB > 0 && lc.cgroup == nil {
+		for _, msg := range []string{"out of memory", "cannot allocate memory", "memoryerror", "bad_alloc", "allocation failed"} {
+			if strings.Contains(lower, msg) {
+				return &ResourceLimitError{Limit: "memory", Detail: fmt.Sprintf("allocation failed at %d MB", lc.limits.MemoryMB)}
+			}
+		}
+	}
+	if lc.limits.MaxProcesses > 0 && lc.cgroup == nil {
+		for _, msg := range []string{"fork: resource temporarily unavailable", "fork: retry", "cannot fork"} {
+			if strings.Contains(lower, msg) {
+				return &ResourceLimitError{Limit: "processes", Detail: fmt.Sprintf("at most %d processes", lc.limits.MaxProcesses)}
+			}
+		}
+	}
+	return nil
+}
+
+// release removes the command's cgroup.
+func (lc *limitedCommand) release() {
+	if lc != nil {
+		lc.cgroup.remove()
+	}
+}
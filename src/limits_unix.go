@@ -0,0 +1,117 @@
+//go:build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// limitsInitArg is the hidden first argument agent-go re-executes itself with to set rlimits
+// on a command before running it (see runLimitsInitIfRequested).
+const limitsInitArg = "__agent-go-limits-init"
+
+// wrapRlimits makes cmd start through agent-go's limits init, which sets the rlimits and then
+// replaces itself with the original command.
+func wrapRlimits(cmd *exec.Cmd, limits ResourceLimits) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("resource limits: %w", err)
+	}
+	spec, err := json.Marshal(limits)
+	if err != nil {
+		return err
+	}
+	cmd.Args = append([]string{exe, limitsInitArg, string(spec), cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = exe
+	return nil
+}
+
+// runLimitsInitIfRequested turns this process into the limits init when agent-go was
+// re-executed by wrapRlimits. Otherwise it returns immediately.
+func runLimitsInitIfRequested() {
+	if len(os.Args) < 4 || os.Args[1] != limitsInitArg {
+		return
+	}
+
+	var limits ResourceLimits
+	if err := json.Unmarshal([]byte(os.Args[2]), &limits); err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting resource limits: %s\n", err)
+		os.Exit(126)
+	}
+	if err := setRlimits(limits); err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting resource limits: %s\n", err)
+		os.Exit(126)
+	}
+	err := syscall.Exec(os.Args[3], os.Args[3:], os.Environ())
+	fmt.Fprintf(os.Stderr, "Error starting command: %s\n", err)
+	os.Exit(127)
+}
+
+// setRlimits applies limits to the current process; they are inherited by everything it starts.
+// Values above the inherited hard limit are lowered to it, since only root may raise it.
+func setRlimits(limits ResourceLimits) error {
+	set := func(resource int, soft, hard uint64) error {
+		var current unix.Rlimit
+		if err := unix.Getrlimit(resource, &current); err != nil {
+			return err
+		}
+		hard = min(hard, current.Max)
+		return unix.Setrlimit(resource, &unix.Rlimit{Cur: min(soft, hard), Max: hard})
+	}
+	if limits.CPUSeconds > 0 {
+		// The soft limit sends SIGXCPU, which identifies the violation; the hard limit one
+		// second later kills processes that ignore it
+		cpu := uint64(limits.CPUSeconds)
+		if err := set(unix.RLIMIT_CPU, cpu, cpu+1); err != nil {
+			return fmt.Errorf("cpu: %w", err)
+		}
+	}
+	if limits.MemoryMB > 0 {
+		memory := uint64(limits.MemoryMB) << 20
+		if err := set(unix.RLIMIT_DATA, memory, memory); err != nil {
+			return fmt.Errorf("memory: %w", err)
+		}
+	}
+	if limits.MaxProcesses > 0 {
+		procs := uint64(limits.MaxProcesses)
+		if err := set(unix.RLIMIT_NPROC, procs, procs); err != nil {
+			return fmt.Errorf("processes: %w", err)
+		}
+	}
+	if limits.MaxFileSizeMB > 0 {
+		size := uint64(limits.MaxFileSizeMB) << 20
+		if err := set(unix.RLIMIT_FSIZE, size, size); err != nil {
+			return fmt.Errorf("file size: %w", err)
+		}
+	}
+	return nil
+}
+
+// limitSignal returns the limit whose signal ended a process: SIGXCPU for CPU time and
+// SIGXFSZ for file size. A shell reports a child killed by a signal as exit code 128+signal.
+func limitSignal(state *os.ProcessState) string {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return ""
+	}
+	var sig syscall.Signal
+	switch {
+	case status.Signaled():
+		sig = status.Signal()
+	case status.Exited() && status.ExitStatus() > 128:
+		sig = syscall.Signal(status.ExitStatus() - 128)
+	}
+	switch sig {
+	case syscall.SIGXCPU:
+		return "cpu"
+	case syscall.SIGXFSZ:
+		return "file size"
+	}
+	return ""
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// wrapRlimits does nothing: Windows has no rlimits, so resource limits are not applied.
+func wrapRlimits(cmd *exec.Cmd, limits ResourceLimits) error {
+	return nil
+}
+
+// runLimitsInitIfRequested is a no-op on Windows.
+func runLimitsInitIfRequested() {}
+
+// limitSignal always returns "" on Windows.
+func limitSignal(state *os.ProcessState) string {
+	return ""
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -24,9 +25,8 @@ var shellMode = false
 var shouldSwitchToBuild = false
 var pipelineMode = false
 
-// Tool loop detection state
-var lastToolCallSignature = ""
-var repeatedToolCallCount = 0
+// Tool loop detection state of the main agent
+var mainToolLoop toolLoopDetector
 
 // Agent Studio + task-specific agents
 type AgentConfigSnapshot struct {
@@ -61,13 +61,19 @@ func getToolCallSignature(toolCalls []ToolCall) string {
 	return signature
 }
 
-// checkToolLoop checks if the model is stuck in a tool loop and returns true if it should be stopped
+// toolLoopDetector notices when a model is stuck calling the same tools over and over. The
+// main agent and every sub-agent have their own.
+type toolLoopDetector struct {
+	lastSignature string
+	repeatCount   int
+}
+
+// check reports whether the model is stuck in a tool loop and should be stopped.
 // It checks both: repeated calls across iterations AND repeated calls within a single response
-func checkToolLoop(toolCalls []ToolCall) bool {
+func (d *toolLoopDetector) check(toolCalls []ToolCall) bool {
 	if len(toolCalls) == 0 {
 		// No tool calls, reset the counter
-		lastToolCallSignature = ""
-		repeatedToolCallCount = 0
+		d.reset()
 		return false
 	}
 
@@ -84,22 +90,32 @@ func checkToolLoop(toolCalls []ToolCall) bool {
 
 	// Second, check if this entire set of tool calls is the same as the previous iteration
 	signature := getToolCallSignature(toolCalls)
-	if signature == lastToolCallSignature {
-		repeatedToolCallCount++
-		if repeatedToolCallCount >= MaxRepeatedToolCalls {
+	if signature == d.lastSignature {
+		d.repeatCount++
+		if d.repeatCount >= MaxRepeatedToolCalls {
 			return true
 		}
 	} else {
-		lastToolCallSignature = signature
-		repeatedToolCallCount = 1
+		d.lastSignature = signature
+		d.repeatCount = 1
 	}
 	return false
 }
 
-// resetToolLoopState resets the tool loop detection state
+// reset clears the loop detection state
+func (d *toolLoopDetector) reset() {
+	d.lastSignature = ""
+	d.repeatCount = 0
+}
+
+// checkToolLoop checks if the main agent is stuck in a tool loop and returns true if it should be stopped
+func checkToolLoop(toolCalls []ToolCall) bool {
+	return mainToolLoop.check(toolCalls)
+}
+
+// resetToolLoopState resets the tool loop detection state of the main agent
 func resetToolLoopState() {
-	lastToolCallSignature = ""
-	repeatedToolCallCount = 0
+	mainToolLoop.reset()
 }
 
 func formatTokenCount(count int) string {
@@ -173,9 +189,26 @@ func initializeColors() {
 }
 
 func main() {
+	// When re-executed to set up limits or the sandbox for a command, these never return
+	runLimitsInitIfRequested()
+	runSandboxInitIfRequested()
+
 	// Initialize colors based on TTY detection
 	initializeColors()
 
+	// Strip --record/--replay/--replay-loose so the remaining arguments form the task
+	args, err := parseCassetteArgs(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	os.Args = append(os.Args[:1], args...)
+	if activeCassette != nil && activeCassette.replaying {
+		fmt.Fprintf(os.Stderr, "%sReplaying %d recorded responses from %s%s\n", ColorMeta, len(activeCassette.recorded), activeCassette.path, ColorReset)
+	} else if activeCassette != nil {
+		fmt.Fprintf(os.Stderr, "%sRecording provider traffic to %s%s\n", ColorMeta, activeCassette.path, ColorReset)
+	}
+
 	// Check for pipeline mode (stdin is piped and we have CLI args)
 	if isPipeMode() && len(os.Args) > 1 {
 		task := strings.Join(os.Args[1:], " ")
@@ -189,6 +222,12 @@ func main() {
 		return
 	}
 
+	// Check for "run <workflow.yaml>"
+	if len(os.Args) > 2 && os.Args[1] == "run" && isWorkflowFile(os.Args[2]) {
+		runWorkflowMode(os.Args[2:])
+		return
+	}
+
 	// Check for command line task argument (no stdin piped)
 	if len(os.Args) > 1 {
 		task := strings.Join(os.Args[1:], " ")
@@ -209,9 +248,13 @@ func main() {
 	}
 
 	config = loadConfig()
-	if config.APIKey == "" {
+	if missingAPIKey(config) {
 		runSetup()
 	}
+	printModelCapabilities(applyModelCapabilities(config))
+	if n := restoreBackgroundProcesses(config); n > 0 {
+		fmt.Printf("%sReattached to %d background processes from an earlier session (see /bg list)%s\n", ColorMeta, n, ColorReset)
+	}
 
 	// Determine initial agent based on deprecated OperationMode (for migration)
 	// Default to "build" agent
@@ -231,12 +274,18 @@ func main() {
 		Role:    "system",
 		Content: &systemPrompt,
 	})
+	runSessionStartHooks(context.Background(), agent)
 
-	// Handle graceful shutdown
+	// Handle graceful shutdown. While a turn is running, the first Ctrl+C only cancels it.
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-c
+		for sig := range c {
+			if sig == os.Interrupt && cancelCurrentTurn() {
+				continue
+			}
+			break
+		}
 		if agent != nil && len(agent.Messages) > 1 {
 			if err := saveSession(agent); err != nil {
 				fmt.Fprintf(os.Stderr, "\nFailed to save session: %v\n", err)
@@ -246,8 +295,7 @@ func main() {
 		}
 		// Check for running background processes
 		if hasRunningBackgroundProcesses() {
-			fmt.Println("\nWarning: There are running background processes. They will be terminated.")
-			// We could ask for confirmation or list them, but for now let's just warn and exit.
+			fmt.Println("\nNote: Background processes keep running; agent-go reattaches to them when it is started here again.")
 		}
 
 		fmt.Println("\nHave a nice day! ;)")
@@ -298,10 +346,14 @@ func showHelp() {
 	printSubCmd("", "(run without subcommand to deploy following DEPLOY.md)")
 	printCmd("/config", "Display current configuration")
 	printCmd("/shell", "Enter shell mode for direct command execution")
+	printCmd("/cwd", "Show the directory and environment changes commands run with")
+	printSubCmd("<dir>", "Change the directory for the next commands")
+	printSubCmd("reset", "Return to the workspace root and drop environment changes")
 	printCmd("/bg", "Background process management")
 	printSubCmd("list", "List background processes")
-	printSubCmd("view <pid>", "View logs (stdout/stderr) for a background process")
+	printSubCmd("view <pid> [lines]", "View the last lines of output of a background process")
 	printSubCmd("kill <pid>", "Kill a background process")
+	printSubCmd("clean", "Forget finished background processes and delete their logs")
 	printCmd("/clear", "Clear context without compressing")
 	printCmd("/compress", "Compress context and start new chat thread")
 	printCmd("/edit", "Edit prompt in nano editor")
@@ -310,7 +362,16 @@ func showHelp() {
 
 	printCmd("/model <name>", "Set the main AI model (e.g., gpt-4)")
 	printCmd("/model mini <name>", "Set the mini AI model for utility tasks")
-	printCmd("/provider <url>", "Set the API provider URL")
+	printCmd("/model pull <name>", "Download a model (Ollama provider)")
+	printCmd("/provider", "Show the current provider backend")
+	printSubCmd("<name> [url]", "Switch backend (openai, anthropic, ollama, llamacpp), optionally with a base URL")
+	printSubCmd("<url>", "Set the API base URL for the current backend")
+	printCmd("/profile", "Named connection profiles (URL, key, models)")
+	printSubCmd("list", "List profiles")
+	printSubCmd("use <name>", "Switch to a profile")
+	printSubCmd("add <name> [key=value ...]", "Save current settings, or the given ones (provider, url, key, key_cmd, model, mini_model, context_length, temp)")
+	printSubCmd("clear", "Deactivate the profile and restore the top-level settings")
+	printSubCmd("rm <name>", "Delete a profile")
 
 	printCmd("/contextlength <val>", "Set the model context length (e.g., 131072)")
 
@@ -320,6 +381,7 @@ func showHelp() {
 
 	printCmd("/usage <1|2|3>", "Set usage verbosity (1: Silent, 2: Basic, 3: Detailed)")
 	printCmd("/cost", "Show current usage statistics")
+	printCmd("/stream on|off", "Toggle token-by-token streaming of responses")
 
 	printCmd("/todo", "Display the current todo list")
 	printCmd("/current", "Display the current in-progress task")
@@ -391,8 +453,14 @@ func runCLI() {
 	sandboxStatus := fmt.Sprintf("Sandbox: %sOff%s", ColorRed, ColorReset)
 	if _, err := os.Stat("/.dockerenv"); err == nil {
 		sandboxStatus = fmt.Sprintf("Sandbox: %sOn%s", ColorGreen, ColorReset)
+	} else if agentDef, err := loadAgentDefinition(agent.AgentDefName); err == nil && resolveSandbox(config, agentDef).enabled() {
+		sandboxStatus = fmt.Sprintf("Sandbox: %sOn%s (%s)", ColorGreen, ColorReset, describeSandbox(resolveSandbox(config, agentDef)))
 	}
-	fmt.Printf("Welcome to Agent-Go!\n%s%s • %s • %s%s\n", ColorMeta, config.Model, cwd, sandboxStatus, ColorReset)
+	modelStatus := config.Model
+	if config.ActiveProfile != "" {
+		modelStatus = fmt.Sprintf("%s (profile: %s)", config.Model, config.ActiveProfile)
+	}
+	fmt.Printf("Welcome to Agent-Go!\n%s%s • %s • %s%s\n", ColorMeta, modelStatus, cwd, sandboxStatus, ColorReset)
 
 	for {
 		var taskline string
@@ -418,11 +486,15 @@ func runCLI() {
 		if taskline != "" {
 			taskline += " "
 		}
+		// Show where commands run once they have left the workspace root
+		if dir := displayShellDir(agent.ID); dir != "" && !agentStudioMode {
+			taskline += ColorMeta + dir + ColorReset + " "
+		}
 
 		if agentStudioMode {
 			rl.SetPrompt(StyleBold + ColorHighlight + ">>> ")
 		} else if shellMode {
-			rl.SetPrompt(StyleBold + ColorCyan + "! ")
+			rl.SetPrompt(taskline + StyleBold + ColorCyan + "! ")
 		} else if config.OperationMode == Plan {
 			rl.SetPrompt(taskline + StyleBold + "? ")
 		} else {
@@ -458,9 +530,11 @@ func runCLI() {
 			studioAgent.Messages = append(studioAgent.Messages, Message{Role: "user", Content: &userInput})
 
 			// Run one (possibly multi-tool) studio turn
-			if err := runAgentStudioTurn(config); err != nil {
+			ctx := beginTurn()
+			if err := runAgentStudioTurn(ctx, config); err != nil && ctx.Err() == nil {
 				fmt.Fprintf(os.Stderr, "Agent Studio error: %v\n", err)
 			}
+			endTurn()
 
 			// If studio finished (agent created), clear studio state.
 			if !agentStudioMode {
@@ -480,7 +554,9 @@ func runCLI() {
 				continue
 			}
 			// Shell mode commands can be run in foreground or background (Ask mode prompts the user).
-			output, err := confirmAndExecute(config, userInput)
+			ctx := beginTurn()
+			output, err := confirmAndExecute(ctx, config, agentDefinitionOf(agent), agent.ID, userInput, 0, BackgroundOptions{})
+			endTurn()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 			}
@@ -497,6 +573,12 @@ func runCLI() {
 			continue
 		}
 
+		// UserPromptSubmit hooks can block the prompt or add context for the model
+		hookContext, ok := runUserPromptSubmitHooks(context.Background(), agent, userInput)
+		if !ok {
+			continue
+		}
+
 		// RAG processing
 		if config.RAGEnabled && config.RAGPath != "" {
 			snippets, err := searchRAGFiles(config.RAGPath, userInput, config.RAGSnippets)
@@ -507,11 +589,21 @@ func runCLI() {
 
 		// Add user message to agent history
 		agent.Messages = append(agent.Messages, Message{Role: "user", Content: &userInput})
+		appendHookContext(agent, hookContext)
 
 		// Message history is now unlimited
 
-		// Agentic loop
+		// Agentic loop. Ctrl+C cancels ctx and ends the turn, returning to the prompt.
+		ctx := beginTurn()
+		stopContinuations := 0
 		for {
+			if ctx.Err() != nil {
+				break
+			}
+			if !checkBudget(config) {
+				break
+			}
+
 			// Auto-compress context if enabled and current context exceeds 75% of limit
 			// Uses "Last Usage" algorithm - currentContextTokens reflects actual context size
 			if config.AutoCompress && currentContextTokens > (config.ModelContextLength*3/4) {
@@ -533,11 +625,20 @@ func runCLI() {
 			}
 
 			// Retry logic if the model returns an empty response
+			var printer *streamPrinter
 			const maxEmptyRetries = 2
 			for attempt := 0; attempt <= maxEmptyRetries; attempt++ {
-				resp, err = sendAPIRequest(agent, config, config.SubagentsEnabled, agentDef)
+				if config.Stream {
+					printer = newStreamPrinter()
+					resp, err = sendAPIRequestStreaming(ctx, agent, config, config.SubagentsEnabled, agentDef, printer.handle)
+					printer.finish()
+				} else {
+					resp, err = sendAPIRequest(ctx, agent, config, config.SubagentsEnabled, agentDef)
+				}
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+					if ctx.Err() == nil {
+						fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+					}
 					break
 				}
 
@@ -575,10 +676,11 @@ func runCLI() {
 			assistantMsg := resp.Choices[0].Message
 			agent.Messages = append(agent.Messages, assistantMsg)
 
-			if assistantMsg.ReasoningContent != nil && *assistantMsg.ReasoningContent != "" {
+			// When streaming, the text has already been rendered token by token
+			if assistantMsg.ReasoningContent != nil && *assistantMsg.ReasoningContent != "" && !printer.printedReasoning() {
 				fmt.Printf("%s● %sThink...\n%s", ColorHighlight, ColorMeta, ColorReset)
 			}
-			if assistantMsg.Content != nil && *assistantMsg.Content != "" {
+			if assistantMsg.Content != nil && *assistantMsg.Content != "" && !printer.printedContent() {
 				fmt.Printf("%s● %s%s%s\n", ColorHighlight, ColorMain, *assistantMsg.Content, ColorReset)
 			}
 
@@ -609,7 +711,7 @@ func runCLI() {
 				}
 			case UsageBasic:
 				if resp.Usage.TotalTokens > 0 {
-					fmt.Printf("%sUsed %s%s%s tokens on %s%s\n", ColorMeta, ColorHighlight, formatTokenCount(totalTokens), ColorMeta, config.Model, ColorReset)
+					fmt.Printf("%sUsed %s%s%s tokens on %s%s\n", ColorMeta, ColorHighlight, formatTokenCount(totalTokens), ColorMeta, resp.Model, ColorReset)
 				}
 			case UsageSilent:
 				fallthrough
@@ -631,7 +733,10 @@ func runCLI() {
 					continue
 				}
 
-				processToolCalls(agent, assistantMsg.ToolCalls, config)
+				processToolCalls(ctx, agent, assistantMsg.ToolCalls, config)
+				if ctx.Err() != nil {
+					break
+				}
 
 				// Check if we need to switch to build mode after tool processing
 				if shouldSwitchToBuild {
@@ -664,6 +769,7 @@ func runCLI() {
 					totalTokens = 0
 					totalPromptTokens = 0
 					totalCompletionTokens = 0
+					resetModelUsage()
 
 					// Update deprecated config for backward compatibility
 					config.OperationMode = Build
@@ -692,6 +798,11 @@ func runCLI() {
 				if assistantMsg.Content == nil || *assistantMsg.Content == "" {
 					fmt.Printf("%sWarning: Received empty response from model%s\n", ColorMeta, ColorReset)
 				}
+				// Stop hooks can send the agent back to work
+				if runStopHooks(ctx, agent, stopContinuations) {
+					stopContinuations++
+					continue
+				}
 				break // No more tools to call, end agent turn
 			}
 			// Continue loop to send tool output back to API
@@ -706,6 +817,10 @@ func runCLI() {
 				// We don't print this to the user, it's just for the agent's context
 			}
 		}
+		if ctx.Err() != nil {
+			fmt.Printf("%sTurn cancelled.%s\n", ColorMeta, ColorReset)
+		}
+		endTurn()
 	}
 }
 
@@ -796,7 +911,9 @@ func handleSlashCommand(command string) {
 		}
 		task := "Review the current changes in the branch/working directory for security issues, bugs, and best practices. Provide a summary of findings."
 		fmt.Println("Spawning subagent to review changes...")
-		result, err := runSubAgent(task, config)
+		ctx := beginTurn()
+		result, err := runSubAgent(ctx, task, config)
+		endTurn()
 		if err != nil {
 			fmt.Printf("Security review failed: %v\n", err)
 		} else {
@@ -834,7 +951,9 @@ CRITICAL: Only include information that is:
 Keep it concise and actionable. Delete obvious or generic information.`
 
 			fmt.Println("Spawning subagent to analyze deployment setup and create DEPLOY.md...")
-			deployResult, err := runSubAgent(deployTask, config)
+			ctx := beginTurn()
+			deployResult, err := runSubAgent(ctx, deployTask, config)
+			endTurn()
 			if err != nil {
 				fmt.Printf("DEPLOY.md creation failed: %v\n", err)
 			} else {
@@ -862,7 +981,9 @@ DEPLOY.md contents:
 Execute the deployment steps. Report progress and any issues encountered.`, deployFileContent)
 
 		fmt.Println("Spawning subagent to deploy project following DEPLOY.md instructions...")
-		result, err := runSubAgent(task, config)
+		ctx := beginTurn()
+		result, err := runSubAgent(ctx, task, config)
+		endTurn()
 		if err != nil {
 			fmt.Printf("Deployment failed: %v\n", err)
 		} else {
@@ -886,6 +1007,30 @@ Execute the deployment steps. Report progress and any issues encountered.`, depl
 		}
 		fmt.Printf("Usage verbose mode set to %d\n", mode)
 
+	case "/stream":
+		if len(parts) > 1 {
+			switch parts[1] {
+			case "on":
+				config.Stream = true
+				fmt.Println("Streaming enabled.")
+			case "off":
+				config.Stream = false
+				fmt.Println("Streaming disabled.")
+			default:
+				fmt.Println("Usage: /stream [on|off]")
+				return
+			}
+			if err := saveConfig(config); err != nil {
+				fmt.Fprintf(os.Stderr, "Error saving config: %s\n", err)
+			}
+		} else {
+			if config.Stream {
+				fmt.Println("Streaming is currently enabled.")
+			} else {
+				fmt.Println("Streaming is currently disabled.")
+			}
+		}
+
 	case "/cost":
 		// Calculate percentage based on CURRENT context (Last Usage algorithm)
 		percent := 0.0
@@ -929,6 +1074,16 @@ Execute the deployment steps. Report progress and any issues encountered.`, depl
 		fmt.Printf("%s•%s Completion Tokens:  %s\n", ColorHighlight, ColorReset, formatNumber(totalCompletionTokens))
 		fmt.Printf("%s•%s Tool Calls:         %s\n", ColorHighlight, ColorReset, formatNumber(totalToolCalls))
 		fmt.Println()
+		if byModel := formatModelUsage(); byModel != "" {
+			fmt.Println(byModel)
+		}
+		if daily, err := dailySpend(); err == nil && daily > 0 {
+			fmt.Printf("%sSpent today (all sessions): %s%s\n", ColorMeta, formatCost(daily), ColorReset)
+			if config.MaxDailyCost > 0 {
+				fmt.Printf("%sDaily budget: %s%s\n", ColorMeta, formatCost(config.MaxDailyCost), ColorReset)
+			}
+			fmt.Println()
+		}
 
 	case "/session":
 		if len(parts) < 2 {
@@ -979,6 +1134,7 @@ Execute the deployment steps. Report progress and any issues encountered.`, depl
 			totalTokens = loadedSession.TotalTokens
 			totalPromptTokens = loadedSession.PromptTokens
 			totalCompletionTokens = loadedSession.CompletionTokens
+			restoreModelUsage(loadedSession)
 			totalToolCalls = loadedSession.ToolCalls
 
 			fmt.Printf("Session '%s' restored.\n", name)
@@ -1013,6 +1169,7 @@ Execute the deployment steps. Report progress and any issues encountered.`, depl
 			totalTokens = 0
 			totalPromptTokens = 0
 			totalCompletionTokens = 0
+			resetModelUsage()
 
 			// Add new system prompt
 			systemPrompt := buildSystemPrompt("")
@@ -1136,6 +1293,7 @@ Execute the deployment steps. Report progress and any issues encountered.`, depl
 		totalTokens = 0
 		totalPromptTokens = 0
 		totalCompletionTokens = 0
+		resetModelUsage()
 
 		fmt.Printf("Switched to %s mode.\n", targetAgent)
 
@@ -1304,6 +1462,7 @@ Execute the deployment steps. Report progress and any issues encountered.`, depl
 			totalTokens = 0
 			totalPromptTokens = 0
 			totalCompletionTokens = 0
+			resetModelUsage()
 
 			fmt.Printf("Switched to %s mode.\n", targetAgent)
 
@@ -1426,6 +1585,7 @@ Execute the deployment steps. Report progress and any issues encountered.`, depl
 			val, err := strconv.Atoi(parts[1])
 			if err == nil && val > 0 {
 				config.ModelContextLength = val
+				autoContextLength = 0 // An explicit value always wins over model metadata
 				if err := saveConfig(config); err != nil {
 					fmt.Fprintf(os.Stderr, "Error saving config: %s\n", err)
 				}
@@ -1438,7 +1598,7 @@ Execute the deployment steps. Report progress and any issues encountered.`, depl
 		}
 	case "/bg":
 		if len(parts) < 2 {
-			fmt.Println("Usage: /bg [list|view <pid>|kill <pid>]")
+			fmt.Println("Usage: /bg [list|view <pid> [lines]|kill <pid>|clean]")
 			return
 		}
 		switch parts[1] {
@@ -1446,15 +1606,22 @@ Execute the deployment steps. Report progress and any issues encountered.`, depl
 			fmt.Println(listBackgroundCommands())
 		case "view", "logs":
 			if len(parts) < 3 {
-				fmt.Println("Usage: /bg view <pid>")
+				fmt.Println("Usage: /bg view <pid> [lines]")
 				return
 			}
 			pid, err := strconv.Atoi(parts[2])
 			if err != nil {
-				fmt.Println("Invalid pid. Usage: /bg view <pid>")
+				fmt.Println("Invalid pid. Usage: /bg view <pid> [lines]")
 				return
 			}
-			logs, err := getBackgroundLogs(pid)
+			lines := 0
+			if len(parts) > 3 {
+				if lines, err = strconv.Atoi(parts[3]); err != nil || lines <= 0 {
+					fmt.Println("Invalid line count. Usage: /bg view <pid> [lines]")
+					return
+				}
+			}
+			logs, err := getBackgroundLogs(pid, nil, lines)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error getting logs: %v\n", err)
 				return
@@ -1480,15 +1647,37 @@ Execute the deployment steps. Report progress and any issues encountered.`, depl
 				return
 			}
 			fmt.Println(result)
+		case "clean":
+			fmt.Printf("Removed %d finished background processes\n", cleanBackgroundProcesses())
 		default:
-			fmt.Println("Usage: /bg [list|view <pid>|kill <pid>]")
+			fmt.Println("Usage: /bg [list|view <pid> [lines]|kill <pid>|clean]")
 		}
+	case "/cwd":
+		if len(parts) < 2 {
+			fmt.Println(describeShellSession(agent.ID))
+			return
+		}
+		if parts[1] == "reset" {
+			resetShellSession(agent.ID)
+			fmt.Printf("Shell directory and environment reset to %s\n", workspaceRoot())
+			return
+		}
+		dir := strings.TrimSpace(strings.TrimPrefix(command, "/cwd"))
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(getShellDir(agent.ID), dir)
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			fmt.Fprintf(os.Stderr, "Error: %s is not a directory\n", dir)
+			return
+		}
+		setShellDir(agent.ID, filepath.Clean(dir))
+		fmt.Printf("Shell directory set to %s\n", getShellDir(agent.ID))
 	case "/shell":
 		shellMode = true
 		fmt.Println("Entered shell mode. Type 'exit' to return.")
 	case "/quit":
 		if hasRunningBackgroundProcesses() {
-			fmt.Println("Warning: You have running background processes.")
+			fmt.Println("Warning: You have running background processes. They keep running after agent-go exits; stop them with /bg kill <pid>.")
 			fmt.Println(listBackgroundCommands())
 			fmt.Print("Are you sure you want to quit? [y/N]: ")
 			var response string
@@ -1519,38 +1708,202 @@ Execute the deployment steps. Report progress and any issues encountered.`, depl
 				} else {
 					fmt.Println("Usage: /model mini <model_name>")
 				}
+			} else if parts[1] == "pull" {
+				if len(parts) < 3 {
+					fmt.Println("Usage: /model pull <model_name>")
+					return
+				}
+				puller, ok := getProvider(config).(modelPuller)
+				if !ok {
+					fmt.Printf("Provider '%s' does not support pulling models.\n", getProvider(config).Name())
+					return
+				}
+				ctx := beginTurn()
+				err := puller.PullModel(ctx, config, parts[2], func(status string, completed, total int64) {
+					if total > 0 {
+						fmt.Printf("\r%s%s: %d%%%s\033[K", ColorMeta, status, completed*100/total, ColorReset)
+					} else {
+						fmt.Printf("\r%s%s%s\033[K", ColorMeta, status, ColorReset)
+					}
+				})
+				endTurn()
+				fmt.Println()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error pulling model: %s\n", err)
+				} else {
+					fmt.Printf("Model %s pulled.\n", parts[2])
+				}
 			} else {
 				config.Model = parts[1]
+				info := applyModelCapabilities(config)
 				if err := saveConfig(config); err != nil {
 					fmt.Fprintf(os.Stderr, "Error saving config: %s\n", err)
 				}
 				fmt.Printf("Model set to: %s\n", config.Model)
+				printModelCapabilities(info)
 			}
 		} else {
-			fmt.Println("Usage: /model <model_name> OR /model mini <model_name>")
+			fmt.Println("Usage: /model <model_name> OR /model mini <model_name> OR /model pull <model_name>")
 		}
 	case "/provider":
-		if len(parts) > 1 {
+		if len(parts) == 1 {
+			fmt.Printf("Provider: %s (%s)\n", getProvider(config).Name(), config.APIURL)
+			fmt.Printf("Available: %s\n", strings.Join(providerNames(), ", "))
+			fmt.Println("Usage: /provider <name> [api_url] OR /provider <api_url>")
+			return
+		}
+
+		// Backward compatible form: /provider <api_url>
+		if strings.HasPrefix(parts[1], "http://") || strings.HasPrefix(parts[1], "https://") {
 			config.APIURL = parts[1]
 			if err := saveConfig(config); err != nil {
 				fmt.Fprintf(os.Stderr, "Error saving config: %s\n", err)
 			}
 			fmt.Printf("Provider URL set to: %s\n", config.APIURL)
-		} else {
-			fmt.Println("Usage: /provider <api_url>")
+			return
+		}
+
+		provider, err := lookupProvider(parts[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return
+		}
+		config.Provider = provider.Name()
+		if len(parts) > 2 {
+			config.APIURL = parts[2]
+		} else if provider.Name() == "openai" && config.APIURL == DefaultAnthropicAPIURL {
+			config.APIURL = DefaultAPIURL
+		}
+		info := applyModelCapabilities(config)
+		if err := saveConfig(config); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving config: %s\n", err)
+		}
+		fmt.Printf("Provider set to: %s (%s)\n", config.Provider, config.APIURL)
+		printModelCapabilities(info)
+	case "/profile":
+		if len(parts) < 2 {
+			fmt.Println("Usage: /profile [list|use <name>|add <name> [key=value ...]|clear|rm <name>]")
+			return
+		}
+		switch parts[1] {
+		case "list":
+			fmt.Print(formatProfilesList(config))
+		case "use":
+			if len(parts) < 3 {
+				fmt.Println("Usage: /profile use <name>")
+				return
+			}
+			if err := activateProfile(config, parts[2]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				return
+			}
+			envProfile = false
+			info := applyModelCapabilities(config)
+			if err := saveConfig(config); err != nil {
+				fmt.Fprintf(os.Stderr, "Error saving config: %s\n", err)
+			}
+			fmt.Printf("Profile set to: %s (%s • %s)\n", config.ActiveProfile, getProvider(config).Name(), config.Model)
+			printModelCapabilities(info)
+		case "add":
+			if len(parts) < 3 {
+				fmt.Println("Usage: /profile add <name> [key=value ...]")
+				return
+			}
+			name := parts[2]
+			var profile Profile
+			if len(parts) > 3 {
+				p, err := parseProfileArgs(strings.Join(parts[3:], " "))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+					return
+				}
+				profile = p
+			} else {
+				// Save the current connection settings, without a context length taken from model metadata
+				profile = snapshotProfile(config)
+				if autoContextLength != 0 && config.ModelContextLength == autoContextLength {
+					profile.ModelContextLength = configuredContextLength
+				}
+				if active, ok := config.Profiles[config.ActiveProfile]; ok && active.APIKeyCommand != "" {
+					profile.APIKey = ""
+					profile.APIKeyCommand = active.APIKeyCommand
+				}
+			}
+			if config.Profiles == nil {
+				config.Profiles = make(map[string]Profile)
+			}
+			config.Profiles[name] = profile
+			if name == config.ActiveProfile {
+				if err := activateProfile(config, name); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				}
+			}
+			if err := saveConfig(config); err != nil {
+				fmt.Fprintf(os.Stderr, "Error saving config: %s\n", err)
+			}
+			fmt.Printf("Profile '%s' saved.\n", name)
+		case "clear":
+			if config.ActiveProfile == "" {
+				fmt.Println("No active profile.")
+				return
+			}
+			deactivateProfile(config)
+			envProfile = false
+			info := applyModelCapabilities(config)
+			if err := saveConfig(config); err != nil {
+				fmt.Fprintf(os.Stderr, "Error saving config: %s\n", err)
+			}
+			fmt.Printf("Profile cleared. Using %s (%s).\n", config.Model, getProvider(config).Name())
+			printModelCapabilities(info)
+		case "rm":
+			if len(parts) < 3 {
+				fmt.Println("Usage: /profile rm <name>")
+				return
+			}
+			name := parts[2]
+			if _, ok := config.Profiles[name]; !ok {
+				fmt.Printf("Profile '%s' not found.\n", name)
+				return
+			}
+			if name == config.ActiveProfile {
+				deactivateProfile(config)
+			}
+			delete(config.Profiles, name)
+			if err := saveConfig(config); err != nil {
+				fmt.Fprintf(os.Stderr, "Error saving config: %s\n", err)
+			}
+			fmt.Printf("Profile '%s' removed.\n", name)
+		default:
+			fmt.Println("Usage: /profile [list|use <name>|add <name> [key=value ...]|clear|rm <name>]")
 		}
 	case "/config":
 		fmt.Printf("Model: %s\n", config.Model)
 		fmt.Printf("Mini Model: %s\n", config.MiniModel)
-		fmt.Printf("Provider: %s\n", config.APIURL)
+		fmt.Printf("Provider: %s\n", getProvider(config).Name())
+		fmt.Printf("API URL: %s\n", config.APIURL)
+		if config.ActiveProfile != "" {
+			fmt.Printf("Profile: %s\n", config.ActiveProfile)
+		}
 		fmt.Printf("RAG Enabled: %t\n", config.RAGEnabled)
 		fmt.Printf("RAG Path: %s\n", config.RAGPath)
 		fmt.Printf("Operation Mode: %s\n", config.OperationMode)
 		fmt.Printf("Execution Mode: %s\n", config.ExecutionMode)
+		fmt.Printf("Sandbox: %s\n", describeSandbox(config.Sandbox))
+		fmt.Printf("Resource Limits: %s\n", config.ResourceLimits)
 		fmt.Printf("Auto Compress Enabled: %t\n", config.AutoCompress)
 		fmt.Printf("Auto Compress Threshold: %d\n", config.AutoCompressThreshold)
 		fmt.Printf("Model Context Length: %d\n", config.ModelContextLength)
 		fmt.Printf("Subagents Enabled: %t\n", config.SubagentsEnabled)
+		fmt.Printf("Streaming: %t\n", config.Stream)
+		if config.MaxSessionTokens > 0 {
+			fmt.Printf("Max Session Tokens: %s\n", formatNumber(config.MaxSessionTokens))
+		}
+		if config.MaxSessionCost > 0 {
+			fmt.Printf("Max Session Cost: %s\n", formatCost(config.MaxSessionCost))
+		}
+		if config.MaxDailyCost > 0 {
+			fmt.Printf("Max Daily Cost: %s\n", formatCost(config.MaxDailyCost))
+		}
 		if len(config.MCPs) > 0 {
 			fmt.Println("MCP Servers:")
 			for name, server := range config.MCPs {
@@ -1603,7 +1956,9 @@ CRITICAL: Only include information that is:
 	  REMEMBER: The goal is to create documentation that enables AI assistants to be immediately productive in this codebase, focusing on project-specific knowledge that isn't obvious from the code structure alone.`
 
 		fmt.Println("Spawning subagent to analyze codebase and create AGENTS.md...")
-		result, err := runSubAgent(task, config)
+		ctx := beginTurn()
+		result, err := runSubAgent(ctx, task, config)
+		endTurn()
 		if err != nil {
 			fmt.Printf("Initialization failed: %v\n", err)
 		} else {
@@ -1679,6 +2034,7 @@ CRITICAL: Only include information that is:
 		totalTokens = 0
 		totalPromptTokens = 0
 		totalCompletionTokens = 0
+		resetModelUsage()
 
 		fmt.Println("Context cleared.")
 	case "/subagents":
@@ -1712,8 +2068,36 @@ CRITICAL: Only include information that is:
 					fmt.Printf("Current sub-agent verbose mode: %d\n", config.SubAgentVerboseMode)
 					fmt.Println("Usage: /subagents verbose <1|2> (1: Default, 2: Full)")
 				}
+			case "depth":
+				if len(parts) > 2 {
+					depth, err := strconv.Atoi(parts[2])
+					if err != nil || depth < 1 {
+						fmt.Println("Usage: /subagents depth <n> (1: only the main agent spawns sub-agents)")
+					} else {
+						config.MaxSubAgentDepth = depth
+						if err := saveConfig(config); err != nil {
+							fmt.Fprintf(os.Stderr, "Error saving config: %s\n", err)
+						}
+						fmt.Printf("Sub-agent nesting depth set to %d\n", depth)
+					}
+				} else {
+					fmt.Printf("Current sub-agent nesting depth: %d\n", maxSubAgentDepth(config))
+					fmt.Println("Usage: /subagents depth <n> (1: only the main agent spawns sub-agents)")
+				}
+			case "tree":
+				width := readline.GetScreenWidth()
+				if width <= 0 {
+					width = 80
+				}
+				lines := formatSubAgentTree(width - 1)
+				if len(lines) == 0 {
+					fmt.Println("No sub-agents have run in this session.")
+				}
+				for _, line := range lines {
+					fmt.Println(line)
+				}
 			default:
-				fmt.Println("Usage: /subagents [on|off|verbose]")
+				fmt.Println("Usage: /subagents [on|off|verbose|depth|tree]")
 			}
 		} else {
 			if config.SubagentsEnabled {
@@ -1722,6 +2106,8 @@ CRITICAL: Only include information that is:
 				fmt.Println("Sub-agent spawning is currently disabled.")
 			}
 			fmt.Printf("Sub-agent verbose mode: %d\n", config.SubAgentVerboseMode)
+			fmt.Printf("Sub-agent nesting depth: %d\n", maxSubAgentDepth(config))
+			fmt.Printf("Sub-agent step limit: %d\n", maxSubAgentIterations(config))
 		}
 	case "/agent":
 		if len(parts) < 2 {
@@ -1797,6 +2183,7 @@ CRITICAL: Only include information that is:
 			totalTokens = 0
 			totalPromptTokens = 0
 			totalCompletionTokens = 0
+			resetModelUsage()
 
 			fmt.Printf("Active agent set to '%s'. Context cleared.\n", name)
 
@@ -1832,6 +2219,7 @@ CRITICAL: Only include information that is:
 			totalTokens = 0
 			totalPromptTokens = 0
 			totalCompletionTokens = 0
+			resetModelUsage()
 
 			fmt.Println("Active agent cleared. Reverted to build agent. Context cleared.")
 
@@ -1876,9 +2264,9 @@ func buildSystemPrompt(contextSummary string) string {
 	}
 
 	if config.OperationMode == Plan {
-		basePrompt += "You are an AI assistant in PLAN mode. Your goals are to:\n1. Analyze the user's request.\n2. Create a detailed implementation plan.\n3. Generate a comprehensive TODO list using the `create_todo` tool. This is CRITICAL. You MUST create the todo list before suggesting the plan.\n4. Present the plan to the user using the `suggest_plan` tool for approval.\n\nIMPORTANT: You CANNOT execute shell commands in this mode. Focus purely on planning. Use the `suggest_plan` tool to show your plan (providing a name and description) and ask for confirmation. If the user approves (answers 'y' to the prompt), the system will automatically switch to 'build' mode for you to start implementation."
+		basePrompt += "You are an AI assistant in PLAN mode. Your goals are to:\n1. Analyze the user's request.\n2. Create a detailed implementation plan.\n3. Generate a comprehensive TODO list using the `create_todo` tool. This is CRITICAL. You MUST create the todo list before suggesting the plan.\n4. Present the plan to the user using the `suggest_plan` tool for approval.\n\nIMPORTANT: You CANNOT execute shell commands in this mode. Use `read_file`, `search_files` and `list_files` to inspect the codebase. Focus purely on planning. Use the `suggest_plan` tool to show your plan (providing a name and description) and ask for confirmation. If the user approves (answers 'y' to the prompt), the system will automatically switch to 'build' mode for you to start implementation."
 	} else {
-		basePrompt += "You are an AI assistant in BUILD mode. You can execute commands, write code, and implement solutions. You can manage a todo list by using the `create_todo`, `update_todo`, and `get_todo_list` tools. You can also create notes using `create_note`, `update_note`, and `delete_note` tools. Notes persist across sessions. For multi-step tasks, chain commands with && (e.g., 'echo content > file.py && python3 file.py'). Use execute_command for shell tasks."
+		basePrompt += "You are an AI assistant in BUILD mode. You can execute commands, write code, and implement solutions. You can manage a todo list by using the `create_todo`, `update_todo`, and `get_todo_list` tools. You can also create notes using `create_note`, `update_note`, and `delete_note` tools. Notes persist across sessions. Use `read_file`, `write_file` and `edit_file` to read and change files, and execute_command for shell tasks. For multi-step tasks, chain commands with && (e.g., 'make build && ./run-tests.sh')."
 	}
 
 	// If a task-specific agent is active, prepend its system prompt.
@@ -1992,10 +2380,11 @@ func runSetup() {
 func runTask(task string) {
 	// Load configuration
 	config = loadConfig()
-	if config.APIKey == "" {
+	if missingAPIKey(config) {
 		fmt.Fprintln(os.Stderr, "Error: API key not set. Please run the interactive setup first.")
 		os.Exit(1)
 	}
+	applyModelCapabilities(config)
 
 	// Create agent instance with build agent as default
 	agent = &Agent{
@@ -2009,15 +2398,27 @@ func runTask(task string) {
 		Role:    "system",
 		Content: &systemPrompt,
 	})
+	runSessionStartHooks(context.Background(), agent)
+
+	hookContext, ok := runUserPromptSubmitHooks(context.Background(), agent, task)
+	if !ok {
+		os.Exit(1)
+	}
 
 	// Add the task as a user message
 	agent.Messages = append(agent.Messages, Message{
 		Role:    "user",
 		Content: &task,
 	})
+	appendHookContext(agent, hookContext)
 
 	// Execute the task using the agentic loop
+	stopContinuations := 0
 	for {
+		if !checkBudget(config) {
+			break
+		}
+
 		var resp *APIResponse
 		var err error
 
@@ -2030,7 +2431,7 @@ func runTask(task string) {
 		// Retry logic if the model returns an empty response
 		const maxEmptyRetries = 2
 		for attempt := 0; attempt <= maxEmptyRetries; attempt++ {
-			resp, err = sendAPIRequest(agent, config, config.SubagentsEnabled, agentDef)
+			resp, err = sendAPIRequest(context.Background(), agent, config, config.SubagentsEnabled, agentDef)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 				break
@@ -2086,7 +2487,7 @@ func runTask(task string) {
 				continue
 			}
 
-			processToolCalls(agent, assistantMsg.ToolCalls, config)
+			processToolCalls(context.Background(), agent, assistantMsg.ToolCalls, config)
 		} else {
 			// No tool calls, reset loop detection
 			resetToolLoopState()
@@ -2094,6 +2495,10 @@ func runTask(task string) {
 			if assistantMsg.Content == nil || *assistantMsg.Content == "" {
 				fmt.Printf("%sWarning: Received empty response from model%s\n", ColorYellow, ColorReset)
 			}
+			if runStopHooks(context.Background(), agent, stopContinuations) {
+				stopContinuations++
+				continue
+			}
 			break // No more tools to call, end agent turn
 		}
 		// Continue loop to send tool output back to API
@@ -2105,10 +2510,11 @@ func runTask(task string) {
 // runDeployMode handles the CLI "deploy" command for non-interactive deployment.
 func runDeployMode() {
 	config = loadConfig()
-	if config.APIKey == "" {
+	if missingAPIKey(config) {
 		fmt.Fprintln(os.Stderr, "Error: API key not set. Please run the interactive setup first.")
 		os.Exit(1)
 	}
+	applyModelCapabilities(config)
 
 	if !config.SubagentsEnabled {
 		fmt.Fprintln(os.Stderr, "Error: Subagents are disabled. Enable them with /subagents on first.")
@@ -2133,7 +2539,7 @@ DEPLOY.md contents:
 Execute the deployment steps. Report progress and any issues encountered.`, deployFileContent)
 
 	fmt.Println("Starting deployment...")
-	result, err := runSubAgent(task, config)
+	result, err := runSubAgent(context.Background(), task, config)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Deployment failed: %v\n", err)
 		os.Exit(1)
@@ -2150,10 +2556,11 @@ func runPipelineMode(task string) {
 
 	// Load configuration
 	config = loadConfig()
-	if config.APIKey == "" {
+	if missingAPIKey(config) {
 		fmt.Fprintln(os.Stderr, "Error: API key not set. Please run the interactive setup first.")
 		os.Exit(1)
 	}
+	applyModelCapabilities(config)
 
 	// Read stdin content
 	stdinBytes, err := io.ReadAll(os.Stdin)
@@ -2188,15 +2595,27 @@ func runPipelineMode(task string) {
 		Role:    "system",
 		Content: &systemPrompt,
 	})
+	runSessionStartHooks(context.Background(), agent)
+
+	hookContext, ok := runUserPromptSubmitHooks(context.Background(), agent, userMessage)
+	if !ok {
+		os.Exit(1)
+	}
 
 	// Add the combined message as a user message
 	agent.Messages = append(agent.Messages, Message{
 		Role:    "user",
 		Content: &userMessage,
 	})
+	appendHookContext(agent, hookContext)
 
 	// Execute the task using the agentic loop
+	stopContinuations := 0
 	for {
+		if !checkBudget(config) {
+			break
+		}
+
 		var resp *APIResponse
 		var err error
 
@@ -2209,7 +2628,7 @@ func runPipelineMode(task string) {
 		// Retry logic if the model returns an empty response
 		const maxEmptyRetries = 2
 		for attempt := 0; attempt <= maxEmptyRetries; attempt++ {
-			resp, err = sendAPIRequest(agent, config, config.SubagentsEnabled, agentDef)
+			resp, err = sendAPIRequest(context.Background(), agent, config, config.SubagentsEnabled, agentDef)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 				break
@@ -2267,10 +2686,14 @@ func runPipelineMode(task string) {
 				continue
 			}
 
-			processToolCalls(agent, assistantMsg.ToolCalls, config)
+			processToolCalls(context.Background(), agent, assistantMsg.ToolCalls, config)
 		} else {
 			// No tool calls, reset loop detection
 			resetToolLoopState()
+			if runStopHooks(context.Background(), agent, stopContinuations) {
+				stopContinuations++
+				continue
+			}
 			// No more tools to call, end agent turn
 			break
 		}
@@ -2336,17 +2759,33 @@ func editCommand() {
 
 	// Add the content to the agent's messages
 	promptContent := string(content)
+	hookContext, ok := runUserPromptSubmitHooks(context.Background(), agent, promptContent)
+	if !ok {
+		return
+	}
 	agent.Messages = append(agent.Messages, Message{
 		Role:    "user",
 		Content: &promptContent,
 	})
+	appendHookContext(agent, hookContext)
 
 	// Print a success message
 	fmt.Printf("Added content to prompt from %s\n", tmpFileName)
 
 	// Now trigger the model response (agentic loop)
 	// We'll call the same loop that processes user input
+	ctx := beginTurn()
+	defer endTurn()
+	stopContinuations := 0
 	for {
+		if ctx.Err() != nil {
+			fmt.Printf("%sTurn cancelled.%s\n", ColorMeta, ColorReset)
+			return
+		}
+		if !checkBudget(config) {
+			return
+		}
+
 		// Auto-compress context if enabled and current context exceeds 75% of limit
 		// Uses "Last Usage" algorithm - currentContextTokens reflects actual context size
 		if config.AutoCompress && currentContextTokens > (config.ModelContextLength*3/4) {
@@ -2366,10 +2805,21 @@ func editCommand() {
 			agentDef, _ = loadAgentDefinition(agent.AgentDefName)
 		}
 
-		resp, err = sendAPIRequest(agent, config, config.SubagentsEnabled, agentDef)
+		var printer *streamPrinter
+		if config.Stream {
+			printer = newStreamPrinter()
+			resp, err = sendAPIRequestStreaming(ctx, agent, config, config.SubagentsEnabled, agentDef, printer.handle)
+			printer.finish()
+		} else {
+			resp, err = sendAPIRequest(ctx, agent, config, config.SubagentsEnabled, agentDef)
+		}
 
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			if ctx.Err() != nil {
+				fmt.Printf("%sTurn cancelled.%s\n", ColorMeta, ColorReset)
+			} else {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			}
 			return // Break from the agentic loop
 		}
 
@@ -2381,10 +2831,10 @@ func editCommand() {
 		assistantMsg := resp.Choices[0].Message
 		agent.Messages = append(agent.Messages, assistantMsg)
 
-		if assistantMsg.ReasoningContent != nil && *assistantMsg.ReasoningContent != "" {
-			fmt.Printf("%s●%s Think...\n%s", ColorHighlight, StyleItalic, ColorMeta, ColorReset)
+		if assistantMsg.ReasoningContent != nil && *assistantMsg.ReasoningContent != "" && !printer.printedReasoning() {
+			fmt.Printf("%s● %sThink...\n%s", ColorHighlight, ColorMeta, ColorReset)
 		}
-		if assistantMsg.Content != nil && *assistantMsg.Content != "" {
+		if assistantMsg.Content != nil && *assistantMsg.Content != "" && !printer.printedContent() {
 			fmt.Printf("%s● %s%s%s\n", ColorHighlight, ColorMain, *assistantMsg.Content, ColorReset)
 		}
 
@@ -2415,7 +2865,7 @@ func editCommand() {
 			}
 		case UsageBasic:
 			if resp.Usage.TotalTokens > 0 {
-				fmt.Printf("%sUsed %s%s%s tokens on %s%s\n", ColorMeta, ColorHighlight, formatTokenCount(totalTokens), ColorMeta, config.Model, ColorReset)
+				fmt.Printf("%sUsed %s%s%s tokens on %s%s\n", ColorMeta, ColorHighlight, formatTokenCount(totalTokens), ColorMeta, resp.Model, ColorReset)
 			}
 		case UsageSilent:
 			fallthrough
@@ -2437,7 +2887,7 @@ func editCommand() {
 				continue
 			}
 
-			processToolCalls(agent, assistantMsg.ToolCalls, config)
+			processToolCalls(ctx, agent, assistantMsg.ToolCalls, config)
 		} else {
 			// No tool calls, reset loop detection
 			resetToolLoopState()
@@ -2445,6 +2895,10 @@ func editCommand() {
 			if assistantMsg.Content == nil || *assistantMsg.Content == "" {
 				fmt.Printf("%sWarning: Received empty response from model%s\n", ColorMeta, ColorReset)
 			}
+			if runStopHooks(ctx, agent, stopContinuations) {
+				stopContinuations++
+				continue
+			}
 			break // No more tools to call, end agent turn
 		}
 		// Continue loop to send tool output back to API
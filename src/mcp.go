@@ -46,6 +46,8 @@ func (m *mcpManager) ensureMCP(serverName string) (*mcp.ClientSession, error) {
 	// Launch the MCP server using the configured command
 	cmdParts := strings.Fields(mcpServer.Command)
 	cmd := exec.Command(cmdParts[0], cmdParts[1:]...)
+	// Keep the server out of the terminal's process group so Ctrl+C doesn't kill it
+	setProcessGroup(cmd)
 	transport := &mcp.CommandTransport{Command: cmd}
 	ctx := context.Background()
 
@@ -60,8 +62,8 @@ func (m *mcpManager) ensureMCP(serverName string) (*mcp.ClientSession, error) {
 	return session, nil
 }
 
-// useMCPTool calls a tool on a specified MCP server
-func useMCPTool(serverName, toolName string, arguments map[string]interface{}) (string, error) {
+// useMCPTool calls a tool on a specified MCP server. The call is abandoned when ctx is cancelled.
+func useMCPTool(ctx context.Context, serverName, toolName string, arguments map[string]interface{}) (string, error) {
 	// SECURITY: Block MCP tool usage in Plan mode
 	// MCP tools can provide command execution capabilities, which would bypass
 	// the Plan mode security restriction against command execution.
@@ -74,7 +76,6 @@ func useMCPTool(serverName, toolName string, arguments map[string]interface{}) (
 		return "", err
 	}
 
-	ctx := context.Background()
 	params := &mcp.CallToolParams{
 		Name:      toolName,
 		Arguments: arguments,
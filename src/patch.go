@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ApplyPatchArgs represents arguments for applying a unified diff
+type ApplyPatchArgs struct {
+	Patch string `json:"patch"`
+}
+
+// FilePatch is the part of a unified diff that changes one file.
+type FilePatch struct {
+	OldPath  string // Empty for a new file
+	NewPath  string // Empty for a deleted file
+	IsNew    bool
+	IsDelete bool
+	Hunks    []Hunk
+}
+
+// Hunk is one "@@ -l,n +l,n @@" section of a FilePatch. Lines keep their ' ', '-' or '+' prefix.
+type Hunk struct {
+	Header       string
+	OldStart     int // 0 if the header has no line numbers
+	Lines        []string
+	OldNoNewline bool // "\ No newline at end of file" after the old side
+	NewNoNewline bool // "\ No newline at end of file" after the new side
+}
+
+// PatchFuzz is the number of context lines that may be dropped from each end of a hunk when its
+// full context can't be found.
+const PatchFuzz = 2
+
+var hunkHeaderPattern = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// parsePatch parses a unified or git-style diff. Hunk line counts in headers are not trusted,
+// since models often get them wrong; a hunk ends at the next header or unrecognized line.
+func parsePatch(text string) ([]FilePatch, error) {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	var patches []FilePatch
+	var current *FilePatch
+
+	startFile := func() {
+		patches = append(patches, FilePatch{})
+		current = &patches[len(patches)-1]
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			startFile()
+			if oldPath, newPath, ok := parseGitDiffPaths(strings.TrimPrefix(line, "diff --git ")); ok {
+				current.OldPath, current.NewPath = oldPath, newPath
+			}
+		case current != nil && len(current.Hunks) == 0 && strings.HasPrefix(line, "new file mode"):
+			current.IsNew = true
+		case current != nil && len(current.Hunks) == 0 && strings.HasPrefix(line, "deleted file mode"):
+			current.IsDelete = true
+		case current != nil && len(current.Hunks) == 0 && strings.HasPrefix(line, "rename from "):
+			current.OldPath = strings.TrimPrefix(line, "rename from ")
+		case current != nil && len(current.Hunks) == 0 && strings.HasPrefix(line, "rename to "):
+			current.NewPath = strings.TrimPrefix(line, "rename to ")
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			// A plain unified diff has no "diff --git" line; start a new file unless the header
+			// belongs to the git block we're in
+			if current == nil || len(current.Hunks) > 0 {
+				startFile()
+			}
+			oldPath := parsePatchPath(strings.TrimPrefix(line, "--- "))
+			newPath := parsePatchPath(strings.TrimPrefix(lines[i+1], "+++ "))
+			current.IsNew = current.IsNew || oldPath == ""
+			current.IsDelete = current.IsDelete || newPath == ""
+			if oldPath != "" {
+				current.OldPath = oldPath
+			}
+			if newPath != "" {
+				current.NewPath = newPath
+			}
+			i++
+		case strings.HasPrefix(line, "@@"):
+			if current == nil {
+				return nil, fmt.Errorf("hunk %q appears before any file header", line)
+			}
+			hunk := Hunk{Header: line}
+			if m := hunkHeaderPattern.FindStringSubmatch(line); m != nil {
+				hunk.OldStart, _ = strconv.Atoi(m[1])
+			}
+			for i+1 < len(lines) {
+				next := lines[i+1]
+				if next == "" {
+					// Editors and models often strip the space from empty context lines
+					if i+2 < len(lines) && isHunkLine(lines[i+2]) && !isFileHeader(lines, i+2) {
+						hunk.Lines = append(hunk.Lines, " ")
+						i++
+						continue
+					}
+					break
+				}
+				if strings.HasPrefix(next, `\`) {
+					if len(hunk.Lines) > 0 {
+						switch hunk.Lines[len(hunk.Lines)-1][0] {
+						case '-':
+							hunk.OldNoNewline = true
+						case '+':
+							hunk.NewNoNewline = true
+						default:
+							hunk.OldNoNewline, hunk.NewNoNewline = true, true
+						}
+					}
+					i++
+					continue
+				}
+				if !isHunkLine(next) || isFileHeader(lines, i+1) {
+					break
+				}
+				hunk.Lines = append(hunk.Lines, next)
+				i++
+			}
+			if len(hunk.Lines) == 0 {
+				return nil, fmt.Errorf("hunk %q has no lines", line)
+			}
+			current.Hunks = append(current.Hunks, hunk)
+		}
+	}
+
+	var result []FilePatch
+	for _, p := range patches {
+		if p.OldPath == "" && p.NewPath == "" {
+			continue
+		}
+		if p.IsNew {
+			p.OldPath = ""
+		}
+		if p.IsDelete {
+			p.NewPath = ""
+		}
+		if len(p.Hunks) == 0 && !p.IsDelete && (p.IsNew || p.OldPath == p.NewPath) {
+			return nil, fmt.Errorf("no hunks for %s", p.displayPath())
+		}
+		result = append(result, p)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no file changes found; the patch must be a unified diff with ---/+++ headers and @@ hunks")
+	}
+	return result, nil
+}
+
+// isHunkLine reports whether line is a context, removed or added line.
+func isHunkLine(line string) bool {
+	return line != "" && (line[0] == ' ' || line[0] == '-' || line[0] == '+')
+}
+
+// isFileHeader reports whether lines[i] starts a "--- old" / "+++ new" header pair.
+func isFileHeader(lines []string, i int) bool {
+	return strings.HasPrefix(lines[i], "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ ")
+}
+
+// parsePatchPath extracts the path from a ---/+++ header, stripping the a/ or b/ prefix and any
+// trailing timestamp. /dev/null yields "".
+func parsePatchPath(header string) string {
+	path, _, _ := strings.Cut(header, "\t")
+	path = strings.TrimSpace(path)
+	if path == "/dev/null" {
+		return ""
+	}
+	if unquoted, err := strconv.Unquote(path); err == nil {
+		path = unquoted
+	}
+	if strings.HasPrefix(path, "a/") || strings.HasPrefix(path, "b/") {
+		path = path[2:]
+	}
+	return path
+}
+
+// parseGitDiffPaths splits "a/old b/new" from a "diff --git" line.
+func parseGitDiffPaths(s string) (string, string, bool) {
+	if idx := strings.Index(s, " b/"); idx >= 0 && strings.HasPrefix(s, "a/") {
+		return s[2:idx], s[idx+3:], true
+	}
+	return "", "", false
+}
+
+func (p FilePatch) displayPath() string {
+	switch {
+	case p.IsNew:
+		return p.NewPath
+	case p.IsDelete:
+		return p.OldPath
+	case p.OldPath != p.NewPath:
+		return p.OldPath + " → " + p.NewPath
+	default:
+		return p.NewPath
+	}
+}
+
+// hunkSides returns the lines a hunk expects to find and the lines it replaces them with.
+func hunkSides(h Hunk) ([]string, []string) {
+	var oldLines, newLines []string
+	for _, line := range h.Lines {
+		text := line[1:]
+		switch line[0] {
+		case ' ':
+			oldLines = append(oldLines, text)
+			newLines = append(newLines, text)
+		case '-':
+			oldLines = append(oldLines, text)
+		case '+':
+			newLines = append(newLines, text)
+		}
+	}
+	return oldLines, newLines
+}
+
+// findHunk locates oldLines in lines, preferring the position nearest to want. It tries an exact
+// match, then one ignoring whitespace differences.
+func findHunk(lines, oldLines []string, want int) int {
+	for _, equal := range []func(a, b string) bool{
+		func(a, b string) bool { return a == b },
+		func(a, b string) bool {
+			return strings.Join(strings.Fields(a), " ") == strings.Join(strings.Fields(b), " ")
+		},
+	} {
+		matches := func(at int) bool {
+			for k, old := range oldLines {
+				if !equal(lines[at+k], old) {
+					return false
+				}
+			}
+			return true
+		}
+		last := len(lines) - len(oldLines)
+		want = min(max(want, 0), max(last, 0))
+		for delta := 0; want-delta >= 0 || want+delta <= last; delta++ {
+			if at := want - delta; at >= 0 && at <= last && matches(at) {
+				return at
+			}
+			if at := want + delta; delta > 0 && at <= last && matches(at) {
+				return at
+			}
+		}
+	}
+	return -1
+}
+
+// applyHunk applies h to lines near line want (0-based). If the full context isn't found, up to
+// PatchFuzz context lines are dropped from each end, like patch's fuzz factor.
+func applyHunk(lines []string, h Hunk, want int) ([]string, error) {
+	oldLines, newLines := hunkSides(h)
+	if len(oldLines) == 0 {
+		// Pure insertion, e.g. into an empty file. "@@ -N,0" inserts after line N, which is
+		// index want+1; -0,0 inserts at the start.
+		at := min(max(want+1, 0), len(lines))
+		return splice(lines, at, 0, newLines), nil
+	}
+
+	for fuzz := 0; fuzz <= PatchFuzz; fuzz++ {
+		lead := min(fuzz, leadingContext(h.Lines))
+		trail := min(fuzz, trailingContext(h.Lines))
+		if fuzz > 0 && lead == 0 && trail == 0 {
+			break
+		}
+		if lead+trail >= len(oldLines) {
+			break
+		}
+		old := oldLines[lead : len(oldLines)-trail]
+		replacement := newLines[lead : len(newLines)-trail]
+		if at := findHunk(lines, old, want+lead); at >= 0 {
+			return splice(lines, at, len(old), replacement), nil
+		}
+	}
+	return nil, fmt.Errorf("context not found")
+}
+
+func leadingContext(hunkLines []string) int {
+	n := 0
+	for n < len(hunkLines) && hunkLines[n][0] == ' ' {
+		n++
+	}
+	return n
+}
+
+func trailingContext(hunkLines []string) int {
+	n := 0
+	for n < len(hunkLines) && hunkLines[len(hunkLines)-1-n][0] == ' ' {
+		n++
+	}
+	return n
+}
+
+// splice replaces count lines of lines at index at with repl.
+func splice(lines []string, at, count int, repl []string) []string {
+	out := make([]string, 0, len(lines)-count+len(repl))
+	out = append(out, lines[:at]...)
+	out = append(out, repl...)
+	return append(out, lines[at+count:]...)
+}
+
+// patchResult is the outcome of applying a FilePatch in memory.
+type patchResult struct {
+	patch   FilePatch
+	before  string
+	after   string
+	mode    os.FileMode
+	failure []string
+}
+
+// applyFilePatch applies all hunks of p to the current file content without writing anything.
+func applyFilePatch(p FilePatch) patchResult {
+	res := patchResult{patch: p, mode: 0644}
+	if !p.IsNew {
+		data, err := os.ReadFile(p.OldPath)
+		if err != nil {
+			res.failure = append(res.failure, fmt.Sprintf("%s: %s", p.OldPath, err))
+			return res
+		}
+		res.before = string(data)
+		if info, err := os.Stat(p.OldPath); err == nil {
+			res.mode = info.Mode().Perm()
+		}
+	} else if _, err := os.Stat(p.NewPath); err == nil {
+		res.failure = append(res.failure, fmt.Sprintf("%s: file already exists", p.NewPath))
+		return res
+	}
+	if !p.IsDelete && !p.IsNew && p.OldPath != p.NewPath {
+		if _, err := os.Stat(p.NewPath); err == nil {
+			res.failure = append(res.failure, fmt.Sprintf("%s: rename target already exists", p.NewPath))
+			return res
+		}
+	}
+	if p.IsDelete {
+		return res
+	}
+
+	lines := splitLines(res.before)
+	eol := "\n"
+	if strings.Contains(res.before, "\r\n") {
+		eol = "\r\n"
+	}
+	finalNewline := res.before == "" || strings.HasSuffix(res.before, "\n")
+
+	offset := 0
+	for n, h := range p.Hunks {
+		updated, err := applyHunk(lines, h, h.OldStart-1+offset)
+		if err != nil {
+			res.failure = append(res.failure, fmt.Sprintf("%s: hunk %d (%s) failed: %s", p.displayPath(), n+1, h.Header, err))
+			continue
+		}
+		offset += len(updated) - len(lines)
+		lines = updated
+		if h.NewNoNewline {
+			finalNewline = false
+		} else if h.OldNoNewline {
+			finalNewline = true
+		}
+	}
+
+	res.after = strings.Join(lines, eol)
+	if len(lines) > 0 && finalNewline {
+		res.after += eol
+	}
+	return res
+}
+
+// applyPatch applies a unified diff to the workspace. The patch is all-or-nothing: if any hunk
+// fails, nothing is written and every failure is reported so the model can fix the patch. With a
+// sandbox, only files in its writable paths can be changed.
+func applyPatch(ctx context.Context, config *Config, sandbox SandboxConfig, dir, argsJSON string) (string, []FileChange, error) {
+	var args ApplyPatchArgs
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return "", nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+	if config.OperationMode == Plan {
+		return "", nil, fmt.Errorf("applying patches is blocked in Plan mode. Switch to Build mode to modify files")
+	}
+
+	patches, err := parsePatch(args.Patch)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid patch: %w", err)
+	}
+	// Paths in the patch are relative to the agent's shell directory, like those of the other file tools.
+	// Each file patch is applied to the file as it is on disk, so a path may only appear once.
+	seen := make(map[string]bool)
+	for i := range patches {
+		if patches[i].OldPath != "" {
+			patches[i].OldPath = resolveAgentPath(dir, patches[i].OldPath)
+		}
+		if patches[i].NewPath != "" {
+			patches[i].NewPath = resolveAgentPath(dir, patches[i].NewPath)
+		}
+		paths := []string{patches[i].OldPath}
+		if patches[i].NewPath != patches[i].OldPath {
+			paths = append(paths, patches[i].NewPath)
+		}
+		for _, path := range paths {
+			if path == "" {
+				continue
+			}
+			if err := checkSandboxWritable(sandbox, path); err != nil {
+				return "", nil, err
+			}
+			if seen[path] {
+				return "", nil, fmt.Errorf("invalid patch: %s is changed by more than one file section; put all its hunks in one section", path)
+			}
+			seen[path] = true
+		}
+	}
+
+	var results []patchResult
+	var failures []string
+	for _, p := range patches {
+		res := applyFilePatch(p)
+		failures = append(failures, res.failure...)
+		results = append(results, res)
+	}
+	if len(failures) > 0 {
+		return "", nil, fmt.Errorf("patch not applied, no files were changed:\n- %s\nRe-read the affected files and send a corrected patch", strings.Join(failures, "\n- "))
+	}
+
+	var preview strings.Builder
+	for _, res := range results {
+		preview.WriteString(describePatchResult(res))
+	}
+	approved, err := confirmFileChange(ctx, config, "Apply patch to", fmt.Sprintf("%d file(s)", len(results)), preview.String())
+	if err != nil || !approved {
+		return fileChangeDeclined, nil, err
+	}
+
+	var summary []string
+	var changes []FileChange
+	for _, res := range results {
+		p := res.patch
+		switch {
+		case p.IsDelete:
+			if err := os.Remove(p.OldPath); err != nil {
+				return "", changes, fmt.Errorf("failed to delete %s: %w", p.OldPath, err)
+			}
+			summary = append(summary, "deleted "+p.OldPath)
+			changes = append(changes, FileChange{Path: p.OldPath, Status: "deleted"})
+			continue
+		case p.IsNew:
+			summary = append(summary, "created "+p.NewPath)
+			changes = append(changes, FileChange{Path: p.NewPath, Status: "added"})
+		case p.OldPath != p.NewPath:
+			summary = append(summary, fmt.Sprintf("renamed %s to %s", p.OldPath, p.NewPath))
+			changes = append(changes, FileChange{Path: p.OldPath, Status: "deleted"}, FileChange{Path: p.NewPath, Status: "added"})
+		default:
+			summary = append(summary, "modified "+p.NewPath)
+			changes = append(changes, FileChange{Path: p.NewPath, Status: "modified"})
+		}
+
+		if err := os.MkdirAll(filepath.Dir(p.NewPath), 0755); err != nil {
+			return "", changes, fmt.Errorf("failed to create directory for %s: %w", p.NewPath, err)
+		}
+		if err := os.WriteFile(p.NewPath, []byte(res.after), res.mode); err != nil {
+			return "", changes, fmt.Errorf("failed to write %s: %w", p.NewPath, err)
+		}
+		if !p.IsNew && p.OldPath != p.NewPath {
+			if err := os.Remove(p.OldPath); err != nil {
+				return "", changes, fmt.Errorf("failed to remove %s after rename: %w", p.OldPath, err)
+			}
+		}
+	}
+	return fmt.Sprintf("Patch applied: %s.", strings.Join(summary, ", ")), changes, nil
+}
+
+// describePatchResult renders the effective change to one file for the approval preview.
+func describePatchResult(res patchResult) string {
+	p := res.patch
+	switch {
+	case p.IsDelete:
+		return fmt.Sprintf("--- a/%s\n+++ /dev/null\n(delete file, %d lines)\n", p.OldPath, len(splitLines(res.before)))
+	case p.OldPath != p.NewPath && !p.IsNew:
+		diff := unifiedDiff(p.NewPath, res.before, res.after, false)
+		return fmt.Sprintf("rename %s → %s\n%s", p.OldPath, p.NewPath, diff)
+	default:
+		return unifiedDiff(p.NewPath, res.before, res.after, p.IsNew)
+	}
+}
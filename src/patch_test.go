@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   string
+		want    []FilePatch
+		wantErr string
+	}{
+		{
+			name:  "unified diff",
+			patch: "--- a/main.go\n+++ b/main.go\n@@ -1,3 +1,3 @@\n package main\n-var x = 1\n+var x = 2\n func main() {}\n",
+			want: []FilePatch{{OldPath: "main.go", NewPath: "main.go", Hunks: []Hunk{{
+				Header:   "@@ -1,3 +1,3 @@",
+				OldStart: 1,
+				Lines:    []string{" package main", "-var x = 1", "+var x = 2", " func main() {}"},
+			}}}},
+		},
+		{
+			name:  "context only",
+			patch: "--- a/f.txt\n+++ b/f.txt\n@@ -4,2 +4,2 @@\n four\n five\n",
+			want: []FilePatch{{OldPath: "f.txt", NewPath: "f.txt", Hunks: []Hunk{{
+				Header: "@@ -4,2 +4,2 @@", OldStart: 4, Lines: []string{" four", " five"},
+			}}}},
+		},
+		{
+			name:  "empty context line without its space",
+			patch: "--- a/f.txt\n+++ b/f.txt\n@@ -1,3 +1,3 @@\n one\n\n-three\n+THREE\n",
+			want: []FilePatch{{OldPath: "f.txt", NewPath: "f.txt", Hunks: []Hunk{{
+				Header: "@@ -1,3 +1,3 @@", OldStart: 1, Lines: []string{" one", " ", "-three", "+THREE"},
+			}}}},
+		},
+		{
+			name:  "new file",
+			patch: "diff --git a/new.txt b/new.txt\nnew file mode 100644\n--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1,2 @@\n+hello\n+world\n\\ No newline at end of file\n",
+			want: []FilePatch{{NewPath: "new.txt", IsNew: true, Hunks: []Hunk{{
+				Header: "@@ -0,0 +1,2 @@", Lines: []string{"+hello", "+world"}, NewNoNewline: true,
+			}}}},
+		},
+		{
+			name:  "delete file",
+			patch: "diff --git a/old.txt b/old.txt\ndeleted file mode 100644\n--- a/old.txt\n+++ /dev/null\n@@ -1 +0,0 @@\n-bye\n",
+			want: []FilePatch{{OldPath: "old.txt", IsDelete: true, Hunks: []Hunk{{
+				Header: "@@ -1 +0,0 @@", OldStart: 1, Lines: []string{"-bye"},
+			}}}},
+		},
+		{
+			name:  "delete file without hunks",
+			patch: "diff --git a/old.txt b/old.txt\ndeleted file mode 100644\n",
+			want:  []FilePatch{{OldPath: "old.txt", IsDelete: true}},
+		},
+		{
+			name:  "rename without changes",
+			patch: "diff --git a/a.txt b/b.txt\nsimilarity index 100%\nrename from a.txt\nrename to b.txt\n",
+			want:  []FilePatch{{OldPath: "a.txt", NewPath: "b.txt"}},
+		},
+		{
+			name:  "two files",
+			patch: "--- a/x\n+++ b/x\n@@ -1 +1 @@\n-a\n+b\n--- a/y\n+++ b/y\n@@ -1 +1 @@\n-c\n+d\n",
+			want: []FilePatch{
+				{OldPath: "x", NewPath: "x", Hunks: []Hunk{{Header: "@@ -1 +1 @@", OldStart: 1, Lines: []string{"-a", "+b"}}}},
+				{OldPath: "y", NewPath: "y", Hunks: []Hunk{{Header: "@@ -1 +1 @@", OldStart: 1, Lines: []string{"-c", "+d"}}}},
+			},
+		},
+		{
+			name:    "empty hunk",
+			patch:   "--- a/f.txt\n+++ b/f.txt\n@@ -1,2 +1,2 @@\n",
+			wantErr: "has no lines",
+		},
+		{
+			name:    "hunk before file header",
+			patch:   "@@ -1 +1 @@\n-a\n+b\n",
+			wantErr: "before any file header",
+		},
+		{
+			name:    "file without hunks",
+			patch:   "--- a/f.txt\n+++ b/f.txt\n",
+			wantErr: "no hunks for f.txt",
+		},
+		{
+			name:    "not a diff",
+			patch:   "replace line 3 with foo",
+			wantErr: "no file changes found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePatch(tt.patch)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePatch: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyHunk(t *testing.T) {
+	file := []string{"l1", "l2", "l3", "l4", "l5", "l6"}
+	tests := []struct {
+		name    string
+		lines   []string
+		hunk    Hunk
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "replace line",
+			lines: file,
+			hunk:  Hunk{OldStart: 2, Lines: []string{" l2", "-l3", "+L3", " l4"}},
+			want:  []string{"l1", "l2", "L3", "l4", "l5", "l6"},
+		},
+		{
+			name:  "context only",
+			lines: file,
+			hunk:  Hunk{OldStart: 3, Lines: []string{" l3", " l4"}},
+			want:  file,
+		},
+		{
+			name:  "insertion after line",
+			lines: []string{"l1", "l2", "l3"},
+			hunk:  Hunk{OldStart: 2, Lines: []string{"+NEW"}},
+			want:  []string{"l1", "l2", "NEW", "l3"},
+		},
+		{
+			name:  "insertion at start",
+			lines: []string{"l1", "l2"},
+			hunk:  Hunk{OldStart: 0, Lines: []string{"+NEW"}},
+			want:  []string{"NEW", "l1", "l2"},
+		},
+		{
+			name:  "insertion at end",
+			lines: []string{"l1", "l2"},
+			hunk:  Hunk{OldStart: 2, Lines: []string{"+NEW"}},
+			want:  []string{"l1", "l2", "NEW"},
+		},
+		{
+			name:  "insertion with context",
+			lines: file,
+			hunk:  Hunk{OldStart: 1, Lines: []string{" l1", "+NEW", " l2"}},
+			want:  []string{"l1", "NEW", "l2", "l3", "l4", "l5", "l6"},
+		},
+		{
+			name:  "new file",
+			lines: nil,
+			hunk:  Hunk{Lines: []string{"+hello", "+world"}},
+			want:  []string{"hello", "world"},
+		},
+		{
+			name:  "deletion",
+			lines: file,
+			hunk:  Hunk{OldStart: 4, Lines: []string{" l4", "-l5", " l6"}},
+			want:  []string{"l1", "l2", "l3", "l4", "l6"},
+		},
+		{
+			name:  "delete whole file",
+			lines: []string{"l1", "l2"},
+			hunk:  Hunk{OldStart: 1, Lines: []string{"-l1", "-l2"}},
+			want:  []string{},
+		},
+		{
+			name:  "wrong line number",
+			lines: file,
+			hunk:  Hunk{OldStart: 1, Lines: []string{" l4", "-l5", "+L5"}},
+			want:  []string{"l1", "l2", "l3", "l4", "L5", "l6"},
+		},
+		{
+			name:  "nearest of repeated matches",
+			lines: []string{"x", "a", "x", "a", "x"},
+			hunk:  Hunk{OldStart: 4, Lines: []string{"-a", "+b"}},
+			want:  []string{"x", "a", "x", "b", "x"},
+		},
+		{
+			name:  "whitespace differences",
+			lines: []string{"func f() {", "\treturn  1", "}"},
+			hunk:  Hunk{OldStart: 1, Lines: []string{" func f() {", "-    return 1", "+\treturn 2", " }"}},
+			want:  []string{"func f() {", "\treturn 2", "}"},
+		},
+		{
+			name:  "fuzz drops stale context",
+			lines: file,
+			hunk:  Hunk{OldStart: 2, Lines: []string{" stale", " l2", "-l3", "+L3", " l4", " gone"}},
+			want:  []string{"l1", "l2", "L3", "l4", "l5", "l6"},
+		},
+		{
+			name:    "context not found",
+			lines:   file,
+			hunk:    Hunk{OldStart: 2, Lines: []string{" l2", "-missing", "+x", " l4"}},
+			wantErr: true,
+		},
+		{
+			name:    "fuzz never drops changed lines",
+			lines:   file,
+			hunk:    Hunk{OldStart: 1, Lines: []string{" stale", "-missing", " gone"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyHunk(tt.lines, tt.hunk, tt.hunk.OldStart-1)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyHunk: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyFilePatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f.txt")
+	if err := os.WriteFile(path, []byte("l1\nl2\nl3\nl4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second hunk's line number is shifted by the line the first one added
+	patches, err := parsePatch("--- a/f.txt\n+++ b/f.txt\n@@ -1,0 +2 @@\n+A\n@@ -3 +4 @@\n-l3\n+L3\n@@ -4,0 +6 @@\n+Z\n")
+	if err != nil {
+		t.Fatalf("parsePatch: %v", err)
+	}
+	p := patches[0]
+	p.OldPath, p.NewPath = path, path
+	res := applyFilePatch(p)
+	if len(res.failure) > 0 {
+		t.Fatalf("failures: %v", res.failure)
+	}
+	if want := "l1\nA\nl2\nL3\nl4\nZ\n"; res.after != want {
+		t.Errorf("after = %q, want %q", res.after, want)
+	}
+
+	newPath := filepath.Join(dir, "new.txt")
+	res = applyFilePatch(FilePatch{NewPath: newPath, IsNew: true, Hunks: []Hunk{{Lines: []string{"+hello"}, NewNoNewline: true}}})
+	if len(res.failure) > 0 || res.after != "hello" {
+		t.Errorf("new file: after = %q, failures %v", res.after, res.failure)
+	}
+	res = applyFilePatch(FilePatch{NewPath: path, IsNew: true, Hunks: []Hunk{{Lines: []string{"+x"}}}})
+	if len(res.failure) == 0 {
+		t.Error("creating an existing file succeeded")
+	}
+
+	res = applyFilePatch(FilePatch{OldPath: path, IsDelete: true})
+	if len(res.failure) > 0 || res.before != "l1\nl2\nl3\nl4\n" {
+		t.Errorf("delete: before = %q, failures %v", res.before, res.failure)
+	}
+	res = applyFilePatch(FilePatch{OldPath: filepath.Join(dir, "missing.txt"), IsDelete: true})
+	if len(res.failure) == 0 {
+		t.Error("deleting a missing file succeeded")
+	}
+}
+
+func TestApplyPatchRejectsRepeatedPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f.txt")
+	if err := os.WriteFile(path, []byte("l1\nl2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each section would be applied to the original file, so the second would undo the first
+	patch := "--- a/f.txt\n+++ b/f.txt\n@@ -1 +1 @@\n-l1\n+L1\n--- a/f.txt\n+++ b/f.txt\n@@ -2 +2 @@\n-l2\n+L2\n"
+	args, _ := json.Marshal(ApplyPatchArgs{Patch: patch})
+	_, _, err := applyPatch(context.Background(), &Config{OperationMode: Build}, SandboxConfig{}, dir, string(args))
+	if err == nil || !strings.Contains(err.Error(), "more than one file section") {
+		t.Errorf("applyPatch error = %v, want a repeated path error", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "l1\nl2\n" {
+		t.Errorf("file = %q, want it unchanged", data)
+	}
+}
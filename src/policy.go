@@ -1,5 +1,10 @@
 package main
 
+import (
+	"fmt"
+	"slices"
+)
+
 // filterToolsByPolicy applies agent-specific tool policy and operation mode filtering to the base tool list
 func filterToolsByPolicy(baseTools []Tool, agentDef *AgentDefinition, operationMode OperationMode) []Tool {
 	// First, filter by operation mode
@@ -90,3 +95,33 @@ func filterToolsByAgentPolicy(baseTools []Tool, agentDef *AgentDefinition) []Too
 
 	return baseTools
 }
+
+// checkToolAllowed rejects a call to a tool that the operation mode or agent policy doesn't offer.
+// The model only sees permitted tools, but it can still name others in a tool call.
+func checkToolAllowed(name string, agentDef *AgentDefinition, operationMode OperationMode) error {
+	tool := []Tool{{Type: "function", Function: FunctionDefinition{Name: name}}}
+	if len(filterToolsByPolicy(tool, agentDef, operationMode)) == 0 {
+		if agentDef != nil {
+			return fmt.Errorf("tool '%s' is not available to the '%s' agent", name, agentDef.Name)
+		}
+		return fmt.Errorf("tool '%s' is not available in %s mode", name, operationMode)
+	}
+	return nil
+}
+
+// subAgentDefinition returns a copy of def for a sub-agent, with MainAgentOnlyTools taken out of
+// its policy. A whitelist that names nothing else is kept; dispatchToolCall rejects those tools anyway.
+func subAgentDefinition(def *AgentDefinition) *AgentDefinition {
+	sub := *def
+	if len(def.AllowedTools) > 0 {
+		allowed := slices.DeleteFunc(slices.Clone(def.AllowedTools), func(name string) bool {
+			return slices.Contains(MainAgentOnlyTools, name)
+		})
+		if len(allowed) > 0 {
+			sub.AllowedTools = allowed
+		}
+	} else {
+		sub.DeniedTools = append(slices.Clone(def.DeniedTools), MainAgentOnlyTools...)
+	}
+	return &sub
+}
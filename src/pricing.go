@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ModelPrice is the price of a model in USD per million tokens.
+type ModelPrice struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+	Cached     float64 `json:"cached,omitempty"` // Cached prompt tokens; 0 means the prompt price applies
+}
+
+// defaultPrices holds list prices for common models. Users can add or override entries with
+// the "pricing" map in config.json. Dated or suffixed model IDs (e.g. "gpt-4o-2024-08-06")
+// match the longest listed prefix.
+var defaultPrices = map[string]ModelPrice{
+	// OpenAI
+	"gpt-5":         {Prompt: 1.25, Completion: 10.00, Cached: 0.125},
+	"gpt-5-mini":    {Prompt: 0.25, Completion: 2.00, Cached: 0.025},
+	"gpt-5-nano":    {Prompt: 0.05, Completion: 0.40, Cached: 0.005},
+	"gpt-4.1":       {Prompt: 2.00, Completion: 8.00, Cached: 0.50},
+	"gpt-4.1-mini":  {Prompt: 0.40, Completion: 1.60, Cached: 0.10},
+	"gpt-4.1-nano":  {Prompt: 0.10, Completion: 0.40, Cached: 0.025},
+	"gpt-4o":        {Prompt: 2.50, Completion: 10.00, Cached: 1.25},
+	"gpt-4o-mini":   {Prompt: 0.15, Completion: 0.60, Cached: 0.075},
+	"gpt-4-turbo":   {Prompt: 10.00, Completion: 30.00},
+	"gpt-4":         {Prompt: 30.00, Completion: 60.00},
+	"gpt-3.5-turbo": {Prompt: 0.50, Completion: 1.50},
+	"o1":            {Prompt: 15.00, Completion: 60.00, Cached: 7.50},
+	"o1-mini":       {Prompt: 1.10, Completion: 4.40, Cached: 0.55},
+	"o3":            {Prompt: 2.00, Completion: 8.00, Cached: 0.50},
+	"o3-mini":       {Prompt: 1.10, Completion: 4.40, Cached: 0.55},
+	"o4-mini":       {Prompt: 1.10, Completion: 4.40, Cached: 0.275},
+
+	// Anthropic
+	"claude-opus-4":     {Prompt: 15.00, Completion: 75.00, Cached: 1.50},
+	"claude-opus-4-5":   {Prompt: 5.00, Completion: 25.00, Cached: 0.50},
+	"claude-sonnet-4":   {Prompt: 3.00, Completion: 15.00, Cached: 0.30},
+	"claude-3-7-sonnet": {Prompt: 3.00, Completion: 15.00, Cached: 0.30},
+	"claude-3-5-sonnet": {Prompt: 3.00, Completion: 15.00, Cached: 0.30},
+	"claude-haiku-4-5":  {Prompt: 1.00, Completion: 5.00, Cached: 0.10},
+	"claude-3-5-haiku":  {Prompt: 0.80, Completion: 4.00, Cached: 0.08},
+
+	// DeepSeek
+	"deepseek-chat":     {Prompt: 0.27, Completion: 1.10, Cached: 0.07},
+	"deepseek-reasoner": {Prompt: 0.55, Completion: 2.19, Cached: 0.14},
+}
+
+// lookupPrice returns the price for model, checking config overrides before the built-in
+// table. Models served by a local provider are free unless priced explicitly.
+func lookupPrice(config *Config, model string) (ModelPrice, bool) {
+	if price, ok := matchPrice(config.Pricing, model); ok {
+		return price, true
+	}
+	if provider := getProvider(config).Name(); provider == "ollama" || provider == "llamacpp" {
+		return ModelPrice{}, true
+	}
+	return matchPrice(defaultPrices, model)
+}
+
+// matchPrice finds model in prices by exact ID, then by the longest matching prefix. A
+// router-style vendor prefix ("openai/gpt-4o") is ignored when nothing matches the full ID.
+func matchPrice(prices map[string]ModelPrice, model string) (ModelPrice, bool) {
+	if price, ok := prices[model]; ok {
+		return price, true
+	}
+
+	candidates := []string{model}
+	if _, name, ok := strings.Cut(model, "/"); ok {
+		candidates = append(candidates, name)
+	}
+	for _, id := range candidates {
+		best := ""
+		for prefix := range prices {
+			if len(prefix) > len(best) && strings.HasPrefix(id, prefix) {
+				best = prefix
+			}
+		}
+		if best != "" {
+			return prices[best], true
+		}
+	}
+	return ModelPrice{}, false
+}
+
+// requestCost returns the USD cost of a single request's usage at the given price.
+func requestCost(price ModelPrice, usage Usage) float64 {
+	cached := usage.cachedTokens()
+	cachedPrice := price.Cached
+	if cachedPrice == 0 {
+		cachedPrice = price.Prompt
+	}
+	uncached := usage.PromptTokens - cached
+	return (float64(uncached)*price.Prompt + float64(cached)*cachedPrice + float64(usage.CompletionTokens)*price.Completion) / 1_000_000
+}
+
+// formatCost formats a USD amount with enough precision for small per-request costs.
+func formatCost(cost float64) string {
+	if cost > 0 && cost < 0.01 {
+		return fmt.Sprintf("$%.4f", cost)
+	}
+	return fmt.Sprintf("$%.2f", cost)
+}
+
+// sessionCost returns the total USD cost of the session and whether any usage was unpriced.
+func sessionCost(usage map[string]ModelUsage) (float64, bool) {
+	var total float64
+	unpriced := false
+	for _, u := range usage {
+		total += u.Cost
+		unpriced = unpriced || u.Unpriced
+	}
+	return total, unpriced
+}
+
+// formatSessionCost renders a session cost, flagging totals that miss unpriced models.
+func formatSessionCost(usage map[string]ModelUsage) string {
+	total, unpriced := sessionCost(usage)
+	if unpriced {
+		return formatCost(total) + " (excludes models without a known price)"
+	}
+	return formatCost(total)
+}
+
+// formatModelCost renders the cost of one model's usage. When only some of its requests had a
+// known price, the cost of those is shown and marked as partial.
+func formatModelCost(u ModelUsage) string {
+	switch {
+	case u.Unpriced && u.Cost == 0:
+		return "price unknown"
+	case u.Unpriced:
+		return formatCost(u.Cost) + " (partial)"
+	}
+	return formatCost(u.Cost)
+}
+
+// sortedModelNames returns the model names of a usage map in sorted order.
+func sortedModelNames(usage map[string]ModelUsage) []string {
+	models := make([]string, 0, len(usage))
+	for model := range usage {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	return models
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in its own process group, so Ctrl+C in the terminal is
+// delivered only to agent-go and the child can be killed together with its descendants.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills cmd and every process in its group.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return killProcessGroupID(cmd.Process.Pid)
+}
+
+// killProcessGroupID kills the process group led by pid, which need not be a child of agent-go.
+func killProcessGroupID(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGKILL)
+}
+
+// processAlive reports whether a process with the given pid exists.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 )
@@ -43,6 +45,11 @@ func formatToolCallCompact(toolCall ToolCall) string {
 		}
 	}
 
+	// For file tools, show as Read/Write/Edit (path)
+	if compact, ok := formatFileToolCompact(name, argsRaw); ok {
+		return compact
+	}
+
 	// For use_mcp_tool, show as MCP:server.tool (...)
 	if name == "use_mcp_tool" {
 		var args UseMCPToolArgs
@@ -59,392 +66,554 @@ func formatToolCallCompact(toolCall ToolCall) string {
 	return fmt.Sprintf("%s (%s)", name, summary)
 }
 
-// processToolCalls handles the logic for executing tool calls from the API response
-func processToolCalls(agent *Agent, toolCalls []ToolCall, config *Config) {
+// processToolCalls handles the logic for executing tool calls from the API response.
+// If ctx is cancelled, the interrupted call and all remaining calls get a synthetic
+// "cancelled by user" result so that every tool call still has a matching tool message.
+func processToolCalls(ctx context.Context, agent *Agent, toolCalls []ToolCall, config *Config) {
+	runToolCalls(ctx, toolCaller{agent: agent, config: config, spawnConfig: config, def: agentDefinitionOf(agent)}, toolCalls)
+}
 
-	for _, toolCall := range toolCalls {
-		// If it's a spawn_agent call, we run it sequentially
-		if toolCall.Function.Name == "spawn_agent" {
-			var output string
-			var err error
-			var logMessage string
+// runToolCalls runs the tool calls of one response for caller, the main agent or a sub-agent,
+// and appends a tool message for each to the caller's messages.
+func runToolCalls(ctx context.Context, caller toolCaller, toolCalls []ToolCall) {
+	agent := caller.agent
 
-			var args SubAgentTask
-			if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); unmarshalErr != nil {
-				output = fmt.Sprintf("Failed to parse arguments: %s", unmarshalErr)
-			} else {
-				agentName := strings.TrimSpace(args.Agent)
-				modelName := strings.TrimSpace(args.Model)
-
-				// Avoid dumping long task prompts into the user's console by default.
-				// Only show the full task when sub-agent verbose mode is "Full" (2).
-				if !pipelineMode {
-					if config.SubAgentVerboseMode == 2 {
-						if agentName != "" {
-							fmt.Printf("%sSpawning sub-agent (%s, %s) for task: %s%s%s\n", ColorMeta, agentName, modelName, ColorHighlight, args.Task, ColorReset)
-						} else {
-							fmt.Printf("%sSpawning sub-agent (%s) for task: %s%s%s\n", ColorMeta, modelName, ColorHighlight, args.Task, ColorReset)
-						}
-					} else {
-						if agentName != "" {
-							fmt.Printf("%sSpawning sub-agent (%s, %s)%s\n", ColorMeta, agentName, modelName, ColorReset)
-						} else {
-							fmt.Printf("%sSpawning sub-agent (%s)%s\n", ColorMeta, modelName, ColorReset)
-						}
-					}
-				}
+	for i := 0; i < len(toolCalls); i++ {
+		toolCall := toolCalls[i]
+		if ctx.Err() != nil {
+			agent.Messages = append(agent.Messages, cancelledToolMessages(toolCalls[i:])...)
+			return
+		}
 
-				output, err = runSubAgentWithAgent(args.Task, agentName, modelName, config)
-				logMessage = "Sub-agent finished task"
+		// Consecutive spawn_agent calls are independent of each other, so they run in parallel
+		if toolCall.Function.Name == "spawn_agent" && maxParallelSubAgents(caller.config) > 1 {
+			n := 1
+			for i+n < len(toolCalls) && toolCalls[i+n].Function.Name == "spawn_agent" {
+				n++
 			}
-
-			if err != nil {
-				output = fmt.Sprintf("Tool execution error: %s", err)
-				if !pipelineMode {
-					fmt.Printf("%s==> %s%s\n", ColorRed, formatToolCallCompact(toolCall), ColorReset)
-				}
-			} else if logMessage != "" && !pipelineMode {
-				fmt.Printf("%s%s%s\n", ColorMeta, logMessage, ColorReset)
-			}
-
-			toolMsg := Message{
-				Role:       "tool",
-				ToolCallID: toolCall.ID,
-				Content:    &output,
+			if n > 1 {
+				autoCheckpoint(caller, "spawn_agent")
+				agent.Messages = append(agent.Messages, runParallelSubAgents(ctx, caller, toolCalls[i:i+n])...)
+				i += n - 1
+				continue
 			}
+		}
 
-			agent.Messages = append(agent.Messages, toolMsg)
+		// PreToolUse hooks can deny the call before anything runs. Within this iteration ctx
+		// carries a hook's approval, if any.
+		ctx, denial, allowed := runPreToolUseHooks(ctx, agent, toolCall)
+		if !allowed {
+			agent.Messages = append(agent.Messages, Message{Role: "tool", ToolCallID: toolCall.ID, Content: &denial})
 			continue
 		}
 
+		// If it's a single spawn_agent call, we run it on its own
 		var output string
-		var err error
-		var logMessage string
-
-		// Auto-checkpoint for dangerous tools
-		// We do this BEFORE the switch to ensure state is saved before any potential damage.
-		// Dangerous tools: execute_command, spawn_agent, use_mcp_tool, kill_background_command
-		dangerousTools := map[string]bool{
-			"execute_command":         true,
-			"spawn_agent":             true,
-			"use_mcp_tool":            true,
-			"kill_background_command": true,
-		}
-
-		if dangerousTools[toolCall.Function.Name] {
-			// Create auto-checkpoint for dangerous tools
-			// Note: We create checkpoints regardless of OperationMode since MCP tools
-			// could potentially execute commands even in Plan mode
-			if _, err := createCheckpoint(agent, config, fmt.Sprintf("Auto-checkpoint before %s", toolCall.Function.Name), true); err != nil {
-				// Log error but proceed
-				fmt.Printf("%sWarning: Failed to create auto-checkpoint: %v%s\n", ColorYellow, err, ColorReset)
-			}
+		if toolCall.Function.Name == "spawn_agent" {
+			autoCheckpoint(caller, "spawn_agent")
+			output = spawnSubAgent(ctx, caller, toolCall)
+		} else {
+			output = dispatchToolCall(ctx, caller, toolCall)
 		}
+		agent.Messages = append(agent.Messages, Message{Role: "tool", ToolCallID: toolCall.ID, Content: &output})
+	}
+}
 
-		switch toolCall.Function.Name {
-		case "execute_command":
-			var args CommandArgs
-			if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); unmarshalErr != nil {
-				output = fmt.Sprintf("Failed to parse arguments: %s", unmarshalErr)
-			} else {
-				// Only show execution message if not in Plan mode and not in pipeline mode
-				if config.OperationMode != Plan && !pipelineMode {
-					logMessage = fmt.Sprintf("%sExecuting command: %s%s\n", ColorMeta, args.Command, ColorReset)
-				}
+// spawnSubAgent runs the sub-agent of a single spawn_agent call and returns its result.
+func spawnSubAgent(ctx context.Context, caller toolCaller, toolCall ToolCall) string {
+	var output string
+	var err error
+	var result *SubAgentResult
 
-				// Background execution is a user choice in Ask mode (not agent-controlled).
-				if pipelineMode {
-					// In pipeline mode, always execute silently in the foreground without prompts/logs.
-					output, err = executeCommandSilent(args.Command)
-				} else {
-					output, err = confirmAndExecute(config, args.Command)
-				}
-				if output == "Command not executed by user." {
-					logMessage = fmt.Sprintf("%sCommand not executed by user.%s\n", ColorMeta, ColorReset)
-				}
-			}
-		case "kill_background_command":
-			var args KillBackgroundCommandArgs
-			if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); unmarshalErr != nil {
-				output = fmt.Sprintf("Failed to parse arguments: %s", unmarshalErr)
+	var args SubAgentTask
+	if err = checkSpawnAllowed(caller); err != nil {
+		output = fmt.Sprintf("Tool execution error: %s", err)
+		caller.failf(toolCall)
+	} else if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); unmarshalErr != nil {
+		output = fmt.Sprintf("Failed to parse arguments: %s", unmarshalErr)
+	} else {
+		agentName := strings.TrimSpace(args.Agent)
+		modelName := strings.TrimSpace(args.Model)
+
+		// Avoid dumping long task prompts into the user's console by default.
+		// Only show the full task when sub-agent verbose mode is "Full" (2).
+		if caller.config.SubAgentVerboseMode == 2 {
+			if agentName != "" {
+				caller.logf("Spawning sub-agent (%s, %s) for task: %s%s", agentName, modelName, ColorHighlight, args.Task)
 			} else {
-				output, err = killBackgroundCommand(args.PID)
-				if err == nil {
-					logMessage = fmt.Sprintf("Killed background process %d", args.PID)
-				}
+				caller.logf("Spawning sub-agent (%s) for task: %s%s", modelName, ColorHighlight, args.Task)
 			}
-		case "get_background_logs":
-			var args GetBackgroundLogsArgs
-			if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); unmarshalErr != nil {
-				output = fmt.Sprintf("Failed to parse arguments: %s", unmarshalErr)
+		} else {
+			if agentName != "" {
+				caller.logf("Spawning sub-agent (%s, %s)", agentName, modelName)
 			} else {
-				output, err = getBackgroundLogs(args.PID)
-				if err == nil {
-					logMessage = fmt.Sprintf("Retrieved logs for PID %d", args.PID)
-				}
+				caller.logf("Spawning sub-agent (%s)", modelName)
 			}
-		case "list_background_commands":
-			output = listBackgroundCommands()
-			logMessage = "Listed background commands"
-		case "suggest_plan":
-			var args SuggestPlanArgs
-			if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); unmarshalErr != nil {
-				output = fmt.Sprintf("Failed to parse arguments: %s", unmarshalErr)
-			} else {
-				if !pipelineMode {
-					fmt.Printf("\n%s%s%sSuggested Plan: %s%s\n", StyleItalic, StyleUnderline, ColorHighlight, args.Name, ColorReset)
-					fmt.Printf("%s%s%s\n", ColorMain, args.Description, ColorReset)
-					fmt.Printf("%sApprove this plan? [y/N]: %s", ColorCyan, ColorReset)
-				}
-				var response string
-				if pipelineMode {
-					// In pipeline mode we cannot interactively ask; default to rejection
-					response = "n"
-				} else {
-					fmt.Scanln(&response)
-				}
-				if strings.ToLower(strings.TrimSpace(response)) == "y" {
-					// User approved the plan: mark for deferred switch to build mode
-					output = "Plan approved by user. Switching to build mode to implement the plan..."
-					logMessage = "Plan approved - will switch to build agent"
-
-					// Set flag for deferred agent switch in main loop
-					shouldSwitchToBuild = true
-
-					// Optionally keep deprecated OperationMode in sync
-					config.OperationMode = Build
-					if err := saveConfig(config); err != nil {
-						fmt.Fprintf(os.Stderr, "Error saving config: %s\n", err)
-					}
+		}
 
-					// Save plan to file (same behavior as before)
-					timestamp := time.Now().Format("20060102_150405")
-					safeName := strings.ReplaceAll(strings.ToLower(args.Name), " ", "_")
-					safeName = strings.ReplaceAll(safeName, "/", "-") // Basic sanitization
-					filename := fmt.Sprintf("plan_%s_%s.md", timestamp, safeName)
-
-					// Ensure plans directory exists
-					cwd, _ := os.Getwd()
-					agentGoDir := filepath.Join(cwd, ".agent-go")
-					plansDir := filepath.Join(agentGoDir, "plans")
-					if err := os.MkdirAll(plansDir, 0755); err != nil {
-						if !pipelineMode {
-							fmt.Printf("Error creating plans directory: %v\n", err)
-						}
-					}
+		node := newSubAgentNode(caller.node, subAgentName(args), args, caller.spawnConfig)
+		result = runSubAgentTask(ctx, node, args, caller.spawnConfig)
+		output, err = result.String(), result.err
+	}
 
-					filePath := filepath.Join(plansDir, filename)
-					content := fmt.Sprintf("# %s\n\n%s", args.Name, args.Description)
-					if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
-						if !pipelineMode {
-							fmt.Printf("Error saving plan to file: %v\n", err)
-						}
-					} else if !pipelineMode {
-						fmt.Printf("Plan saved to %s\n", filePath)
-						// Also update '.agent-go/current_plan.md' for easy access / inclusion in prompts
-						currentPlanPath := filepath.Join(agentGoDir, "current_plan.md")
-						if err := os.WriteFile(currentPlanPath, []byte(content), 0644); err != nil {
-							fmt.Printf("Error saving current_plan.md: %v\n", err)
-						}
-					}
+	// A failed sub-agent still returns its structured result, which says what went wrong
+	if err != nil && ctx.Err() != nil {
+		output = CancelledToolResult
+	} else if result != nil && result.Status == SubAgentStatusFailed {
+		caller.failf(toolCall)
+	} else if result != nil {
+		caller.logf("Sub-agent finished task (%s)", result.Status)
+	}
+	return runPostToolUseHooks(ctx, caller.agent, toolCall, output, err)
+}
 
-				} else {
-					output = "Plan rejected by user."
-					logMessage = "Plan rejected"
-				}
+// checkSpawnAllowed checks that caller may spawn a sub-agent. The main agent is only offered
+// spawn_agent when it may; a sub-agent also needs room below max_subagent_depth.
+func checkSpawnAllowed(caller toolCaller) error {
+	if !caller.subAgent {
+		return nil
+	}
+	if !caller.config.SubagentsEnabled {
+		return fmt.Errorf("sub-agents are disabled")
+	}
+	if caller.agent.Depth >= maxSubAgentDepth(caller.config) {
+		return fmt.Errorf("sub-agents may not be nested deeper than %d levels", maxSubAgentDepth(caller.config))
+	}
+	return checkToolAllowed("spawn_agent", caller.def, caller.config.OperationMode)
+}
+
+// checkpointedTools are the tools that may change files or run commands. When the main agent
+// calls one, an auto-checkpoint is created first, so the change can be undone. Sub-agents don't
+// create checkpoints of their own: the checkpoint taken before the main agent spawned them
+// covers everything they change.
+var checkpointedTools = map[string]bool{
+	"spawn_agent":             true,
+	"execute_command":         true,
+	"write_file":              true,
+	"edit_file":               true,
+	"apply_patch":             true,
+	"use_mcp_tool":            true,
+	"kill_background_command": true,
+}
+
+// toolCaller is the agent a tool call runs for: the main agent, or a sub-agent with its own
+// config and agent definition.
+type toolCaller struct {
+	agent       *Agent
+	config      *Config
+	spawnConfig *Config // The config sub-agents spawned by the caller start from
+	def         *AgentDefinition
+	subAgent    bool
+	node        *subAgentNode   // The caller's place in the sub-agent tree, if it is a sub-agent
+	result      *SubAgentResult // What a sub-agent did, for its parent
+}
+
+// logf prints what a tool call did. Sub-agent lines are marked with "==>" and go through the
+// progress view when sub-agents run in parallel.
+func (c toolCaller) logf(format string, args ...any) {
+	if pipelineMode {
+		return
+	}
+	if c.subAgent {
+		c.node.logf("%s%s==> %s%s%s", StyleBold, ColorHighlight, ColorReset, fmt.Sprintf(format, args...), ColorReset)
+		return
+	}
+	fmt.Printf("%s%s%s\n", ColorMeta, fmt.Sprintf(format, args...), ColorReset)
+}
+
+// failf prints the compact form of a failed tool call.
+func (c toolCaller) failf(toolCall ToolCall) {
+	if pipelineMode {
+		return
+	}
+	if c.subAgent {
+		c.node.logf("%s==> %s%s", ColorRed, formatToolCallCompact(toolCall), ColorReset)
+		return
+	}
+	fmt.Printf("%s==> %s%s\n", ColorRed, formatToolCallCompact(toolCall), ColorReset)
+}
+
+// autoCheckpoint creates an auto-checkpoint of the main agent before it calls tool, if tool is
+// in checkpointedTools, and returns its ID. Failures are reported but don't stop the call.
+func autoCheckpoint(caller toolCaller, tool string) string {
+	if caller.subAgent || !checkpointedTools[tool] {
+		return ""
+	}
+	// Note: We create checkpoints regardless of OperationMode since MCP tools
+	// could potentially execute commands even in Plan mode
+	id, err := createCheckpoint(caller.agent, caller.config, fmt.Sprintf("Auto-checkpoint before %s", tool), true)
+	if err != nil {
+		// Log error but proceed
+		fmt.Printf("%sWarning: Failed to create auto-checkpoint: %v%s\n", ColorYellow, err, ColorReset)
+	}
+	return id
+}
+
+// dispatchToolCall runs one tool call for caller and returns the result for the model. Both the
+// main agent and sub-agents use it, so a sub-agent can call every tool its agent definition
+// permits. Before a call that may change something an auto-checkpoint is created; afterwards the
+// call is logged and the PostToolUse hooks run. PreToolUse hooks are run by the caller.
+func dispatchToolCall(ctx context.Context, caller toolCaller, toolCall ToolCall) string {
+	agent, config := caller.agent, caller.config
+
+	var output string
+	var err error
+	var logMessage string
+
+	// The model only sees the tools it may use, but it can still name others in a tool call.
+	// Sub-agents always have the tools to report back to their parent.
+	if caller.subAgent && slices.Contains(SubAgentOnlyTools, toolCall.Function.Name) {
+		err = nil
+	} else if err = checkToolAllowed(toolCall.Function.Name, caller.def, config.OperationMode); err == nil && caller.subAgent && slices.Contains(MainAgentOnlyTools, toolCall.Function.Name) {
+		err = fmt.Errorf("tool '%s' is only available to the main agent", toolCall.Function.Name)
+	}
+	if err != nil {
+		output = fmt.Sprintf("Tool execution error: %s", err)
+		caller.failf(toolCall)
+		return runPostToolUseHooks(ctx, agent, toolCall, output, err)
+	}
+
+	// Auto-checkpoint before tools that may change something.
+	// We do this BEFORE the switch to ensure state is saved before any potential damage.
+	checkpointID := autoCheckpoint(caller, toolCall.Function.Name)
+
+	switch toolCall.Function.Name {
+	case "execute_command":
+		var args CommandArgs
+		if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); unmarshalErr != nil {
+			output = fmt.Sprintf("Failed to parse arguments: %s", unmarshalErr)
+		} else {
+			// Only show execution message if not in Plan mode and not in pipeline mode.
+			// Sub-agents log the command once it has run.
+			if config.OperationMode != Plan && !pipelineMode && !caller.subAgent {
+				logMessage = fmt.Sprintf("%sExecuting command: %s%s\n", ColorMeta, args.Command, ColorReset)
 			}
-		case "create_todo":
-			output, err = createTodo(agent.ID, toolCall.Function.Arguments)
-			if err == nil {
-				logMessage = "Created todo item"
-				if !pipelineMode {
-					fmt.Println(output)
-				}
+
+			// Background execution is a user choice in Ask mode (not agent-controlled).
+			// In pipeline mode, confirmAndExecute runs silently in the foreground without prompts/logs.
+			if caller.result != nil {
+				caller.result.beforeCommand()
 			}
-		case "update_todo":
-			output, err = updateTodo(agent.ID, toolCall.Function.Arguments)
-			if err == nil {
-				logMessage = "Updated todo item"
-				if !pipelineMode {
-					fmt.Println(output)
+			output, err = confirmAndExecute(ctx, config, caller.def, agent.ID, args.Command, args.TimeoutSeconds, args.BackgroundOptions)
+			if output == "Command not executed by user." {
+				logMessage = fmt.Sprintf("%sCommand not executed by user.%s\n", ColorMeta, ColorReset)
+			} else {
+				if caller.result != nil {
+					caller.result.recordCommand(args.Command, output, err)
+				}
+				if err == nil && caller.subAgent {
+					logMessage = fmt.Sprintf("Bash %s(%s)%s", ColorMeta, args.Command, ColorReset)
 				}
 			}
-		case "get_todo_list":
-			output, err = getTodoList(agent.ID)
-			if err == nil {
-				logMessage = "Retrieved todo list"
+		}
+	case "read_file", "search_files", "list_files", "write_file", "edit_file", "apply_patch":
+		var changes []FileChange
+		output, changes, err = executeFileTool(ctx, config, caller.def, getShellDir(agent.ID), toolCall.Function.Name, toolCall.Function.Arguments)
+		if caller.result != nil {
+			caller.result.recordFileChanges(changes)
+		}
+		if err == nil && (output == fileChangeDeclined || output == fileReadDeclined) {
+			logMessage = output
+		} else if err == nil {
+			logMessage = formatToolCallCompact(toolCall)
+			// Only the main agent's checkpoints can be restored with /checkpoint restore
+			if toolCall.Function.Name == "apply_patch" && checkpointID != "" && !caller.subAgent {
+				logMessage += fmt.Sprintf(" (undo with /checkpoint restore %s)", checkpointID)
 			}
-		case "get_current_task":
-			output, err = getCurrentTask(agent.ID)
+		}
+	case "kill_background_command":
+		var args KillBackgroundCommandArgs
+		if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); unmarshalErr != nil {
+			output = fmt.Sprintf("Failed to parse arguments: %s", unmarshalErr)
+		} else {
+			output, err = killBackgroundCommand(args.PID)
 			if err == nil {
-				logMessage = "Retrieved current task"
+				logMessage = fmt.Sprintf("Killed background process %d", args.PID)
 			}
-		case "clear_todo":
-			output, err = clearTodo(agent.ID)
+		}
+	case "get_background_logs":
+		var args GetBackgroundLogsArgs
+		if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); unmarshalErr != nil {
+			output = fmt.Sprintf("Failed to parse arguments: %s", unmarshalErr)
+		} else {
+			output, err = getBackgroundLogs(args.PID, args.Since, args.Tail)
 			if err == nil {
-				logMessage = "Cleared todo list"
+				logMessage = fmt.Sprintf("Retrieved logs for PID %d", args.PID)
 			}
-		case "use_mcp_tool":
-			var args UseMCPToolArgs
-			if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); unmarshalErr != nil {
-				output = fmt.Sprintf("Failed to parse arguments for use_mcp_tool: %s", unmarshalErr)
+		}
+	case "list_background_commands":
+		output = listBackgroundCommands()
+		logMessage = "Listed background commands"
+	case "suggest_plan":
+		var args SuggestPlanArgs
+		if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); unmarshalErr != nil {
+			output = fmt.Sprintf("Failed to parse arguments: %s", unmarshalErr)
+		} else {
+			if !pipelineMode {
+				fmt.Printf("\n%s%s%sSuggested Plan: %s%s\n", StyleItalic, StyleUnderline, ColorHighlight, args.Name, ColorReset)
+				fmt.Printf("%s%s%s\n", ColorMain, args.Description, ColorReset)
+				fmt.Printf("%sApprove this plan? [y/N]: %s", ColorCyan, ColorReset)
+			}
+			var response string
+			if pipelineMode {
+				// In pipeline mode we cannot interactively ask; default to rejection
+				response = "n"
 			} else {
-				output, err = useMCPTool(args.ServerName, args.ToolName, args.Arguments)
-				if err == nil {
-					logMessage = fmt.Sprintf("Called MCP server: %s (%s)", args.ServerName, args.ToolName)
+				fmt.Scanln(&response)
+			}
+			if strings.ToLower(strings.TrimSpace(response)) == "y" {
+				// User approved the plan: mark for deferred switch to build mode
+				output = "Plan approved by user. Switching to build mode to implement the plan..."
+				logMessage = "Plan approved - will switch to build agent"
+
+				// Set flag for deferred agent switch in main loop
+				shouldSwitchToBuild = true
+
+				// Optionally keep deprecated OperationMode in sync
+				config.OperationMode = Build
+				if err := saveConfig(config); err != nil {
+					fmt.Fprintf(os.Stderr, "Error saving config: %s\n", err)
+				}
+
+				// Save plan to file (same behavior as before)
+				timestamp := time.Now().Format("20060102_150405")
+				safeName := strings.ReplaceAll(strings.ToLower(args.Name), " ", "_")
+				safeName = strings.ReplaceAll(safeName, "/", "-") // Basic sanitization
+				filename := fmt.Sprintf("plan_%s_%s.md", timestamp, safeName)
+
+				// Ensure plans directory exists
+				cwd, _ := os.Getwd()
+				agentGoDir := filepath.Join(cwd, ".agent-go")
+				plansDir := filepath.Join(agentGoDir, "plans")
+				if err := os.MkdirAll(plansDir, 0755); err != nil {
+					if !pipelineMode {
+						fmt.Printf("Error creating plans directory: %v\n", err)
+					}
+				}
+
+				filePath := filepath.Join(plansDir, filename)
+				content := fmt.Sprintf("# %s\n\n%s", args.Name, args.Description)
+				if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+					if !pipelineMode {
+						fmt.Printf("Error saving plan to file: %v\n", err)
+					}
+				} else if !pipelineMode {
+					fmt.Printf("Plan saved to %s\n", filePath)
+					// Also update '.agent-go/current_plan.md' for easy access / inclusion in prompts
+					currentPlanPath := filepath.Join(agentGoDir, "current_plan.md")
+					if err := os.WriteFile(currentPlanPath, []byte(content), 0644); err != nil {
+						fmt.Printf("Error saving current_plan.md: %v\n", err)
+					}
 				}
+
+			} else {
+				output = "Plan rejected by user."
+				logMessage = "Plan rejected"
 			}
-		case "create_note":
-			output, err = createNote(toolCall.Function.Arguments)
-			if err == nil {
-				logMessage = "Created note"
+		}
+	case "create_todo":
+		output, err = createTodo(agent.ID, toolCall.Function.Arguments)
+		if err == nil {
+			logMessage = "Created todo item"
+			if !pipelineMode && !caller.subAgent {
+				fmt.Println(output)
 			}
-		case "update_note":
-			output, err = updateNote(toolCall.Function.Arguments)
-			if err == nil {
-				logMessage = "Updated note"
+		}
+	case "update_todo":
+		output, err = updateTodo(agent.ID, toolCall.Function.Arguments)
+		if err == nil {
+			logMessage = "Updated todo item"
+			if !pipelineMode && !caller.subAgent {
+				fmt.Println(output)
 			}
-		case "delete_note":
-			output, err = deleteNote(toolCall.Function.Arguments)
+		}
+	case "get_todo_list":
+		output, err = getTodoList(agent.ID)
+		if err == nil {
+			logMessage = "Retrieved todo list"
+		}
+	case "get_current_task":
+		output, err = getCurrentTask(agent.ID)
+		if err == nil {
+			logMessage = "Retrieved current task"
+		}
+	case "clear_todo":
+		output, err = clearTodo(agent.ID)
+		if err == nil {
+			logMessage = "Cleared todo list"
+		}
+	case "use_mcp_tool":
+		var args UseMCPToolArgs
+		if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); unmarshalErr != nil {
+			output = fmt.Sprintf("Failed to parse arguments for use_mcp_tool: %s", unmarshalErr)
+		} else {
+			output, err = useMCPTool(ctx, args.ServerName, args.ToolName, args.Arguments)
 			if err == nil {
-				logMessage = "Deleted note"
+				logMessage = fmt.Sprintf("Called MCP server: %s (%s)", args.ServerName, args.ToolName)
 			}
-		case "name_session":
-			output, err = nameSession(agent, toolCall.Function.Arguments)
-			if err == nil {
-				logMessage = "Named session"
+		}
+	case "create_note":
+		output, err = createNote(toolCall.Function.Arguments)
+		if err == nil {
+			logMessage = "Created note"
+		}
+	case "update_note":
+		output, err = updateNote(toolCall.Function.Arguments)
+		if err == nil {
+			logMessage = "Updated note"
+		}
+	case "delete_note":
+		output, err = deleteNote(toolCall.Function.Arguments)
+		if err == nil {
+			logMessage = "Deleted note"
+		}
+	case "name_session":
+		output, err = nameSession(agent, toolCall.Function.Arguments)
+		if err == nil {
+			logMessage = "Named session"
+		}
+	case "create_agent_definition":
+		output, err = createAgentDefinition(toolCall.Function.Arguments)
+		if err == nil {
+			logMessage = "Created agent definition"
+		}
+	case "create_checkpoint":
+		var args map[string]string
+		if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); unmarshalErr != nil {
+			output = fmt.Sprintf("Failed to parse arguments: %s", unmarshalErr)
+		} else {
+			name := args["name"]
+			if name == "" {
+				name = "Manual Checkpoint"
 			}
-		case "create_agent_definition":
-			output, err = createAgentDefinition(toolCall.Function.Arguments)
+			var id string
+			id, err = createCheckpoint(agent, config, name, false)
 			if err == nil {
-				logMessage = "Created agent definition"
+				output = fmt.Sprintf("Checkpoint created with ID: %s", id)
+				logMessage = fmt.Sprintf("Created checkpoint '%s'", name)
 			}
-		case "create_checkpoint":
-			var args map[string]string
-			if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); unmarshalErr != nil {
-				output = fmt.Sprintf("Failed to parse arguments: %s", unmarshalErr)
+		}
+	case "list_checkpoints":
+		checkpoints, errC := listCheckpoints(agent.ID)
+		if errC != nil {
+			err = errC
+		} else {
+			if len(checkpoints) == 0 {
+				output = "No checkpoints found."
 			} else {
-				name := args["name"]
-				if name == "" {
-					name = "Manual Checkpoint"
-				}
-				var id string
-				id, err = createCheckpoint(agent, config, name, false)
-				if err == nil {
-					output = fmt.Sprintf("Checkpoint created with ID: %s", id)
-					logMessage = fmt.Sprintf("Created checkpoint '%s'", name)
+				var sb strings.Builder
+				sb.WriteString("Checkpoints:\n")
+				for _, cp := range checkpoints {
+					sb.WriteString(fmt.Sprintf("- %s (%s): %s\n", cp.ID, cp.CreatedAt.Format("2006-01-02 15:04:05"), cp.Name))
 				}
+				output = sb.String()
 			}
-		case "list_checkpoints":
-			checkpoints, errC := listCheckpoints(agent.ID)
-			if errC != nil {
-				err = errC
-			} else {
-				if len(checkpoints) == 0 {
-					output = "No checkpoints found."
+			logMessage = "Listed checkpoints"
+		}
+	case "open_terminal_session":
+		output, err = openTerminalSession(config, resolveSandbox(config, caller.def), agent.ID, toolCall.Function.Arguments)
+		if err == nil {
+			logMessage = "Opened terminal session"
+		}
+	case "send_terminal_input":
+		var inputArgs TerminalInputArgs
+		if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &inputArgs); unmarshalErr != nil {
+			output = fmt.Sprintf("Failed to parse arguments: %s", unmarshalErr)
+		} else {
+			output, err = sendTerminalInput(toolCall.Function.Arguments)
+			if err == nil {
+				// Show more verbose log with the actual input
+				inputDisplay := inputArgs.Input
+				if len(inputDisplay) > 50 {
+					inputDisplay = inputDisplay[:47] + "..."
+				}
+				// Check if it's a keycode
+				if _, isKeycode := KeyMappings[inputArgs.Input]; isKeycode {
+					logMessage = fmt.Sprintf("Sent keycode '%s' to session %s", inputArgs.Input, inputArgs.SessionID)
 				} else {
-					var sb strings.Builder
-					sb.WriteString("Checkpoints:\n")
-					for _, cp := range checkpoints {
-						sb.WriteString(fmt.Sprintf("- %s (%s): %s\n", cp.ID, cp.CreatedAt.Format("2006-01-02 15:04:05"), cp.Name))
-					}
-					output = sb.String()
+					logMessage = fmt.Sprintf("Sent '%s' to session %s", inputDisplay, inputArgs.SessionID)
 				}
-				logMessage = "Listed checkpoints"
 			}
-		case "open_terminal_session":
-			output, err = openTerminalSession(toolCall.Function.Arguments)
-			if err == nil {
-				logMessage = "Opened terminal session"
-			}
-		case "send_terminal_input":
-			var inputArgs TerminalInputArgs
-			if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &inputArgs); unmarshalErr != nil {
-				output = fmt.Sprintf("Failed to parse arguments: %s", unmarshalErr)
-			} else {
-				output, err = sendTerminalInput(toolCall.Function.Arguments)
-				if err == nil {
-					// Show more verbose log with the actual input
-					inputDisplay := inputArgs.Input
-					if len(inputDisplay) > 50 {
-						inputDisplay = inputDisplay[:47] + "..."
-					}
-					// Check if it's a keycode
-					if _, isKeycode := KeyMappings[inputArgs.Input]; isKeycode {
-						logMessage = fmt.Sprintf("Sent keycode '%s' to session %s", inputArgs.Input, inputArgs.SessionID)
-					} else {
-						logMessage = fmt.Sprintf("Sent '%s' to session %s", inputDisplay, inputArgs.SessionID)
+		}
+	case "read_terminal_output":
+		output, err = readTerminalOutput(toolCall.Function.Arguments)
+		if err == nil {
+			logMessage = "Read terminal output"
+		}
+	case "close_terminal_session":
+		output, err = closeTerminalSession(toolCall.Function.Arguments)
+		if err == nil {
+			logMessage = "Closed terminal session"
+		}
+	case "list_terminal_sessions":
+		output = listTerminalSessions()
+		logMessage = "Listed terminal sessions"
+	case "declare_artifact":
+		if caller.result == nil {
+			err = fmt.Errorf("only sub-agents can declare artifacts")
+		} else if output, err = caller.result.declareArtifact(toolCall.Function.Arguments); err == nil {
+			logMessage = "Declared artifact"
+		}
+	default:
+		// Check if it's a custom skill
+		var skillExecuted bool
+		for _, skill := range config.Skills {
+			if skill.Name == toolCall.Function.Name {
+				// Prepare command with arguments
+				var argsMap map[string]interface{}
+				if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &argsMap); unmarshalErr != nil {
+					output = fmt.Sprintf("Failed to parse arguments for skill %s: %s", skill.Name, unmarshalErr)
+				} else {
+					// Pass arguments as JSON environment variable
+					argsJSON, _ := json.Marshal(argsMap)
+
+					// Execute skill command
+					if config.OperationMode != Plan {
+						logMessage = fmt.Sprintf("%sExecuting skill: %s%s\n", ColorMeta, skill.Name, ColorReset)
 					}
-				}
-			}
-		case "read_terminal_output":
-			output, err = readTerminalOutput(toolCall.Function.Arguments)
-			if err == nil {
-				logMessage = "Read terminal output"
-			}
-		case "close_terminal_session":
-			output, err = closeTerminalSession(toolCall.Function.Arguments)
-			if err == nil {
-				logMessage = "Closed terminal session"
-			}
-		case "list_terminal_sessions":
-			output = listTerminalSessions()
-			logMessage = "Listed terminal sessions"
-		default:
-			// Check if it's a custom skill
-			var skillExecuted bool
-			for _, skill := range config.Skills {
-				if skill.Name == toolCall.Function.Name {
-					// Prepare command with arguments
-					var argsMap map[string]interface{}
-					if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &argsMap); unmarshalErr != nil {
-						output = fmt.Sprintf("Failed to parse arguments for skill %s: %s", skill.Name, unmarshalErr)
-					} else {
-						// Pass arguments as JSON environment variable
-						argsJSON, _ := json.Marshal(argsMap)
-
-						// Execute skill command
-						if config.OperationMode != Plan {
-							logMessage = fmt.Sprintf("%sExecuting skill: %s%s\n", ColorMeta, skill.Name, ColorReset)
-						}
-
-						// Use executeSkill to handle .sh files directly or fallback to shell
-						output, err = executeSkill(skill.Command, argsJSON)
-						if err == nil {
-							logMessage = fmt.Sprintf("Executed skill: %s", skill.Name)
-						}
+
+					// Use executeSkill to handle .sh files directly or fallback to shell
+					output, err = executeSkill(ctx, config, resolveSandbox(config, caller.def), skill.Command, argsJSON)
+					if err == nil {
+						logMessage = fmt.Sprintf("Executed skill: %s", skill.Name)
 					}
-					skillExecuted = true
-					break
 				}
-			}
-
-			if !skillExecuted {
-				output = fmt.Sprintf("Unknown tool: %s", toolCall.Function.Name)
-				logMessage = fmt.Sprintf("Executed unknown tool: %s", toolCall.Function.Name)
+				skillExecuted = true
+				break
 			}
 		}
 
-		if err != nil {
-			output = fmt.Sprintf("Tool execution error: %s", err)
-			if !pipelineMode {
-				fmt.Printf("%s==> %s%s\n", ColorRed, formatToolCallCompact(toolCall), ColorReset)
-			}
-		} else if logMessage != "" && !pipelineMode {
-			// Always log the action summary (formerly only in verbose)
-			// In verbose mode, we might want even more details, but for now let's make the summary always visible
-			// as requested: "what is currently output in verbose mode should be output always".
-			// The previous code only printed logMessage if config.Verbose.
-			// Now we print it always (except in pipeline mode).
-			fmt.Printf("%s%s%s\n", ColorMeta, logMessage, ColorReset)
-
+		if !skillExecuted {
+			output = fmt.Sprintf("Unknown tool: %s", toolCall.Function.Name)
+			logMessage = fmt.Sprintf("Executed unknown tool: %s", toolCall.Function.Name)
 		}
+	}
 
-		toolMsg := Message{
-			Role:       "tool",
-			ToolCallID: toolCall.ID,
-			Content:    &output,
+	if err != nil && ctx.Err() != nil {
+		// Keep whatever the command printed before it was killed; it's often useful context
+		if output != "" {
+			output = CancelledToolResult + " Partial output:\n" + output
+		} else {
+			output = CancelledToolResult
+		}
+	} else if err != nil {
+		// Keep the output of failed commands; the model needs it to fix the problem
+		if output != "" && toolCall.Function.Name == "execute_command" {
+			output = fmt.Sprintf("Tool execution error: %s\n%s", err, output)
+		} else {
+			output = fmt.Sprintf("Tool execution error: %s", err)
 		}
-		agent.Messages = append(agent.Messages, toolMsg)
+		caller.failf(toolCall)
+	} else if logMessage != "" {
+		// Always log the action summary (formerly only in verbose)
+		// In verbose mode, we might want even more details, but for now let's make the summary always visible
+		// as requested: "what is currently output in verbose mode should be output always".
+		// The previous code only printed logMessage if config.Verbose.
+		// Now we print it always (except in pipeline mode).
+		caller.logf("%s", logMessage)
+	}
+	if caller.subAgent {
+		caller.node.tool(formatToolCallCompact(toolCall))
 	}
+	return runPostToolUseHooks(ctx, agent, toolCall, output, err)
 }
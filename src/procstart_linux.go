@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// processStartID identifies the process with the given pid across PID reuse and reboots: the
+// boot ID together with the start time in /proc/<pid>/stat. It returns "" if there is no such
+// process.
+func processStartID(pid int) string {
+	bootID, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return ""
+	}
+	// The command name in field 2 may contain spaces, so count fields after it
+	end := strings.LastIndexByte(string(stat), ')')
+	if end < 0 {
+		return ""
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return ""
+	}
+	return strings.TrimSpace(string(bootID)) + ":" + fields[19] // Field 22, starttime
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+// processStartID is unavailable on this platform; background processes are identified by
+// their PID alone.
+func processStartID(pid int) string {
+	return ""
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Profile is a named set of connection settings stored in config.json. Empty fields fall
+// back to the top-level settings, so a profile only needs to list what differs.
+type Profile struct {
+	Provider           string   `json:"provider,omitempty"`
+	APIURL             string   `json:"api_url,omitempty"`
+	APIKey             string   `json:"api_key,omitempty"`
+	APIKeyCommand      string   `json:"api_key_command,omitempty"` // Shell command that prints the API key
+	Model              string   `json:"model,omitempty"`
+	MiniModel          string   `json:"mini_model,omitempty"`
+	ModelContextLength int      `json:"model_context_length,omitempty"`
+	Temp               *float32 `json:"temp,omitempty"`
+}
+
+// baseProfile holds the top-level connection settings from config.json while a profile is
+// active, so they can be restored on switch and aren't overwritten when the config is saved.
+var baseProfile *Profile
+
+// envProfile is set while the active profile was chosen with AGENT_GO_PROFILE, in which case
+// savedActiveProfile (the value from config.json) is written back instead of it.
+var (
+	envProfile         bool
+	savedActiveProfile string
+)
+
+// profileKeyCache holds the keys printed by API key commands, by command, so a password
+// manager is asked once per session rather than on every switch or fallback.
+var (
+	profileKeyMu    sync.Mutex
+	profileKeyCache = make(map[string]string)
+)
+
+// profileKeys lists the settings accepted by /profile add, in display order.
+var profileKeys = []string{"provider", "url", "key", "key_cmd", "model", "mini_model", "context_length", "temp"}
+
+// snapshotProfile captures the current connection settings of config as a profile.
+func snapshotProfile(config *Config) Profile {
+	temp := config.Temp
+	return Profile{
+		Provider:           config.Provider,
+		APIURL:             config.APIURL,
+		APIKey:             config.APIKey,
+		Model:              config.Model,
+		MiniModel:          config.MiniModel,
+		ModelContextLength: config.ModelContextLength,
+		Temp:               &temp,
+	}
+}
+
+// restoreProfile sets every connection setting of config from a snapshot taken by snapshotProfile.
+func restoreProfile(config *Config, p Profile) {
+	config.Provider = p.Provider
+	config.APIURL = p.APIURL
+	config.APIKey = p.APIKey
+	config.Model = p.Model
+	config.MiniModel = p.MiniModel
+	config.ModelContextLength = p.ModelContextLength
+	config.Temp = *p.Temp
+}
+
+// applyProfile overlays the non-empty fields of p onto config, resolving the key command if set.
+func applyProfile(config *Config, p Profile) error {
+	if p.Provider != "" {
+		config.Provider = p.Provider
+	}
+	if p.APIURL != "" {
+		config.APIURL = p.APIURL
+	}
+	if p.APIKeyCommand != "" {
+		key, err := resolveKeyCommand(p.APIKeyCommand)
+		if err != nil {
+			return err
+		}
+		config.APIKey = key
+	} else if p.APIKey != "" {
+		config.APIKey = p.APIKey
+	}
+	if p.Model != "" {
+		config.Model = p.Model
+	}
+	if p.MiniModel != "" {
+		config.MiniModel = p.MiniModel
+	}
+	if p.ModelContextLength > 0 {
+		config.ModelContextLength = p.ModelContextLength
+	}
+	if p.Temp != nil {
+		config.Temp = *p.Temp
+	}
+	return nil
+}
+
+// resolveKeyCommand returns the key printed by command, running it only the first time.
+func resolveKeyCommand(command string) (string, error) {
+	profileKeyMu.Lock()
+	defer profileKeyMu.Unlock()
+	if key, ok := profileKeyCache[command]; ok {
+		return key, nil
+	}
+	key, err := runKeyCommand(command)
+	if err != nil {
+		return "", err
+	}
+	profileKeyCache[command] = key
+	return key, nil
+}
+
+// runKeyCommand runs a shell command (e.g. "pass show openrouter") and returns its trimmed output.
+func runKeyCommand(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ProfileKeyCommandTimeout)
+	defer cancel()
+
+	cmd := newShellCommand(ctx, command)
+	// Password managers may prompt for a passphrase
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("api key command failed: %w", err)
+	}
+	key := strings.TrimSpace(string(output))
+	if key == "" {
+		return "", fmt.Errorf("api key command printed nothing")
+	}
+	return key, nil
+}
+
+// activateProfile switches config to the named profile. Settings the profile doesn't set
+// revert to the top-level values, so nothing leaks over from a previously active profile.
+func activateProfile(config *Config, name string) error {
+	p, ok := config.Profiles[name]
+	if !ok {
+		return fmt.Errorf("profile '%s' not found", name)
+	}
+
+	if baseProfile == nil {
+		base := snapshotProfile(config)
+		baseProfile = &base
+	}
+	next := *config
+	restoreProfile(&next, *baseProfile)
+	if err := applyProfile(&next, p); err != nil {
+		return err
+	}
+
+	*config = next
+	config.ActiveProfile = name
+	// Context length metadata belongs to the previous model
+	autoContextLength = 0
+	return nil
+}
+
+// deactivateProfile restores the top-level connection settings.
+func deactivateProfile(config *Config) {
+	if baseProfile != nil {
+		restoreProfile(config, *baseProfile)
+		baseProfile = nil
+	}
+	config.ActiveProfile = ""
+	autoContextLength = 0
+}
+
+// configForSave returns the config as it should be written to disk: while a profile is active,
+// changed connection settings go into that profile and the top-level values stay untouched.
+func configForSave(config *Config) *Config {
+	if baseProfile == nil || config.ActiveProfile == "" {
+		return config
+	}
+	p, ok := config.Profiles[config.ActiveProfile]
+	if !ok {
+		return config
+	}
+
+	current := snapshotProfile(config)
+	base := *baseProfile
+	// Keep fields the profile sets, and add any the user has changed since activating it
+	if p.Provider != "" || current.Provider != base.Provider {
+		p.Provider = current.Provider
+	}
+	if p.APIURL != "" || current.APIURL != base.APIURL {
+		p.APIURL = current.APIURL
+	}
+	if p.APIKeyCommand == "" && (p.APIKey != "" || current.APIKey != base.APIKey) {
+		p.APIKey = current.APIKey
+	}
+	if p.Model != "" || current.Model != base.Model {
+		p.Model = current.Model
+	}
+	if p.MiniModel != "" || current.MiniModel != base.MiniModel {
+		p.MiniModel = current.MiniModel
+	}
+	if p.ModelContextLength > 0 || current.ModelContextLength != base.ModelContextLength {
+		p.ModelContextLength = current.ModelContextLength
+	}
+	if p.Temp != nil || *current.Temp != *base.Temp {
+		p.Temp = current.Temp
+	}
+
+	saved := *config
+	saved.Profiles = make(map[string]Profile, len(config.Profiles))
+	for name, profile := range config.Profiles {
+		saved.Profiles[name] = profile
+	}
+	saved.Profiles[config.ActiveProfile] = p
+	restoreProfile(&saved, base)
+	if envProfile {
+		saved.ActiveProfile = savedActiveProfile
+	}
+	return &saved
+}
+
+// parseProfileArgs parses "key=value" settings for /profile add. Values may contain spaces
+// (e.g. key_cmd=pass show openrouter); words without a known key continue the previous value.
+func parseProfileArgs(args string) (Profile, error) {
+	values := make(map[string]string)
+	var current string
+	for _, word := range strings.Fields(args) {
+		if k, v, ok := strings.Cut(word, "="); ok && isProfileKey(k) {
+			current = k
+			values[k] = v
+			continue
+		}
+		if current == "" {
+			return Profile{}, fmt.Errorf("expected key=value, got '%s' (keys: %s)", word, strings.Join(profileKeys, ", "))
+		}
+		values[current] += " " + word
+	}
+
+	var p Profile
+	for k, v := range values {
+		switch k {
+		case "provider":
+			provider, err := lookupProvider(v)
+			if err != nil {
+				return Profile{}, err
+			}
+			p.Provider = provider.Name()
+		case "url":
+			p.APIURL = v
+		case "key":
+			p.APIKey = v
+		case "key_cmd":
+			p.APIKeyCommand = v
+		case "model":
+			p.Model = v
+		case "mini_model":
+			p.MiniModel = v
+		case "context_length":
+			val, err := strconv.Atoi(v)
+			if err != nil || val <= 0 {
+				return Profile{}, fmt.Errorf("invalid context_length: %s", v)
+			}
+			p.ModelContextLength = val
+		case "temp":
+			val, err := strconv.ParseFloat(v, 32)
+			if err != nil {
+				return Profile{}, fmt.Errorf("invalid temp: %s", v)
+			}
+			temp := float32(val)
+			p.Temp = &temp
+		}
+	}
+	return p, nil
+}
+
+func isProfileKey(key string) bool {
+	for _, k := range profileKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// listProfileNames returns the configured profile names in sorted order.
+func listProfileNames(config *Config) []string {
+	names := make([]string, 0, len(config.Profiles))
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formatProfilesList returns a formatted list of profiles for display.
+func formatProfilesList(config *Config) string {
+	if len(config.Profiles) == 0 {
+		return "No profiles configured. Use /profile add <name> to save the current settings as one."
+	}
+
+	var b strings.Builder
+	b.WriteString("Profiles:\n")
+	for _, name := range listProfileNames(config) {
+		p := config.Profiles[name]
+		marker := "  "
+		if name == config.ActiveProfile {
+			marker = "* "
+		}
+
+		var details []string
+		if p.Provider != "" {
+			details = append(details, p.Provider)
+		}
+		if p.APIURL != "" {
+			details = append(details, p.APIURL)
+		}
+		if p.Model != "" {
+			details = append(details, p.Model)
+		}
+		if p.APIKeyCommand != "" {
+			details = append(details, "key: command")
+		} else if p.APIKey != "" {
+			details = append(details, "key: set")
+		}
+		b.WriteString(fmt.Sprintf("%s%s: %s\n", marker, name, strings.Join(details, " • ")))
+	}
+	return b.String()
+}
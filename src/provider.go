@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Provider is a chat backend that speaks a specific wire protocol. Requests and responses
+// are always expressed in the OpenAI-shaped types from types.go; each provider converts them
+// to and from its own format.
+type Provider interface {
+	// Name returns the identifier used in the "provider" config field.
+	Name() string
+	// ChatCompletion sends a chat request. When onDelta is non-nil the response is streamed
+	// and onDelta receives content/reasoning deltas as they arrive.
+	ChatCompletion(ctx context.Context, config *Config, req APIRequest, onDelta StreamHandler) (*APIResponse, error)
+	// ListModels returns the model IDs available from the provider.
+	ListModels(ctx context.Context, config *Config) ([]string, error)
+	// RequiresAPIKey reports whether requests can't be made without an API key.
+	RequiresAPIKey() bool
+}
+
+var providers = map[string]Provider{
+	"openai":    &openAIProvider{},
+	"anthropic": &anthropicProvider{},
+	"ollama":    &ollamaProvider{},
+	"llamacpp":  &llamaCppProvider{},
+}
+
+// getProvider returns the provider selected in config, defaulting to OpenAI.
+func getProvider(config *Config) Provider {
+	if p, ok := providers[strings.ToLower(strings.TrimSpace(config.Provider))]; ok {
+		return p
+	}
+	return providers[DefaultProvider]
+}
+
+// lookupProvider returns the provider with the given name.
+func lookupProvider(name string) (Provider, error) {
+	p, ok := providers[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider '%s' (available: %s)", name, strings.Join(providerNames(), ", "))
+	}
+	return p, nil
+}
+
+// providerNames returns the sorted names of all registered providers.
+func providerNames() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// missingAPIKey reports whether the configured provider needs an API key that isn't set.
+func missingAPIKey(config *Config) bool {
+	// A replayed session never talks to the provider
+	return config.APIKey == "" && getProvider(config).RequiresAPIKey() && !isReplaying()
+}
+
+// postChatCompletion sends a chat request through the configured provider.
+func postChatCompletion(ctx context.Context, config *Config, requestBody APIRequest, onDelta StreamHandler) (*APIResponse, error) {
+	resp, err := getProvider(config).ChatCompletion(ctx, config, requestBody, onDelta)
+	if err != nil {
+		return nil, err
+	}
+	// Every successful request is billed, including mini-model calls, compression and sub-agents
+	recordModelUsage(config, requestBody.Model, resp.Usage)
+	return resp, nil
+}
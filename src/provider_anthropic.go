@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// anthropicProvider talks to the native Anthropic Messages API (/v1/messages).
+type anthropicProvider struct{}
+
+// Anthropic Messages API wire types
+
+type anthropicRequest struct {
+	Model       string               `json:"model"`
+	System      string               `json:"system,omitempty"`
+	Messages    []anthropicMessage   `json:"messages"`
+	MaxTokens   int                  `json:"max_tokens"`
+	Temperature *float32             `json:"temperature,omitempty"`
+	Tools       []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice  *anthropicToolChoice `json:"tool_choice,omitempty"`
+	Thinking    *anthropicThinking   `json:"thinking,omitempty"`
+	Stream      bool                 `json:"stream,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []anthropicContentBlock `json:"content"`
+}
+
+// anthropicContentBlock covers the text, thinking, tool_use and tool_result block types.
+type anthropicContentBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	Thinking  string          `json:"thinking,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   string          `json:"content,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema any    `json:"input_schema"`
+}
+
+type anthropicToolChoice struct {
+	Type string `json:"type"`
+}
+
+type anthropicThinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens"`
+}
+
+type anthropicResponse struct {
+	Model      string                  `json:"model"`
+	Content    []anthropicContentBlock `json:"content"`
+	StopReason string                  `json:"stop_reason"`
+	Usage      anthropicUsage          `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// anthropicStreamEvent is one SSE event of a streamed Messages API response.
+type anthropicStreamEvent struct {
+	Type         string                 `json:"type"`
+	Message      *anthropicResponse     `json:"message,omitempty"`
+	Index        int                    `json:"index"`
+	ContentBlock *anthropicContentBlock `json:"content_block,omitempty"`
+	Delta        *struct {
+		Type        string `json:"type"`
+		Text        string `json:"text,omitempty"`
+		Thinking    string `json:"thinking,omitempty"`
+		Signature   string `json:"signature,omitempty"`
+		PartialJSON string `json:"partial_json,omitempty"`
+		StopReason  string `json:"stop_reason,omitempty"`
+	} `json:"delta,omitempty"`
+	Usage *anthropicUsage `json:"usage,omitempty"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+func (p *anthropicProvider) Name() string {
+	return "anthropic"
+}
+
+func (p *anthropicProvider) RequiresAPIKey() bool {
+	return true
+}
+
+// baseURL returns the configured API URL, or the Anthropic default when the URL
+// was left at the OpenAI default.
+func (p *anthropicProvider) baseURL(config *Config) string {
+	url := strings.TrimSuffix(config.APIURL, "/")
+	if url == "" || url == DefaultAPIURL {
+		url = DefaultAnthropicAPIURL
+	}
+	return url
+}
+
+func (p *anthropicProvider) headers(config *Config) map[string]string {
+	return map[string]string{
+		"Content-Type":      "application/json",
+		"x-api-key":         config.APIKey,
+		"anthropic-version": AnthropicAPIVersion,
+	}
+}
+
+func (p *anthropicProvider) ChatCompletion(ctx context.Context, config *Config, req APIRequest, onDelta StreamHandler) (*APIResponse, error) {
+	body := toAnthropicRequest(config, req)
+	body.Stream = onDelta != nil
+
+	headers := p.headers(config)
+	if onDelta != nil {
+		headers["Accept"] = "text/event-stream"
+	}
+
+	resp, err := newLLMClient(config).postJSON(ctx, p.baseURL(config)+"/v1/messages", headers, body, onDelta != nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			fmt.Printf("failed to close response body: %v\n", err)
+		}
+	}()
+
+	if onDelta != nil && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return readAnthropicStream(resp.Body, onDelta)
+	}
+
+	var parsed anthropicResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return fromAnthropicResponse(&parsed), nil
+}
+
+func (p *anthropicProvider) ListModels(ctx context.Context, config *Config) ([]string, error) {
+	return listModelsFrom(ctx, config, p.baseURL(config)+"/v1/models?limit=1000", p.headers(config))
+}
+
+// toAnthropicRequest converts an OpenAI-shaped request to the Messages API format:
+// system messages are hoisted into the top-level system prompt, tool calls become
+// tool_use blocks and tool results become tool_result blocks in a user turn.
+func toAnthropicRequest(config *Config, req APIRequest) anthropicRequest {
+	var systemParts []string
+	var messages []anthropicMessage
+
+	// The Messages API requires alternating roles, so consecutive same-role
+	// messages (e.g. several tool results) are merged into one turn.
+	appendBlocks := func(role string, blocks []anthropicContentBlock) {
+		if len(blocks) == 0 {
+			return
+		}
+		if n := len(messages); n > 0 && messages[n-1].Role == role {
+			messages[n-1].Content = append(messages[n-1].Content, blocks...)
+			return
+		}
+		messages = append(messages, anthropicMessage{Role: role, Content: blocks})
+	}
+
+	for _, msg := range req.Messages {
+		text := ""
+		if msg.Content != nil {
+			text = *msg.Content
+		}
+
+		switch msg.Role {
+		case "system":
+			if strings.TrimSpace(text) != "" {
+				systemParts = append(systemParts, text)
+			}
+		case "user":
+			if text != "" {
+				appendBlocks("user", []anthropicContentBlock{{Type: "text", Text: text}})
+			}
+		case "assistant":
+			var blocks []anthropicContentBlock
+			// Thinking blocks can only be replayed together with their signature
+			if msg.ReasoningContent != nil && *msg.ReasoningContent != "" && msg.ReasoningSignature != "" {
+				blocks = append(blocks, anthropicContentBlock{
+					Type:      "thinking",
+					Thinking:  *msg.ReasoningContent,
+					Signature: msg.ReasoningSignature,
+				})
+			}
+			if strings.TrimSpace(text) != "" {
+				blocks = append(blocks, anthropicContentBlock{Type: "text", Text: text})
+			}
+			for _, tc := range msg.ToolCalls {
+				blocks = append(blocks, anthropicContentBlock{
+					Type:  "tool_use",
+					ID:    tc.ID,
+					Name:  tc.Function.Name,
+					Input: toolInputJSON(tc.Function.Arguments),
+				})
+			}
+			appendBlocks("assistant", blocks)
+		case "tool":
+			appendBlocks("user", []anthropicContentBlock{{
+				Type:      "tool_result",
+				ToolUseID: msg.ToolCallID,
+				Content:   text,
+			}})
+		}
+	}
+
+	out := anthropicRequest{
+		Model:     req.Model,
+		System:    strings.Join(systemParts, "\n\n"),
+		Messages:  messages,
+		MaxTokens: req.MaxTokens,
+	}
+	if out.MaxTokens <= 0 {
+		out.MaxTokens = DefaultAnthropicMaxTokens
+	}
+
+	for _, tool := range req.Tools {
+		schema := tool.Function.Parameters
+		if schema == nil {
+			schema = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+		}
+		out.Tools = append(out.Tools, anthropicTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: schema,
+		})
+	}
+	if len(out.Tools) > 0 {
+		out.ToolChoice = &anthropicToolChoice{Type: "auto"}
+	}
+
+	// Extended thinking is only used for agent turns (requests that offer tools),
+	// not for short utility calls like compression or session naming.
+	if config.ThinkingBudget > 0 && len(out.Tools) > 0 {
+		out.Thinking = &anthropicThinking{Type: "enabled", BudgetTokens: config.ThinkingBudget}
+		if out.MaxTokens <= config.ThinkingBudget {
+			out.MaxTokens = config.ThinkingBudget + DefaultAnthropicMaxTokens
+		}
+		// Temperature must be left at its default when thinking is enabled
+	} else {
+		temp := req.Temperature
+		out.Temperature = &temp
+	}
+
+	return out
+}
+
+// toolInputJSON returns tool call arguments as a JSON object suitable for a tool_use block.
+func toolInputJSON(arguments string) json.RawMessage {
+	trimmed := strings.TrimSpace(arguments)
+	if trimmed == "" || !json.Valid([]byte(trimmed)) || !strings.HasPrefix(trimmed, "{") {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(trimmed)
+}
+
+// fromAnthropicResponse converts a Messages API response to the OpenAI-shaped APIResponse.
+func fromAnthropicResponse(resp *anthropicResponse) *APIResponse {
+	msg := Message{Role: "assistant"}
+	var text, thinking strings.Builder
+
+	for _, block := range resp.Content {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "thinking":
+			thinking.WriteString(block.Thinking)
+			if block.Signature != "" {
+				msg.ReasoningSignature = block.Signature
+			}
+		case "tool_use":
+			args := string(block.Input)
+			if args == "" {
+				args = "{}"
+			}
+			msg.ToolCalls = append(msg.ToolCalls, ToolCall{
+				ID:       block.ID,
+				Type:     "function",
+				Function: FunctionCall{Name: block.Name, Arguments: args},
+			})
+		}
+	}
+	if text.Len() > 0 {
+		content := text.String()
+		msg.Content = &content
+	}
+	if thinking.Len() > 0 {
+		reasoning := thinking.String()
+		msg.ReasoningContent = &reasoning
+	}
+
+	prompt := resp.Usage.InputTokens + resp.Usage.CacheCreationInputTokens + resp.Usage.CacheReadInputTokens
+	return &APIResponse{
+		Model:   resp.Model,
+		Choices: []Choice{{Message: msg}},
+		Usage: Usage{
+			PromptTokens:     prompt,
+			CompletionTokens: resp.Usage.OutputTokens,
+			TotalTokens:      prompt + resp.Usage.OutputTokens,
+			PromptTokensDetails: &PromptTokensDetails{
+				CachedTokens: resp.Usage.CacheReadInputTokens,
+			},
+		},
+	}
+}
+
+// readAnthropicStream consumes a streamed Messages API response, reporting text and
+// thinking deltas to onDelta, and assembles the final APIResponse.
+func readAnthropicStream(body io.Reader, onDelta StreamHandler) (*APIResponse, error) {
+	var final anthropicResponse
+	blocks := make(map[int]*anthropicContentBlock)
+	partialInputs := make(map[int]*strings.Builder)
+	maxIndex := -1
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 8*1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue // Skip "event:" lines, comments and blank separators
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "" {
+			continue
+		}
+
+		var event anthropicStreamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return nil, fmt.Errorf("failed to decode stream event: %w", err)
+		}
+
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil {
+				final.Model = event.Message.Model
+				final.Usage = event.Message.Usage
+			}
+		case "content_block_start":
+			if event.ContentBlock != nil {
+				block := *event.ContentBlock
+				block.Input = nil // Tool input arrives as input_json_delta fragments
+				blocks[event.Index] = &block
+				if event.Index > maxIndex {
+					maxIndex = event.Index
+				}
+			}
+		case "content_block_delta":
+			block, ok := blocks[event.Index]
+			if !ok || event.Delta == nil {
+				continue
+			}
+			switch event.Delta.Type {
+			case "text_delta":
+				block.Text += event.Delta.Text
+				if onDelta != nil && event.Delta.Text != "" {
+					onDelta(StreamDelta{Content: event.Delta.Text})
+				}
+			case "thinking_delta":
+				block.Thinking += event.Delta.Thinking
+				if onDelta != nil && event.Delta.Thinking != "" {
+					onDelta(StreamDelta{ReasoningContent: event.Delta.Thinking})
+				}
+			case "signature_delta":
+				block.Signature += event.Delta.Signature
+			case "input_json_delta":
+				if partialInputs[event.Index] == nil {
+					partialInputs[event.Index] = &strings.Builder{}
+				}
+				partialInputs[event.Index].WriteString(event.Delta.PartialJSON)
+			}
+		case "message_delta":
+			if event.Delta != nil && event.Delta.StopReason != "" {
+				final.StopReason = event.Delta.StopReason
+			}
+			if event.Usage != nil {
+				mergeAnthropicUsage(&final.Usage, event.Usage)
+			}
+		case "error":
+			apiErr := &APIError{Kind: APIErrorServer, Message: "stream error"}
+			if event.Error != nil {
+				apiErr.Message = event.Error.Message
+				if event.Error.Type == "rate_limit_error" {
+					apiErr.Kind = APIErrorRateLimited
+				}
+			}
+			return nil, apiErr
+		case "message_stop":
+			// Handled after the loop
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read stream: %w", err)
+	}
+
+	for i := 0; i <= maxIndex; i++ {
+		block, ok := blocks[i]
+		if !ok {
+			continue
+		}
+		if block.Type == "tool_use" {
+			if partial, ok := partialInputs[i]; ok && partial.Len() > 0 {
+				block.Input = json.RawMessage(partial.String())
+			} else {
+				block.Input = json.RawMessage("{}")
+			}
+		}
+		final.Content = append(final.Content, *block)
+	}
+
+	return fromAnthropicResponse(&final), nil
+}
+
+// mergeAnthropicUsage applies the non-zero counters from a message_delta usage update.
+func mergeAnthropicUsage(dst, src *anthropicUsage) {
+	if src.InputTokens > 0 {
+		dst.InputTokens = src.InputTokens
+	}
+	if src.OutputTokens > 0 {
+		dst.OutputTokens = src.OutputTokens
+	}
+	if src.CacheCreationInputTokens > 0 {
+		dst.CacheCreationInputTokens = src.CacheCreationInputTokens
+	}
+	if src.CacheReadInputTokens > 0 {
+		dst.CacheReadInputTokens = src.CacheReadInputTokens
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// anthropicTestServer serves the Messages API with handler and returns a config pointing at it.
+// Every request body is decoded into the returned request.
+func anthropicTestServer(t *testing.T, handler func(w http.ResponseWriter)) (*Config, *anthropicRequest) {
+	t.Helper()
+	var got anthropicRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			t.Errorf("path = %q, want /v1/messages", r.URL.Path)
+		}
+		if key := r.Header.Get("x-api-key"); key != "test-key" {
+			t.Errorf("x-api-key = %q, want test-key", key)
+		}
+		if version := r.Header.Get("anthropic-version"); version != AnthropicAPIVersion {
+			t.Errorf("anthropic-version = %q, want %q", version, AnthropicAPIVersion)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read request body: %v", err)
+		}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("decode request body: %v", err)
+		}
+		handler(w)
+	}))
+	t.Cleanup(srv.Close)
+	return &Config{Provider: "anthropic", APIURL: srv.URL, APIKey: "test-key"}, &got
+}
+
+func strPtr(s string) *string { return &s }
+
+func TestAnthropicRequestMapping(t *testing.T) {
+	config, got := anthropicTestServer(t, func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"model":"claude-test","content":[{"type":"text","text":"done"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	})
+	config.ThinkingBudget = 2048
+
+	req := APIRequest{
+		Model:       "claude-test",
+		Temperature: 0.5,
+		MaxTokens:   1024,
+		Tools: []Tool{{Type: "function", Function: FunctionDefinition{
+			Name:        "read_file",
+			Description: "Read a file",
+			Parameters:  map[string]any{"type": "object"},
+		}}},
+		Messages: []Message{
+			{Role: "system", Content: strPtr("You are an agent.")},
+			{Role: "system", Content: strPtr("Be brief.")},
+			{Role: "user", Content: strPtr("Read a and b")},
+			{
+				Role:               "assistant",
+				Content:            strPtr("Reading both."),
+				ReasoningContent:   strPtr("Both files are needed."),
+				ReasoningSignature: "sig-1",
+				ToolCalls: []ToolCall{
+					{ID: "call_a", Type: "function", Function: FunctionCall{Name: "read_file", Arguments: `{"path":"a"}`}},
+					{ID: "call_b", Type: "function", Function: FunctionCall{Name: "read_file", Arguments: "not json"}},
+				},
+			},
+			{Role: "tool", ToolCallID: "call_a", Content: strPtr("contents of a")},
+			{Role: "tool", ToolCallID: "call_b", Content: strPtr("contents of b")},
+			{Role: "user", Content: strPtr("Summarize them")},
+			// Thinking without a signature can't be replayed and is dropped
+			{Role: "assistant", Content: strPtr("Summary."), ReasoningContent: strPtr("unsigned")},
+		},
+	}
+
+	resp, err := (&anthropicProvider{}).ChatCompletion(context.Background(), config, req, nil)
+	if err != nil {
+		t.Fatalf("ChatCompletion: %v", err)
+	}
+	if content := resp.Choices[0].Message.Content; content == nil || *content != "done" {
+		t.Errorf("response content = %v, want done", content)
+	}
+
+	if got.System != "You are an agent.\n\nBe brief." {
+		t.Errorf("system = %q", got.System)
+	}
+	if got.Stream {
+		t.Error("stream set on a non-streamed request")
+	}
+	if got.Thinking == nil || got.Thinking.Type != "enabled" || got.Thinking.BudgetTokens != 2048 {
+		t.Errorf("thinking = %+v, want enabled with budget 2048", got.Thinking)
+	}
+	if got.MaxTokens <= 2048 {
+		t.Errorf("max_tokens = %d, want above the thinking budget", got.MaxTokens)
+	}
+	if got.Temperature != nil {
+		t.Errorf("temperature = %v, want unset with thinking enabled", *got.Temperature)
+	}
+	if len(got.Tools) != 1 || got.Tools[0].Name != "read_file" || got.ToolChoice == nil || got.ToolChoice.Type != "auto" {
+		t.Errorf("tools = %+v, tool_choice = %+v", got.Tools, got.ToolChoice)
+	}
+
+	wantRoles := []string{"user", "assistant", "user", "assistant"}
+	if len(got.Messages) != len(wantRoles) {
+		t.Fatalf("got %d messages, want %d: %+v", len(got.Messages), len(wantRoles), got.Messages)
+	}
+	for i, role := range wantRoles {
+		if got.Messages[i].Role != role {
+			t.Errorf("message %d role = %q, want %q", i, got.Messages[i].Role, role)
+		}
+	}
+
+	assistant := got.Messages[1].Content
+	if len(assistant) != 4 {
+		t.Fatalf("assistant blocks = %+v, want thinking, text and two tool_use", assistant)
+	}
+	if assistant[0].Type != "thinking" || assistant[0].Thinking != "Both files are needed." || assistant[0].Signature != "sig-1" {
+		t.Errorf("thinking block = %+v", assistant[0])
+	}
+	if assistant[1].Type != "text" || assistant[1].Text != "Reading both." {
+		t.Errorf("text block = %+v", assistant[1])
+	}
+	if assistant[2].Type != "tool_use" || assistant[2].ID != "call_a" || assistant[2].Name != "read_file" || string(assistant[2].Input) != `{"path":"a"}` {
+		t.Errorf("tool_use block = %+v", assistant[2])
+	}
+	if string(assistant[3].Input) != "{}" {
+		t.Errorf("invalid arguments sent as %s, want {}", assistant[3].Input)
+	}
+
+	// Both tool results and the following user message share one user turn
+	results := got.Messages[2].Content
+	if len(results) != 3 {
+		t.Fatalf("user turn blocks = %+v, want two tool_result and a text", results)
+	}
+	for i, id := range []string{"call_a", "call_b"} {
+		if results[i].Type != "tool_result" || results[i].ToolUseID != id {
+			t.Errorf("block %d = %+v, want tool_result for %s", i, results[i], id)
+		}
+	}
+	if results[0].Content != "contents of a" || results[2].Text != "Summarize them" {
+		t.Errorf("user turn blocks = %+v", results)
+	}
+
+	last := got.Messages[3].Content
+	if len(last) != 1 || last[0].Type != "text" {
+		t.Errorf("unsigned thinking was replayed: %+v", last)
+	}
+}
+
+func TestAnthropicRequestWithoutTools(t *testing.T) {
+	config, got := anthropicTestServer(t, func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"content":[]}`)
+	})
+	config.ThinkingBudget = 2048
+
+	// Utility calls without tools never enable thinking, so the temperature is kept
+	req := APIRequest{Model: "claude-test", Temperature: 0.2, Messages: []Message{{Role: "user", Content: strPtr("Name this session")}}}
+	if _, err := (&anthropicProvider{}).ChatCompletion(context.Background(), config, req, nil); err != nil {
+		t.Fatalf("ChatCompletion: %v", err)
+	}
+	if got.Thinking != nil {
+		t.Errorf("thinking = %+v, want unset without tools", got.Thinking)
+	}
+	if got.Temperature == nil || *got.Temperature != 0.2 {
+		t.Errorf("temperature = %v, want 0.2", got.Temperature)
+	}
+	if got.MaxTokens != DefaultAnthropicMaxTokens {
+		t.Errorf("max_tokens = %d, want %d", got.MaxTokens, DefaultAnthropicMaxTokens)
+	}
+	if got.ToolChoice != nil {
+		t.Errorf("tool_choice = %+v, want unset without tools", got.ToolChoice)
+	}
+}
+
+func TestAnthropicResponseMapping(t *testing.T) {
+	config, _ := anthropicTestServer(t, func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{
+			"model": "claude-test",
+			"content": [
+				{"type": "thinking", "thinking": "Need the file.", "signature": "sig-2"},
+				{"type": "text", "text": "Let me look."},
+				{"type": "tool_use", "id": "toolu_1", "name": "read_file", "input": {"path": "main.go"}}
+			],
+			"stop_reason": "tool_use",
+			"usage": {"input_tokens": 10, "output_tokens": 5, "cache_creation_input_tokens": 20, "cache_read_input_tokens": 30}
+		}`)
+	})
+
+	req := APIRequest{Model: "claude-test", Messages: []Message{{Role: "user", Content: strPtr("Read main.go")}}}
+	resp, err := (&anthropicProvider{}).ChatCompletion(context.Background(), config, req, nil)
+	if err != nil {
+		t.Fatalf("ChatCompletion: %v", err)
+	}
+	msg := resp.Choices[0].Message
+	if msg.Content == nil || *msg.Content != "Let me look." {
+		t.Errorf("content = %v", msg.Content)
+	}
+	if msg.ReasoningContent == nil || *msg.ReasoningContent != "Need the file." || msg.ReasoningSignature != "sig-2" {
+		t.Errorf("reasoning = %v, signature = %q", msg.ReasoningContent, msg.ReasoningSignature)
+	}
+	if len(msg.ToolCalls) != 1 || msg.ToolCalls[0].ID != "toolu_1" || msg.ToolCalls[0].Function.Name != "read_file" {
+		t.Fatalf("tool calls = %+v", msg.ToolCalls)
+	}
+	if args := msg.ToolCalls[0].Function.Arguments; args != `{"path": "main.go"}` {
+		t.Errorf("arguments = %s", args)
+	}
+	if resp.Usage.PromptTokens != 60 || resp.Usage.CompletionTokens != 5 || resp.Usage.TotalTokens != 65 || resp.Usage.cachedTokens() != 30 {
+		t.Errorf("usage = %+v, cached %d", resp.Usage, resp.Usage.cachedTokens())
+	}
+}
+
+// writeSSE writes Messages API stream events, each preceded by its event line.
+func writeSSE(w http.ResponseWriter, events ...string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, event := range events {
+		var head struct {
+			Type string `json:"type"`
+		}
+		_ = json.Unmarshal([]byte(event), &head)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", head.Type, event)
+	}
+}
+
+func TestAnthropicStream(t *testing.T) {
+	config, got := anthropicTestServer(t, func(w http.ResponseWriter) {
+		writeSSE(w,
+			`{"type":"message_start","message":{"model":"claude-test","content":[],"usage":{"input_tokens":12,"cache_read_input_tokens":8,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"Check "}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"the file."}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"sig-3"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"Reading "}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"it."}}`,
+			`{"type":"content_block_stop","index":1}`,
+			`{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_2","name":"read_file","input":{}}}`,
+			`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{\"path\":"}}`,
+			`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"\"go.mod\"}"}}`,
+			`{"type":"content_block_stop","index":2}`,
+			`{"type":"content_block_start","index":3,"content_block":{"type":"tool_use","id":"toolu_3","name":"list_files","input":{}}}`,
+			`{"type":"content_block_stop","index":3}`,
+			`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":42}}`,
+			`{"type":"message_stop"}`,
+		)
+	})
+
+	var content, reasoning strings.Builder
+	onDelta := func(d StreamDelta) {
+		content.WriteString(d.Content)
+		reasoning.WriteString(d.ReasoningContent)
+	}
+	req := APIRequest{Model: "claude-test", Messages: []Message{{Role: "user", Content: strPtr("Read go.mod")}}}
+	resp, err := (&anthropicProvider{}).ChatCompletion(context.Background(), config, req, onDelta)
+	if err != nil {
+		t.Fatalf("ChatCompletion: %v", err)
+	}
+	if !got.Stream {
+		t.Error("stream not set on a streamed request")
+	}
+	if content.String() != "Reading it." || reasoning.String() != "Check the file." {
+		t.Errorf("deltas: content %q, reasoning %q", content.String(), reasoning.String())
+	}
+
+	msg := resp.Choices[0].Message
+	if msg.Content == nil || *msg.Content != "Reading it." {
+		t.Errorf("content = %v", msg.Content)
+	}
+	if msg.ReasoningContent == nil || *msg.ReasoningContent != "Check the file." || msg.ReasoningSignature != "sig-3" {
+		t.Errorf("reasoning = %v, signature = %q", msg.ReasoningContent, msg.ReasoningSignature)
+	}
+	if len(msg.ToolCalls) != 2 {
+		t.Fatalf("tool calls = %+v", msg.ToolCalls)
+	}
+	if tc := msg.ToolCalls[0]; tc.ID != "toolu_2" || tc.Function.Name != "read_file" || tc.Function.Arguments != `{"path":"go.mod"}` {
+		t.Errorf("tool call = %+v", tc)
+	}
+	if args := msg.ToolCalls[1].Function.Arguments; args != "{}" {
+		t.Errorf("tool call without input deltas has arguments %s, want {}", args)
+	}
+	if resp.Model != "claude-test" || resp.Usage.PromptTokens != 20 || resp.Usage.CompletionTokens != 42 || resp.Usage.cachedTokens() != 8 {
+		t.Errorf("model = %q, usage = %+v", resp.Model, resp.Usage)
+	}
+}
+
+func TestAnthropicStreamError(t *testing.T) {
+	config, _ := anthropicTestServer(t, func(w http.ResponseWriter) {
+		writeSSE(w,
+			`{"type":"message_start","message":{"model":"claude-test","content":[],"usage":{"input_tokens":3}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Partial"}}`,
+			`{"type":"error","error":{"type":"rate_limit_error","message":"Too many requests"}}`,
+		)
+	})
+
+	req := APIRequest{Model: "claude-test", Messages: []Message{{Role: "user", Content: strPtr("Hi")}}}
+	_, err := (&anthropicProvider{}).ChatCompletion(context.Background(), config, req, func(StreamDelta) {})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want an APIError", err)
+	}
+	if apiErr.Kind != APIErrorRateLimited || apiErr.Message != "Too many requests" {
+		t.Errorf("err = %+v, want rate limited with the event message", apiErr)
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ModelInfo describes what a local model server reports about the loaded model.
+type ModelInfo struct {
+	ContextLength    int
+	SupportsTools    bool
+	SupportsThinking bool
+}
+
+// modelProber is implemented by providers that can report model capabilities.
+type modelProber interface {
+	ProbeModel(ctx context.Context, config *Config) (*ModelInfo, error)
+}
+
+// modelPuller is implemented by providers that can download models on demand.
+type modelPuller interface {
+	PullModel(ctx context.Context, config *Config, model string, progress func(status string, completed, total int64)) error
+}
+
+var (
+	modelInfoMu     sync.Mutex
+	modelInfoCache  = make(map[string]*ModelInfo)
+	modelInfoErrors = make(map[string]error) // Failed probes, so an unreachable server isn't asked on every request
+
+	// autoContextLength is the last context length filled in from model metadata, and
+	// configuredContextLength the value it replaced, so saveConfig doesn't persist it.
+	autoContextLength       int
+	configuredContextLength int
+)
+
+// localBaseURL returns the configured API URL unless it is still one of the hosted defaults.
+func localBaseURL(config *Config, fallback string) string {
+	url := strings.TrimSuffix(config.APIURL, "/")
+	if url == "" || url == DefaultAPIURL || url == DefaultAnthropicAPIURL {
+		return fallback
+	}
+	return url
+}
+
+// localHeaders returns request headers for a local server; the API key is optional and
+// only sent when configured (e.g. for servers behind an authenticating proxy).
+func localHeaders(config *Config) map[string]string {
+	headers := map[string]string{"Content-Type": "application/json"}
+	if config.APIKey != "" {
+		headers["Authorization"] = "Bearer " + config.APIKey
+	}
+	return headers
+}
+
+// probeModelInfo returns cached capabilities for the configured model, probing the
+// server on first use. It returns nil when the provider can't report capabilities. A failed
+// probe is not repeated in this session, unless it was only cancelled.
+func probeModelInfo(ctx context.Context, config *Config) (*ModelInfo, error) {
+	provider := getProvider(config)
+	prober, ok := provider.(modelProber)
+	if !ok {
+		return nil, nil
+	}
+
+	key := provider.Name() + "|" + config.APIURL + "|" + config.Model
+	modelInfoMu.Lock()
+	if info, ok := modelInfoCache[key]; ok {
+		modelInfoMu.Unlock()
+		return info, nil
+	}
+	if err, ok := modelInfoErrors[key]; ok {
+		modelInfoMu.Unlock()
+		return nil, err
+	}
+	modelInfoMu.Unlock()
+
+	info, err := prober.ProbeModel(ctx, config)
+	if err != nil {
+		if ctx.Err() == nil {
+			modelInfoMu.Lock()
+			modelInfoErrors[key] = err
+			modelInfoMu.Unlock()
+		}
+		return nil, err
+	}
+
+	modelInfoMu.Lock()
+	modelInfoCache[key] = info
+	modelInfoMu.Unlock()
+	return info, nil
+}
+
+// applyModelCapabilities probes the configured model and fills ModelContextLength from its
+// metadata unless the user set a context length explicitly. It returns the probed info, or
+// nil if the provider doesn't support probing or the server couldn't be reached.
+func applyModelCapabilities(config *Config) *ModelInfo {
+	info, err := probeModelInfo(context.Background(), config)
+	if err != nil || info == nil {
+		return nil
+	}
+
+	isAuto := autoContextLength != 0 && config.ModelContextLength == autoContextLength
+	if info.ContextLength > 0 && !contextLengthConfigured(config) {
+		if !isAuto {
+			configuredContextLength = config.ModelContextLength
+		}
+		config.ModelContextLength = info.ContextLength
+		autoContextLength = info.ContextLength
+	}
+	return info
+}
+
+// contextLengthConfigured reports whether the user set ModelContextLength explicitly, rather
+// than leaving the default or a value filled in from model metadata.
+func contextLengthConfigured(config *Config) bool {
+	if autoContextLength != 0 && config.ModelContextLength == autoContextLength {
+		return false
+	}
+	return config.ModelContextLength > 0 && config.ModelContextLength != DefaultModelContextLength
+}
+
+// printModelCapabilities reports probed model capabilities to the user.
+func printModelCapabilities(info *ModelInfo) {
+	if info == nil {
+		return
+	}
+	if info.ContextLength > 0 {
+		fmt.Printf("%sContext length from model metadata: %d%s\n", ColorMeta, info.ContextLength, ColorReset)
+	}
+	if !info.SupportsTools {
+		fmt.Printf("%sModel has no native tool calling; using prompt-based tool calls.%s\n", ColorYellow, ColorReset)
+	}
+}
+
+// usePromptTools reports whether a request must use the prompt-based tool protocol.
+func usePromptTools(ctx context.Context, config *Config, req APIRequest) bool {
+	if len(req.Tools) == 0 {
+		return false
+	}
+	info, err := probeModelInfo(ctx, config)
+	// If probing fails, assume native support and let the server report errors
+	return err == nil && info != nil && !info.SupportsTools
+}
+
+// --- Ollama ---
+
+// ollamaProvider talks to an Ollama server through its native /api endpoints.
+type ollamaProvider struct{}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Tools    []Tool          `json:"tools,omitempty"`
+	Stream   bool            `json:"stream"`
+	Options  map[string]any  `json:"options,omitempty"`
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Thinking  string           `json:"thinking,omitempty"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+// ollamaChatChunk is both the non-streaming response and one NDJSON line of a stream.
+type ollamaChatChunk struct {
+	Model           string        `json:"model"`
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error,omitempty"`
+}
+
+func (p *ollamaProvider) Name() string {
+	return "ollama"
+}
+
+func (p *ollamaProvider) RequiresAPIKey() bool {
+	return false
+}
+
+func (p *ollamaProvider) baseURL(config *Config) string {
+	return localBaseURL(config, DefaultOllamaURL)
+}
+
+func (p *ollamaProvider) ChatCompletion(ctx context.Context, config *Config, req APIRequest, onDelta StreamHandler) (*APIResponse, error) {
+	promptTools := usePromptTools(ctx, config, req)
+	flushDeltas := func() {}
+	if promptTools {
+		req = applyPromptToolProtocol(req)
+		if onDelta != nil {
+			onDelta, flushDeltas = hidePromptToolCalls(onDelta)
+		}
+	}
+
+	body := toOllamaChatRequest(config, req, onDelta != nil)
+	resp, err := newLLMClient(config).postJSON(ctx, p.baseURL(config)+"/api/chat", localHeaders(config), body, body.Stream)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			fmt.Printf("failed to close response body: %v\n", err)
+		}
+	}()
+
+	// A non-streaming response is a single JSON object, which is also valid NDJSON
+	apiResp, err := readOllamaStream(resp.Body, onDelta)
+	if err != nil {
+		return nil, err
+	}
+	flushDeltas()
+	if promptTools && len(apiResp.Choices) > 0 {
+		extractPromptToolCalls(&apiResp.Choices[0].Message)
+	}
+	return apiResp, nil
+}
+
+func (p *ollamaProvider) ListModels(ctx context.Context, config *Config) ([]string, error) {
+	url := p.baseURL(config) + "/api/tags"
+	resp, err := newQuietLLMClient(config).get(ctx, url, localHeaders(config))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch models from %s: %w", url, err)
+	}
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			fmt.Printf("failed to close response body: %v\n", err)
+		}
+	}()
+
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, fmt.Errorf("could not unmarshal models response: %w", err)
+	}
+
+	var models []string
+	for _, m := range tags.Models {
+		models = append(models, m.Name)
+	}
+	return models, nil
+}
+
+func (p *ollamaProvider) ProbeModel(ctx context.Context, config *Config) (*ModelInfo, error) {
+	resp, err := newQuietLLMClient(config).postJSON(ctx, p.baseURL(config)+"/api/show", localHeaders(config), map[string]string{"model": config.Model}, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query model '%s': %w", config.Model, err)
+	}
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			fmt.Printf("failed to close response body: %v\n", err)
+		}
+	}()
+
+	var show struct {
+		Capabilities []string       `json:"capabilities"`
+		ModelInfo    map[string]any `json:"model_info"`
+		Template     string         `json:"template"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&show); err != nil {
+		return nil, fmt.Errorf("failed to decode model info: %w", err)
+	}
+
+	info := &ModelInfo{}
+	for key, value := range show.ModelInfo {
+		if strings.HasSuffix(key, ".context_length") {
+			if n, ok := value.(float64); ok {
+				info.ContextLength = int(n)
+			}
+		}
+	}
+	if show.Capabilities != nil {
+		for _, capability := range show.Capabilities {
+			switch capability {
+			case "tools":
+				info.SupportsTools = true
+			case "thinking":
+				info.SupportsThinking = true
+			}
+		}
+	} else {
+		// Older Ollama versions don't report capabilities; tool support shows up in the template
+		info.SupportsTools = strings.Contains(show.Template, ".Tools")
+	}
+	return info, nil
+}
+
+func (p *ollamaProvider) PullModel(ctx context.Context, config *Config, model string, progress func(status string, completed, total int64)) error {
+	payload := map[string]any{"model": model, "stream": true}
+	resp, err := newLLMClient(config).postJSON(ctx, p.baseURL(config)+"/api/pull", localHeaders(config), payload, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			fmt.Printf("failed to close response body: %v\n", err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var status struct {
+			Status    string `json:"status"`
+			Total     int64  `json:"total"`
+			Completed int64  `json:"completed"`
+			Error     string `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &status); err != nil {
+			continue
+		}
+		if status.Error != "" {
+			return fmt.Errorf("pull failed: %s", status.Error)
+		}
+		if progress != nil {
+			progress(status.Status, status.Completed, status.Total)
+		}
+	}
+	return scanner.Err()
+}
+
+// toOllamaChatRequest converts an OpenAI-shaped request to Ollama's /api/chat format.
+func toOllamaChatRequest(config *Config, req APIRequest, stream bool) ollamaChatRequest {
+	toolNames := make(map[string]string)
+	messages := make([]ollamaMessage, 0, len(req.Messages))
+
+	for _, msg := range req.Messages {
+		out := ollamaMessage{Role: msg.Role}
+		if msg.Content != nil {
+			out.Content = *msg.Content
+		}
+		if msg.ReasoningContent != nil {
+			out.Thinking = *msg.ReasoningContent
+		}
+		for _, tc := range msg.ToolCalls {
+			toolNames[tc.ID] = tc.Function.Name
+			var call ollamaToolCall
+			call.Function.Name = tc.Function.Name
+			call.Function.Arguments = toolInputJSON(tc.Function.Arguments)
+			out.ToolCalls = append(out.ToolCalls, call)
+		}
+		if msg.Role == "tool" {
+			out.ToolName = toolNames[msg.ToolCallID]
+		}
+		messages = append(messages, out)
+	}
+
+	// The model's full context can need far more memory than the machine has, so the
+	// server's default applies unless the user chose a context length
+	options := map[string]any{"temperature": req.Temperature}
+	if contextLengthConfigured(config) {
+		options["num_ctx"] = config.ModelContextLength
+	}
+	if req.MaxTokens > 0 {
+		options["num_predict"] = req.MaxTokens
+	}
+
+	return ollamaChatRequest{
+		Model:    req.Model,
+		Messages: messages,
+		Tools:    req.Tools,
+		Stream:   stream,
+		Options:  options,
+	}
+}
+
+// readOllamaStream reads Ollama's NDJSON chat stream and assembles the final APIResponse.
+func readOllamaStream(body io.Reader, onDelta StreamHandler) (*APIResponse, error) {
+	var content, thinking strings.Builder
+	var toolCalls []ToolCall
+	var model string
+	var usage Usage
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 8*1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var chunk ollamaChatChunk
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+		if chunk.Error != "" {
+			return nil, &APIError{Kind: APIErrorServer, Message: chunk.Error}
+		}
+
+		if chunk.Model != "" {
+			model = chunk.Model
+		}
+		if chunk.Message.Thinking != "" {
+			thinking.WriteString(chunk.Message.Thinking)
+			if onDelta != nil {
+				onDelta(StreamDelta{ReasoningContent: chunk.Message.Thinking})
+			}
+		}
+		if chunk.Message.Content != "" {
+			content.WriteString(chunk.Message.Content)
+			if onDelta != nil {
+				onDelta(StreamDelta{Content: chunk.Message.Content})
+			}
+		}
+		for _, tc := range chunk.Message.ToolCalls {
+			args := string(tc.Function.Arguments)
+			if args == "" || args == "null" {
+				args = "{}"
+			}
+			// Ollama doesn't assign tool call IDs
+			toolCalls = append(toolCalls, ToolCall{
+				ID:       "call_" + uuid.New().String()[:8],
+				Type:     "function",
+				Function: FunctionCall{Name: tc.Function.Name, Arguments: args},
+			})
+		}
+		if chunk.Done {
+			usage = Usage{
+				PromptTokens:     chunk.PromptEvalCount,
+				CompletionTokens: chunk.EvalCount,
+				TotalTokens:      chunk.PromptEvalCount + chunk.EvalCount,
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read stream: %w", err)
+	}
+
+	msg := Message{Role: "assistant", ToolCalls: toolCalls}
+	if content.Len() > 0 {
+		text := content.String()
+		msg.Content = &text
+	}
+	if thinking.Len() > 0 {
+		text := thinking.String()
+		msg.ReasoningContent = &text
+	}
+	return &APIResponse{Model: model, Choices: []Choice{{Message: msg}}, Usage: usage}, nil
+}
+
+// --- llama.cpp ---
+
+// llamaCppProvider talks to a llama.cpp server (llama-server). Chat goes through its
+// OpenAI-compatible endpoint; capabilities come from the native /props endpoint.
+type llamaCppProvider struct{}
+
+func (p *llamaCppProvider) Name() string {
+	return "llamacpp"
+}
+
+func (p *llamaCppProvider) RequiresAPIKey() bool {
+	return false
+}
+
+func (p *llamaCppProvider) baseURL(config *Config) string {
+	return localBaseURL(config, DefaultLlamaCppURL)
+}
+
+func (p *llamaCppProvider) ChatCompletion(ctx context.Context, config *Config, req APIRequest, onDelta StreamHandler) (*APIResponse, error) {
+	promptTools := usePromptTools(ctx, config, req)
+	flushDeltas := func() {}
+	if promptTools {
+		req = applyPromptToolProtocol(req)
+		if onDelta != nil {
+			onDelta, flushDeltas = hidePromptToolCalls(onDelta)
+		}
+	}
+
+	localConfig := *config
+	localConfig.APIURL = p.baseURL(config)
+	apiResp, err := (&openAIProvider{}).ChatCompletion(ctx, &localConfig, req, onDelta)
+	if err != nil {
+		return nil, err
+	}
+	flushDeltas()
+	if promptTools && len(apiResp.Choices) > 0 {
+		extractPromptToolCalls(&apiResp.Choices[0].Message)
+	}
+	return apiResp, nil
+}
+
+func (p *llamaCppProvider) ListModels(ctx context.Context, config *Config) ([]string, error) {
+	return listModelsFrom(ctx, config, p.baseURL(config)+"/v1/models", localHeaders(config))
+}
+
+func (p *llamaCppProvider) ProbeModel(ctx context.Context, config *Config) (*ModelInfo, error) {
+	resp, err := newQuietLLMClient(config).get(ctx, p.baseURL(config)+"/props", localHeaders(config))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query server properties: %w", err)
+	}
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			fmt.Printf("failed to close response body: %v\n", err)
+		}
+	}()
+
+	var props struct {
+		NCtx                      int `json:"n_ctx"`
+		DefaultGenerationSettings struct {
+			NCtx int `json:"n_ctx"`
+		} `json:"default_generation_settings"`
+		ChatTemplate     string          `json:"chat_template"`
+		ChatTemplateCaps map[string]bool `json:"chat_template_caps"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&props); err != nil {
+		return nil, fmt.Errorf("failed to decode server properties: %w", err)
+	}
+
+	// n_ctx is the context actually allocated by the server, which is what matters here
+	info := &ModelInfo{ContextLength: props.DefaultGenerationSettings.NCtx}
+	if info.ContextLength == 0 {
+		info.ContextLength = props.NCtx
+	}
+	if supported, ok := props.ChatTemplateCaps["supports_tool_calls"]; ok {
+		info.SupportsTools = supported
+	} else if supported, ok := props.ChatTemplateCaps["supports_tools"]; ok {
+		info.SupportsTools = supported
+	} else {
+		info.SupportsTools = strings.Contains(props.ChatTemplate, "tool")
+	}
+	return info, nil
+}
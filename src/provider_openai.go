@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// openAIProvider talks to OpenAI and OpenAI-compatible servers via /v1/chat/completions.
+type openAIProvider struct{}
+
+func (p *openAIProvider) Name() string {
+	return "openai"
+}
+
+func (p *openAIProvider) RequiresAPIKey() bool {
+	return true
+}
+
+func (p *openAIProvider) headers(config *Config) map[string]string {
+	return map[string]string{
+		"Content-Type":  "application/json",
+		"Authorization": "Bearer " + config.APIKey,
+	}
+}
+
+func (p *openAIProvider) ChatCompletion(ctx context.Context, config *Config, requestBody APIRequest, onDelta StreamHandler) (*APIResponse, error) {
+	apiURL := strings.TrimSuffix(config.APIURL, "/") + "/v1/chat/completions"
+
+	// Signatures are an Anthropic-only field; don't send them to OpenAI-compatible servers
+	requestBody.Messages = stripReasoningSignatures(requestBody.Messages)
+
+	headers := p.headers(config)
+	if onDelta != nil {
+		headers["Accept"] = "text/event-stream"
+	}
+
+	resp, err := newLLMClient(config).postJSON(ctx, apiURL, headers, requestBody, onDelta != nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			fmt.Printf("failed to close response body: %v\n", err)
+		}
+	}()
+
+	// Some OpenAI-compatible servers ignore stream=true; fall back to decoding a plain JSON body.
+	if onDelta != nil && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return readStreamResponse(resp.Body, onDelta)
+	}
+
+	var apiResponse APIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&apiResponse); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &apiResponse, nil
+}
+
+func (p *openAIProvider) ListModels(ctx context.Context, config *Config) ([]string, error) {
+	url := strings.TrimSuffix(config.APIURL, "/") + "/v1/models"
+	return listModelsFrom(ctx, config, url, p.headers(config))
+}
+
+// stripReasoningSignatures returns messages without ReasoningSignature set, copying only if needed.
+func stripReasoningSignatures(messages []Message) []Message {
+	for i := range messages {
+		if messages[i].ReasoningSignature != "" {
+			cleaned := make([]Message, len(messages))
+			copy(cleaned, messages)
+			for j := range cleaned {
+				cleaned[j].ReasoningSignature = ""
+			}
+			return cleaned
+		}
+	}
+	return messages
+}
+
+// listModelsFrom fetches an OpenAI-style {"data": [{"id": ...}]} model list.
+func listModelsFrom(ctx context.Context, config *Config, url string, headers map[string]string) ([]string, error) {
+	resp, err := newQuietLLMClient(config).get(ctx, url, headers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch models from %s: %w", url, err)
+	}
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			fmt.Printf("failed to close response body: %v\n", err)
+		}
+	}()
+
+	var modelList ModelListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&modelList); err != nil {
+		return nil, fmt.Errorf("could not unmarshal models response: %w", err)
+	}
+
+	var models []string
+	for _, model := range modelList.Data {
+		models = append(models, model.ID)
+	}
+	return models, nil
+}
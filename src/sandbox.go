@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Sandbox modes
+const (
+	SandboxOff        = "off"
+	SandboxAuto       = "auto"       // bwrap when installed, otherwise namespaces
+	SandboxBwrap      = "bwrap"      // bubblewrap
+	SandboxNamespaces = "namespaces" // Linux user, mount and network namespaces set up by agent-go itself
+)
+
+// SandboxConfig controls how commands are isolated. Inside the sandbox the workspace is
+// writable, /tmp is a private scratch directory and the rest of the filesystem is read-only.
+type SandboxConfig struct {
+	Mode           string   `json:"mode,omitempty"`            // off (default), auto, bwrap or namespaces
+	DisableNetwork bool     `json:"disable_network,omitempty"` // Run commands without network access
+	Writable       []string `json:"writable,omitempty"`        // Extra writable paths, e.g. "~/.cache/go-build"
+}
+
+// enabled reports whether commands should run in a sandbox.
+func (s SandboxConfig) enabled() bool {
+	return s.Mode != "" && s.Mode != SandboxOff
+}
+
+// resolveSandbox returns the sandbox settings for commands run by an agent: the agent
+// definition's own settings if it has any, otherwise the global ones.
+func resolveSandbox(config *Config, agentDef *AgentDefinition) SandboxConfig {
+	if agentDef != nil && agentDef.Sandbox != nil {
+		return *agentDef.Sandbox
+	}
+	return config.Sandbox
+}
+
+// validateSandboxMode checks a mode from the config or an agent definition.
+func validateSandboxMode(mode string) error {
+	switch mode {
+	case "", SandboxOff, SandboxAuto, SandboxBwrap, SandboxNamespaces:
+		return nil
+	}
+	return fmt.Errorf("unknown sandbox mode %q (expected off, auto, bwrap or namespaces)", mode)
+}
+
+// writablePaths returns the directories a sandboxed command may modify: the workspace root
+// plus the configured extra paths that exist, with "~" expanded and relative paths resolved
+// from the workspace.
+func (s SandboxConfig) writablePaths() []string {
+	root := workspaceRoot()
+	paths := []string{root}
+	home, _ := os.UserHomeDir()
+	for _, p := range s.Writable {
+		if p == "~" || strings.HasPrefix(p, "~/") {
+			p = filepath.Join(home, strings.TrimPrefix(p, "~"))
+		}
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(root, p)
+		}
+		if _, err := os.Stat(p); err == nil {
+			paths = append(paths, filepath.Clean(p))
+		}
+	}
+	return paths
+}
+
+// checkSandboxWritable returns an error if path is outside the writable paths of the sandbox s,
+// so the file tools can't change what a sandboxed command could not. Symlinks are resolved
+// first, so a link in the workspace can't point the write elsewhere.
+func checkSandboxWritable(s SandboxConfig, path string) error {
+	if !s.enabled() {
+		return nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	var writable []string
+	for _, p := range s.writablePaths() {
+		writable = append(writable, resolveExistingPath(p))
+	}
+	if !isWithinAny(resolveExistingPath(abs), writable) {
+		return fmt.Errorf("%s is outside the sandbox's writable paths (%s)", path, strings.Join(writable, ", "))
+	}
+	return nil
+}
+
+// resolveExistingPath resolves the symlinks in the longest existing prefix of the absolute path
+// p and appends the rest unchanged.
+func resolveExistingPath(p string) string {
+	var rest []string
+	for dir := p; ; dir = filepath.Dir(dir) {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			for i := len(rest) - 1; i >= 0; i-- {
+				resolved = filepath.Join(resolved, rest[i])
+			}
+			return resolved
+		}
+		if dir == filepath.Dir(dir) {
+			return p
+		}
+		rest = append(rest, filepath.Base(dir))
+	}
+}
+
+// isWithinAny reports whether path is one of dirs or below one of them.
+func isWithinAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dir, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// describeSandbox returns a short status like "bwrap, no network" for display.
+func describeSandbox(s SandboxConfig) string {
+	if !s.enabled() {
+		return SandboxOff
+	}
+	desc := s.Mode
+	if s.Mode == SandboxAuto {
+		desc = fmt.Sprintf("auto (%s)", sandboxBackend(s))
+	}
+	if s.DisableNetwork {
+		desc += ", no network"
+	}
+	return desc
+}
+
+// sandboxCommand rewrites cmd to run inside the sandbox described by s. It must be called
+// after cmd.Dir, cmd.Env and the process group are set. A background command keeps running
+// when agent-go exits, so it can be reattached; other commands are killed with agent-go.
+func sandboxCommand(cmd *exec.Cmd, s SandboxConfig, background bool) error {
+	if !s.enabled() {
+		return nil
+	}
+	if err := validateSandboxMode(s.Mode); err != nil {
+		return err
+	}
+	switch sandboxBackend(s) {
+	case SandboxBwrap:
+		return wrapBwrap(cmd, s, background)
+	case SandboxNamespaces:
+		return wrapNamespaces(cmd, s)
+	}
+	return fmt.Errorf("sandboxing is not supported on %s", runtime.GOOS)
+}
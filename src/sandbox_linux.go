@@ -0,0 +1,307 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// sandboxInitArg is the hidden first argument agent-go re-executes itself with to set up the
+// namespaces sandbox before running a command (see runSandboxInitIfRequested).
+const sandboxInitArg = "__agent-go-sandbox-init"
+
+// Linux capability and prctl constants missing from package syscall
+const (
+	capSetPCap              = 8
+	capSysAdmin             = 21
+	prCapBSetDrop           = 24
+	prSetNoNewPrivs         = 38
+	prCapAmbient            = 47
+	prCapAmbientClearAll    = 4
+	maxCapabilityToDrop     = 63
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+// sandboxSpec is passed from agent-go to its sandbox init process.
+type sandboxSpec struct {
+	Writable []string `json:"writable"`
+	Dir      string   `json:"dir"`
+}
+
+// sandboxBackend returns the backend used for s, resolving "auto".
+func sandboxBackend(s SandboxConfig) string {
+	if s.Mode == SandboxAuto {
+		if _, err := exec.LookPath("bwrap"); err == nil {
+			return SandboxBwrap
+		}
+		return SandboxNamespaces
+	}
+	return s.Mode
+}
+
+// wrapBwrap runs cmd under bubblewrap. The command gets its own PID namespace, so killing
+// bwrap takes every process of the command with it. Unless it runs in the background, bwrap
+// also dies with agent-go.
+func wrapBwrap(cmd *exec.Cmd, s SandboxConfig, background bool) error {
+	bwrap, err := exec.LookPath("bwrap")
+	if err != nil {
+		return fmt.Errorf("bwrap sandbox: bubblewrap is not installed")
+	}
+
+	args := []string{"bwrap", "--ro-bind", "/", "/", "--dev", "/dev", "--proc", "/proc", "--tmpfs", "/tmp"}
+	for _, p := range s.writablePaths() {
+		args = append(args, "--bind", p, p)
+	}
+	if s.DisableNetwork {
+		args = append(args, "--unshare-net")
+	}
+	args = append(args, "--unshare-pid")
+	if !background {
+		args = append(args, "--die-with-parent")
+	}
+	if cmd.Dir != "" {
+		args = append(args, "--chdir", cmd.Dir)
+	}
+	args = append(args, "--", cmd.Path)
+
+	cmd.Args = append(args, cmd.Args[1:]...)
+	cmd.Path = bwrap
+	return nil
+}
+
+// wrapNamespaces runs cmd through agent-go's own sandbox init in new user and mount (and
+// optionally network) namespaces. This needs unprivileged user namespaces, which some
+// distributions restrict.
+func wrapNamespaces(cmd *exec.Cmd, s SandboxConfig) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("namespaces sandbox: %w", err)
+	}
+	spec, err := json.Marshal(sandboxSpec{Writable: s.writablePaths(), Dir: cmd.Dir})
+	if err != nil {
+		return err
+	}
+
+	cmd.Args = append([]string{exe, sandboxInitArg, string(spec), cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = exe
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS
+	if s.DisableNetwork {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	// Map the current user to itself, so files created in the workspace keep their owner
+	uid, gid := os.Getuid(), os.Getgid()
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	// The init needs these to set up the mounts; it drops every capability before running the command
+	cmd.SysProcAttr.AmbientCaps = []uintptr{capSysAdmin, capSetPCap}
+	return nil
+}
+
+// runSandboxInitIfRequested turns this process into the sandbox init when agent-go was
+// re-executed by wrapNamespaces: it sets up the mounts and replaces itself with the command.
+// Otherwise it returns immediately.
+func runSandboxInitIfRequested() {
+	if len(os.Args) < 4 || os.Args[1] != sandboxInitArg {
+		return
+	}
+
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(os.Args[2]), &spec); err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up sandbox: %s\n", err)
+		os.Exit(126)
+	}
+	// Capabilities are per thread; the one that drops them must also exec the command
+	runtime.LockOSThread()
+	if err := setupSandboxMounts(spec); err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up sandbox: %s\n", err)
+		os.Exit(126)
+	}
+	if err := dropCapabilities(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up sandbox: %s\n", err)
+		os.Exit(126)
+	}
+	err := syscall.Exec(os.Args[3], os.Args[3:], os.Environ())
+	fmt.Fprintf(os.Stderr, "Error starting sandboxed command: %s\n", err)
+	os.Exit(127)
+}
+
+// setupSandboxMounts makes every mount read-only, gives the sandbox a private /tmp and binds
+// the writable paths back in read-write. It runs in a fresh mount namespace, so nothing
+// changes outside the sandbox.
+func setupSandboxMounts(spec sandboxSpec) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	// Keep handles on the writable paths; /tmp is about to be covered by a fresh tmpfs
+	sources := make([]*os.File, len(spec.Writable))
+	for i, p := range spec.Writable {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		sources[i] = f
+	}
+
+	mounts, err := listMountPoints()
+	if err != nil {
+		return err
+	}
+	var detached []string
+	for _, m := range mounts {
+		if m == "/proc" || m == "/sys" || m == "/dev" ||
+			strings.HasPrefix(m, "/proc/") || strings.HasPrefix(m, "/sys/") || strings.HasPrefix(m, "/dev/") {
+			continue
+		}
+		if isWithinAny(m, detached) {
+			continue // Gone with the mount above it
+		}
+		err := remount(m, true)
+		if err == nil {
+			continue
+		}
+		if m == "/" {
+			return fmt.Errorf("failed to make / read-only: %w", err)
+		}
+		// A mount that can't be made read-only must not stay writable; drop it from the sandbox
+		if uerr := syscall.Unmount(m, syscall.MNT_DETACH); uerr != nil {
+			return fmt.Errorf("failed to make %s read-only: %w", m, err)
+		}
+		detached = append(detached, m)
+	}
+
+	if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("failed to mount /tmp: %w", err)
+	}
+
+	for i, p := range spec.Writable {
+		if strings.HasPrefix(p, "/tmp/") {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+		}
+		source := fmt.Sprintf("/proc/self/fd/%d", sources[i].Fd())
+		if err := syscall.Mount(source, p, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind %s: %w", p, err)
+		}
+		if err := remount(p, false); err != nil {
+			return fmt.Errorf("failed to make %s writable: %w", p, err)
+		}
+		if err := sources[i].Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to close sandbox path: %v\n", err)
+		}
+	}
+
+	// The working directory still refers to the mount underneath the new binds
+	if spec.Dir != "" {
+		if err := os.Chdir(spec.Dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropCapabilities makes sure the command cannot gain any capability, even as root inside the
+// user namespace; otherwise it could simply remount the filesystem read-write.
+func dropCapabilities() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0); errno != 0 {
+		return fmt.Errorf("failed to clear ambient capabilities: %w", errno)
+	}
+	for c := 0; c <= maxCapabilityToDrop; c++ {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapBSetDrop, uintptr(c), 0)
+		if errno == syscall.EINVAL {
+			break // Past the last capability this kernel knows
+		}
+		if errno != 0 {
+			return fmt.Errorf("failed to drop capability %d: %w", c, errno)
+		}
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("failed to set no_new_privs: %w", errno)
+	}
+
+	// Root keeps its inheritable capabilities across exec, so clear all sets as well
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion3}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("failed to clear capabilities: %w", errno)
+	}
+	return nil
+}
+
+// listMountPoints returns the mount points of the current mount namespace.
+func listMountPoints() ([]string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to close mountinfo: %v\n", err)
+		}
+	}()
+
+	var mounts []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 {
+			mounts = append(mounts, filepath.Clean(unescapeMountPath(fields[4])))
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes (e.g. "\040" for a space) used in mountinfo.
+func unescapeMountPath(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			var c byte
+			if _, err := fmt.Sscanf(s[i+1:i+4], "%03o", &c); err == nil {
+				b.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// remount changes a mount to read-only or read-write. Flags such as nosuid and nodev are kept:
+// inside a user namespace the kernel refuses to clear flags set by the host.
+func remount(path string, readOnly bool) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return err
+	}
+	// Statfs reports ST_* flags, which match the MS_* mount flags except for relatime
+	const stRelatime = 0x1000
+	flags := uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME)
+	if st.Flags&stRelatime != 0 {
+		flags |= syscall.MS_RELATIME
+	}
+	if readOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	return syscall.Mount("", path, "", flags|syscall.MS_REMOUNT|syscall.MS_BIND, "")
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// sandboxBackend returns the backend used for s. Sandboxing needs Linux namespaces, so there
+// is none on other systems.
+func sandboxBackend(s SandboxConfig) string {
+	return ""
+}
+
+func wrapBwrap(cmd *exec.Cmd, s SandboxConfig, background bool) error {
+	return fmt.Errorf("sandboxing is not supported on %s", runtime.GOOS)
+}
+
+func wrapNamespaces(cmd *exec.Cmd, s SandboxConfig) error {
+	return fmt.Errorf("sandboxing is not supported on %s", runtime.GOOS)
+}
+
+// runSandboxInitIfRequested is a no-op outside Linux.
+func runSandboxInitIfRequested() {}
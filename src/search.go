@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// SearchFilesArgs represents arguments for searching file contents
+type SearchFilesArgs struct {
+	Pattern         string `json:"pattern"`
+	Path            string `json:"path,omitempty"`
+	Glob            string `json:"glob,omitempty"`
+	ContextLines    int    `json:"context_lines,omitempty"`
+	MaxResults      int    `json:"max_results,omitempty"`
+	CaseInsensitive bool   `json:"case_insensitive,omitempty"`
+}
+
+// ListFilesArgs represents arguments for listing files
+type ListFilesArgs struct {
+	Path     string `json:"path,omitempty"`
+	Glob     string `json:"glob,omitempty"`
+	MaxDepth int    `json:"max_depth,omitempty"`
+}
+
+// errSearchLimit stops a walk once enough results have been collected.
+var errSearchLimit = errors.New("search limit reached")
+
+// walkWorkspace walks root depth-first in lexical order, skipping ignored paths (see
+// ignoreMatcher) and calling fn with each remaining entry and its slash-separated path
+// relative to root. Ignore files are resolved from the current working directory when root
+// is inside it.
+func walkWorkspace(ctx context.Context, root string, fn func(path, rel string, d fs.DirEntry, depth int) error) error {
+	if _, err := os.Stat(root); err != nil {
+		return err
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	base := absRoot
+	if cwd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(cwd, absRoot); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			base = cwd
+		}
+	}
+	matcher := newIgnoreMatcher(base)
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			// Unreadable entries are skipped rather than failing the whole search
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if path == root {
+			return nil
+		}
+
+		abs := filepath.Join(absRoot, mustRel(root, path))
+		if matcher.ignored(abs, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		rel := filepath.ToSlash(mustRel(root, path))
+		return fn(path, rel, d, strings.Count(rel, "/")+1)
+	})
+}
+
+// mustRel returns target relative to base, or target itself if that isn't possible.
+func mustRel(base, target string) string {
+	rel, err := filepath.Rel(base, target)
+	if err != nil {
+		return target
+	}
+	return rel
+}
+
+// compileSearchGlob compiles the glob argument of a search tool once per search. It returns nil
+// when no glob is given.
+func compileSearchGlob(glob string) (*regexp.Regexp, error) {
+	if glob == "" {
+		return nil, nil
+	}
+	return compileGlob(glob)
+}
+
+// searchFiles greps files under a path for a regular expression, grep-style: matching lines as
+// "path:line:text" and context lines as "path-line-text", with "--" between groups.
+func searchFiles(ctx context.Context, dir, argsJSON string) (string, error) {
+	var args SearchFilesArgs
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	if args.Pattern == "" {
+		return "", fmt.Errorf("pattern cannot be empty")
+	}
+	pattern := args.Pattern
+	if args.CaseInsensitive {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid pattern: %w", err)
+	}
+
+	glob, err := compileSearchGlob(args.Glob)
+	if err != nil {
+		return "", err
+	}
+
+	root := resolveAgentPath(dir, args.Path)
+	maxResults := args.MaxResults
+	if maxResults <= 0 {
+		maxResults = DefaultSearchMaxResults
+	}
+	maxResults = min(maxResults, MaxSearchResults)
+	contextLines := min(max(args.ContextLines, 0), MaxSearchContextLines)
+
+	var out strings.Builder
+	matches, files := 0, 0
+	limited := false
+	search := func(path, display string) error {
+		info, err := os.Stat(path)
+		if err != nil || info.Size() > MaxSearchFileSize {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0 {
+			return nil
+		}
+
+		lines := splitLines(string(data))
+		printed := -1 // Index of the last line written for this file
+		found := false
+		for i, line := range lines {
+			if !re.MatchString(line) {
+				continue
+			}
+			if !found {
+				found = true
+				files++
+			}
+			from := max(i-contextLines, printed+1)
+			if contextLines > 0 && out.Len() > 0 && (printed < 0 || from > printed+1) {
+				out.WriteString("--\n")
+			}
+			for j := from; j <= min(i+contextLines, len(lines)-1); j++ {
+				if j <= printed {
+					continue
+				}
+				sep := "-"
+				if re.MatchString(lines[j]) {
+					sep = ":"
+				}
+				text := lines[j]
+				if len(text) > MaxSearchLineLength {
+					text = truncateUTF8(text, MaxSearchLineLength) + "..."
+				}
+				out.WriteString(fmt.Sprintf("%s%s%d%s%s\n", display, sep, j+1, sep, text))
+				printed = j
+			}
+			matches++
+			if matches >= maxResults {
+				limited = true
+				return errSearchLimit
+			}
+		}
+		return nil
+	}
+
+	if info, err := os.Stat(root); err == nil && !info.IsDir() {
+		err = search(root, filepath.ToSlash(root))
+		if err != nil && !errors.Is(err, errSearchLimit) {
+			return "", err
+		}
+	} else {
+		err := walkWorkspace(ctx, root, func(path, rel string, d fs.DirEntry, depth int) error {
+			if d.IsDir() || !d.Type().IsRegular() {
+				return nil
+			}
+			if glob != nil && !glob.MatchString(rel) {
+				return nil
+			}
+			return search(path, filepath.ToSlash(path))
+		})
+		if err != nil && !errors.Is(err, errSearchLimit) {
+			return "", err
+		}
+	}
+
+	if matches == 0 {
+		return "No matches found.", nil
+	}
+	if limited {
+		out.WriteString(fmt.Sprintf("(stopped after %d matches in %d files; narrow the pattern, path or glob, or raise max_results)\n", matches, files))
+	} else {
+		out.WriteString(fmt.Sprintf("(%d matches in %d files)\n", matches, files))
+	}
+	return out.String(), nil
+}
+
+// listFiles lists the files and directories under a path, one per line, with directories
+// marked by a trailing slash. With a glob only matching files are listed.
+func listFiles(ctx context.Context, dir, argsJSON string) (string, error) {
+	var args ListFilesArgs
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	glob, err := compileSearchGlob(args.Glob)
+	if err != nil {
+		return "", err
+	}
+	root := resolveAgentPath(dir, args.Path)
+
+	var out strings.Builder
+	count := 0
+	err = walkWorkspace(ctx, root, func(path, rel string, d fs.DirEntry, depth int) error {
+		if args.MaxDepth > 0 && depth > args.MaxDepth {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if glob != nil && (d.IsDir() || !glob.MatchString(rel)) {
+			return nil
+		}
+		if count >= MaxListFiles {
+			return errSearchLimit
+		}
+		count++
+		if d.IsDir() {
+			out.WriteString(rel + "/\n")
+		} else {
+			out.WriteString(rel + "\n")
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errSearchLimit) {
+		return "", err
+	}
+
+	if count == 0 {
+		return "No files found.", nil
+	}
+	if errors.Is(err, errSearchLimit) {
+		out.WriteString(fmt.Sprintf("(stopped after %d entries; use a deeper path, a glob or max_depth to narrow the listing)\n", count))
+	}
+	return out.String(), nil
+}
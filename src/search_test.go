@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSearchFiles(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".gitignore":        "ignored/\n",
+		"a.go":              "package a\nneedle one\nfunc f() {}\n\n\n\nneedle two\n",
+		"sub/b.go":          "needle three\n",
+		"notes.txt":         "needle in notes\n",
+		"ignored/c.go":      "needle ignored\n",
+		"..hidden/d.go":     "needle dotdot\n",
+		"vendor/.gitignore": "*.go\n",
+		"vendor/e.go":       "needle vendored\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(root)
+
+	out, err := searchFiles(context.Background(), root, `{"pattern": "needle", "glob": "*.go", "context_lines": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "..hidden/d.go:1:needle dotdot\n" +
+		"--\n" +
+		"a.go-1-package a\n" +
+		"a.go:2:needle one\n" +
+		"a.go-3-func f() {}\n" +
+		"--\n" +
+		"a.go-6-\n" +
+		"a.go:7:needle two\n" +
+		"--\n" +
+		"sub/b.go:1:needle three\n" +
+		"(4 matches in 3 files)\n"
+	if out != want {
+		t.Errorf("search output:\n%s\nwant:\n%s", out, want)
+	}
+
+	// The result limit stops the walk and says so
+	out, err = searchFiles(context.Background(), root, `{"pattern": "NEEDLE", "case_insensitive": true, "max_results": 2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(out, ":needle"); got != 2 || !strings.Contains(out, "stopped after 2 matches") {
+		t.Errorf("limited search returned %d matches:\n%s", got, out)
+	}
+
+	if out, err := searchFiles(context.Background(), root, `{"pattern": "haystack"}`); err != nil || out != "No matches found." {
+		t.Errorf("search without matches = %q, %v", out, err)
+	}
+	if _, err := searchFiles(context.Background(), root, `{"pattern": "("}`); err == nil {
+		t.Error("invalid pattern succeeded")
+	}
+}
@@ -28,6 +28,10 @@ type Session struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	ToolCalls        int `json:"tool_calls"`
+
+	// Tokens per serving model and model fallbacks that happened during the session
+	ModelUsage map[string]ModelUsage `json:"model_usage,omitempty"`
+	Fallbacks  []FallbackEvent       `json:"fallbacks,omitempty"`
 }
 
 // getSessionsDir returns the path to the sessions directory
@@ -79,6 +83,7 @@ func saveSession(agent *Agent) error {
 		CompletionTokens: totalCompletionTokens,
 		ToolCalls:        totalToolCalls,
 	}
+	session.ModelUsage, session.Fallbacks = snapshotModelUsage()
 	// Try to load existing session to preserve CreatedAt
 	existing, err := loadSession(agent.ID)
 	if err == nil {
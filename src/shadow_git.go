@@ -138,6 +138,56 @@ func (g *ShadowGit) Restore(hash string) error {
 	return nil
 }
 
+// Snapshot records the current state of the workspace as a tree object and returns its hash.
+// It uses indexFile instead of the repository's index, so it creates no commit and several
+// snapshots may be taken at the same time. Reusing indexFile for later snapshots of the same
+// workspace makes them faster.
+func (g *ShadowGit) Snapshot(indexFile string) (string, error) {
+	env := append(os.Environ(), "GIT_INDEX_FILE="+indexFile)
+
+	// The repository itself must not end up in the snapshot when agent-go runs in the home directory
+	pathspec := []string{"."}
+	if rel, err := filepath.Rel(g.WorkTree, g.RepoDir); err == nil && !strings.HasPrefix(rel, "..") {
+		pathspec = append(pathspec, ":(exclude)"+filepath.ToSlash(rel))
+	}
+	add := exec.Command("git", append([]string{"--git-dir=" + g.RepoDir, "--work-tree=" + g.WorkTree, "add", "-A", "--"}, pathspec...)...)
+	add.Env = env
+	if output, err := add.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to add files: %s: %s", err, string(output))
+	}
+
+	writeTree := exec.Command("git", "--git-dir="+g.RepoDir, "--work-tree="+g.WorkTree, "write-tree")
+	writeTree.Env = env
+	output, err := writeTree.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to write tree: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// ChangedFiles lists the files that differ between two snapshots.
+func (g *ShadowGit) ChangedFiles(from, to string) ([]FileChange, error) {
+	cmd := exec.Command("git", "-c", "core.quotePath=false", "--git-dir="+g.RepoDir, "diff-tree", "-r", "--name-status", "--no-renames", from, to)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff snapshots: %w", err)
+	}
+
+	statuses := map[string]string{"A": "added", "M": "modified", "D": "deleted", "T": "modified"}
+	var changes []FileChange
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		status, path, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		if name, known := statuses[status]; known {
+			status = name
+		}
+		changes = append(changes, FileChange{Path: path, Status: status})
+	}
+	return changes, nil
+}
+
 // getCurrentHash returns the current HEAD hash
 func (g *ShadowGit) getCurrentHash() (string, error) {
 	cmd := exec.Command("git", "--git-dir="+g.RepoDir, "--work-tree="+g.WorkTree, "rev-parse", "HEAD")
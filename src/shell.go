@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ShellSession is the working directory and environment that execute_command carries from
+// one call to the next. Each command still runs in a fresh shell; afterwards its final
+// directory and exported variables are read back, so "cd" and "export" persist per agent.
+type ShellSession struct {
+	Dir   string            // Empty means the workspace root (agent-go's own working directory)
+	Env   map[string]string // Variables set or changed by commands
+	Unset map[string]bool   // Variables removed by commands
+}
+
+var (
+	shellSessions = make(map[string]*ShellSession)
+	shellMutex    sync.Mutex
+)
+
+// volatileShellVars are maintained by the shell itself and never carried over
+var volatileShellVars = map[string]bool{
+	"PWD":    true,
+	"OLDPWD": true,
+	"SHLVL":  true,
+	"_":      true,
+}
+
+// shellStateSupported reports whether commands report their final directory and environment.
+// cmd.exe has no exit trap, so on Windows only /cwd changes the directory.
+func shellStateSupported() bool {
+	return runtime.GOOS != "windows"
+}
+
+// workspaceRoot returns agent-go's working directory, where every shell session starts.
+func workspaceRoot() string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "."
+	}
+	return cwd
+}
+
+// resolveAgentPath resolves a path an agent passed to a tool against its shell directory, so a
+// relative path means the same to the file tools as to execute_command. Paths inside the
+// workspace are returned relative to the workspace root, others as absolute paths.
+func resolveAgentPath(dir, path string) string {
+	if path == "" {
+		path = "."
+	}
+	if filepath.IsAbs(path) {
+		return path
+	}
+	joined := filepath.Join(dir, path)
+	if rel, err := filepath.Rel(workspaceRoot(), joined); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return rel
+	}
+	return joined
+}
+
+// getShellDir returns the directory the next command of an agent runs in. A directory that
+// no longer exists falls back to the workspace root.
+func getShellDir(agentID string) string {
+	shellMutex.Lock()
+	defer shellMutex.Unlock()
+
+	session, ok := shellSessions[agentID]
+	if !ok || session.Dir == "" {
+		return workspaceRoot()
+	}
+	if info, err := os.Stat(session.Dir); err != nil || !info.IsDir() {
+		session.Dir = ""
+		return workspaceRoot()
+	}
+	return session.Dir
+}
+
+// getShellEnv returns the environment for the next command of an agent, or nil when no
+// command has changed it.
+func getShellEnv(agentID string) []string {
+	shellMutex.Lock()
+	defer shellMutex.Unlock()
+
+	session, ok := shellSessions[agentID]
+	if !ok || (len(session.Env) == 0 && len(session.Unset) == 0) {
+		return nil
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if _, changed := session.Env[key]; changed || session.Unset[key] {
+			continue
+		}
+		env = append(env, kv)
+	}
+	for key, value := range session.Env {
+		env = append(env, key+"="+value)
+	}
+	return env
+}
+
+// setShellDir changes the directory of an agent's shell session. An empty dir resets it to
+// the workspace root.
+func setShellDir(agentID, dir string) {
+	shellMutex.Lock()
+	defer shellMutex.Unlock()
+
+	session := shellSessions[agentID]
+	if session == nil {
+		session = &ShellSession{}
+		shellSessions[agentID] = session
+	}
+	if dir == workspaceRoot() {
+		dir = ""
+	}
+	session.Dir = dir
+}
+
+// resetShellSession drops the directory and environment changes of an agent.
+func resetShellSession(agentID string) {
+	shellMutex.Lock()
+	defer shellMutex.Unlock()
+	delete(shellSessions, agentID)
+}
+
+// wrapShellCommand prepends an exit trap to command that writes the shell's final directory
+// and environment to file descriptor 3. The trap keeps the command's exit status.
+func wrapShellCommand(command string) string {
+	return "trap '{ pwd; env -0 2>/dev/null || env; } >&3' EXIT\n" + command
+}
+
+// updateShellSession records the directory and environment a command left behind, as written
+// by the trap from wrapShellCommand. An empty state (the command was killed or replaced the
+// shell with exec) leaves the session unchanged.
+func updateShellSession(agentID string, state []byte) {
+	dir, dump, ok := bytes.Cut(state, []byte("\n"))
+	if !ok || len(dir) == 0 {
+		return
+	}
+
+	// env -0 separates variables with NUL; plain env (without -0 support) uses newlines, where
+	// lines without "=" continue a multi-line value
+	var entries []string
+	if bytes.IndexByte(dump, 0) >= 0 {
+		entries = strings.Split(string(dump), "\x00")
+	} else {
+		for _, line := range strings.Split(string(dump), "\n") {
+			if !strings.Contains(line, "=") && len(entries) > 0 {
+				entries[len(entries)-1] += "\n" + line
+				continue
+			}
+			entries = append(entries, line)
+		}
+	}
+	current := make(map[string]string)
+	for _, kv := range entries {
+		if key, value, ok := strings.Cut(kv, "="); ok && key != "" && !volatileShellVars[key] {
+			current[key] = value
+		}
+	}
+
+	session := &ShellSession{Env: make(map[string]string), Unset: make(map[string]bool)}
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if volatileShellVars[key] {
+			continue
+		}
+		if newValue, ok := current[key]; !ok {
+			session.Unset[key] = true
+		} else if newValue != value {
+			session.Env[key] = newValue
+		}
+		delete(current, key)
+	}
+	for key, value := range current {
+		session.Env[key] = value
+	}
+	session.Dir = filepath.Clean(string(dir))
+	if session.Dir == workspaceRoot() {
+		session.Dir = ""
+	}
+
+	shellMutex.Lock()
+	shellSessions[agentID] = session
+	shellMutex.Unlock()
+}
+
+// displayShellDir returns the shell directory of an agent for display: relative to the
+// workspace root when inside it, and empty when it is the root itself.
+func displayShellDir(agentID string) string {
+	dir := getShellDir(agentID)
+	root := workspaceRoot()
+	if dir == root {
+		return ""
+	}
+	if rel, err := filepath.Rel(root, dir); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return dir
+}
+
+// describeShellSession summarizes an agent's shell directory and environment changes for /cwd.
+func describeShellSession(agentID string) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("Shell directory: %s\n", getShellDir(agentID)))
+
+	shellMutex.Lock()
+	session := shellSessions[agentID]
+	var changes []string
+	if session != nil {
+		for key, value := range session.Env {
+			changes = append(changes, fmt.Sprintf("  %s=%s", key, value))
+		}
+		for key := range session.Unset {
+			changes = append(changes, fmt.Sprintf("  unset %s", key))
+		}
+	}
+	shellMutex.Unlock()
+
+	if len(changes) == 0 {
+		b.WriteString("Environment: unchanged")
+		return b.String()
+	}
+	sort.Strings(changes)
+	b.WriteString("Environment changes:\n")
+	b.WriteString(strings.Join(changes, "\n"))
+	return b.String()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// StreamDelta is a single incremental piece of an assistant message delivered over SSE.
+type StreamDelta struct {
+	Content          string
+	ReasoningContent string
+}
+
+// StreamHandler is called for every content/reasoning delta as it arrives.
+type StreamHandler func(delta StreamDelta)
+
+// StreamOptions controls extra data sent by the provider in streaming mode.
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// StreamChunk represents one "data:" event of a chat completions stream.
+type StreamChunk struct {
+	Model   string         `json:"model,omitempty"`
+	Choices []StreamChoice `json:"choices"`
+	Usage   *Usage         `json:"usage,omitempty"`
+}
+
+type StreamChoice struct {
+	Index        int               `json:"index"`
+	Delta        StreamMessageDiff `json:"delta"`
+	FinishReason string            `json:"finish_reason,omitempty"`
+}
+
+type StreamMessageDiff struct {
+	Role             string          `json:"role,omitempty"`
+	Content          *string         `json:"content,omitempty"`
+	ReasoningContent *string         `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCallDelta `json:"tool_calls,omitempty"`
+}
+
+// ToolCallDelta is a fragment of a tool call. The ID and name usually arrive in the
+// first fragment for a given index; arguments are delivered in pieces.
+type ToolCallDelta struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments,omitempty"`
+	} `json:"function"`
+}
+
+// readStreamResponse consumes an SSE chat completions stream and assembles it into a
+// regular APIResponse, so callers can treat streamed and blocking responses the same way.
+func readStreamResponse(body io.Reader, onDelta StreamHandler) (*APIResponse, error) {
+	var content, reasoning strings.Builder
+	var hasContent, hasReasoning bool
+	role := "assistant"
+	toolCalls := make(map[int]*ToolCall)
+	var usage Usage
+	var model string
+	sawChunk := false
+
+	scanner := bufio.NewScanner(body)
+	// Tool call arguments can arrive as large single events; allow generous line sizes.
+	scanner.Buffer(make([]byte, 0, 64*1024), 8*1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ":") {
+			continue
+		}
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk StreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("failed to decode stream chunk: %w", err)
+		}
+		sawChunk = true
+
+		if chunk.Model != "" {
+			model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
+		}
+
+		for _, choice := range chunk.Choices {
+			delta := choice.Delta
+			if delta.Role != "" {
+				role = delta.Role
+			}
+			var piece StreamDelta
+			if delta.ReasoningContent != nil && *delta.ReasoningContent != "" {
+				reasoning.WriteString(*delta.ReasoningContent)
+				hasReasoning = true
+				piece.ReasoningContent = *delta.ReasoningContent
+			}
+			if delta.Content != nil && *delta.Content != "" {
+				content.WriteString(*delta.Content)
+				hasContent = true
+				piece.Content = *delta.Content
+			}
+			if onDelta != nil && (piece.Content != "" || piece.ReasoningContent != "") {
+				onDelta(piece)
+			}
+
+			for _, tc := range delta.ToolCalls {
+				existing, ok := toolCalls[tc.Index]
+				if !ok {
+					existing = &ToolCall{Type: "function"}
+					toolCalls[tc.Index] = existing
+				}
+				if tc.ID != "" {
+					existing.ID = tc.ID
+				}
+				if tc.Type != "" {
+					existing.Type = tc.Type
+				}
+				if tc.Function.Name != "" {
+					existing.Function.Name += tc.Function.Name
+				}
+				existing.Function.Arguments += tc.Function.Arguments
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read stream: %w", err)
+	}
+	if !sawChunk {
+		return &APIResponse{}, nil
+	}
+
+	msg := Message{Role: role}
+	if hasContent {
+		text := content.String()
+		msg.Content = &text
+	}
+	if hasReasoning {
+		text := reasoning.String()
+		msg.ReasoningContent = &text
+	}
+	if len(toolCalls) > 0 {
+		indexes := make([]int, 0, len(toolCalls))
+		for idx := range toolCalls {
+			indexes = append(indexes, idx)
+		}
+		sort.Ints(indexes)
+		for _, idx := range indexes {
+			msg.ToolCalls = append(msg.ToolCalls, *toolCalls[idx])
+		}
+	}
+
+	return &APIResponse{
+		Model:   model,
+		Choices: []Choice{{Message: msg}},
+		Usage:   usage,
+	}, nil
+}
+
+// streamPrinter renders streamed deltas to the terminal in the same style as
+// the non-streaming output ("● Think..." marker, then "● <content>").
+type streamPrinter struct {
+	thinking bool
+	content  bool
+}
+
+func newStreamPrinter() *streamPrinter {
+	return &streamPrinter{}
+}
+
+// handle prints one delta. It is passed to sendAPIRequestStreaming as the StreamHandler.
+func (p *streamPrinter) handle(delta StreamDelta) {
+	if delta.ReasoningContent != "" && !p.thinking && !p.content {
+		p.thinking = true
+		fmt.Printf("%s● %sThink...\n%s", ColorHighlight, ColorMeta, ColorReset)
+	}
+	if delta.Content != "" {
+		if !p.content {
+			p.content = true
+			fmt.Printf("%s● %s", ColorHighlight, ColorMain)
+		}
+		fmt.Print(delta.Content)
+	}
+}
+
+// finish terminates the streamed line, if anything was printed.
+func (p *streamPrinter) finish() {
+	if p != nil && p.content {
+		fmt.Printf("%s\n", ColorReset)
+	}
+}
+
+// printedReasoning reports whether the "Think..." marker was already shown.
+func (p *streamPrinter) printedReasoning() bool {
+	return p != nil && p.thinking
+}
+
+// printedContent reports whether the assistant content was already shown.
+func (p *streamPrinter) printedContent() bool {
+	return p != nil && p.content
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadStreamResponse(t *testing.T) {
+	body := strings.Join([]string{
+		`: keep-alive comment`,
+		`data: {"model":"gpt-test","choices":[{"index":0,"delta":{"role":"assistant","reasoning_content":"hmm"}}]}`,
+		``,
+		`data: {"choices":[{"index":0,"delta":{"content":"Hel"}}]}`,
+		`data: {"choices":[{"index":0,"delta":{"content":"lo"}}]}`,
+		// Two tool calls, interleaved, with the second index arriving first
+		`data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_b","type":"function","function":{"name":"list_files","arguments":""}}]}}]}`,
+		`data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_a","function":{"name":"read_","arguments":"{\"pa"}}]}}]}`,
+		`data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"function":{"arguments":"{}"}}]}}]}`,
+		`data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"name":"file","arguments":"th\":\"a.go\"}"}}]}}]}`,
+		`data: {"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+		`data: {"choices":[],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`,
+		`data: [DONE]`,
+		// Nothing after the terminator is read
+		`data: {"choices":[{"index":0,"delta":{"content":" ignored"}}]}`,
+	}, "\n")
+
+	var deltas []StreamDelta
+	resp, err := readStreamResponse(strings.NewReader(body), func(d StreamDelta) { deltas = append(deltas, d) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantDeltas := []StreamDelta{{ReasoningContent: "hmm"}, {Content: "Hel"}, {Content: "lo"}}
+	if !reflect.DeepEqual(deltas, wantDeltas) {
+		t.Errorf("deltas = %+v, want %+v", deltas, wantDeltas)
+	}
+	if resp.Model != "gpt-test" || resp.Usage.TotalTokens != 15 {
+		t.Errorf("model %q, usage %+v", resp.Model, resp.Usage)
+	}
+	msg := resp.Choices[0].Message
+	if msg.Role != "assistant" || msg.Content == nil || *msg.Content != "Hello" || msg.ReasoningContent == nil || *msg.ReasoningContent != "hmm" {
+		t.Errorf("message = %+v", msg)
+	}
+	if len(msg.ToolCalls) != 2 {
+		t.Fatalf("got %d tool calls, want 2", len(msg.ToolCalls))
+	}
+	want := [][3]string{{"call_a", "read_file", `{"path":"a.go"}`}, {"call_b", "list_files", "{}"}}
+	for i, tc := range msg.ToolCalls {
+		got := [3]string{tc.ID, tc.Function.Name, tc.Function.Arguments}
+		if got != want[i] || tc.Type != "function" {
+			t.Errorf("tool call %d = %q (%s), want %q", i, got, tc.Type, want[i])
+		}
+	}
+}
+
+func TestReadStreamResponseWithoutChunks(t *testing.T) {
+	resp, err := readStreamResponse(strings.NewReader(": ping\n\ndata: [DONE]\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Choices) != 0 {
+		t.Errorf("choices = %+v, want none", resp.Choices)
+	}
+
+	if _, err := readStreamResponse(strings.NewReader("data: {not json\n"), nil); err == nil {
+		t.Error("a malformed chunk was accepted")
+	}
+}
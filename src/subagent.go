@@ -1,51 +1,149 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/google/jsonschema-go/jsonschema"
 	"github.com/google/uuid"
 )
 
 // runSubAgent executes a task in a separate sub-agent context (backward-compatible behavior, defaults to "build" agent).
-func runSubAgent(task string, config *Config) (string, error) {
-	return runSubAgentWithAgent(task, "build", "", config)
+func runSubAgent(ctx context.Context, task string, config *Config) (string, error) {
+	return runSubAgentWithAgent(ctx, task, "build", "", config)
 }
 
 // runSubAgentWithAgent executes a task in a separate sub-agent context, using a specified agent
-// definition (built-in: 'plan', 'build', or a custom saved agent).
-func runSubAgentWithAgent(task string, agentName string, modelName string, config *Config) (string, error) {
-	sysInfo := getSystemInfo()
+// definition (built-in: 'plan', 'build', or a custom saved agent), and returns the sub-agent's
+// final message. Cancelling ctx stops the sub-agent between steps and aborts its in-flight
+// request or command.
+func runSubAgentWithAgent(ctx context.Context, task string, agentName string, modelName string, config *Config) (string, error) {
+	args := SubAgentTask{Task: task, Agent: agentName, Model: modelName}
+	result := runSubAgentTask(ctx, newSubAgentNode(nil, subAgentName(args), args, config), args, config)
+	return result.Summary, result.err
+}
 
-	basePrompt := `You are a sub-agent tasked with completing a specific goal. You have access to the 'execute_command' and todo list management tools. Plan your steps and execute them sequentially.
+// subAgentName returns the name of the agent definition a spawn_agent call asks for.
+func subAgentName(args SubAgentTask) string {
+	// Default to "build" agent if no agent specified
+	if name := strings.TrimSpace(args.Agent); name != "" {
+		return name
+	}
+	return "build"
+}
 
-IMPORTANT: To create or modify files, you MUST use the execute_command tool with shell commands like:
-- cat > filename.txt << 'EOF'
-content here
-EOF
-- echo "content" > filename.txt
+// maxSubAgentDepth returns how deep sub-agents may be nested: 1 lets only the main agent spawn them.
+func maxSubAgentDepth(config *Config) int {
+	if config.MaxSubAgentDepth > 0 {
+		return config.MaxSubAgentDepth
+	}
+	return DefaultMaxSubAgentDepth
+}
 
-Do NOT just output file contents as text - you must actually write them to disk using execute_command.
+// maxSubAgentIterations returns the most steps any sub-agent may take.
+func maxSubAgentIterations(config *Config) int {
+	if config.MaxSubAgentIterations > 0 {
+		return config.MaxSubAgentIterations
+	}
+	return MaxSubAgentIterations
+}
 
-When you have fully completed the task (including writing any required files), provide a brief summary of what was done.`
+// runSubAgentTask executes the task of a spawn_agent call as the sub-agent of node. Besides the
+// sub-agent's final message, the result lists the files it changed, the commands it ran, the
+// artifacts it declared and the tokens it used. With an output_schema, the final message must be
+// JSON matching the schema. A timeout in args stops the sub-agent, and everything it spawned,
+// once it is over.
+func runSubAgentTask(ctx context.Context, node *subAgentNode, args SubAgentTask, config *Config) *SubAgentResult {
+	result := &SubAgentResult{Agent: subAgentName(args)}
+	node.start()
 
-	// Default to "build" agent if no agent specified
-	if strings.TrimSpace(agentName) == "" {
-		agentName = "build"
+	var summary string
+	var err error
+	var schema *jsonschema.Resolved
+	if len(args.OutputSchema) > 0 {
+		schema, err = resolveOutputSchema(args.OutputSchema)
 	}
+	if err == nil {
+		subCtx := ctx
+		if args.TimeoutSeconds > 0 {
+			var cancel context.CancelFunc
+			subCtx, cancel = context.WithTimeout(ctx, time.Duration(args.TimeoutSeconds)*time.Second)
+			defer cancel()
+		}
+
+		subAgentID := uuid.New().String()
+		summary, err = runSubAgentLoop(subCtx, subAgentID, node, args, schema, config, result)
+		result.addCommandChanges(node.overlapped())
+		result.Usage.NestedTokens = node.nestedTokens()
+	}
+	result.finish(summary, err)
+
+	// Only the parent's ctx counts as a cancellation; a timeout of the sub-agent is a failure
+	cancelled := err != nil && ctx.Err() != nil
+	node.update(func(n *subAgentNode) {
+		n.Finished = time.Now()
+		switch {
+		case cancelled:
+			n.State = SubAgentCancelled
+		case result.Status == SubAgentStatusFailed:
+			n.State = SubAgentFailed
+		default:
+			n.State = SubAgentDone
+		}
+	})
+	return result
+}
+
+// subAgentStopped returns why a sub-agent whose ctx is done stopped.
+func subAgentStopped(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("sub-agent timed out: %w", ctx.Err())
+	}
+	return fmt.Errorf("sub-agent cancelled: %w", ctx.Err())
+}
+
+// runSubAgentLoop runs the sub-agent of node until it gives its final message, which it returns.
+// What the sub-agent does along the way is recorded in result and node.
+func runSubAgentLoop(ctx context.Context, subAgentID string, node *subAgentNode, args SubAgentTask, schema *jsonschema.Resolved, config *Config, result *SubAgentResult) (string, error) {
+	agentName := subAgentName(args)
+
+	basePrompt := `You are a sub-agent tasked with completing a specific goal. You have access to shell commands, file tools, todo list management and every other tool your agent definition allows. Plan your steps and execute them sequentially.
+
+IMPORTANT: To create or modify files, use the file tools:
+- search_files and list_files to find code and files (they skip ignored files like node_modules)
+- read_file to look at a file (use start_line/end_line for large files)
+- write_file to create a file or replace its whole content
+- edit_file to change part of an existing file by replacing an exact, unique string
+- apply_patch to make related changes across several files with one unified diff
+
+Do NOT just output file contents as text - you must actually write them to disk.
+
+When you have fully completed the task (including writing any required files), provide a brief summary of what was done.`
 
 	// Load the agent definition
 	def, err := loadAgentDefinition(agentName)
 	if err != nil {
 		return "", fmt.Errorf("failed to load agent '%s' for sub-agent: %w", agentName, err)
 	}
+	def = subAgentDefinition(def)
 
-	systemPrompt := sysInfo + "\n\n" + fmt.Sprintf("=== Task-Specific Agent: %s ===\n%s\n\n%s", def.Name, def.SystemPrompt, basePrompt)
+	defer resetShellSession(subAgentID)
+	systemPrompt := getSystemInfo() + "\n\n" + fmt.Sprintf("=== Task-Specific Agent: %s ===\n%s\n\n%s", def.Name, def.SystemPrompt, basePrompt)
+
+	task := args.Task
+	if schema != nil {
+		task += "\n\nWhen you are done, reply with only a JSON value that matches this JSON schema, without any other text:\n" + string(args.OutputSchema)
+	}
 
 	subAgent := &Agent{
-		ID:           uuid.New().String(),
+		ID:           subAgentID,
 		AgentDefName: agentName,
+		Depth:        node.Depth,
 		Messages: []Message{
 			{
 				Role:    "system",
@@ -60,22 +158,47 @@ When you have fully completed the task (including writing any required files), p
 
 	// Determine which model to use
 	subConfig := *config
-	if modelName == "mini" && config.MiniModel != "" {
+	if strings.TrimSpace(args.Model) == "mini" && config.MiniModel != "" {
 		subConfig.Model = config.MiniModel
 	}
 
+	// The sub-agent reports to the progress view it runs in, if any. It may spawn sub-agents of
+	// its own while it is above max_subagent_depth.
+	caller := toolCaller{agent: subAgent, config: &subConfig, spawnConfig: config, def: def, subAgent: true, node: node, result: result}
+	includeSpawn := config.SubagentsEnabled && node.Depth < maxSubAgentDepth(config)
+
 	// Track tool loop for sub-agent
-	var lastSubAgentToolSig string
-	var subAgentToolRepeatCount int
+	var loop toolLoopDetector
+
+	// The last message of the sub-agent, for a partial result when it runs out of iterations
+	var lastContent string
+	var schemaRetries int
 
 	// Limit iterations to prevent infinite loops
-	for iteration := 0; iteration < MaxSubAgentIterations; iteration++ {
-		// Use false for includeSpawn to prevent sub-agents from creating more sub-agents
+	for iteration := 0; iteration < node.MaxIterations; iteration++ {
+		if ctx.Err() != nil {
+			return lastContent, subAgentStopped(ctx)
+		}
+		if !checkBudget(config) {
+			return lastContent, fmt.Errorf("sub-agent stopped: spending budget reached")
+		}
+		// The tokens of the sub-agent and all it spawned count against its budget and its ancestors'
+		if exhausted := node.exhaustedBudget(); exhausted != nil {
+			return lastContent, fmt.Errorf("sub-agent stopped: token budget of %s (%d tokens) used up", exhausted.Label, exhausted.MaxTokens)
+		}
+		node.step(iteration + 1)
+		result.Usage.Iterations = iteration + 1
+
 		// Pass the agent definition for tool filtering
-		resp, err := sendAPIRequest(subAgent, &subConfig, false, def)
+		resp, err := sendAPIRequest(ctx, subAgent, &subConfig, includeSpawn, def)
 		if err != nil {
-			return "", fmt.Errorf("sub-agent API request failed: %w", err)
+			if ctx.Err() != nil {
+				return lastContent, subAgentStopped(ctx)
+			}
+			return lastContent, fmt.Errorf("sub-agent API request failed: %w", err)
 		}
+		node.usage(resp.Usage)
+		result.addUsage(resp.Usage)
 
 		if len(resp.Choices) == 0 {
 			return "", fmt.Errorf("sub-agent received an empty response from the API")
@@ -84,106 +207,178 @@ When you have fully completed the task (including writing any required files), p
 		assistantMsg := resp.Choices[0].Message
 		subAgent.Messages = append(subAgent.Messages, assistantMsg)
 
+		if assistantMsg.Content != nil && strings.TrimSpace(*assistantMsg.Content) != "" {
+			lastContent = *assistantMsg.Content
+		}
+
 		if len(assistantMsg.ToolCalls) == 0 {
 			// If there are no more tool calls, the sub-agent's work is done
-			if assistantMsg.Content != nil {
+			if assistantMsg.Content == nil {
+				return "", fmt.Errorf("sub-agent finished without providing a result")
+			}
+			if schema == nil {
 				return *assistantMsg.Content, nil
 			}
-			return "", fmt.Errorf("sub-agent finished without providing a result")
-		}
 
-		// Check for tool loop in sub-agent (within single response)
-		toolCallMap := make(map[string]int)
-		for _, tc := range assistantMsg.ToolCalls {
-			sig := tc.Function.Name + ":" + tc.Function.Arguments
-			toolCallMap[sig]++
-			if toolCallMap[sig] >= MaxRepeatedToolCalls {
-				// Sub-agent is stuck with repeated calls in single response
-				fmt.Printf("%sWarning: Sub-agent detected repeated tool calls. Stopping and suggesting different approach.%s\n", ColorYellow, ColorReset)
-				stopMsg := ToolLoopStopMessage
-				subAgent.Messages = append(subAgent.Messages, Message{
-					Role:    "user",
-					Content: &stopMsg,
-				})
-				lastSubAgentToolSig = ""
-				subAgentToolRepeatCount = 0
-				// Continue to let sub-agent respond to stop message
-				continue
+			// The final message must match the output schema; the sub-agent gets a few tries
+			output, err := validateSubAgentOutput(schema, *assistantMsg.Content)
+			if err == nil {
+				result.Output = output
+				return "", nil
+			}
+			if schemaRetries >= MaxSubAgentSchemaRetries {
+				return *assistantMsg.Content, fmt.Errorf("final message does not match output_schema: %w", err)
 			}
+			schemaRetries++
+			retryMsg := fmt.Sprintf("Your final message does not match the output schema: %s\nReply again with only a JSON value that matches the schema.", err)
+			subAgent.Messages = append(subAgent.Messages, Message{Role: "user", Content: &retryMsg})
+			continue
 		}
 
-		// Check for tool loop across iterations
-		signature := getToolCallSignature(assistantMsg.ToolCalls)
-		if signature == lastSubAgentToolSig {
-			subAgentToolRepeatCount++
-			if subAgentToolRepeatCount >= MaxRepeatedToolCalls {
-				// Sub-agent is stuck, inject stop message
-				fmt.Printf("%sWarning: Sub-agent detected repeated tool calls. Stopping and suggesting different approach.%s\n", ColorYellow, ColorReset)
-				stopMsg := ToolLoopStopMessage
-				subAgent.Messages = append(subAgent.Messages, Message{
-					Role:    "user",
-					Content: &stopMsg,
-				})
-				lastSubAgentToolSig = ""
-				subAgentToolRepeatCount = 0
-				// Continue to let sub-agent respond to stop message
-				continue
-			}
-		} else {
-			lastSubAgentToolSig = signature
-			subAgentToolRepeatCount = 1
+		// Check for tool loop before processing, the same way as for the main agent
+		if loop.check(assistantMsg.ToolCalls) {
+			node.warnf("%sWarning: Sub-agent detected repeated tool calls. Stopping and suggesting different approach.%s", ColorYellow, ColorReset)
+			stopMsg := ToolLoopStopMessage
+			subAgent.Messages = append(subAgent.Messages, Message{
+				Role:    "user",
+				Content: &stopMsg,
+			})
+			loop.reset()
+			// Continue to let sub-agent respond to stop message
+			continue
 		}
 
-		for _, toolCall := range assistantMsg.ToolCalls {
-			var output string
-			var err error
-			var logMessage string
-
-			switch toolCall.Function.Name {
-			case "execute_command":
-				var args CommandArgs
-				if unmarshalErr := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); unmarshalErr != nil {
-					output = fmt.Sprintf("Failed to parse arguments: %s", unmarshalErr)
-				} else {
-					output, err = confirmAndExecute(&subConfig, args.Command)
-					if err == nil {
-						logMessage = fmt.Sprintf("Bash %s(%s)%s", ColorMeta, args.Command, ColorReset)
-					}
-				}
-			case "create_todo":
-				output, err = createTodo(subAgent.ID, toolCall.Function.Arguments)
-				if err == nil {
-					logMessage = "Created todo item"
-				}
-			case "update_todo":
-				output, err = updateTodo(subAgent.ID, toolCall.Function.Arguments)
-				if err == nil {
-					logMessage = "Updated todo item"
-				}
-			case "get_todo_list":
-				output, err = getTodoList(subAgent.ID)
-				if err == nil {
-					logMessage = "Retrieved todo list"
-				}
-			default:
-				output = fmt.Sprintf("Unknown tool: %s", toolCall.Function.Name)
+		// The same way as for the main agent, so spawn_agent calls of a sub-agent run in parallel too
+		runToolCalls(ctx, caller, assistantMsg.ToolCalls)
+	}
+
+	return lastContent, fmt.Errorf("sub-agent exceeded maximum iterations (%d)", node.MaxIterations)
+}
+
+// maxParallelSubAgents returns how many sub-agents may run at the same time.
+func maxParallelSubAgents(config *Config) int {
+	if config.MaxParallelSubAgents > 0 {
+		return config.MaxParallelSubAgents
+	}
+	return DefaultMaxParallelSubAgents
+}
+
+// runParallelSubAgents runs the sub-agents of several spawn_agent calls concurrently, at most
+// max_parallel_subagents at a time, each with its own ID, shell session and todo list. While
+// they run, their progress is shown in one status view instead of interleaved log lines; a batch
+// spawned by a sub-agent shows up below it in the view that sub-agent is part of. The returned
+// tool messages are in the order of toolCalls, however the sub-agents finish.
+func runParallelSubAgents(ctx context.Context, caller toolCaller, toolCalls []ToolCall) []Message {
+	agent := caller.agent
+	outputs := make([]string, len(toolCalls))
+	errs := make([]error, len(toolCalls))
+	denied := make([]bool, len(toolCalls))
+	callCtxs := make([]context.Context, len(toolCalls))
+
+	type job struct {
+		call int // Index into toolCalls
+		args SubAgentTask
+		node *subAgentNode
+	}
+	var jobs []job
+
+	// Hooks may prompt, so they run one after the other before any sub-agent starts
+	spawnErr := checkSpawnAllowed(caller)
+	for i, toolCall := range toolCalls {
+		callCtx, denial, allowed := runPreToolUseHooks(ctx, agent, toolCall)
+		callCtxs[i] = callCtx
+		if !allowed {
+			outputs[i] = denial
+			denied[i] = true
+			continue
+		}
+		if spawnErr != nil {
+			outputs[i], errs[i] = fmt.Sprintf("Tool execution error: %s", spawnErr), spawnErr
+			caller.failf(toolCall)
+			continue
+		}
+		var args SubAgentTask
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+			outputs[i] = fmt.Sprintf("Failed to parse arguments: %s", err)
+			continue
+		}
+		jobs = append(jobs, job{call: i, args: args})
+	}
+	if len(jobs) == 0 {
+		return toolMessages(caller, toolCalls, outputs, errs, denied, callCtxs)
+	}
+
+	limit := maxParallelSubAgents(caller.config)
+	caller.logf("Spawning %d sub-agents (%d at a time)", len(jobs), min(limit, len(jobs)))
+	nodes := make([]*subAgentNode, len(jobs))
+	for n := range jobs {
+		nodes[n] = newSubAgentNode(caller.node, fmt.Sprintf("%s #%d", subAgentName(jobs[n].args), jobs[n].call+1), jobs[n].args, caller.spawnConfig)
+		jobs[n].node = nodes[n]
+		if caller.config.SubAgentVerboseMode == 2 {
+			caller.logf("[%s] %s%s", nodes[n].Label, ColorHighlight, jobs[n].args.Task)
+		}
+	}
+
+	// Only one progress view is on screen at a time: sub-agents spawned by a sub-agent that
+	// already has one are shown in it
+	progress := caller.node.progressView()
+	ownProgress := progress == nil
+	if ownProgress {
+		progress = newSubAgentProgress(nodes)
+		progress.start()
+	}
+
+	slots := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			callCtx := callCtxs[j.call]
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-callCtx.Done():
+				errs[j.call] = callCtx.Err()
+				j.node.update(func(n *subAgentNode) {
+					n.State = SubAgentCancelled
+					n.Finished = time.Now()
+				})
+				return
 			}
 
-			if err != nil {
-				output = fmt.Sprintf("Tool execution error: %s", err)
-				fmt.Printf("%s==> %s%s\n", ColorRed, formatToolCallCompact(toolCall), ColorReset)
-			} else if logMessage != "" {
-				fmt.Printf("%s%s==> %s%s%s\n", StyleBold, ColorHighlight, ColorReset, logMessage, ColorReset)
+			result := runSubAgentTask(callCtx, j.node, j.args, caller.spawnConfig)
+			outputs[j.call], errs[j.call] = result.String(), result.err
+
+			cancelled := result.err != nil && callCtx.Err() != nil
+			if !cancelled && result.Status == SubAgentStatusFailed {
+				j.node.logf("%s==> %s%s", ColorRed, formatToolCallCompact(toolCalls[j.call]), ColorReset)
+			} else if !cancelled {
+				j.node.logf("%sSub-agent finished task (%s)%s", ColorMeta, result.Status, ColorReset)
 			}
+		}()
+	}
+	wg.Wait()
+	if ownProgress {
+		progress.finish()
+	}
+	return toolMessages(caller, toolCalls, outputs, errs, denied, callCtxs)
+}
 
-			toolMsg := Message{
-				Role:       "tool",
-				ToolCallID: toolCall.ID,
-				Content:    &output,
+// toolMessages returns the tool messages of a batch of spawn_agent calls, after their
+// PostToolUse hooks.
+func toolMessages(caller toolCaller, toolCalls []ToolCall, outputs []string, errs []error, denied []bool, callCtxs []context.Context) []Message {
+	messages := make([]Message, 0, len(toolCalls))
+	for i, toolCall := range toolCalls {
+		output, err := outputs[i], errs[i]
+		if !denied[i] {
+			// A failed sub-agent still returns its structured result, which says what went wrong
+			if err != nil && callCtxs[i].Err() != nil {
+				output = CancelledToolResult
 			}
-			subAgent.Messages = append(subAgent.Messages, toolMsg)
+			output = runPostToolUseHooks(callCtxs[i], caller.agent, toolCall, output, err)
 		}
+		messages = append(messages, Message{Role: "tool", ToolCallID: toolCall.ID, Content: &output})
 	}
-
-	return "", fmt.Errorf("sub-agent exceeded maximum iterations (%d)", MaxSubAgentIterations)
+	return messages
 }
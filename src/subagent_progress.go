@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/chzyer/readline"
+)
+
+// Sub-agent states shown in the progress view
+const (
+	SubAgentQueued    = "queued"
+	SubAgentRunning   = "running"
+	SubAgentDone      = "done"
+	SubAgentFailed    = "failed"
+	SubAgentCancelled = "cancelled"
+	SubAgentSkipped   = "skipped" // A workflow node whose dependencies failed
+	SubAgentReused    = "reused"  // A workflow node taken over from the run that was resumed
+)
+
+// subAgentProgress reports the progress of sub-agents running in parallel. On a TTY it keeps a
+// compact status block at the bottom of the output, with the sub-agents they spawn in turn
+// indented below them, and redraws it in place; otherwise each sub-agent's log lines are
+// printed with its label so they can be told apart.
+type subAgentProgress struct {
+	mu     sync.Mutex
+	agents []*subAgentNode
+	live   bool // Redraw a status block instead of printing log lines
+	quiet  bool // Pipeline mode: print nothing but warnings
+	drawn  int  // Lines of the status block currently on screen
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// activeProgress is the progress view currently on screen, if any. Console prompts erase it
+// first (see lockConsole), so it never gets mixed up with a question to the user.
+var (
+	activeProgressMu sync.Mutex
+	activeProgress   *subAgentProgress
+)
+
+// newSubAgentProgress creates the progress view for a batch of sub-agents and makes it theirs.
+func newSubAgentProgress(agents []*subAgentNode) *subAgentProgress {
+	p := &subAgentProgress{
+		agents: agents,
+		live:   !pipelineMode && isTTY(),
+		quiet:  pipelineMode,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	subAgentTreeMu.Lock()
+	for _, n := range agents {
+		n.progress = p
+	}
+	subAgentTreeMu.Unlock()
+	return p
+}
+
+// start shows the view and, on a TTY, keeps redrawing it until finish is called.
+func (p *subAgentProgress) start() {
+	activeProgressMu.Lock()
+	activeProgress = p
+	activeProgressMu.Unlock()
+
+	if !p.live {
+		close(p.done)
+		return
+	}
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(SubAgentProgressInterval)
+		defer ticker.Stop()
+		for {
+			p.redraw()
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// finish stops redrawing and leaves the final state of every sub-agent on screen.
+func (p *subAgentProgress) finish() {
+	close(p.stop)
+	<-p.done
+
+	activeProgressMu.Lock()
+	if activeProgress == p {
+		activeProgress = nil
+	}
+	activeProgressMu.Unlock()
+
+	if p.live {
+		executionMutex.Lock()
+		p.mu.Lock()
+		p.eraseLocked()
+		p.drawLocked()
+		p.mu.Unlock()
+		executionMutex.Unlock()
+	}
+}
+
+// redraw replaces the status block on screen. It skips the frame while a prompt holds the console.
+func (p *subAgentProgress) redraw() {
+	if !executionMutex.TryLock() {
+		return
+	}
+	defer executionMutex.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.eraseLocked()
+	p.drawLocked()
+}
+
+// eraseLocked removes the status block from the screen, leaving the cursor where it started.
+func (p *subAgentProgress) eraseLocked() {
+	if p.drawn > 0 {
+		fmt.Printf("\033[%dA\033[J", p.drawn)
+		p.drawn = 0
+	}
+}
+
+// drawLocked prints one line per sub-agent, cut to the terminal width so that lines never wrap.
+func (p *subAgentProgress) drawLocked() {
+	width := readline.GetScreenWidth()
+	if width <= 0 {
+		width = 80
+	}
+	subAgentTreeMu.Lock()
+	var lines []string
+	for _, n := range p.agents {
+		lines = appendTreeLinesLocked(lines, n, n.Depth, width-1)
+	}
+	subAgentTreeMu.Unlock()
+	for _, line := range lines {
+		fmt.Printf("%s\n", line)
+	}
+	p.drawn = len(lines)
+}
+
+// println prints a line for sub-agent n above the status block. Log lines are left out on a
+// TTY, where the status block already shows the last tool, and in pipeline mode; warnings
+// are always printed.
+func (p *subAgentProgress) println(n *subAgentNode, line string, warning bool) {
+	if !warning && (p.live || p.quiet) {
+		return
+	}
+	executionMutex.Lock()
+	defer executionMutex.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.eraseLocked()
+	fmt.Printf("%s[%s]%s %s\n", ColorMeta, n.Label, ColorReset, line)
+}
+
+// lockConsole takes the console for a prompt to the user. A progress view on screen is erased
+// first and comes back once the prompt is done and the console is unlocked.
+func lockConsole() {
+	executionMutex.Lock()
+	activeProgressMu.Lock()
+	p := activeProgress
+	activeProgressMu.Unlock()
+	if p != nil {
+		p.mu.Lock()
+		p.eraseLocked()
+		p.mu.Unlock()
+	}
+}
+
+// unlockConsole gives the console back after a prompt taken with lockConsole.
+func unlockConsole() {
+	executionMutex.Unlock()
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/jsonschema-go/jsonschema"
+)
+
+// Sub-agent result statuses
+const (
+	SubAgentStatusSuccess = "success" // The sub-agent finished its task
+	SubAgentStatusPartial = "partial" // The sub-agent stopped early, but did some of the work
+	SubAgentStatusFailed  = "failed"  // The sub-agent stopped before doing anything
+)
+
+// SubAgentResult is what spawn_agent returns to the parent agent: besides the sub-agent's own
+// summary, what it actually did, so the parent doesn't have to find out again.
+type SubAgentResult struct {
+	Agent        string          `json:"agent"`
+	Status       string          `json:"status"`
+	Summary      string          `json:"summary,omitempty"` // The sub-agent's final message
+	Output       json.RawMessage `json:"output,omitempty"`  // The final answer, validated against output_schema
+	Error        string          `json:"error,omitempty"`
+	FilesChanged []FileChange    `json:"files_changed,omitempty"`
+	// FilesUnattributable is set when commands changed files while other sub-agents were
+	// running, so files_changed may also list files those changed.
+	FilesUnattributable bool            `json:"files_changed_not_attributable,omitempty"`
+	Commands            []CommandRecord `json:"commands,omitempty"`
+	Artifacts           []Artifact      `json:"artifacts,omitempty"`
+	Usage               SubAgentUsage   `json:"usage"`
+
+	err           error
+	snapshot      *workspaceSnapshot // Taken before the first command, whose changes the file tools don't report
+	snapshotTaken bool               // The snapshot was attempted, so a failed one isn't retried
+}
+
+// FileChange is a file a sub-agent added, modified or deleted.
+type FileChange struct {
+	Path   string `json:"path"`
+	Status string `json:"status"` // "added", "modified" or "deleted"
+}
+
+// CommandRecord is a command a sub-agent ran.
+type CommandRecord struct {
+	Command    string `json:"command"`
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	Background bool   `json:"background,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Artifact is something a sub-agent produced for the parent, declared with declare_artifact.
+type Artifact struct {
+	Name        string `json:"name"`
+	Path        string `json:"path,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// DeclareArtifactArgs represents arguments for declare_artifact
+type DeclareArtifactArgs struct {
+	Name        string `json:"name"`
+	Path        string `json:"path,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// SubAgentUsage is what a sub-agent used to do its task.
+type SubAgentUsage struct {
+	Iterations       int `json:"iterations"`
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+	NestedTokens     int `json:"nested_tokens,omitempty"` // Tokens of the sub-agents it spawned
+}
+
+// exitCodePattern finds the exit code in the status line that executeCommand appends.
+var exitCodePattern = regexp.MustCompile(`\[exit_code: (-?\d+)`)
+
+// addUsage adds the tokens of one API response.
+func (r *SubAgentResult) addUsage(u Usage) {
+	r.Usage.PromptTokens += u.PromptTokens
+	r.Usage.CompletionTokens += u.CompletionTokens
+	r.Usage.TotalTokens += u.TotalTokens
+}
+
+// recordCommand records a command the sub-agent ran, with the exit code from its output.
+func (r *SubAgentResult) recordCommand(command, output string, err error) {
+	record := CommandRecord{Command: command, Background: strings.HasPrefix(output, "Background command started")}
+	if matches := exitCodePattern.FindAllStringSubmatch(output, -1); len(matches) > 0 {
+		if code, convErr := strconv.Atoi(matches[len(matches)-1][1]); convErr == nil {
+			record.ExitCode = &code
+		}
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	r.Commands = append(r.Commands, record)
+}
+
+// recordFileChanges adds the files a file tool changed. A file changed more than once is listed
+// once, with the status from before the first change to after the last.
+func (r *SubAgentResult) recordFileChanges(changes []FileChange) {
+	for _, c := range changes {
+		c.Path = filepath.ToSlash(c.Path)
+		i := slices.IndexFunc(r.FilesChanged, func(f FileChange) bool { return f.Path == c.Path })
+		if i < 0 {
+			r.FilesChanged = append(r.FilesChanged, c)
+			continue
+		}
+		switch prev := r.FilesChanged[i].Status; {
+		case prev == "added" && c.Status == "deleted":
+			r.FilesChanged = slices.Delete(r.FilesChanged, i, i+1)
+		case prev == "added":
+		case prev == "deleted" && c.Status == "added":
+			r.FilesChanged[i].Status = "modified"
+		default:
+			r.FilesChanged[i].Status = c.Status
+		}
+	}
+}
+
+// beforeCommand takes the workspace snapshot before the sub-agent's first command, so the
+// files its commands change can be found afterwards. If that fails, the sub-agent runs without
+// a snapshot rather than trying again before every command.
+func (r *SubAgentResult) beforeCommand() {
+	if r.snapshotTaken {
+		return
+	}
+	r.snapshotTaken = true
+	r.snapshot = newWorkspaceSnapshot()
+}
+
+// addCommandChanges adds the files changed since the snapshot that the file tools didn't report,
+// and removes the snapshot. overlapped tells whether other sub-agents ran at the same time; their
+// changes are in the snapshot too.
+func (r *SubAgentResult) addCommandChanges(overlapped bool) {
+	if r.snapshot == nil {
+		return
+	}
+	defer r.snapshot.close()
+	changes, err := r.snapshot.changes()
+	if err != nil {
+		return
+	}
+	for _, c := range changes {
+		if !slices.ContainsFunc(r.FilesChanged, func(f FileChange) bool { return f.Path == c.Path }) {
+			r.FilesChanged = append(r.FilesChanged, c)
+			r.FilesUnattributable = r.FilesUnattributable || overlapped
+		}
+	}
+}
+
+// declareArtifact handles the declare_artifact tool.
+func (r *SubAgentResult) declareArtifact(argsJSON string) (string, error) {
+	var args DeclareArtifactArgs
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	if strings.TrimSpace(args.Name) == "" {
+		return "", fmt.Errorf("name is required")
+	}
+	r.Artifacts = append(r.Artifacts, Artifact(args))
+	return fmt.Sprintf("Artifact '%s' declared", args.Name), nil
+}
+
+// finish sets the status from how the sub-agent ended. Work it did before an error makes the
+// result partial rather than failed.
+func (r *SubAgentResult) finish(summary string, err error) {
+	r.Summary = summary
+	r.err = err
+	switch {
+	case err == nil:
+		r.Status = SubAgentStatusSuccess
+	case summary != "" || len(r.FilesChanged) > 0 || len(r.Commands) > 0 || len(r.Artifacts) > 0:
+		r.Status = SubAgentStatusPartial
+		r.Error = err.Error()
+	default:
+		r.Status = SubAgentStatusFailed
+		r.Error = err.Error()
+	}
+}
+
+// String returns the result as the JSON the parent agent gets.
+func (r *SubAgentResult) String() string {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false) // Keep commands like "a && b" readable
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(r); err != nil {
+		return fmt.Sprintf("Failed to encode sub-agent result: %s", err)
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// resolveOutputSchema parses the output_schema argument of spawn_agent.
+func resolveOutputSchema(raw json.RawMessage) (*jsonschema.Resolved, error) {
+	var schema jsonschema.Schema
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, fmt.Errorf("invalid output_schema: %w", err)
+	}
+	resolved, err := schema.Resolve(nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output_schema: %w", err)
+	}
+	return resolved, nil
+}
+
+// validateSubAgentOutput checks that a sub-agent's final message is a JSON value matching
+// schema, and returns it compacted. A surrounding Markdown code fence is ignored.
+func validateSubAgentOutput(schema *jsonschema.Resolved, content string) (json.RawMessage, error) {
+	text := strings.TrimSpace(content)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text, "```json")
+		text = strings.TrimPrefix(text, "```")
+		text = strings.TrimSuffix(strings.TrimSpace(text), "```")
+	}
+
+	var value any
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return nil, fmt.Errorf("not valid JSON: %w", err)
+	}
+	if err := schema.Validate(value); err != nil {
+		return nil, err
+	}
+	compact, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return compact, nil
+}
+
+// workspaceSnapshot finds the files a sub-agent's commands changed, by comparing the workspace
+// before and after. The snapshots go into a temporary repository that is removed afterwards.
+type workspaceSnapshot struct {
+	git    *ShadowGit
+	index  string
+	before string
+}
+
+// newWorkspaceSnapshot takes the snapshot before the first command. It returns nil if that is not
+// possible, e.g. when git is not installed; the changes of commands are then not listed.
+func newWorkspaceSnapshot() *workspaceSnapshot {
+	dir, err := os.MkdirTemp("", "agent-go-snapshot-")
+	if err != nil {
+		return nil
+	}
+	s := &workspaceSnapshot{git: &ShadowGit{RepoDir: dir, WorkTree: workspaceRoot()}, index: filepath.Join(dir, "snapshot-index")}
+	if err := s.git.Init(); err != nil {
+		s.close()
+		return nil
+	}
+	if s.before, err = s.git.Snapshot(s.index); err != nil {
+		s.close()
+		return nil
+	}
+	return s
+}
+
+// changes takes the snapshot after the sub-agent ran and lists what differs. Files agent-go
+// keeps for itself in .agent-go are left out.
+func (s *workspaceSnapshot) changes() ([]FileChange, error) {
+	after, err := s.git.Snapshot(s.index)
+	if err != nil {
+		return nil, err
+	}
+	all, err := s.git.ChangedFiles(s.before, after)
+	if err != nil {
+		return nil, err
+	}
+	var changes []FileChange
+	for _, c := range all {
+		if c.Path != ".agent-go" && !strings.HasPrefix(c.Path, ".agent-go/") {
+			changes = append(changes, c)
+		}
+	}
+	return changes, nil
+}
+
+// close removes the snapshot's repository.
+func (s *workspaceSnapshot) close() {
+	_ = os.RemoveAll(s.git.RepoDir)
+}
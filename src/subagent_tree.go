@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// subAgentNode is a sub-agent in the tree of agents spawned during the session. The main agent
+// is the implicit root. Each node holds the limits of the spawn_agent call that started it, and
+// the tokens it used together with everything it spawned.
+type subAgentNode struct {
+	Label         string // Agent name, numbered by its position when spawned in parallel
+	Parent        *subAgentNode
+	Children      []*subAgentNode
+	Depth         int // 1 for sub-agents of the main agent
+	State         string
+	Iteration     int
+	MaxIterations int
+	LastTool      string
+	OwnTokens     int // Tokens of the sub-agent's own requests
+	Tokens        int // OwnTokens plus the tokens of all its descendants
+	MaxTokens     int // Budget for Tokens; 0 if the spawn_agent call set none
+	Started       time.Time
+	Finished      time.Time
+	Overlapped    bool // Another sub-agent, neither an ancestor nor a descendant, ran at the same time
+
+	progress *subAgentProgress // The progress view that shows the node, if any
+}
+
+// subAgentRoots are the sub-agents the main agent spawned, oldest first. All nodes are guarded by
+// subAgentTreeMu; finished trees are dropped once there are more than MaxSubAgentTreeRoots.
+var (
+	subAgentTreeMu sync.Mutex
+	subAgentRoots  []*subAgentNode
+)
+
+// newSubAgentNode adds a queued sub-agent below parent, or as a root if parent is nil. The
+// node shares its parent's progress view. Its steps are capped by max_subagent_iterations and
+// by the steps its parent has left.
+func newSubAgentNode(parent *subAgentNode, label string, args SubAgentTask, config *Config) *subAgentNode {
+	n := &subAgentNode{
+		Label:         label,
+		Parent:        parent,
+		Depth:         1,
+		State:         SubAgentQueued,
+		MaxIterations: maxSubAgentIterations(config),
+		MaxTokens:     args.MaxTokens,
+	}
+	if args.MaxIterations > 0 {
+		n.MaxIterations = min(args.MaxIterations, n.MaxIterations)
+	}
+
+	subAgentTreeMu.Lock()
+	defer subAgentTreeMu.Unlock()
+	if parent != nil {
+		n.MaxIterations = min(n.MaxIterations, max(parent.MaxIterations-parent.Iteration, 1))
+		n.Depth = parent.Depth + 1
+		n.progress = parent.progress
+		parent.Children = append(parent.Children, n)
+		return n
+	}
+	subAgentRoots = append(subAgentRoots, n)
+	for i := 0; len(subAgentRoots) > MaxSubAgentTreeRoots && i < len(subAgentRoots); {
+		if subAgentRoots[i].Finished.IsZero() {
+			i++
+			continue
+		}
+		subAgentRoots = append(subAgentRoots[:i], subAgentRoots[i+1:]...)
+	}
+	return n
+}
+
+// update changes the node. A progress view showing it catches up on its next redraw.
+func (n *subAgentNode) update(fn func(n *subAgentNode)) {
+	if n == nil {
+		return
+	}
+	subAgentTreeMu.Lock()
+	defer subAgentTreeMu.Unlock()
+	fn(n)
+}
+
+// start marks the sub-agent as running. Sub-agents that run at the same time without one having
+// spawned the other share the workspace unknowingly, so both are marked as overlapped.
+func (n *subAgentNode) start() {
+	subAgentTreeMu.Lock()
+	defer subAgentTreeMu.Unlock()
+	n.State = SubAgentRunning
+	n.Started = time.Now()
+	var visit func(o *subAgentNode)
+	visit = func(o *subAgentNode) {
+		if o.State == SubAgentRunning && !o.relatedLocked(n) {
+			o.Overlapped = true
+			n.Overlapped = true
+		}
+		for _, child := range o.Children {
+			visit(child)
+		}
+	}
+	for _, root := range subAgentRoots {
+		visit(root)
+	}
+}
+
+// relatedLocked reports whether n and o are the same sub-agent or one is an ancestor of the
+// other. The caller holds subAgentTreeMu.
+func (n *subAgentNode) relatedLocked(o *subAgentNode) bool {
+	for a := n; a != nil; a = a.Parent {
+		if a == o {
+			return true
+		}
+	}
+	for a := o; a != nil; a = a.Parent {
+		if a == n {
+			return true
+		}
+	}
+	return false
+}
+
+// overlapped reports whether another sub-agent ran alongside n; see start.
+func (n *subAgentNode) overlapped() bool {
+	subAgentTreeMu.Lock()
+	defer subAgentTreeMu.Unlock()
+	return n.Overlapped
+}
+
+// step records that the sub-agent started iteration i.
+func (n *subAgentNode) step(i int) {
+	n.update(func(n *subAgentNode) { n.Iteration = i })
+}
+
+// usage adds the tokens of one API response to the sub-agent and all its ancestors, whose
+// budgets cover everything they spawned.
+func (n *subAgentNode) usage(u Usage) {
+	n.update(func(n *subAgentNode) {
+		n.OwnTokens += u.TotalTokens
+		for a := n; a != nil; a = a.Parent {
+			a.Tokens += u.TotalTokens
+		}
+	})
+}
+
+// tool records the last tool call of the sub-agent, in the compact form of formatToolCallCompact.
+func (n *subAgentNode) tool(compact string) {
+	n.update(func(n *subAgentNode) { n.LastTool = compact })
+}
+
+// exhaustedBudget returns the sub-agent or ancestor whose token budget is used up, or nil.
+func (n *subAgentNode) exhaustedBudget() *subAgentNode {
+	subAgentTreeMu.Lock()
+	defer subAgentTreeMu.Unlock()
+	for a := n; a != nil; a = a.Parent {
+		if a.MaxTokens > 0 && a.Tokens >= a.MaxTokens {
+			return a
+		}
+	}
+	return nil
+}
+
+// nestedTokens returns the tokens the sub-agents spawned by n used.
+func (n *subAgentNode) nestedTokens() int {
+	subAgentTreeMu.Lock()
+	defer subAgentTreeMu.Unlock()
+	return n.Tokens - n.OwnTokens
+}
+
+// progressView returns the progress view that shows the sub-agent, or nil.
+func (n *subAgentNode) progressView() *subAgentProgress {
+	if n == nil {
+		return nil
+	}
+	return n.progress
+}
+
+// logf prints a log line of the sub-agent, through its progress view if it has one.
+func (n *subAgentNode) logf(format string, args ...any) {
+	if n == nil || n.progress == nil {
+		fmt.Printf(format+"\n", args...)
+		return
+	}
+	n.progress.println(n, fmt.Sprintf(format, args...), false)
+}
+
+// warnf prints a warning of the sub-agent, which is shown even when log lines are not.
+func (n *subAgentNode) warnf(format string, args ...any) {
+	if n == nil || n.progress == nil {
+		fmt.Printf(format+"\n", args...)
+		return
+	}
+	n.progress.println(n, fmt.Sprintf(format, args...), true)
+}
+
+// appendTreeLinesLocked appends the status lines of n and its descendants, indented by depth
+// below top. The caller holds subAgentTreeMu.
+func appendTreeLinesLocked(lines []string, n *subAgentNode, top, width int) []string {
+	indent := strings.Repeat("  ", n.Depth-top)
+	lines = append(lines, n.formatStatusLocked(indent, width))
+	for _, child := range n.Children {
+		lines = appendTreeLinesLocked(lines, child, top, width)
+	}
+	return lines
+}
+
+// formatStatusLocked renders the status line of the node, e.g.
+// "● explore #1  step 3/50  Read (main.go)  12.4K/50K tok  0:42", cut to width so it never wraps.
+// The caller holds subAgentTreeMu.
+func (n *subAgentNode) formatStatusLocked(indent string, width int) string {
+	var marker, color string
+	switch n.State {
+	case SubAgentRunning:
+		marker, color = "●", ColorCyan
+	case SubAgentDone, SubAgentReused:
+		marker, color = "✓", ColorGreen
+	case SubAgentFailed, SubAgentCancelled:
+		marker, color = "✗", ColorRed
+	default:
+		marker, color = "○", ColorMeta
+	}
+
+	fields := []string{n.Label}
+	switch {
+	case n.State == SubAgentQueued, n.State == SubAgentSkipped, n.State == SubAgentReused:
+		fields = append(fields, n.State)
+	case n.State == SubAgentCancelled && n.Started.IsZero():
+		fields = append(fields, "cancelled")
+	default:
+		fields = append(fields, fmt.Sprintf("step %d/%d", n.Iteration, n.MaxIterations))
+		if n.LastTool != "" {
+			fields = append(fields, n.LastTool)
+		}
+		tokens := formatTokenCount(n.Tokens)
+		if n.MaxTokens > 0 {
+			tokens += "/" + formatTokenCount(n.MaxTokens)
+		}
+		tokens += " tok"
+		if len(n.Children) > 0 {
+			tokens += fmt.Sprintf(" (%s own)", formatTokenCount(n.OwnTokens))
+		}
+		fields = append(fields, tokens)
+		end := n.Finished
+		if end.IsZero() {
+			end = time.Now()
+		}
+		elapsed := end.Sub(n.Started).Round(time.Second)
+		fields = append(fields, fmt.Sprintf("%d:%02d", int(elapsed.Minutes()), int(elapsed.Seconds())%60))
+	}
+
+	line := indent + marker + " " + strings.Join(fields, "  ")
+	if runes := []rune(line); len(runes) > width {
+		line = string(runes[:max(width-3, 0)]) + "..."
+	}
+	return color + line + ColorReset
+}
+
+// formatSubAgentTree renders the sub-agents of the session as a tree, for /subagents tree.
+func formatSubAgentTree(width int) []string {
+	subAgentTreeMu.Lock()
+	defer subAgentTreeMu.Unlock()
+	var lines []string
+	for _, root := range subAgentRoots {
+		lines = appendTreeLinesLocked(lines, root, root.Depth, width)
+	}
+	return lines
+}
@@ -37,17 +37,20 @@ func getCurrentTimeContext() string {
 		utcTime, localTime, zone, offsetStr)
 }
 
+// getSystemInfo describes the system for the system prompt. The agent's current directory
+// changes with every "cd", so it is sent with each request instead (see getShellDirContext).
 func getSystemInfo() string {
 	osName := runtime.GOOS
 	arch := runtime.GOARCH
 	distro := getDistro()
-	cwd, err := os.Getwd()
-	if err != nil {
-		cwd = "unknown"
-	}
 	currentTime := time.Now().Format(time.RFC1123)
 
-	return fmt.Sprintf("OS: %s, Architecture: %s, Distribution: %s, CWD: %s, Time: %s", osName, arch, distro, cwd, currentTime)
+	return fmt.Sprintf("OS: %s, Architecture: %s, Distribution: %s, Workspace: %s, Time: %s", osName, arch, distro, workspaceRoot(), currentTime)
+}
+
+// getShellDirContext tells the model where the agent's commands run and relative file paths resolve.
+func getShellDirContext(agentID string) string {
+	return fmt.Sprintf("Current directory (execute_command and relative file paths): %s", getShellDir(agentID))
 }
 
 func getDistro() string {
@@ -26,18 +26,20 @@ type OpenTerminalSessionArgs struct {
 	Command string `json:"command,omitempty"`
 }
 
-// openTerminalSession starts a new terminal session with bash
-// All sessions start with bash by default for stability
+// openTerminalSession starts a new terminal session with bash in the shell directory of agentID
+// All sessions start with bash by default for stability, in the agent's sandbox if it has one
 // If a command is provided, it will be sent to bash after the session starts
-func openTerminalSession(argsJSON string) (string, error) {
+func openTerminalSession(config *Config, sandbox SandboxConfig, agentID, argsJSON string) (string, error) {
 	var args OpenTerminalSessionArgs
 	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
 		return "", fmt.Errorf("invalid arguments: %w", err)
 	}
 
+	dir := getShellDir(agentID)
+
 	// Security: validate command if provided
 	if args.Command != "" {
-		if err := validateCommand(args.Command); err != nil {
+		if err := validateCommand(args.Command, dir); err != nil {
 			return "", fmt.Errorf("command validation failed: %w", err)
 		}
 	}
@@ -53,10 +55,19 @@ func openTerminalSession(argsJSON string) (string, error) {
 	// Always start with bash for stability - sessions don't close when a command finishes
 	var cmd *exec.Cmd
 	cmd = exec.Command("bash")
+	cmd.Dir = dir
+	if err := sandboxCommand(cmd, sandbox, false); err != nil {
+		return "", err
+	}
+	limited, err := applyResourceLimits(cmd, config.ResourceLimits)
+	if err != nil {
+		return "", err
+	}
 
 	// Start the command with a PTY
 	ptyFile, err := pty.Start(cmd)
 	if err != nil {
+		limited.release()
 		return "", fmt.Errorf("failed to start PTY: %w", err)
 	}
 
@@ -82,6 +93,7 @@ func openTerminalSession(argsJSON string) (string, error) {
 	go func() {
 		defer func() {
 			ptyFile.Close()
+			limited.release()
 			close(session.DoneChan)
 			terminalSessionMux.Lock()
 			delete(terminalSessions, sessionID)
@@ -310,8 +322,8 @@ func parseKeycode(input string) string {
 	return input
 }
 
-// validateCommand checks if a command is safe to execute
-func validateCommand(command string) error {
+// validateCommand checks if a command run in dir is safe to execute
+func validateCommand(command, dir string) error {
 	// Basic validation
 	if strings.TrimSpace(command) == "" {
 		return fmt.Errorf("command is empty")
@@ -331,5 +343,10 @@ func validateCommand(command string) error {
 		}
 	}
 
+	// Terminal sessions have no approval prompt, so only deny rules of the command policy apply
+	if decision := evaluateCommandPolicy(command, dir); decision.Action == PolicyDeny {
+		return fmt.Errorf("command denied by policy: %s", decision.Describe())
+	}
+
 	return nil
 }
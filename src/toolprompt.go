@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Prompt-based tool calling for models without native tool support. Tool definitions are
+// described in the system prompt and the model is asked to answer with <tool_call> blocks,
+// which are parsed back into regular ToolCalls so the rest of the agent loop is unchanged.
+
+const (
+	promptToolCallOpen  = "<tool_call>"
+	promptToolCallClose = "</tool_call>"
+)
+
+var promptToolCallPattern = regexp.MustCompile(`(?s)<tool_call>\s*(.*?)\s*(?:</tool_call>|$)`)
+
+// buildToolPrompt describes the available tools and the expected call format.
+func buildToolPrompt(tools []Tool) string {
+	var sb strings.Builder
+	sb.WriteString("# Tools\n\n")
+	sb.WriteString("You can call the following tools. Each tool is described by its name, purpose and JSON Schema parameters:\n\n")
+	for _, tool := range tools {
+		params, _ := json.Marshal(tool.Function.Parameters)
+		sb.WriteString(fmt.Sprintf("- %s: %s\n  Parameters: %s\n", tool.Function.Name, tool.Function.Description, string(params)))
+	}
+	sb.WriteString("\nTo call a tool, reply with one block per call in exactly this format and nothing after it:\n")
+	sb.WriteString(promptToolCallOpen + `{"name": "<tool name>", "arguments": {<arguments as JSON>}}` + promptToolCallClose + "\n\n")
+	sb.WriteString("Tool results are returned to you in <tool_result> blocks. When you don't need a tool, answer normally without any <tool_call> block.")
+	return sb.String()
+}
+
+// applyPromptToolProtocol rewrites a request for a model without native tool support:
+// tools move into the system prompt, previous tool calls are rendered as <tool_call>
+// text and tool results become user messages.
+func applyPromptToolProtocol(req APIRequest) APIRequest {
+	if len(req.Tools) == 0 {
+		return req
+	}
+
+	toolNames := make(map[string]string)
+	messages := make([]Message, 0, len(req.Messages)+1)
+	for _, msg := range req.Messages {
+		switch {
+		case msg.Role == "assistant" && len(msg.ToolCalls) > 0:
+			var sb strings.Builder
+			if msg.Content != nil && *msg.Content != "" {
+				sb.WriteString(*msg.Content)
+				sb.WriteString("\n")
+			}
+			for _, tc := range msg.ToolCalls {
+				toolNames[tc.ID] = tc.Function.Name
+				sb.WriteString(fmt.Sprintf(`%s{"name": %q, "arguments": %s}%s`+"\n", promptToolCallOpen, tc.Function.Name, toolInputJSON(tc.Function.Arguments), promptToolCallClose))
+			}
+			text := strings.TrimSpace(sb.String())
+			messages = append(messages, Message{Role: "assistant", Content: &text})
+		case msg.Role == "tool":
+			output := ""
+			if msg.Content != nil {
+				output = *msg.Content
+			}
+			text := fmt.Sprintf("<tool_result name=%q>\n%s\n</tool_result>", toolNames[msg.ToolCallID], output)
+			messages = append(messages, Message{Role: "user", Content: &text})
+		default:
+			messages = append(messages, msg)
+		}
+	}
+
+	// Many local chat templates only accept a single leading system message
+	toolPrompt := buildToolPrompt(req.Tools)
+	if len(messages) > 0 && messages[0].Role == "system" && messages[0].Content != nil {
+		merged := *messages[0].Content + "\n\n" + toolPrompt
+		messages[0].Content = &merged
+	} else {
+		messages = append([]Message{{Role: "system", Content: &toolPrompt}}, messages...)
+	}
+
+	req.Messages = messages
+	req.Tools = nil
+	req.ToolChoice = ""
+	return req
+}
+
+// extractPromptToolCalls parses <tool_call> blocks out of the message content into ToolCalls.
+func extractPromptToolCalls(msg *Message) {
+	if msg.Content == nil || !strings.Contains(*msg.Content, promptToolCallOpen) {
+		return
+	}
+
+	for _, match := range promptToolCallPattern.FindAllStringSubmatch(*msg.Content, -1) {
+		var call struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimSpace(match[1])), &call); err != nil || call.Name == "" {
+			continue
+		}
+
+		args := string(call.Arguments)
+		// Some models send the arguments as a JSON-encoded string
+		var asString string
+		if json.Unmarshal(call.Arguments, &asString) == nil {
+			args = asString
+		}
+		if strings.TrimSpace(args) == "" || args == "null" {
+			args = "{}"
+		}
+
+		msg.ToolCalls = append(msg.ToolCalls, ToolCall{
+			ID:       "call_" + uuid.New().String()[:8],
+			Type:     "function",
+			Function: FunctionCall{Name: call.Name, Arguments: args},
+		})
+	}
+
+	if len(msg.ToolCalls) == 0 {
+		return
+	}
+	remaining := strings.TrimSpace(promptToolCallPattern.ReplaceAllString(*msg.Content, ""))
+	if remaining == "" {
+		msg.Content = nil
+	} else {
+		msg.Content = &remaining
+	}
+}
+
+// hidePromptToolCalls wraps a StreamHandler so raw <tool_call> blocks are not printed
+// while the response streams in. The returned flush prints text held back in case it
+// started a tag; call it once the stream has ended.
+func hidePromptToolCalls(onDelta StreamHandler) (StreamHandler, func()) {
+	var pending string
+	hidden := false
+
+	flush := func() {
+		if pending != "" && !hidden {
+			onDelta(StreamDelta{Content: pending})
+		}
+		pending = ""
+	}
+	return func(delta StreamDelta) {
+		if delta.ReasoningContent != "" {
+			onDelta(StreamDelta{ReasoningContent: delta.ReasoningContent})
+		}
+		if delta.Content == "" || hidden {
+			return
+		}
+
+		text := pending + delta.Content
+		pending = ""
+		if idx := strings.Index(text, promptToolCallOpen); idx >= 0 {
+			hidden = true
+			if idx > 0 {
+				onDelta(StreamDelta{Content: text[:idx]})
+			}
+			return
+		}
+
+		// Hold back a trailing fragment that could be the start of the tag
+		keep := 0
+		for n := len(promptToolCallOpen) - 1; n > 0; n-- {
+			if strings.HasSuffix(text, promptToolCallOpen[:n]) {
+				keep = n
+				break
+			}
+		}
+		pending = text[len(text)-keep:]
+		if out := text[:len(text)-keep]; out != "" {
+			onDelta(StreamDelta{Content: out})
+		}
+	}, flush
+}
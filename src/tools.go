@@ -25,6 +25,9 @@ type SuggestPlanArgs struct {
 // BuildModeTools lists the tools that are only available in Build mode
 var BuildModeTools = []string{
 	"execute_command",
+	"write_file",
+	"edit_file",
+	"apply_patch",
 	"kill_background_command",
 	"get_background_logs",
 	"list_background_commands",
@@ -38,6 +41,19 @@ var PlanModeTools = []string{
 	"create_agent_definition",
 }
 
+// MainAgentOnlyTools lists the tools that act on the user's session. Sub-agents never get them.
+var MainAgentOnlyTools = []string{
+	"suggest_plan",
+	"name_session",
+	"create_checkpoint",
+	"list_checkpoints",
+}
+
+// SubAgentOnlyTools lists the tools of getSubAgentTools. Sub-agents get them regardless of their agent definition.
+var SubAgentOnlyTools = []string{
+	"declare_artifact",
+}
+
 // getAvailableTools returns the list of tools available to the agent
 func getAvailableTools(config *Config, includeSpawn bool, operationMode OperationMode) []Tool {
 	tools := []Tool{}
@@ -59,17 +75,123 @@ func getAvailableTools(config *Config, includeSpawn bool, operationMode Operatio
 		Type: "function",
 		Function: FunctionDefinition{
 			Name:        "execute_command",
-			Description: "Execute shell command (foreground). In Ask mode the user may choose to run it in the background at approval time.",
+			Description: "Execute shell command (foreground). In Ask mode the user may choose to run it in the background at approval time. The command is killed when it exceeds its timeout; long output is truncated in the middle. The result ends with the exit code and duration. For long-running commands such as servers, ready_port/ready_pattern and restart describe how to supervise them if run in the background.",
 			Parameters: map[string]interface{}{
 				"type": "object",
 				"properties": map[string]interface{}{
-					"command": map[string]string{"type": "string"},
+					"command":         map[string]string{"type": "string"},
+					"timeout_seconds": map[string]string{"type": "integer", "description": "Optional timeout for slow commands such as builds or test suites. Defaults to the configured command timeout and is capped by max_command_timeout."},
+					"ready_port":      map[string]string{"type": "integer", "description": "Background only: the command is ready once this local TCP port accepts connections. Starting it waits until then."},
+					"ready_pattern":   map[string]string{"type": "string", "description": "Background only: the command is ready once its output matches this regular expression. Starting it waits until then."},
+					"restart":         map[string]interface{}{"type": "string", "enum": []string{"no", "on-failure", "always"}, "description": "Background only: restart the command when it exits (default no)."},
+					"max_restarts":    map[string]string{"type": "integer", "description": "Background only: restarts before giving up (default 3)."},
 				},
 				"required": []string{"command"},
 			},
 		},
 	})
 
+	tools = append(tools, Tool{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        "read_file",
+			Description: fmt.Sprintf("Read a text file. Lines are prefixed with their line numbers. Without a range at most %d lines are returned. Lines longer than %d bytes are cut and at most %d KB are returned per call.", MaxReadFileLines, MaxReadFileLineLength, MaxReadFileBytes/1024),
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path":       map[string]string{"type": "string"},
+					"start_line": map[string]string{"type": "integer", "description": "Optional first line to read (1-based)."},
+					"end_line":   map[string]string{"type": "integer", "description": "Optional last line to read (inclusive)."},
+				},
+				"required": []string{"path"},
+			},
+		},
+	})
+
+	tools = append(tools, Tool{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        "search_files",
+			Description: "Search file contents for a regular expression (RE2 syntax) under a path, skipping files ignored by .gitignore or .agent-go/ignore. Results are grep-style 'path:line:text' lines. Prefer this over grep/find via execute_command.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"pattern":          map[string]string{"type": "string", "description": "Regular expression to search for."},
+					"path":             map[string]string{"type": "string", "description": "Optional file or directory to search. Defaults to the current directory."},
+					"glob":             map[string]string{"type": "string", "description": "Optional file filter, e.g. '*.go' or 'src/**/*.ts'."},
+					"context_lines":    map[string]string{"type": "integer", "description": fmt.Sprintf("Optional lines of context around each match (max %d).", MaxSearchContextLines)},
+					"max_results":      map[string]string{"type": "integer", "description": fmt.Sprintf("Optional maximum number of matches (default %d, max %d).", DefaultSearchMaxResults, MaxSearchResults)},
+					"case_insensitive": map[string]string{"type": "boolean"},
+				},
+				"required": []string{"pattern"},
+			},
+		},
+	})
+
+	tools = append(tools, Tool{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        "list_files",
+			Description: "List files and directories under a path (directories end with '/'), skipping files ignored by .gitignore or .agent-go/ignore.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path":      map[string]string{"type": "string", "description": "Optional directory to list. Defaults to the current directory."},
+					"glob":      map[string]string{"type": "string", "description": "Optional filter; only matching files are listed, e.g. '*.md' or 'cmd/**/main.go'."},
+					"max_depth": map[string]string{"type": "integer", "description": "Optional maximum depth; 1 lists only direct children."},
+				},
+			},
+		},
+	})
+
+	tools = append(tools, Tool{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        "write_file",
+			Description: "Create a file or overwrite it with the given content. Parent directories are created as needed. Prefer edit_file for changes to existing files.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path":    map[string]string{"type": "string"},
+					"content": map[string]string{"type": "string", "description": "The complete new file content."},
+				},
+				"required": []string{"path", "content"},
+			},
+		},
+	})
+
+	tools = append(tools, Tool{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        "edit_file",
+			Description: "Replace an exact string in a file. old_string must match the file exactly (including whitespace and indentation) and occur exactly once; include enough surrounding lines to make it unique.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path":       map[string]string{"type": "string"},
+					"old_string": map[string]string{"type": "string", "description": "The text to replace."},
+					"new_string": map[string]string{"type": "string", "description": "The replacement text."},
+				},
+				"required": []string{"path", "old_string", "new_string"},
+			},
+		},
+	})
+
+	tools = append(tools, Tool{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        "apply_patch",
+			Description: "Apply a unified diff (as produced by `diff -u` or `git diff`) to one or more files. Supports file creation (--- /dev/null), deletion (+++ /dev/null) and git renames. Include a few unchanged context lines around each change; hunks are located by their context, so line numbers may be approximate. If any hunk fails, no file is changed and the failures are reported.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"patch": map[string]string{"type": "string", "description": "The unified diff to apply."},
+				},
+				"required": []string{"patch"},
+			},
+		},
+	})
+
 	tools = append(tools, Tool{
 		Type: "function",
 		Function: FunctionDefinition{
@@ -205,11 +327,15 @@ func getAvailableTools(config *Config, includeSpawn bool, operationMode Operatio
 		Type: "function",
 		Function: FunctionDefinition{
 			Name:        "get_background_logs",
-			Description: "Get the logs (stdout/stderr) of a background command by PID.",
+			Description: "Get the logs (stdout/stderr) of a background command by PID: the last lines by default, or the output after an offset. The result ends with the status and the current offset; pass it as since to read only newer output.",
 			Parameters: map[string]interface{}{
-				"type":       "object",
-				"properties": map[string]interface{}{"pid": map[string]interface{}{"type": "integer"}},
-				"required":   []string{"pid"},
+				"type": "object",
+				"properties": map[string]interface{}{
+					"pid":   map[string]interface{}{"type": "integer"},
+					"tail":  map[string]interface{}{"type": "integer", "description": "Number of last lines to return (default 100)."},
+					"since": map[string]interface{}{"type": "integer", "description": "Return the output after this offset instead of the last lines."},
+				},
+				"required": []string{"pid"},
 			},
 		},
 	})
@@ -217,7 +343,7 @@ func getAvailableTools(config *Config, includeSpawn bool, operationMode Operatio
 		Type: "function",
 		Function: FunctionDefinition{
 			Name:        "list_background_commands",
-			Description: "List all running background commands.",
+			Description: "List background commands with their status, including recently finished ones.",
 			Parameters:  map[string]interface{}{"type": "object", "properties": map[string]interface{}{}},
 		},
 	})
@@ -382,13 +508,17 @@ func getAvailableTools(config *Config, includeSpawn bool, operationMode Operatio
 			Type: "function",
 			Function: FunctionDefinition{
 				Name:        "spawn_agent",
-				Description: "Spawn a sub-agent to perform a specific task and return the result. Optionally choose a task-specific agent definition (built-in: 'plan', 'build', or a custom saved agent).",
+				Description: "Spawn a sub-agent to perform a specific task. Returns a JSON result with status (success/partial/failed), the sub-agent's summary, the files it changed, the commands it ran with their exit codes, declared artifacts and token usage. Optionally choose a task-specific agent definition (built-in: 'plan', 'build', or a custom saved agent). Several spawn_agent calls in the same response run in parallel, so spawn independent tasks together. Sub-agents may spawn sub-agents of their own, up to a configured depth.",
 				Parameters: map[string]interface{}{
 					"type": "object",
 					"properties": map[string]interface{}{
-						"task":  map[string]string{"type": "string"},
-						"agent": map[string]string{"type": "string", "description": "Optional agent name (e.g. 'build', 'plan', or a custom agent) to use as the sub-agent's system prompt. Defaults to 'build'."},
-						"model": map[string]string{"type": "string", "description": "Optional model selection ('main' or 'mini'). Defaults to 'main'."},
+						"task":            map[string]string{"type": "string"},
+						"agent":           map[string]string{"type": "string", "description": "Optional agent name (e.g. 'build', 'plan', or a custom agent) to use as the sub-agent's system prompt. Defaults to 'build'."},
+						"model":           map[string]string{"type": "string", "description": "Optional model selection ('main' or 'mini'). Defaults to 'main'."},
+						"output_schema":   map[string]string{"type": "object", "description": "Optional JSON schema. The sub-agent must then answer with JSON matching it, returned validated as the result's output."},
+						"max_iterations":  map[string]string{"type": "integer", "description": fmt.Sprintf("Optional maximum number of steps the sub-agent may take, capped by the configured limit (%d by default) and by the steps the calling agent has left.", MaxSubAgentIterations)},
+						"max_tokens":      map[string]string{"type": "integer", "description": "Optional token budget for the sub-agent, including the tokens of any sub-agents it spawns. It stops once the budget is used up."},
+						"timeout_seconds": map[string]string{"type": "integer", "description": "Optional time limit in seconds for the sub-agent and any sub-agents it spawns."},
 					},
 					"required": []string{"task"},
 				},
@@ -399,6 +529,26 @@ func getAvailableTools(config *Config, includeSpawn bool, operationMode Operatio
 	return tools
 }
 
+// getSubAgentTools returns the tools only sub-agents get, to report back to their parent
+func getSubAgentTools() []Tool {
+	return []Tool{{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        "declare_artifact",
+			Description: "Declare something you produced for the agent that gave you your task, such as a report file or a build output. Declared artifacts are listed in your result.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"name":        map[string]string{"type": "string", "description": "Short name of the artifact"},
+					"path":        map[string]string{"type": "string", "description": "Optional path of the file or directory"},
+					"description": map[string]string{"type": "string", "description": "Optional description of what it contains"},
+				},
+				"required": []string{"name"},
+			},
+		},
+	}}
+}
+
 // validateTodoStatus validates if a status is valid
 func validateTodoStatus(status string) error {
 	if !ValidTodoStatuses[status] {
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Project files like hooks and command policies come with the repository, so the parts of them
+// that can run commands without asking only apply once the user trusted the exact content of
+// the file. Trusted hashes are kept in a file per kind; projectTrust holds the answers of this
+// session by trust file and hash, so a declined file is asked about only once.
+var (
+	projectTrustMu sync.Mutex
+	projectTrust   = make(map[string]bool)
+)
+
+// projectFileTrust describes one project file to be trusted.
+type projectFileTrust struct {
+	Path      string   // The project file
+	Hash      string   // SHA-256 of its content
+	TrustPath string   // The file trusted hashes of this kind are kept in
+	Kind      string   // What the file holds, e.g. "hooks"
+	Summary   string   // Shown before Lines, e.g. "The project hooks in x run these commands:"
+	Lines     []string // What trusting the file allows
+	Untrusted string   // What happens without trust, e.g. "not running hooks from x"
+	Declined  string   // Printed when the user declines
+}
+
+// projectFileTrusted reports whether a project file is trusted. The first time a content is
+// seen, the user is shown what it does and asked; trust is remembered across sessions until the
+// file changes. Without a terminal to ask on, untrusted files are not trusted.
+func projectFileTrusted(file projectFileTrust) bool {
+	projectTrustMu.Lock()
+	defer projectTrustMu.Unlock()
+	key := file.TrustPath + "\x00" + file.Hash
+	if trusted, ok := projectTrust[key]; ok {
+		return trusted
+	}
+
+	trustedFiles := make(map[string]string) // Content hash to the path it was trusted at
+	if data, err := os.ReadFile(file.TrustPath); err == nil {
+		if err := json.Unmarshal(data, &trustedFiles); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring %s: %s\n", file.TrustPath, err)
+		}
+	}
+	if _, ok := trustedFiles[file.Hash]; ok {
+		projectTrust[key] = true
+		return true
+	}
+
+	if pipelineMode {
+		fmt.Fprintf(os.Stderr, "Warning: %s: the file is not trusted yet. Run agent-go interactively once to trust it\n", file.Untrusted)
+		projectTrust[key] = false
+		return false
+	}
+
+	lockConsole()
+	defer unlockConsole()
+	fmt.Printf("%s%s%s\n", ColorCyan, file.Summary, ColorReset)
+	for _, line := range file.Lines {
+		fmt.Printf("  %s\n", line)
+	}
+	fmt.Printf("%s?%s Trust these %s? [y/N]: ", ColorHighlight, ColorReset, file.Kind)
+	var response string
+	fmt.Scanln(&response)
+
+	answer := strings.ToLower(strings.TrimSpace(response))
+	trusted := answer == "y" || answer == "yes"
+	projectTrust[key] = trusted
+	if !trusted {
+		fmt.Println(file.Declined)
+		return false
+	}
+	trustedFiles[file.Hash] = file.Path
+	data, err := json.MarshalIndent(trustedFiles, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(file.TrustPath), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(file.TrustPath, data, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not save %s trust: %s\n", file.Kind, err)
+	}
+	return true
+}
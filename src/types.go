@@ -2,38 +2,66 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"os"
 	"time"
 )
 
 type Message struct {
-	Role             string     `json:"role"`
-	Content          *string    `json:"content,omitempty"`
-	ReasoningContent *string    `json:"reasoning_content,omitempty"`
-	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
-	ToolCallID       string     `json:"tool_call_id,omitempty"`
+	Role             string  `json:"role"`
+	Content          *string `json:"content,omitempty"`
+	ReasoningContent *string `json:"reasoning_content,omitempty"`
+	// ReasoningSignature is the Anthropic thinking block signature; it must be sent back
+	// unchanged with the thinking text during a tool use loop.
+	ReasoningSignature string     `json:"reasoning_signature,omitempty"`
+	ToolCalls          []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID         string     `json:"tool_call_id,omitempty"`
 }
 
 type Config struct {
-	APIURL                string               `json:"api_url"`
-	Model                 string               `json:"model"`
-	MiniModel             string               `json:"mini_model"`
-	APIKey                string               `json:"api_key"`
-	RAGPath               string               `json:"rag_path"`
-	Temp                  float32              `json:"temp"`
-	MaxTokens             int                  `json:"max_tokens"`
-	RAGEnabled            bool                 `json:"rag_enabled"`
-	RAGSnippets           int                  `json:"rag_snippets"`
-	AutoCompress          bool                 `json:"auto_compress"`
-	AutoCompressThreshold int                  `json:"auto_compress_threshold"`
-	ModelContextLength    int                  `json:"model_context_length"`
-	SubagentsEnabled      bool                 `json:"subagents_enabled"`
-	SubAgentVerboseMode   int                  `json:"subagent_verbose_mode"`
-	ExecutionMode         ExecuteMode          `json:"execution_mode"`
-	OperationMode         OperationMode        `json:"operation_mode"`
-	MCPs                  map[string]MCPServer `json:"mcp_servers"`
-	Skills                []Skill              `json:"skills"`
-	UsageVerboseMode      int                  `json:"usage_verbose_mode"`
+	Provider              string                `json:"provider"` // "openai" (default), "anthropic", "ollama" or "llamacpp"
+	APIURL                string                `json:"api_url"`
+	Model                 string                `json:"model"`
+	MiniModel             string                `json:"mini_model"`
+	APIKey                string                `json:"api_key"`
+	RAGPath               string                `json:"rag_path"`
+	Temp                  float32               `json:"temp"`
+	MaxTokens             int                   `json:"max_tokens"`
+	RAGEnabled            bool                  `json:"rag_enabled"`
+	RAGSnippets           int                   `json:"rag_snippets"`
+	AutoCompress          bool                  `json:"auto_compress"`
+	AutoCompressThreshold int                   `json:"auto_compress_threshold"`
+	ModelContextLength    int                   `json:"model_context_length"`
+	SubagentsEnabled      bool                  `json:"subagents_enabled"`
+	SubAgentVerboseMode   int                   `json:"subagent_verbose_mode"`
+	MaxParallelSubAgents  int                   `json:"max_parallel_subagents"`  // Sub-agents that may run at once (1 runs them one by one)
+	MaxSubAgentDepth      int                   `json:"max_subagent_depth"`      // How deep sub-agents may be nested (1: only the main agent spawns them)
+	MaxSubAgentIterations int                   `json:"max_subagent_iterations"` // Most steps a sub-agent may take, whatever spawn_agent asks for
+	ExecutionMode         ExecuteMode           `json:"execution_mode"`
+	OperationMode         OperationMode         `json:"operation_mode"`
+	MCPs                  map[string]MCPServer  `json:"mcp_servers"`
+	Skills                []Skill               `json:"skills"`
+	UsageVerboseMode      int                   `json:"usage_verbose_mode"`
+	Stream                bool                  `json:"stream"`
+	ConnectTimeout        int                   `json:"connect_timeout"`     // seconds
+	RequestTimeout        int                   `json:"request_timeout"`     // seconds to wait for a response
+	StreamIdleTimeout     int                   `json:"stream_idle_timeout"` // seconds a streamed response may go without data
+	MaxRetries            int                   `json:"max_retries"`
+	ThinkingBudget        int                   `json:"thinking_budget"` // Anthropic extended thinking budget in tokens (0 = disabled)
+	Profiles              map[string]Profile    `json:"profiles,omitempty"`
+	ActiveProfile         string                `json:"active_profile,omitempty"`
+	Fallbacks             []string              `json:"fallbacks,omitempty"`   // Tried in order on failure: "mini", a profile name or a model name
+	FallbackOn            []string              `json:"fallback_on,omitempty"` // Error kinds that trigger a fallback (defaults to DefaultFallbackOn)
+	Pricing               map[string]ModelPrice `json:"pricing,omitempty"`     // USD per million tokens, overriding the built-in prices
+	MaxSessionTokens      int                   `json:"max_session_tokens"`    // 0 = unlimited
+	MaxSessionCost        float64               `json:"max_session_cost"`      // USD, 0 = unlimited
+	MaxDailyCost          float64               `json:"max_daily_cost"`        // USD across all processes, 0 = unlimited
+	BudgetWarnPercent     int                   `json:"budget_warn_percent"`   // Warn when a budget is this % used (0 = no warning)
+	CommandTimeout        int                   `json:"command_timeout"`       // Default seconds a foreground command may run
+	MaxCommandTimeout     int                   `json:"max_command_timeout"`   // Upper bound for the timeout_seconds tool argument
+	MaxCommandOutput      int                   `json:"max_command_output"`    // Bytes of command output kept (head and tail)
+	Sandbox               SandboxConfig         `json:"sandbox"`               // Isolation for commands, unless an agent definition sets its own
+	ResourceLimits        ResourceLimits        `json:"resource_limits"`       // Limits for every process started for the agent
 }
 
 const (
@@ -71,15 +99,18 @@ type Agent struct {
 	ID           string    // Unique identifier for the agent
 	Messages     []Message // List of messages in the conversation
 	AgentDefName string    `json:"agent_def_name,omitempty"` // Name of the agent definition in use
+	Depth        int       `json:"-"`                        // 0 for the main agent, 1 for its sub-agents
 }
 
 type APIRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Temperature float32   `json:"temperature"`
-	MaxTokens   int       `json:"max_tokens"`
-	Tools       []Tool    `json:"tools"`
-	ToolChoice  string    `json:"tool_choice"`
+	Model         string         `json:"model"`
+	Messages      []Message      `json:"messages"`
+	Temperature   float32        `json:"temperature"`
+	MaxTokens     int            `json:"max_tokens"`
+	Tools         []Tool         `json:"tools"`
+	ToolChoice    string         `json:"tool_choice"`
+	Stream        bool           `json:"stream,omitempty"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
 }
 
 type Tool struct {
@@ -94,14 +125,28 @@ type FunctionDefinition struct {
 }
 
 type APIResponse struct {
+	Model   string   `json:"model,omitempty"`
 	Choices []Choice `json:"choices"`
 	Usage   Usage    `json:"usage"`
 }
 
 type Usage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens        int                  `json:"prompt_tokens"`
+	CompletionTokens    int                  `json:"completion_tokens"`
+	TotalTokens         int                  `json:"total_tokens"`
+	PromptTokensDetails *PromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+// PromptTokensDetails breaks down prompt tokens; CachedTokens were served from the prompt cache.
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+func (u Usage) cachedTokens() int {
+	if u.PromptTokensDetails == nil {
+		return 0
+	}
+	return u.PromptTokensDetails.CachedTokens
 }
 
 type Choice struct {
@@ -120,14 +165,30 @@ type FunctionCall struct {
 }
 
 type CommandArgs struct {
-	Command    string `json:"command"`
-	Background bool   `json:"background,omitempty"`
+	Command        string `json:"command"`
+	Background     bool   `json:"background,omitempty"`
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"` // Overrides the configured command timeout, up to max_command_timeout
+	BackgroundOptions
+}
+
+// BackgroundOptions control a command the user chooses to run in the background
+type BackgroundOptions struct {
+	ReadyPort    int    `json:"ready_port,omitempty"`    // Ready once this local TCP port accepts connections
+	ReadyPattern string `json:"ready_pattern,omitempty"` // Ready once the output matches this regular expression
+	Restart      string `json:"restart,omitempty"`       // "no" (default), "on-failure" or "always"
+	MaxRestarts  int    `json:"max_restarts,omitempty"`  // Defaults to DefaultBackgroundMaxRestarts
 }
 
 type SubAgentTask struct {
 	Task  string `json:"task"`
 	Agent string `json:"agent,omitempty"` // Optional task-specific agent name (e.g., "build", "plan", or a custom agent). Defaults to "build".
 	Model string `json:"model,omitempty"` // Optional model selection ("main" or "mini")
+	// OutputSchema optionally requests the result as JSON matching this JSON schema
+	OutputSchema json.RawMessage `json:"output_schema,omitempty"`
+	// Optional limits. MaxTokens covers the sub-agent and every sub-agent it spawns.
+	MaxIterations  int `json:"max_iterations,omitempty"`
+	MaxTokens      int `json:"max_tokens,omitempty"`
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
 }
 
 type UseMCPToolArgs struct {
@@ -155,7 +216,9 @@ type KillBackgroundCommandArgs struct {
 }
 
 type GetBackgroundLogsArgs struct {
-	PID int `json:"pid"`
+	PID   int    `json:"pid"`
+	Tail  int    `json:"tail,omitempty"`  // Number of last lines to return
+	Since *int64 `json:"since,omitempty"` // Log offset to return output after
 }
 
 type SwitchOperationModeArgs struct {
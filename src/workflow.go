@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Workflow node statuses, besides those of SubAgentResult
+const (
+	WorkflowNodeSkipped   = "skipped"   // A dependency did not succeed
+	WorkflowNodeCancelled = "cancelled" // The run was interrupted before the node finished
+)
+
+// Workflow is a graph of agent tasks loaded from a workflow file, e.g.
+//
+//	name: release
+//	nodes:
+//	  - id: migration
+//	    task: Generate a migration that adds the users.last_login column
+//	  - id: models
+//	    depends_on: [migration]
+//	    task: "Update the models for this migration: {{nodes.migration.output}}"
+type Workflow struct {
+	Name  string         `yaml:"name"`
+	Nodes []WorkflowNode `yaml:"nodes"`
+
+	path string
+}
+
+// WorkflowNode is one task of a workflow. It runs as a sub-agent once all the nodes it depends
+// on succeeded, and its task can use what they returned.
+type WorkflowNode struct {
+	ID             string         `yaml:"id"`
+	Agent          string         `yaml:"agent"` // Agent definition, defaults to "build"
+	Model          string         `yaml:"model"` // "main" or "mini"
+	Task           string         `yaml:"task"`  // Template, see renderWorkflowTask
+	DependsOn      []string       `yaml:"depends_on"`
+	OutputSchema   map[string]any `yaml:"output_schema"`
+	MaxIterations  int            `yaml:"max_iterations"`
+	MaxTokens      int            `yaml:"max_tokens"`
+	TimeoutSeconds int            `yaml:"timeout_seconds"`
+}
+
+// WorkflowReport is the outcome of a workflow run. It is saved after the run, and a resumed run
+// reuses the nodes that succeeded.
+type WorkflowReport struct {
+	Workflow string               `json:"workflow"` // Path of the workflow file
+	Name     string               `json:"name"`
+	Status   string               `json:"status"` // "success" or "failed"
+	Started  time.Time            `json:"started"`
+	Finished time.Time            `json:"finished"`
+	Nodes    []WorkflowNodeReport `json:"nodes"`
+}
+
+// WorkflowNodeReport is the outcome of one node.
+type WorkflowNodeReport struct {
+	ID       string          `json:"id"`
+	Status   string          `json:"status"`
+	Reused   bool            `json:"reused,omitempty"` // Taken over from the run that was resumed
+	Error    string          `json:"error,omitempty"`
+	Task     string          `json:"task,omitempty"` // The task with the upstream outputs filled in
+	Output   string          `json:"output,omitempty"`
+	Result   *SubAgentResult `json:"result,omitempty"`
+	Hash     string          `json:"hash,omitempty"` // Identifies the node's definition and task, for resuming
+	Started  time.Time       `json:"started,omitzero"`
+	Finished time.Time       `json:"finished,omitzero"`
+}
+
+// workflowNodeIDPattern is what node IDs may look like, so templates can name them.
+var workflowNodeIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// workflowTemplatePattern finds {{nodes.<id>.<field>}} references in a task.
+var workflowTemplatePattern = regexp.MustCompile(`\{\{\s*nodes\.([A-Za-z0-9_-]+)\.(output|status|files)\s*\}\}`)
+
+// isWorkflowFile reports whether arg names a workflow file, for "agent-go run <file>".
+func isWorkflowFile(arg string) bool {
+	ext := strings.ToLower(filepath.Ext(arg))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// loadWorkflow reads and checks a workflow file: node IDs must be unique, dependencies must
+// exist and form no cycle, and tasks may only use the outputs of nodes they depend on.
+func loadWorkflow(path string) (*Workflow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing workflow file: %s\n", err)
+		}
+	}()
+
+	var wf Workflow
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&wf); err != nil {
+		return nil, fmt.Errorf("invalid workflow file: %w", err)
+	}
+	wf.path = path
+	if strings.TrimSpace(wf.Name) == "" {
+		wf.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if len(wf.Nodes) == 0 {
+		return nil, errors.New("workflow has no nodes")
+	}
+
+	ids := make(map[string]bool)
+	for _, n := range wf.Nodes {
+		if !workflowNodeIDPattern.MatchString(n.ID) {
+			return nil, fmt.Errorf("invalid node id '%s': use letters, digits, '-' and '_'", n.ID)
+		}
+		if ids[n.ID] {
+			return nil, fmt.Errorf("duplicate node id '%s'", n.ID)
+		}
+		ids[n.ID] = true
+	}
+	for _, n := range wf.Nodes {
+		if strings.TrimSpace(n.Task) == "" {
+			return nil, fmt.Errorf("node '%s' has no task", n.ID)
+		}
+		for _, dep := range n.DependsOn {
+			if !ids[dep] {
+				return nil, fmt.Errorf("node '%s' depends on unknown node '%s'", n.ID, dep)
+			}
+		}
+		for _, ref := range workflowTemplatePattern.FindAllStringSubmatch(n.Task, -1) {
+			if !slices.Contains(n.DependsOn, ref[1]) {
+				return nil, fmt.Errorf("node '%s' uses the %s of '%s' without depending on it", n.ID, ref[2], ref[1])
+			}
+		}
+	}
+	if cycle := workflowCycle(wf.Nodes); len(cycle) > 0 {
+		return nil, fmt.Errorf("dependency cycle between nodes %s", strings.Join(cycle, ", "))
+	}
+	return &wf, nil
+}
+
+// workflowCycle returns the nodes that are part of or wait on a dependency cycle, or nil.
+func workflowCycle(nodes []WorkflowNode) []string {
+	done := make(map[string]bool)
+	for progress := true; progress; {
+		progress = false
+		for _, n := range nodes {
+			if !done[n.ID] && !slices.ContainsFunc(n.DependsOn, func(dep string) bool { return !done[dep] }) {
+				done[n.ID] = true
+				progress = true
+			}
+		}
+	}
+	var cycle []string
+	for _, n := range nodes {
+		if !done[n.ID] {
+			cycle = append(cycle, n.ID)
+		}
+	}
+	return cycle
+}
+
+// renderWorkflowTask fills the upstream results into a node's task: {{nodes.<id>.output}} is
+// the final message of the node (its JSON output with an output_schema), {{nodes.<id>.status}}
+// its status and {{nodes.<id>.files}} the files it changed, one per line.
+func renderWorkflowTask(task string, reports map[string]*WorkflowNodeReport) string {
+	return workflowTemplatePattern.ReplaceAllStringFunc(task, func(ref string) string {
+		m := workflowTemplatePattern.FindStringSubmatch(ref)
+		r := reports[m[1]]
+		switch m[2] {
+		case "status":
+			return r.Status
+		case "files":
+			if r.Result == nil {
+				return ""
+			}
+			var files []string
+			for _, c := range r.Result.FilesChanged {
+				files = append(files, fmt.Sprintf("%s (%s)", c.Path, c.Status))
+			}
+			return strings.Join(files, "\n")
+		default:
+			return r.Output
+		}
+	})
+}
+
+// subAgentTask returns the spawn_agent arguments of the node, with task as its task.
+func (n WorkflowNode) subAgentTask(task string) (SubAgentTask, error) {
+	args := SubAgentTask{
+		Task:           task,
+		Agent:          n.Agent,
+		Model:          n.Model,
+		MaxIterations:  n.MaxIterations,
+		MaxTokens:      n.MaxTokens,
+		TimeoutSeconds: n.TimeoutSeconds,
+	}
+	if n.OutputSchema != nil {
+		schema, err := json.Marshal(n.OutputSchema)
+		if err != nil {
+			return args, fmt.Errorf("invalid output_schema of node '%s': %w", n.ID, err)
+		}
+		args.OutputSchema = schema
+	}
+	return args, nil
+}
+
+// workflowNodeHash identifies what a node runs. A resumed run reuses a node only if its hash is
+// unchanged, so editing a node, or a different upstream output, runs it again.
+func workflowNodeHash(args SubAgentTask) string {
+	data, _ := json.Marshal(args)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// workflowReportPath is where the report of a workflow is saved.
+func workflowReportPath(wf *Workflow) string {
+	name := strings.NewReplacer("/", "_", "\\", "_", " ", "-", "..", "_").Replace(wf.Name)
+	return filepath.Join(workspaceRoot(), ".agent-go", "workflows", name+".json")
+}
+
+// loadWorkflowReport reads the report of the last run of wf.
+func loadWorkflowReport(wf *Workflow) (*WorkflowReport, error) {
+	data, err := os.ReadFile(workflowReportPath(wf))
+	if err != nil {
+		return nil, err
+	}
+	var report WorkflowReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("invalid workflow report: %w", err)
+	}
+	return &report, nil
+}
+
+// saveWorkflowReport writes the report of wf, replacing that of the last run.
+func saveWorkflowReport(wf *Workflow, report *WorkflowReport) error {
+	path := workflowReportPath(wf)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// runWorkflowNode runs the sub-agent of a workflow node. Tests replace it.
+var runWorkflowNode = runSubAgentTask
+
+// workflowNodeDone is sent by a node's sub-agent when it finishes.
+type workflowNodeDone struct {
+	id     string
+	result *SubAgentResult
+}
+
+// runWorkflow runs the nodes of wf as sub-agents, each as soon as the nodes it depends on
+// succeeded, at most max_parallel_subagents at a time. Nodes whose dependencies failed are
+// skipped. With previous, the report of an earlier run, nodes that succeeded then with the
+// same hash are not run again.
+func runWorkflow(ctx context.Context, wf *Workflow, previous *WorkflowReport, config *Config) *WorkflowReport {
+	report := &WorkflowReport{Workflow: wf.path, Name: wf.Name, Started: time.Now()}
+	reports := make(map[string]*WorkflowNodeReport)
+	reused := make(map[string]WorkflowNodeReport)
+	if previous != nil {
+		for _, r := range previous.Nodes {
+			if r.Status == SubAgentStatusSuccess {
+				reused[r.ID] = r
+			}
+		}
+	}
+
+	// Every node is in the progress view from the start, queued until it can run
+	nodes := make(map[string]*subAgentNode)
+	var all []*subAgentNode
+	for _, n := range wf.Nodes {
+		reports[n.ID] = &WorkflowNodeReport{ID: n.ID}
+		nodes[n.ID] = newSubAgentNode(nil, n.ID, SubAgentTask{MaxIterations: n.MaxIterations, MaxTokens: n.MaxTokens}, config)
+		all = append(all, nodes[n.ID])
+	}
+	progress := newSubAgentProgress(all)
+	progress.start()
+
+	finished := make(map[string]bool)
+	finish := func(id, status, errMsg string) {
+		r := reports[id]
+		r.Status, r.Error, r.Finished = status, errMsg, time.Now()
+		finished[id] = true
+	}
+
+	done := make(chan workflowNodeDone)
+	running := 0
+	limit := maxParallelSubAgents(config)
+	for len(finished) < len(wf.Nodes) {
+		// Start, reuse or skip every node whose dependencies have finished
+		for _, n := range wf.Nodes {
+			r := reports[n.ID]
+			if finished[n.ID] || !r.Started.IsZero() || running >= limit {
+				continue
+			}
+			if slices.ContainsFunc(n.DependsOn, func(dep string) bool { return !finished[dep] }) {
+				continue
+			}
+			if i := slices.IndexFunc(n.DependsOn, func(dep string) bool { return reports[dep].Status != SubAgentStatusSuccess }); i >= 0 {
+				finish(n.ID, WorkflowNodeSkipped, fmt.Sprintf("dependency '%s' did not succeed", n.DependsOn[i]))
+				nodes[n.ID].update(func(s *subAgentNode) { s.State = SubAgentSkipped })
+				continue
+			}
+
+			r.Task = renderWorkflowTask(n.Task, reports)
+			args, err := n.subAgentTask(r.Task)
+			if err != nil {
+				finish(n.ID, SubAgentStatusFailed, err.Error())
+				nodes[n.ID].update(func(s *subAgentNode) { s.State = SubAgentFailed })
+				continue
+			}
+			r.Hash = workflowNodeHash(args)
+			if prev, ok := reused[n.ID]; ok && prev.Hash == r.Hash {
+				r.Output, r.Result, r.Reused, r.Started = prev.Output, prev.Result, true, time.Now()
+				finish(n.ID, SubAgentStatusSuccess, "")
+				nodes[n.ID].update(func(s *subAgentNode) { s.State = SubAgentReused })
+				continue
+			}
+			if ctx.Err() != nil {
+				finish(n.ID, WorkflowNodeCancelled, "")
+				nodes[n.ID].update(func(s *subAgentNode) { s.State = SubAgentCancelled })
+				continue
+			}
+
+			r.Started = time.Now()
+			running++
+			go func() {
+				done <- workflowNodeDone{id: n.ID, result: runWorkflowNode(ctx, nodes[n.ID], args, config)}
+			}()
+		}
+		if running == 0 {
+			continue
+		}
+
+		d := <-done
+		running--
+		r := reports[d.id]
+		r.Result = d.result
+		r.Output = d.result.Summary
+		if len(d.result.Output) > 0 {
+			r.Output = string(d.result.Output)
+		}
+		status := d.result.Status
+		if d.result.err != nil && ctx.Err() != nil {
+			status = WorkflowNodeCancelled
+		}
+		finish(d.id, status, d.result.Error)
+	}
+	progress.finish()
+
+	report.Finished = time.Now()
+	report.Status = SubAgentStatusSuccess
+	for _, n := range wf.Nodes {
+		report.Nodes = append(report.Nodes, *reports[n.ID])
+		if reports[n.ID].Status != SubAgentStatusSuccess {
+			report.Status = SubAgentStatusFailed
+		}
+	}
+	return report
+}
+
+// printWorkflowReport prints the status of each node of a finished run.
+func printWorkflowReport(report *WorkflowReport) {
+	fmt.Printf("\n%s=== Workflow Report: %s ===%s\n", StyleBold, report.Name, ColorReset)
+	width := 0
+	for _, r := range report.Nodes {
+		width = max(width, len(r.ID))
+	}
+	for _, r := range report.Nodes {
+		var marker, color string
+		switch r.Status {
+		case SubAgentStatusSuccess:
+			marker, color = "✓", ColorGreen
+		case WorkflowNodeSkipped:
+			marker, color = "○", ColorMeta
+		default:
+			marker, color = "✗", ColorRed
+		}
+
+		detail := r.Status
+		switch {
+		case r.Reused:
+			detail += " (reused)"
+		case r.Result != nil:
+			elapsed := r.Finished.Sub(r.Started).Round(time.Second)
+			detail += fmt.Sprintf("  %s tok  %d:%02d", formatTokenCount(r.Result.Usage.TotalTokens+r.Result.Usage.NestedTokens), int(elapsed.Minutes()), int(elapsed.Seconds())%60)
+		}
+		if r.Error != "" {
+			detail += "  " + r.Error
+		}
+		fmt.Printf("%s%s %-*s  %s%s\n", color, marker, width, r.ID, detail, ColorReset)
+	}
+}
+
+// runWorkflowMode runs a workflow file: "agent-go run <file> [--resume]". With --resume, the
+// nodes that succeeded in the last run are reused and the run continues from the first node
+// that failed. The exit code is 1 unless every node succeeded.
+func runWorkflowMode(args []string) {
+	var path string
+	resume := false
+	for _, arg := range args {
+		switch {
+		case arg == "--resume":
+			resume = true
+		case path == "" && !strings.HasPrefix(arg, "-"):
+			path = arg
+		default:
+			fmt.Fprintln(os.Stderr, "Usage: agent-go run <workflow.yaml> [--resume]")
+			os.Exit(1)
+		}
+	}
+
+	wf, err := loadWorkflow(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading workflow %s: %s\n", path, err)
+		os.Exit(1)
+	}
+
+	config = loadConfig()
+	if missingAPIKey(config) {
+		fmt.Fprintln(os.Stderr, "Error: API key not set. Please run the interactive setup first.")
+		os.Exit(1)
+	}
+	applyModelCapabilities(config)
+
+	if !config.SubagentsEnabled {
+		fmt.Fprintln(os.Stderr, "Error: Subagents are disabled. Enable them with /subagents on first.")
+		os.Exit(1)
+	}
+
+	var previous *WorkflowReport
+	if resume {
+		if previous, err = loadWorkflowReport(wf); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot resume workflow '%s': %s\n", wf.Name, err)
+			os.Exit(1)
+		}
+	}
+
+	// Ctrl+C stops the running nodes; the report still records how far the run got
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("%sRunning workflow '%s' (%d nodes)%s\n", ColorMeta, wf.Name, len(wf.Nodes), ColorReset)
+	report := runWorkflow(ctx, wf, previous, config)
+	printWorkflowReport(report)
+
+	if err := saveWorkflowReport(wf, report); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving workflow report: %s\n", err)
+	} else {
+		fmt.Printf("%sReport saved to %s%s\n", ColorMeta, workflowReportPath(wf), ColorReset)
+	}
+	if report.Status != SubAgentStatusSuccess {
+		fmt.Printf("%sResume from the first failed node with: agent-go run %s --resume%s\n", ColorMeta, path, ColorReset)
+		stop()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadWorkflow(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{"valid", "nodes:\n  - id: a\n    task: do a\n  - id: b\n    depends_on: [a]\n    task: 'use {{ nodes.a.output }} and {{nodes.a.files}}'\n", ""},
+		{"no nodes", "name: empty\n", "no nodes"},
+		{"unknown field", "nodes:\n  - id: a\n    task: do a\n    dependson: [b]\n", "invalid workflow file"},
+		{"invalid id", "nodes:\n  - id: a.b\n    task: do a\n", "invalid node id"},
+		{"duplicate id", "nodes:\n  - id: a\n    task: do a\n  - id: a\n    task: again\n", "duplicate node id"},
+		{"no task", "nodes:\n  - id: a\n", "has no task"},
+		{"unknown dependency", "nodes:\n  - id: a\n    depends_on: [missing]\n    task: do a\n", "unknown node 'missing'"},
+		{"template without dependency", "nodes:\n  - id: a\n    task: do a\n  - id: b\n    task: 'use {{nodes.a.output}}'\n", "uses the output of 'a' without depending on it"},
+		{"cycle", "nodes:\n  - id: a\n    depends_on: [c]\n    task: do a\n  - id: b\n    depends_on: [a]\n    task: do b\n  - id: c\n    depends_on: [b]\n    task: do c\n  - id: d\n    task: do d\n", "cycle between nodes a, b, c"},
+		{"self dependency", "nodes:\n  - id: a\n    depends_on: [a]\n    task: do a\n", "cycle between nodes a"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-")+".yaml")
+		if err := os.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		wf, err := loadWorkflow(path)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: loadWorkflow: %v", tt.name, err)
+			} else if wf.Name != "valid" {
+				t.Errorf("%s: name = %q, want the file name", tt.name, wf.Name)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: loadWorkflow error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRenderWorkflowTask(t *testing.T) {
+	reports := map[string]*WorkflowNodeReport{
+		"a": {ID: "a", Status: SubAgentStatusSuccess, Output: "the output", Result: &SubAgentResult{FilesChanged: []FileChange{{Path: "x.go", Status: "modified"}, {Path: "y.go", Status: "added"}}}},
+		"b": {ID: "b", Status: SubAgentStatusPartial},
+	}
+	task := "{{nodes.a.output}} | {{ nodes.a.status }} | {{nodes.a.files}} | {{nodes.b.files}} | {{nodes.b.status}} | {{nodes.a.other}}"
+	want := "the output | success | x.go (modified)\ny.go (added) |  | partial | {{nodes.a.other}}"
+	if got := renderWorkflowTask(task, reports); got != want {
+		t.Errorf("renderWorkflowTask = %q, want %q", got, want)
+	}
+}
+
+// stubWorkflowNodes replaces the sub-agent runner of workflow nodes. Nodes whose task starts
+// with "fail" fail; the others succeed with their task as the summary. It returns the tasks
+// that ran, by node.
+func stubWorkflowNodes(t *testing.T) (map[string]string, *int) {
+	t.Helper()
+	var mu sync.Mutex
+	ran := make(map[string]string)
+	active, maxActive := 0, 0
+	runWorkflowNode = func(ctx context.Context, node *subAgentNode, args SubAgentTask, config *Config) *SubAgentResult {
+		mu.Lock()
+		ran[node.Label] = args.Task
+		active++
+		maxActive = max(maxActive, active)
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+		if strings.HasPrefix(args.Task, "fail") {
+			return &SubAgentResult{Status: SubAgentStatusFailed, Error: "failed on purpose"}
+		}
+		return &SubAgentResult{Status: SubAgentStatusSuccess, Summary: "done: " + args.Task}
+	}
+	t.Cleanup(func() { runWorkflowNode = runSubAgentTask })
+	return ran, &maxActive
+}
+
+func TestRunWorkflow(t *testing.T) {
+	defer func(mode bool) { pipelineMode = mode }(pipelineMode)
+	pipelineMode = true
+	wf := &Workflow{Name: "test", Nodes: []WorkflowNode{
+		{ID: "broken", Task: "fail now"},
+		{ID: "after-broken", Task: "never runs", DependsOn: []string{"broken"}},
+		{ID: "skipped-too", Task: "never runs", DependsOn: []string{"after-broken"}},
+		{ID: "x", Task: "make x"},
+		{ID: "y", Task: "make y"},
+		{ID: "join", Task: "combine {{nodes.x.output}} and {{nodes.y.output}}", DependsOn: []string{"x", "y"}},
+	}}
+	config := &Config{MaxParallelSubAgents: 2}
+
+	ran, maxActive := stubWorkflowNodes(t)
+	report := runWorkflow(context.Background(), wf, nil, config)
+	if *maxActive != 2 {
+		t.Errorf("at most %d nodes ran at once, want 2", *maxActive)
+	}
+	want := map[string]string{
+		"broken":       SubAgentStatusFailed,
+		"after-broken": WorkflowNodeSkipped,
+		"skipped-too":  WorkflowNodeSkipped,
+		"x":            SubAgentStatusSuccess,
+		"y":            SubAgentStatusSuccess,
+		"join":         SubAgentStatusSuccess,
+	}
+	for _, r := range report.Nodes {
+		if r.Status != want[r.ID] {
+			t.Errorf("node %s: status %q, want %q", r.ID, r.Status, want[r.ID])
+		}
+	}
+	if report.Status != SubAgentStatusFailed {
+		t.Errorf("workflow status %q, want failed", report.Status)
+	}
+	if _, ok := ran["after-broken"]; ok {
+		t.Error("a node whose dependency failed ran")
+	}
+	if got := ran["join"]; got != "combine done: make x and done: make y" {
+		t.Errorf("join task = %q, want the upstream outputs filled in", got)
+	}
+
+	// A resumed run reuses the nodes that succeeded with the same hash and runs the rest
+	wf.Nodes[0].Task = "fixed now"
+	wf.Nodes[4].Task = "make y differently"
+	ran, _ = stubWorkflowNodes(t)
+	resumed := runWorkflow(context.Background(), wf, report, config)
+	if resumed.Status != SubAgentStatusSuccess {
+		t.Errorf("resumed workflow status %q, want success", resumed.Status)
+	}
+	for _, r := range resumed.Nodes {
+		_, rerun := ran[r.ID]
+		if wantReused := r.ID == "x"; r.Reused != wantReused || rerun == wantReused {
+			t.Errorf("resumed node %s: reused %v, ran %v", r.ID, r.Reused, rerun)
+		}
+	}
+}